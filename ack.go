@@ -0,0 +1,79 @@
+package multiplex
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+)
+
+// ErrAcksUnsupported is returned by NewStreamSync when stream
+// acknowledgements aren't in use on the session (see CapStreamAcks).
+var ErrAcksUnsupported = errors.New("peer doesn't support stream acknowledgements")
+
+// NewStreamSync opens a stream and waits for the peer to acknowledge it. It
+// returns once the peer took the stream, or with a *ResetError if it refused
+// it (because it has too many streams open, for instance). Unlike with
+// NewStream, nothing written to a stream returned by NewStreamSync goes
+// unnoticed by a peer that won't take it.
+//
+// Acknowledgements are a protocol extension: NewStreamSync fails with
+// ErrAcksUnsupported unless both sides support CapStreamAcks. If ctx is done
+// first, the stream is reset.
+func (mp *Multiplex) NewStreamSync(ctx context.Context) (*Stream, error) {
+	s, err := mp.newNamedStream(ctx, "", openOptions{ack: true})
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case <-s.acked:
+		return s, nil
+	case <-s.writeCancel:
+		// Reset by the peer, or the session went away.
+		select {
+		case <-s.acked:
+			return s, nil
+		default:
+		}
+		return nil, s.writeCancelErr
+	case <-ctx.Done():
+		s.Reset()
+		return nil, ctx.Err()
+	}
+}
+
+// handleAckReq processes the peer's request to acknowledge a stream it's
+// about to open.
+func (mp *Multiplex) handleAckReq(payload []byte) error {
+	id, n := binary.Uvarint(payload)
+	if n <= 0 {
+		mp.log.Debugw("received malformed ack request")
+		return nil
+	}
+	if p := mp.pendingOpen(id); p != nil {
+		p.ack = true
+	}
+	return nil
+}
+
+// handleAck processes the peer's acknowledgement of a stream we opened.
+func (mp *Multiplex) handleAck(payload []byte) error {
+	id, n := binary.Uvarint(payload)
+	if n <= 0 {
+		mp.log.Debugw("received malformed stream ack")
+		return nil
+	}
+	mp.chLock.Lock()
+	s := mp.channels[streamID{id: id, initiator: true}]
+	mp.chLock.Unlock()
+	if s == nil || s.acked == nil {
+		// Gone already, or we didn't ask.
+		return nil
+	}
+	select {
+	case <-s.acked:
+		mp.log.Debugw("received duplicate stream ack", s.logFields()...)
+	default:
+		close(s.acked)
+	}
+	return nil
+}
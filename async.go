@@ -0,0 +1,23 @@
+package multiplex
+
+import "context"
+
+// StreamOrError is the outcome of opening a stream asynchronously.
+type StreamOrError struct {
+	Stream *Stream
+	Err    error
+}
+
+// NewStreamAsync opens a named stream like NewNamedStream, without waiting for
+// the open frame to be queued: when the outbound buffers are all taken by a
+// congested write queue, the caller doesn't have to wait for room. The
+// returned channel receives the stream, or the error opening it failed with,
+// once the frame is queued. ctx bounds how long that may take.
+func (mp *Multiplex) NewStreamAsync(ctx context.Context, name string) <-chan StreamOrError {
+	res := make(chan StreamOrError, 1)
+	mp.spawn(func() {
+		s, err := mp.NewNamedStream(ctx, name)
+		res <- StreamOrError{Stream: s, Err: err}
+	})
+	return res
+}
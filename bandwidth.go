@@ -0,0 +1,112 @@
+package multiplex
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket limiting throughput to a number of bytes per
+// second. A zero rate disables limiting.
+type rateLimiter struct {
+	clock  Clock
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	// changed is closed, and replaced, whenever the rate changes, to wake
+	// up the callers waiting at the old rate.
+	changed chan struct{}
+}
+
+func newRateLimiter(rate int, clock Clock) *rateLimiter {
+	l := &rateLimiter{clock: clock}
+	l.setRate(rate)
+	return l
+}
+
+// setRate changes the rate of the limiter. It takes effect for all future
+// calls to wait, and for those waiting already.
+func (l *rateLimiter) setRate(rate int) {
+	if rate < 0 {
+		rate = 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.rate = float64(rate)
+	// Allow bursts of up to a tenth of a second worth of traffic, but never
+	// less than a single buffer.
+	l.burst = l.rate / 10
+	if l.burst < BufferSize {
+		l.burst = BufferSize
+	}
+	l.tokens = l.burst
+	l.last = l.clock.Now()
+	if l.changed != nil {
+		close(l.changed)
+	}
+	l.changed = make(chan struct{})
+}
+
+// reserve takes n bytes from the bucket and returns how long the caller has
+// to wait before it's allowed to use them, and a channel closed if the rate
+// changes in the meantime, in which case the bytes should be reserved again.
+func (l *rateLimiter) reserve(n int) (time.Duration, <-chan struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.rate <= 0 {
+		return 0, l.changed
+	}
+
+	now := l.clock.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0, l.changed
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second)), l.changed
+}
+
+// wait blocks until n bytes may pass through the limiter, or until cancel is
+// closed.
+func (l *rateLimiter) wait(n int, cancel <-chan struct{}) error {
+	for {
+		d, changed := l.reserve(n)
+		if d <= 0 {
+			return nil
+		}
+
+		t := l.clock.NewTimer(d)
+		select {
+		case <-t.Chan():
+			return nil
+		case <-changed:
+			// The old debt is forgiven, the bytes are taken from the
+			// new bucket.
+			t.Stop()
+		case <-cancel:
+			t.Stop()
+			return ErrShutdown
+		}
+	}
+}
+
+// SetBandwidthLimit changes the session-wide outbound and inbound throughput
+// caps, in bytes per second, on a live session. A limit of zero disables
+// throttling in that direction.
+func (mp *Multiplex) SetBandwidthLimit(send, recv int) {
+	mp.sendLimiter.setRate(send)
+	mp.recvLimiter.setRate(recv)
+	if mp.loop != nil && !mp.isShutdown() {
+		// Let a batch held back at the old rate through.
+		mp.loop.schedule(mp)
+	}
+}
@@ -0,0 +1,172 @@
+package multiplex
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/libp2p/go-mplex/frame"
+)
+
+// NewStreams opens a stream for each of the given names in one go. The stream
+// IDs are allocated together, and the open frames are queued together so
+// that they go out in as few writes as the outbound buffers allow. An empty
+// name defaults to the stream's ID, like with NewNamedStream.
+//
+// Either all the streams are opened or none are: if the stream limit doesn't
+// leave room for all of them, nothing is opened, and if queueing fails part
+// way through, the streams already announced to the peer are reset.
+func (mp *Multiplex) NewStreams(ctx context.Context, names []string) ([]*Stream, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	streams, err := mp.registerStreams(names)
+	if err != nil {
+		return nil, err
+	}
+
+	queued, err := mp.queueOpens(ctx, streams)
+	if err != nil {
+		for i, s := range streams {
+			if i < queued {
+				s.Reset()
+			} else {
+				// The peer never heard of these.
+				s.abandon(ErrStreamReset)
+			}
+		}
+		if err == errCanceled {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return streams, nil
+}
+
+// registerStreams allocates an ID for each of the named streams, and registers
+// them.
+func (mp *Multiplex) registerStreams(names []string) ([]*Stream, error) {
+	mp.chLock.Lock()
+	defer mp.chLock.Unlock()
+
+	if mp.channels == nil {
+		return nil, ErrShutdown
+	}
+	if mp.IsDraining() || mp.PeerDraining() {
+		return nil, ErrDraining
+	}
+	if mp.maxOutbound > 0 && mp.outboundStreams+len(names) > mp.maxOutbound {
+		return nil, ErrStreamLimitReached
+	}
+	if mp.nextID > maxStreamID || uint64(len(names)) > maxStreamID-mp.nextID+1 {
+		return nil, ErrStreamIDsExhausted
+	}
+	max := mp.peerMaxMessageSize()
+	for _, name := range names {
+		if len(name) > max {
+			return nil, ErrMessageTooLarge
+		}
+	}
+	if mp.manager != nil && !mp.manager.acquireStreams(mp, len(names)) {
+		return nil, ErrStreamLimitReached
+	}
+
+	streams := make([]*Stream, len(names))
+	for i, name := range names {
+		sid := mp.nextChanID()
+		if name == "" {
+			name = fmt.Sprint(sid)
+		}
+		s := mp.newStream(streamID{
+			id:        sid,
+			initiator: true,
+		}, name)
+		s.captureStack()
+		mp.channels[s.id] = s
+		streams[i] = s
+	}
+	mp.outboundStreams += len(names)
+	return streams, nil
+}
+
+// queueOpens queues the open frames of the given streams, and returns how
+// many of them made it. The frames are handed to the write queue in batches of
+// as many as there are free outbound buffers.
+func (mp *Multiplex) queueOpens(ctx context.Context, streams []*Stream) (int, error) {
+	ids := make([]streamID, 0, len(streams))
+	frames := make([]outFrame, 0, len(streams))
+	queued := 0
+	flush := func() error {
+		if mp.isShutdown() {
+			for _, f := range frames {
+				mp.releaseFrame(f)
+			}
+			return mp.sendErr()
+		}
+		mp.writeQueue.pushAll(ids, frames)
+		if mp.loop != nil {
+			mp.loop.schedule(mp)
+		}
+		atomic.AddUint64(&mp.counters.streamsOpened, uint64(len(frames)))
+		queued += len(frames)
+		ids, frames = ids[:0], frames[:0]
+		return nil
+	}
+
+	for _, s := range streams {
+		size := len(s.name) + frame.MaxHeaderSize
+		var buf []byte
+		select {
+		case mp.bufOut <- struct{}{}:
+			mp.outSlots.taken(false, 0)
+			buf = mp.getBuffer(size)
+		default:
+			// Out of buffers: send off what we have before waiting for
+			// more.
+			if len(frames) > 0 {
+				if err := flush(); err != nil {
+					return queued, err
+				}
+			}
+			var err error
+			if buf, err = mp.getBufferOutbound(size, ctx.Done(), nil, nil); err != nil {
+				return queued, err
+			}
+		}
+		n := frame.PutHeader(buf, frame.PackHeader(s.id.id, newStreamTag), len(s.name))
+		n += copy(buf[n:], s.name)
+		ids = append(ids, s.id)
+		frames = append(frames, outFrame{data: buf[:n]})
+	}
+	return queued, flush()
+}
+
+// AcceptBatch waits for the peer to open a stream, and returns it along with
+// all the other streams already waiting to be accepted, up to max of them (no
+// limit if max is zero or less). It spares accept loops a round trip per
+// stream when the peer opens streams in bursts.
+//
+// AcceptBatch returns nil once the session is closed; ShutdownReason tells
+// why.
+func (mp *Multiplex) AcceptBatch(max int) []*Stream {
+	var streams []*Stream
+	select {
+	case s := <-mp.nstreams:
+		s.captureStack()
+		streams = append(streams, s)
+	case <-mp.closed:
+		return nil
+	}
+
+	for max <= 0 || len(streams) < max {
+		select {
+		case s := <-mp.nstreams:
+			s.captureStack()
+			streams = append(streams, s)
+		default:
+			return streams
+		}
+	}
+	return streams
+}
@@ -0,0 +1,53 @@
+package multiplex
+
+import (
+	"fmt"
+
+	pool "github.com/libp2p/go-buffer-pool"
+)
+
+// BufferPool allocates the buffers used to read and write frames.
+// Implementations must be safe for concurrent use.
+type BufferPool interface {
+	// Get returns a buffer of the given length.
+	Get(length int) []byte
+	// Put returns a buffer obtained from Get. The caller must not use the
+	// buffer afterwards.
+	Put(buf []byte)
+}
+
+// NoBufferPool allocates a new buffer for every Get and scribbles over
+// buffers passed to Put, so that code using a buffer after returning it reads
+// garbage instead of silently racing with the next user. It's meant for
+// debugging.
+var NoBufferPool BufferPool = noBufferPool{}
+
+type noBufferPool struct{}
+
+func (noBufferPool) Get(length int) []byte { return make([]byte, length) }
+
+func (noBufferPool) Put(buf []byte) {
+	for i := range buf {
+		buf[i] = 0xdb
+	}
+}
+
+// WithBufferPool sets the pool used to allocate frame buffers (defaults to
+// the global go-buffer-pool pool).
+func WithBufferPool(p BufferPool) Option {
+	return func(c *config) error {
+		if p == nil {
+			return fmt.Errorf("nil buffer pool")
+		}
+		c.bufferPool = p
+		return nil
+	}
+}
+
+var defaultBufferPool BufferPool = pool.GlobalPool
+
+// BufferPool returns the pool the session allocates frame buffers from, for
+// code layered on top of the session to share (see WithBufferPool).
+func (mp *Multiplex) BufferPool() BufferPool {
+	return mp.pool
+}
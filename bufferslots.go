@@ -0,0 +1,213 @@
+package multiplex
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BufferStats describes the use of a session's buffer slots in one direction.
+type BufferStats struct {
+	// Slots is the number of buffer slots, and InUse the number of them
+	// currently holding a buffer. MaxSlots is the most slots the session
+	// may be resized to (see SetBufferSlots).
+	Slots, InUse, MaxSlots int
+	// HighWater is the most slots ever in use at once.
+	HighWater int
+	// Waits counts the times a buffer had to be waited for because all
+	// the slots were in use, and WaitTime is the total time spent waiting.
+	Waits    uint64
+	WaitTime time.Duration
+}
+
+// bufferSlots is a budget of buffer slots. A slot is taken by sending on c,
+// and given back by receiving from it. The capacity of c is the most slots
+// there may be: the session takes the slots it doesn't use itself, so that
+// they can be handed out again when the budget grows.
+type bufferSlots struct {
+	// held is the number of slots taken by the session. It's guarded by
+	// mu, but also read atomically. highWater, waits and waitTime are
+	// updated atomically. They must stay the first fields, so that they're
+	// 64-bit aligned on 32-bit platforms.
+	held      int64
+	highWater int64
+	waits     uint64
+	waitTime  int64
+
+	c chan struct{}
+
+	// pending is the number of slots the session still has to take, once
+	// they're given back, to shrink the budget. shrinking is set while a
+	// goroutine is waiting for them.
+	mu        sync.Mutex
+	pending   int
+	shrinking bool
+}
+
+func newBufferSlots(n, max int) *bufferSlots {
+	s := &bufferSlots{c: make(chan struct{}, max)}
+	for i := n; i < max; i++ {
+		s.c <- struct{}{}
+	}
+	s.held = int64(max - n)
+	return s
+}
+
+// size returns the number of slots in the budget.
+func (s *bufferSlots) size() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return cap(s.c) - int(s.held) - s.pending
+}
+
+// taken records a slot being taken, after waiting for the given time if
+// waited is set.
+func (s *bufferSlots) taken(waited bool, d time.Duration) {
+	if waited {
+		atomic.AddUint64(&s.waits, 1)
+		atomic.AddInt64(&s.waitTime, int64(d))
+	}
+	inUse := int64(len(s.c)) - atomic.LoadInt64(&s.held)
+	for {
+		high := atomic.LoadInt64(&s.highWater)
+		if inUse <= high || atomic.CompareAndSwapInt64(&s.highWater, high, inUse) {
+			return
+		}
+	}
+}
+
+func (s *bufferSlots) stats() BufferStats {
+	inUse := len(s.c) - int(atomic.LoadInt64(&s.held))
+	if inUse < 0 {
+		inUse = 0
+	}
+	return BufferStats{
+		Slots:     s.size(),
+		InUse:     inUse,
+		MaxSlots:  cap(s.c),
+		HighWater: int(atomic.LoadInt64(&s.highWater)),
+		Waits:     atomic.LoadUint64(&s.waits),
+		WaitTime:  time.Duration(atomic.LoadInt64(&s.waitTime)),
+	}
+}
+
+// resize changes the number of slots in the budget to n. Slots in use beyond
+// the new size are retired once they're given back, in a goroutine started
+// with spawn, until done is closed.
+func (s *bufferSlots) resize(n int, done <-chan struct{}, spawn func(func())) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delta := n - (cap(s.c) - int(s.held) - s.pending)
+	switch {
+	case delta > 0:
+		// Give up on the slots we were still going to take first.
+		if s.pending >= delta {
+			s.pending -= delta
+			return
+		}
+		delta -= s.pending
+		s.pending = 0
+		for ; delta > 0; delta-- {
+			<-s.c
+			atomic.AddInt64(&s.held, -1)
+		}
+	case delta < 0:
+		for ; delta < 0; delta++ {
+			select {
+			case s.c <- struct{}{}:
+				atomic.AddInt64(&s.held, 1)
+			default:
+				s.pending++
+			}
+		}
+		if s.pending > 0 && !s.shrinking {
+			s.shrinking = true
+			spawn(func() { s.shrink(done) })
+		}
+	}
+}
+
+// shrink takes the slots pending retirement as they're given back.
+func (s *bufferSlots) shrink(done <-chan struct{}) {
+	for {
+		select {
+		case s.c <- struct{}{}:
+		case <-done:
+			s.mu.Lock()
+			s.shrinking = false
+			s.mu.Unlock()
+			return
+		}
+
+		s.mu.Lock()
+		if s.pending == 0 {
+			// The budget grew back meanwhile.
+			<-s.c
+		} else {
+			s.pending--
+			atomic.AddInt64(&s.held, 1)
+		}
+		if s.pending == 0 {
+			s.shrinking = false
+			s.mu.Unlock()
+			return
+		}
+		s.mu.Unlock()
+	}
+}
+
+// SetBufferSlots resizes the session's inbound and outbound buffer budgets
+// while it's running. Neither may exceed the maximum set with
+// WithInboundBuffers, WithOutboundBuffers or WithMaxBuffers. Memory for
+// additional slots is reserved from the MemoryManager, and fails with its
+// error if it isn't granted. When shrinking, slots currently in use are
+// retired as their buffers are released.
+func (mp *Multiplex) SetBufferSlots(inbound, outbound int) error {
+	if inbound < 1 || inbound > cap(mp.inSlots.c) {
+		return fmt.Errorf("invalid inbound buffer count: %d (max %d)", inbound, cap(mp.inSlots.c))
+	}
+	if outbound < 1 || outbound > cap(mp.outSlots.c) {
+		return fmt.Errorf("invalid outbound buffer count: %d (max %d)", outbound, cap(mp.outSlots.c))
+	}
+
+	mp.shutdownLock.Lock()
+	defer mp.shutdownLock.Unlock()
+	if mp.isShutdown() {
+		return ErrShutdown
+	}
+
+	inDelta := (inbound - mp.inSlots.size()) * BufferSize
+	outDelta := (outbound - mp.outSlots.size()) * BufferSize
+	if inDelta > 0 {
+		if err := mp.memoryManager.ReserveMemory(inDelta, mp.inPriority); err != nil {
+			return err
+		}
+	}
+	if outDelta > 0 {
+		if err := mp.memoryManager.ReserveMemory(outDelta, mp.outPriority); err != nil {
+			if inDelta > 0 {
+				mp.memoryManager.ReleaseMemory(inDelta)
+			}
+			return err
+		}
+	}
+	released := 0
+	for _, d := range []int{inDelta, outDelta} {
+		if d < 0 {
+			released -= d
+		}
+	}
+	if released > 0 {
+		mp.memoryManager.ReleaseMemory(released)
+	}
+	mp.reservedMemory += inDelta + outDelta
+
+	mp.inSlots.resize(inbound, mp.shutdown, mp.spawn)
+	mp.outSlots.resize(outbound, mp.shutdown, mp.spawn)
+	atomic.StoreInt64(&mp.sessionInboundLimit, mp.inboundLimit(inbound))
+	// Writers may be waiting for room.
+	mp.notifyOutboundFreed()
+	return nil
+}
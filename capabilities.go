@@ -0,0 +1,88 @@
+package multiplex
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Capability is a set of protocol extensions. Extensions are only used once
+// both sides announced support for them during version negotiation (see
+// WithVersionNegotiation): legacy peers, which don't negotiate, get the
+// classic mplex protocol.
+type Capability uint64
+
+const (
+	// CapCloseErrors sends the error a session is closed with (see
+	// CloseWithError).
+	CapCloseErrors Capability = 1 << iota
+	// CapStreamHeaders sends headers along with new streams (see
+	// NewStreamWithHeaders).
+	CapStreamHeaders
+	// CapEarlyData sends data in stream opens (see NewStreamWithData).
+	CapEarlyData
+	// CapStreamAcks acknowledges new streams (see NewStreamSync).
+	CapStreamAcks
+	// CapMessageSize announces the largest frames accepted (see
+	// WithMaxMessageSize).
+	CapMessageSize
+	// CapPing answers pings (see Ping).
+	CapPing
+	// CapCloseAcks acknowledges stream closes once they're read (see
+	// CloseSync).
+	CapCloseAcks
+	// CapDatagrams carries unreliable datagrams (see SendDatagram).
+	CapDatagrams
+	// CapGoAway tells the peer the session is being drained, so that it
+	// stops opening streams (see Drain).
+	CapGoAway
+
+	// AllCapabilities are all the extensions supported by this
+	// implementation.
+	AllCapabilities = CapGoAway<<1 - 1
+)
+
+var capabilityNames = []string{"close-errors", "stream-headers", "early-data", "stream-acks", "message-size", "ping", "close-acks", "datagrams", "go-away"}
+
+func (c Capability) String() string {
+	var names []string
+	for i, name := range capabilityNames {
+		if c&(1<<i) != 0 {
+			names = append(names, name)
+			c &^= 1 << i
+		}
+	}
+	if c != 0 {
+		names = append(names, fmt.Sprintf("%#x", uint64(c)))
+	}
+	return strings.Join(names, "|")
+}
+
+// WithCapabilities restricts the protocol extensions we announce, and use, to
+// the given ones (AllCapabilities by default). It only matters with version
+// negotiation (see WithVersionNegotiation).
+func WithCapabilities(c Capability) Option {
+	return func(cfg *config) error {
+		if c&^AllCapabilities != 0 {
+			return fmt.Errorf("unsupported capabilities: %s", c&^AllCapabilities)
+		}
+		cfg.capabilities = c
+		return nil
+	}
+}
+
+// Capabilities returns the protocol extensions in use on the session: those
+// both sides announced. It's empty until the peer's announcement has been
+// received, and if either side doesn't negotiate.
+func (mp *Multiplex) Capabilities() Capability {
+	select {
+	case <-mp.negotiated:
+	default:
+		return 0
+	}
+	return mp.capabilities & mp.remoteCapabilities
+}
+
+// supports returns true if the given extensions are in use on the session.
+func (mp *Multiplex) supports(c Capability) bool {
+	return mp.Capabilities()&c == c
+}
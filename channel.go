@@ -0,0 +1,91 @@
+package multiplex
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"sync"
+)
+
+// Codec encodes the values sent over a Channel.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// Channel sends and receives values over a stream, as messages encoded with
+// a codec and prefixed with their length (an unsigned varint). Messages can
+// be up to MaxMessageSize bytes: Send and Recv fail with ErrMessageTooLarge
+// for larger ones.
+//
+// A Channel takes over the stream: it reads ahead, so the stream mustn't be
+// read from other than through the Channel. Send and Recv can be called
+// concurrently with each other, and from several goroutines.
+//
+// Values are passed as interface{}, the way encoding/json takes them, rather
+// than through a type parameter: the module still supports Go 1.17, which
+// has no generics. A typed wrapper is a few lines on top.
+type Channel struct {
+	s     *Stream
+	codec Codec
+
+	sendLock sync.Mutex
+	recvLock sync.Mutex
+	r        *bufio.Reader
+}
+
+// NewChannel returns a Channel sending and receiving values over the stream
+// with the given codec.
+func NewChannel(s *Stream, codec Codec) *Channel {
+	return &Channel{s: s, codec: codec, r: bufio.NewReader(s)}
+}
+
+// Stream returns the stream the channel is over.
+func (c *Channel) Stream() *Stream {
+	return c.s
+}
+
+// Send encodes v and sends it, waiting for room in the send window like
+// Write. Like WriteAll, it returns a *PartialWriteError if the stream fails
+// part way through the message: the peer can't make sense of the rest of the
+// stream then.
+func (c *Channel) Send(v interface{}) error {
+	data, err := c.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if len(data) > MaxMessageSize {
+		return ErrMessageTooLarge
+	}
+	msg := make([]byte, binary.MaxVarintLen64+len(data))
+	n := binary.PutUvarint(msg, uint64(len(data)))
+	n += copy(msg[n:], data)
+
+	c.sendLock.Lock()
+	defer c.sendLock.Unlock()
+	return c.s.WriteAll(context.Background(), msg[:n])
+}
+
+// Recv receives the next message and decodes it into v, which is passed to
+// the codec as is. It returns io.EOF once the peer closed the stream between
+// messages, and io.ErrUnexpectedEOF if it did so mid-message.
+func (c *Channel) Recv(v interface{}) error {
+	c.recvLock.Lock()
+	defer c.recvLock.Unlock()
+	size, err := binary.ReadUvarint(c.r)
+	if err != nil {
+		return err
+	}
+	if size > MaxMessageSize {
+		return ErrMessageTooLarge
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return c.codec.Unmarshal(data, v)
+}
@@ -0,0 +1,65 @@
+package multiplex
+
+import "time"
+
+// frameAction tells the session what to do with an outbound frame. The zero
+// value writes it normally.
+type frameAction struct {
+	// Drop discards the frame.
+	Drop bool
+	// Duplicate writes that many extra copies of the frame.
+	Duplicate int
+	// Delay holds the frame back for that long, letting the frames queued
+	// after it overtake it.
+	Delay time.Duration
+}
+
+// frameInjector decides the fate of every frame a session is about to write,
+// for testing how the session copes with a transport that loses, duplicates or
+// reorders data. It's only set by tests.
+//
+// injectFrame is called from the session's write loop and must not block.
+// Payloads are set in the FrameInfo, and only valid for the duration of the
+// call.
+type frameInjector interface {
+	injectFrame(FrameInfo) frameAction
+}
+
+// inject runs a frame by the injector. It returns false if the frame isn't to
+// be written now.
+func (mp *Multiplex) inject(f *outFrame) bool {
+	f.injected = true
+	info := outboundFrameInfo(f.data)
+	info.Payload = f.data[len(f.data)-info.Length:]
+	act := mp.injector.injectFrame(info)
+
+	switch {
+	case act.Drop:
+		mp.releaseFrame(*f)
+		if f.written != nil {
+			close(f.written)
+		}
+		return false
+	case act.Delay > 0:
+		held := *f
+		held.copies = act.Duplicate
+		mp.clock.AfterFunc(act.Delay, func() {
+			if mp.isShutdown() {
+				// Nothing writes anymore.
+				mp.releaseFrame(held)
+				if held.written != nil {
+					close(held.written)
+				}
+				return
+			}
+			mp.writeQueue.pushUrgent(held)
+			if mp.loop != nil {
+				mp.loop.schedule(mp)
+			}
+		})
+		return false
+	default:
+		f.copies = act.Duplicate
+		return true
+	}
+}
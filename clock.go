@@ -0,0 +1,58 @@
+package multiplex
+
+import (
+	"fmt"
+	"time"
+)
+
+// Clock is the source of time for a session's internal timers: the receive
+// timeout, the buffer timeout, write coalescing and bandwidth limiting. Tests
+// can inject a fake clock (see mplextest.FakeClock) to trigger them without
+// waiting. Stream deadlines and the timeouts of Close and Reset always use
+// the wall clock.
+type Clock interface {
+	Now() time.Time
+	// NewTimer and AfterFunc work like their counterparts in the time
+	// package.
+	NewTimer(d time.Duration) Timer
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a timer created by a Clock. It works like a time.Timer.
+type Timer interface {
+	// Chan returns the channel the time is delivered on. It's nil for
+	// timers created with AfterFunc.
+	Chan() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return realTimer{time.AfterFunc(d, f)}
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) Chan() <-chan time.Time { return t.C }
+
+// WithClock sets the clock used by the session's internal timers (defaults to
+// the wall clock).
+func WithClock(c Clock) Option {
+	return func(cfg *config) error {
+		if c == nil {
+			return fmt.Errorf("nil clock")
+		}
+		cfg.clock = c
+		return nil
+	}
+}
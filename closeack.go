@@ -0,0 +1,122 @@
+package multiplex
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+)
+
+// ErrCloseAcksUnsupported is returned by CloseSync when close
+// acknowledgements aren't in use on the session (see CapCloseAcks).
+var ErrCloseAcksUnsupported = errors.New("peer doesn't support close acknowledgements")
+
+// closeAckRequest is the payload of a close frame asking for an
+// acknowledgement.
+var closeAckRequest = []byte{1}
+
+// CloseSync closes the stream like Close, but first waits for the peer to
+// read everything written to the stream, up to the close. Once it returns
+// nil, the peer has consumed all the data: it's safe to tear down whatever
+// state the data depended on.
+//
+// If ctx is done first, or the peer resets the stream, the stream is reset
+// and CloseSync returns why. Peers that stop reading without reaching the
+// close never acknowledge it: ctx should have a deadline.
+//
+// Close acknowledgements are a protocol extension: CloseSync fails with
+// ErrCloseAcksUnsupported, leaving the stream untouched, unless both sides
+// support CapCloseAcks.
+func (s *Stream) CloseSync(ctx context.Context) error {
+	if !s.mp.supports(CapCloseAcks) {
+		return ErrCloseAcksUnsupported
+	}
+
+	acked := make(chan struct{})
+	s.mp.chLock.Lock()
+	if s.mp.closeAcks == nil {
+		s.mp.closeAcks = make(map[streamID]chan struct{})
+	}
+	s.mp.closeAcks[s.id] = acked
+	s.mp.chLock.Unlock()
+	defer func() {
+		s.mp.chLock.Lock()
+		delete(s.mp.closeAcks, s.id)
+		s.mp.chLock.Unlock()
+	}()
+
+	if !s.cancelWrite(ErrStreamClosed) {
+		// Too late to ask for an acknowledgement.
+		if s.writeCancelErr == ErrStreamClosed {
+			return ErrStreamClosed
+		}
+		return s.writeCancelErr
+	}
+	if err := s.sendClose(closeAckRequest); err != nil {
+		s.Reset()
+		return err
+	}
+
+	// A reset by the peer cancels our reads, unless we're done reading
+	// already.
+	readCancel := s.readCancel
+	if isClosedChan(readCancel) {
+		readCancel = nil
+	}
+	select {
+	case <-acked:
+		return s.CloseRead()
+	case <-readCancel:
+		select {
+		case <-acked:
+			return nil
+		default:
+		}
+		return s.readCancelErr
+	case <-s.mp.closed:
+		return s.mp.streamShutdownErr()
+	case <-ctx.Done():
+		s.Reset()
+		return ctx.Err()
+	}
+}
+
+// ackClose acknowledges the peer's close, once we read it, if the peer asked.
+func (s *Stream) ackClose() {
+	if !s.closeAck {
+		return
+	}
+	s.closeAckOnce.Do(func() {
+		// Tell the peer which side opened the stream, from its point of
+		// view.
+		var opener uint64
+		if !s.id.initiator {
+			opener = 1
+		}
+		payload := appendUvarint(appendUvarint(nil, s.id.id), opener)
+		s.mp.spawn(func() { s.mp.sendControl(nil, ctrlCloseAck, payload, nil) })
+	})
+}
+
+// handleCloseAck processes the peer's acknowledgement of a close we sent.
+func (mp *Multiplex) handleCloseAck(payload []byte) error {
+	id, n := binary.Uvarint(payload)
+	if n <= 0 {
+		mp.log.Debugw("received malformed close ack")
+		return nil
+	}
+	opener, m := binary.Uvarint(payload[n:])
+	if m <= 0 {
+		mp.log.Debugw("received malformed close ack")
+		return nil
+	}
+	sid := streamID{id: id, initiator: opener == 1}
+
+	mp.chLock.Lock()
+	acked := mp.closeAcks[sid]
+	delete(mp.closeAcks, sid)
+	mp.chLock.Unlock()
+	if acked != nil {
+		close(acked)
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mplex "github.com/libp2p/go-mplex"
+	"github.com/libp2p/go-mplex/mplextest"
+)
+
+// config describes a benchmark run.
+type config struct {
+	transport string
+	size      int
+	streams   int
+	duration  time.Duration
+}
+
+// result holds the measurements of a benchmark run.
+type result struct {
+	elapsed   time.Duration
+	messages  int
+	bytes     int64
+	latencies []time.Duration
+
+	allocs        uint64
+	reads, writes int64
+}
+
+func (r *result) throughput() float64 {
+	return float64(r.bytes) / r.elapsed.Seconds()
+}
+
+func (r *result) rate() float64 {
+	return float64(r.messages) / r.elapsed.Seconds()
+}
+
+func (r *result) perMessage(n float64) float64 {
+	if r.messages == 0 {
+		return 0
+	}
+	return n / float64(r.messages)
+}
+
+// percentile returns the p-th percentile of the message latencies.
+func (r *result) percentile(p int) time.Duration {
+	if len(r.latencies) == 0 {
+		return 0
+	}
+	i := len(r.latencies) * p / 100
+	if i >= len(r.latencies) {
+		i = len(r.latencies) - 1
+	}
+	return r.latencies[i]
+}
+
+// countingConn counts the reads and writes made on a connection.
+type countingConn struct {
+	net.Conn
+	reads, writes *int64
+}
+
+func (c countingConn) Read(b []byte) (int, error) {
+	atomic.AddInt64(c.reads, 1)
+	return c.Conn.Read(b)
+}
+
+func (c countingConn) Write(b []byte) (int, error) {
+	atomic.AddInt64(c.writes, 1)
+	return c.Conn.Write(b)
+}
+
+// connect returns the two ends of a connection over the given transport.
+func connect(transport string) (net.Conn, net.Conn, error) {
+	switch transport {
+	case "pipe":
+		a, b := mplextest.Pipe()
+		return a, b, nil
+	case "tcp":
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return nil, nil, err
+		}
+		defer l.Close()
+
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			c, err := l.Accept()
+			if err != nil {
+				close(accepted)
+				return
+			}
+			accepted <- c
+		}()
+		a, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return nil, nil, err
+		}
+		b, ok := <-accepted
+		if !ok {
+			a.Close()
+			return nil, nil, fmt.Errorf("failed to accept the connection")
+		}
+		return a, b, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown transport %q", transport)
+	}
+}
+
+// run runs a benchmark.
+func run(cfg config) (*result, error) {
+	if cfg.size < 8 {
+		// We need room for the timestamp.
+		cfg.size = 8
+	}
+
+	a, b, err := connect(cfg.transport)
+	if err != nil {
+		return nil, err
+	}
+	var res result
+	client, err := mplex.NewMultiplex(countingConn{a, &res.reads, &res.writes}, true, nil)
+	if err != nil {
+		a.Close()
+		b.Close()
+		return nil, err
+	}
+	defer client.Close()
+	server, err := mplex.NewMultiplex(countingConn{b, &res.reads, &res.writes}, false, nil)
+	if err != nil {
+		b.Close()
+		return nil, err
+	}
+	defer server.Close()
+
+	var (
+		mu        sync.Mutex
+		wg        sync.WaitGroup
+		errs      = make(chan error, 2*cfg.streams)
+		deadline  = time.Now().Add(cfg.duration)
+		latencies []time.Duration
+	)
+
+	// Server: read messages until the client closes the stream.
+	wg.Add(cfg.streams)
+	go func() {
+		for i := 0; i < cfg.streams; i++ {
+			s, err := server.Accept()
+			if err != nil {
+				errs <- err
+				for ; i < cfg.streams; i++ {
+					wg.Done()
+				}
+				return
+			}
+			go func() {
+				defer wg.Done()
+				defer s.Close()
+				var local []time.Duration
+				buf := make([]byte, cfg.size)
+				for {
+					if _, err := io.ReadFull(s, buf); err != nil {
+						if err != io.EOF {
+							errs <- err
+						}
+						break
+					}
+					sent := time.Unix(0, int64(binary.BigEndian.Uint64(buf)))
+					local = append(local, time.Since(sent))
+				}
+				mu.Lock()
+				latencies = append(latencies, local...)
+				mu.Unlock()
+			}()
+		}
+	}()
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+
+	// Client: write messages until the deadline.
+	var cwg sync.WaitGroup
+	cwg.Add(cfg.streams)
+	for i := 0; i < cfg.streams; i++ {
+		go func() {
+			defer cwg.Done()
+			s, err := client.NewStream(context.Background())
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer s.Close()
+			msg := make([]byte, cfg.size)
+			for time.Now().Before(deadline) {
+				binary.BigEndian.PutUint64(msg, uint64(time.Now().UnixNano()))
+				if _, err := s.Write(msg); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	cwg.Wait()
+	wg.Wait()
+
+	res.elapsed = time.Since(start)
+	runtime.ReadMemStats(&after)
+	res.allocs = after.Mallocs - before.Mallocs
+
+	select {
+	case err := <-errs:
+		return nil, err
+	default:
+	}
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	res.latencies = latencies
+	res.messages = len(latencies)
+	res.bytes = int64(res.messages) * int64(cfg.size)
+	return &res, nil
+}
@@ -0,0 +1,81 @@
+// Command mplexbench measures the throughput and latency of mplex sessions.
+//
+// For every combination of message size and stream count, it runs a client
+// and a server session connected over loopback TCP or an in-memory pipe. The
+// client writes fixed-size messages on all streams as fast as it can for a
+// while, and the server reads them. It reports the throughput, the latency of
+// the messages (from the moment they're written to the moment they're fully
+// read), the allocations per message, and the reads and writes made on the
+// connections per message, which approximate syscalls over TCP.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func main() {
+	var (
+		transport = flag.String("transport", "tcp", "connect the sessions over `tcp` (loopback) or an in-memory `pipe`")
+		sizes     = flag.String("sizes", "64,1024,16384,262144", "comma separated list of message sizes, in bytes")
+		streams   = flag.String("streams", "1,16,128", "comma separated list of stream counts")
+		duration  = flag.Duration("duration", 3*time.Second, "how long to run each benchmark")
+	)
+	flag.Parse()
+
+	sizeList, err := parseInts(*sizes)
+	if err != nil {
+		fatal(fmt.Errorf("invalid sizes: %w", err))
+	}
+	streamList, err := parseInts(*streams)
+	if err != nil {
+		fatal(fmt.Errorf("invalid stream counts: %w", err))
+	}
+
+	fmt.Printf("%9s %8s %9s %9s %12s %12s %11s %11s %11s\n",
+		"size", "streams", "MB/s", "msgs/s", "p50", "p99", "allocs/msg", "writes/msg", "reads/msg")
+	for _, size := range sizeList {
+		for _, n := range streamList {
+			res, err := run(config{
+				transport: *transport,
+				size:      size,
+				streams:   n,
+				duration:  *duration,
+			})
+			if err != nil {
+				fatal(err)
+			}
+			fmt.Printf("%9d %8d %9.1f %9.0f %12s %12s %11.1f %11.2f %11.2f\n",
+				size, n,
+				res.throughput()/1e6, res.rate(),
+				res.percentile(50).Round(time.Microsecond), res.percentile(99).Round(time.Microsecond),
+				res.perMessage(float64(res.allocs)),
+				res.perMessage(float64(res.writes)), res.perMessage(float64(res.reads)),
+			)
+		}
+	}
+}
+
+func parseInts(s string) ([]int, error) {
+	var out []int
+	for _, f := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil {
+			return nil, err
+		}
+		if n <= 0 {
+			return nil, fmt.Errorf("%d isn't positive", n)
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "mplexbench:", err)
+	os.Exit(1)
+}
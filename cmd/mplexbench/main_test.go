@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRun(t *testing.T) {
+	for _, transport := range []string{"pipe", "tcp"} {
+		res, err := run(config{
+			transport: transport,
+			size:      1024,
+			streams:   4,
+			duration:  100 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatalf("%s: %s", transport, err)
+		}
+		if res.messages == 0 || res.bytes != int64(res.messages)*1024 {
+			t.Fatalf("%s: unexpected result %+v", transport, res)
+		}
+		if res.percentile(50) > res.percentile(99) {
+			t.Fatalf("%s: p50 above p99", transport)
+		}
+	}
+}
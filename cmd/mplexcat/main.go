@@ -0,0 +1,126 @@
+// Command mplexcat bridges an mplex stream to stdin and stdout, like netcat.
+//
+// It dials the given TCP address (or listens on it with -l and takes the first
+// connection), establishes an mplex session over the connection, and opens a
+// stream with the given name (or, when listening, accepts the first stream
+// the peer opens). Whatever is read from stdin is
+// written to the stream, closing it for writing at EOF, and whatever is read
+// from the stream is written to stdout. It exits once both directions are
+// done, or as soon as the stream is reset.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+
+	mplex "github.com/libp2p/go-mplex"
+)
+
+func main() {
+	var (
+		listen  = flag.Bool("l", false, "listen on the address instead of dialing it")
+		name    = flag.String("name", "", "name of the stream to open (the stream ID if empty)")
+		verbose = flag.Bool("v", false, "report the session on stderr")
+	)
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: mplexcat [flags] [-l] host:port\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	con, err := connect(flag.Arg(0), *listen)
+	if err != nil {
+		fatal(err)
+	}
+	mp, err := mplex.NewMultiplex(con, !*listen, nil)
+	if err != nil {
+		fatal(err)
+	}
+	defer mp.Close()
+
+	s, err := openStream(mp, *listen, *name)
+	if err != nil {
+		fatal(err)
+	}
+	if *verbose {
+		fmt.Fprintf(os.Stderr, "mplexcat: bridging %s\n", mp)
+	}
+	if err := bridge(s, os.Stdin, os.Stdout); err != nil {
+		fatal(err)
+	}
+}
+
+// connect dials addr, or listens on it and accepts a single connection.
+func connect(addr string, listen bool) (net.Conn, error) {
+	if !listen {
+		return net.Dial("tcp", addr)
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+	return l.Accept()
+}
+
+// openStream opens a stream named name, or accepts one when listening. The
+// session doesn't keep the names of the streams it accepts, so the first one
+// is taken.
+func openStream(mp *mplex.Multiplex, listen bool, name string) (*mplex.Stream, error) {
+	if listen {
+		return mp.Accept()
+	}
+	return mp.NewNamedStream(context.Background(), name)
+}
+
+// bridge copies in to the stream and the stream to out, until both
+// directions are done. The stream is closed for writing when in reaches EOF,
+// and reset if either direction fails.
+func bridge(s *mplex.Stream, in io.Reader, out io.Writer) error {
+	// Make sure everything went out before the session is closed.
+	s.SetLinger(-1)
+
+	sent := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(s, in)
+		if err == nil {
+			err = s.CloseWrite()
+		}
+		sent <- err
+	}()
+
+	_, err := io.Copy(out, s)
+	if err != nil {
+		// Unblocks the copy from stdin if it's stuck writing.
+		s.Reset()
+		return err
+	}
+	select {
+	case err := <-sent:
+		if err != nil {
+			s.Reset()
+		}
+		return err
+	case <-s.CloseChan():
+		// Reset while we're waiting on in, unless our own CloseWrite just
+		// finished the stream.
+		if err := s.Context().Err(); !errors.Is(err, mplex.ErrStreamClosed) {
+			return errors.Unwrap(err)
+		}
+		return <-sent
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "mplexcat:", err)
+	os.Exit(1)
+}
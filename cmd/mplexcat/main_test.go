@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	mplex "github.com/libp2p/go-mplex"
+	"github.com/libp2p/go-mplex/mplextest"
+)
+
+func sessions(t *testing.T) (*mplex.Multiplex, *mplex.Multiplex) {
+	a, b := mplextest.Pipe()
+	dialer, err := mplex.NewMultiplex(a, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := mplex.NewMultiplex(b, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		dialer.Close()
+		listener.Close()
+	})
+	return dialer, listener
+}
+
+func TestBridge(t *testing.T) {
+	dialer, listener := sessions(t)
+
+	accepted := make(chan *mplex.Stream, 1)
+	go func() {
+		s, err := openStream(listener, true, "")
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- s
+	}()
+	s, err := openStream(dialer, false, "cat")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fromListener bytes.Buffer
+	done := make(chan error, 1)
+	go func() {
+		done <- bridge(s, strings.NewReader("ping"), &fromListener)
+	}()
+	var fromDialer bytes.Buffer
+	if err := bridge(<-accepted, strings.NewReader("pong"), &fromDialer); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if fromDialer.String() != "ping" || fromListener.String() != "pong" {
+		t.Fatalf("got %q and %q", fromDialer.String(), fromListener.String())
+	}
+}
+
+func TestBridgeReset(t *testing.T) {
+	dialer, listener := sessions(t)
+
+	s, err := openStream(dialer, false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nothing ever comes in on stdin, yet the bridge returns once the peer
+	// resets the stream.
+	in, _ := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- bridge(s, in, ioutil.Discard)
+	}()
+	remote, err := openStream(listener, true, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote.Reset()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, mplex.ErrStreamReset) {
+			t.Fatalf("expected a reset, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("bridge didn't return after the reset")
+	}
+}
@@ -0,0 +1,132 @@
+// Command mplexdump prints the frames recorded in a capture written with
+// mplexcap, one per line, from the given file or stdin.
+//
+// Each line gives when the frame was sent or received, its direction, stream
+// ID, tag and payload length, followed by the beginning of the payload, if it
+// was recorded, or with -x a hex dump of all of it.
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/libp2p/go-mplex/frame"
+	"github.com/libp2p/go-mplex/mplexcap"
+)
+
+// quoted is how much of the payload is printed without -x.
+const quoted = 64
+
+func main() {
+	hexdump := flag.Bool("x", false, "print a hex dump of the payloads")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: mplexdump [flags] [capture]\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() > 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	in := io.Reader(os.Stdin)
+	if flag.NArg() == 1 {
+		f, err := os.Open(flag.Arg(0))
+		if err != nil {
+			fatal(err)
+		}
+		defer f.Close()
+		in = f
+	}
+	out := bufio.NewWriter(os.Stdout)
+	err := dump(in, out, *hexdump)
+	if ferr := out.Flush(); err == nil {
+		err = ferr
+	}
+	if err != nil {
+		fatal(err)
+	}
+}
+
+// dump prints the frames of the capture read from in.
+func dump(in io.Reader, out io.Writer, hexdump bool) error {
+	r := mplexcap.NewReader(in)
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintln(out, format(rec, hexdump)); err != nil {
+			return err
+		}
+	}
+}
+
+// format describes a frame on a line, followed by a hex dump of its payload
+// if asked to.
+func format(rec mplexcap.Record, hexdump bool) string {
+	f := rec.Frame
+	stream := fmt.Sprint(f.StreamID)
+	if f.StreamID == frame.ControlStreamID {
+		stream = "control"
+	}
+	line := fmt.Sprintf("%s %-8s stream %s %s len %d",
+		rec.Time.UTC().Format("2006-01-02T15:04:05.000000000"), f.Direction, stream, tagName(f.Tag), f.Length)
+	switch {
+	case len(f.Payload) == 0:
+		if f.Length > 0 {
+			line += " (payload not recorded)"
+		}
+	case hexdump:
+		if len(f.Payload) < f.Length {
+			line += fmt.Sprintf(" (%d bytes recorded)", len(f.Payload))
+		}
+		line += "\n" + hex.Dump(f.Payload)
+		// hex.Dump ends with a newline already.
+		line = line[:len(line)-1]
+	default:
+		p := f.Payload
+		if len(p) > quoted {
+			p = p[:quoted]
+		}
+		line += fmt.Sprintf(" %q", p)
+		if len(p) < f.Length {
+			line += "..."
+		}
+	}
+	return line
+}
+
+func tagName(tag uint64) string {
+	switch tag {
+	case frame.TagNewStream:
+		return "new-stream"
+	case frame.TagMessageReceiver:
+		return "message-receiver"
+	case frame.TagMessageInitiator:
+		return "message-initiator"
+	case frame.TagCloseReceiver:
+		return "close-receiver"
+	case frame.TagCloseInitiator:
+		return "close-initiator"
+	case frame.TagResetReceiver:
+		return "reset-receiver"
+	case frame.TagResetInitiator:
+		return "reset-initiator"
+	case frame.TagExtension:
+		return "extension"
+	}
+	return fmt.Sprintf("tag-%d", tag)
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "mplexdump:", err)
+	os.Exit(1)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	mplex "github.com/libp2p/go-mplex"
+	"github.com/libp2p/go-mplex/frame"
+	"github.com/libp2p/go-mplex/mplexcap"
+)
+
+func TestDump(t *testing.T) {
+	var capture bytes.Buffer
+	w, err := mplexcap.NewWriter(&capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.ObserveFrame(mplex.FrameInfo{Direction: mplex.FrameOutbound, StreamID: 3, Tag: frame.TagNewStream, Length: 1, Payload: []byte("3")})
+	w.ObserveFrame(mplex.FrameInfo{Direction: mplex.FrameInbound, StreamID: 3, Tag: frame.TagMessageReceiver, Length: 100, Payload: []byte("hi")})
+	w.ObserveFrame(mplex.FrameInfo{Direction: mplex.FrameInbound, StreamID: frame.ControlStreamID, Tag: frame.TagExtension, Length: 4})
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := dump(bytes.NewReader(capture.Bytes()), &out, false); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	expected := []string{
+		`outbound stream 3 new-stream len 1 "3"`,
+		`inbound  stream 3 message-receiver len 100 "hi"...`,
+		`inbound  stream control extension len 4 (payload not recorded)`,
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("expected %d lines, got %q", len(expected), lines)
+	}
+	for i, line := range lines {
+		if !strings.HasSuffix(line, expected[i]) {
+			t.Fatalf("expected %q to end with %q", line, expected[i])
+		}
+	}
+
+	out.Reset()
+	if err := dump(bytes.NewReader(capture.Bytes()), &out, true); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "(2 bytes recorded)\n00000000  68 69") {
+		t.Fatalf("expected a hex dump, got %q", out.String())
+	}
+}
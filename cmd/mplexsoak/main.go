@@ -0,0 +1,165 @@
+// Command mplexsoak churns streams between two mplex sessions for a long time,
+// reporting the goroutines and memory used by the process as it goes, to
+// catch leaks.
+//
+// The sessions are connected over loopback TCP or an in-memory pipe. Once the
+// run is over, the streams are given a moment to wind down, and the process
+// is compared with how it was when the sessions were created: it exits with
+// an error if the goroutine count or the heap grew beyond the given slack.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	mplex "github.com/libp2p/go-mplex"
+	"github.com/libp2p/go-mplex/mplextest"
+)
+
+func main() {
+	var (
+		transport   = flag.String("transport", "tcp", "connect the sessions over `tcp` (loopback) or an in-memory `pipe`")
+		duration    = flag.Duration("duration", time.Hour, "how long to run")
+		rate        = flag.Int("rate", 1000, "streams opened per second (0 for as fast as possible)")
+		concurrency = flag.Int("concurrency", 256, "maximum number of streams in flight")
+		sizes       = flag.String("sizes", "1,1024,16384,262144", "comma separated list of message sizes, in bytes")
+		resets      = flag.Float64("resets", 0.1, "fraction of the streams to reset instead of closing")
+		interval    = flag.Duration("report", 10*time.Second, "how often to report progress")
+		slackG      = flag.Int("goroutine-slack", 16, "goroutine growth tolerated at the end of the run")
+		slackHeap   = flag.Int("heap-slack", 16<<20, "heap growth tolerated at the end of the run, in bytes")
+	)
+	flag.Parse()
+
+	sizeList, err := parseInts(*sizes)
+	if err != nil {
+		fatal(fmt.Errorf("invalid sizes: %w", err))
+	}
+
+	a, b, err := connect(*transport)
+	if err != nil {
+		fatal(err)
+	}
+	client, err := mplex.NewMultiplex(a, true, nil)
+	if err != nil {
+		fatal(err)
+	}
+	server, err := mplex.NewMultiplex(b, false, nil)
+	if err != nil {
+		fatal(err)
+	}
+	baseG, baseHeap := usage()
+
+	ctx, cancel := context.WithTimeout(context.Background(), *duration)
+	defer cancel()
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt)
+	defer stop()
+
+	report, err := mplextest.Churn(ctx, client, server, mplextest.ChurnConfig{
+		Rate:           *rate,
+		Concurrency:    *concurrency,
+		MessageSizes:   sizeList,
+		ResetRatio:     *resets,
+		OnReport:       printReport,
+		ReportInterval: *interval,
+	})
+	printReport(report)
+	if err != nil {
+		fatal(err)
+	}
+
+	// Give the server side time to wind down.
+	var g int
+	var heap uint64
+	for i := 0; i < 50; i++ {
+		time.Sleep(100 * time.Millisecond)
+		g, heap = usage()
+		if g <= baseG+*slackG && heap <= baseHeap+uint64(*slackHeap) {
+			break
+		}
+	}
+	fmt.Printf("goroutines: %d -> %d, heap: %s -> %s\n", baseG, g, mib(baseHeap), mib(heap))
+
+	client.Close()
+	server.Close()
+
+	if g > baseG+*slackG {
+		fatal(fmt.Errorf("goroutines grew from %d to %d", baseG, g))
+	}
+	if heap > baseHeap+uint64(*slackHeap) {
+		fatal(fmt.Errorf("heap grew from %s to %s", mib(baseHeap), mib(heap)))
+	}
+}
+
+func printReport(r mplextest.ChurnReport) {
+	fmt.Printf("%8s streams=%d resets=%d echoed=%s goroutines=%d heap=%s client-queue=%d server-buffered=%d\n",
+		r.Elapsed.Round(time.Second), r.Streams, r.Resets, mib(r.Bytes),
+		r.Goroutines, mib(r.HeapInUse), r.Client.WriteQueueDepth, r.Server.InboundBuffered)
+}
+
+// usage returns the goroutine count and the heap in use, after a GC.
+func usage() (int, uint64) {
+	// Twice, so that pooled buffers are collected too.
+	runtime.GC()
+	runtime.GC()
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return runtime.NumGoroutine(), ms.HeapInuse
+}
+
+func mib(n uint64) string {
+	return fmt.Sprintf("%.1fMiB", float64(n)/(1<<20))
+}
+
+func connect(transport string) (net.Conn, net.Conn, error) {
+	switch transport {
+	case "pipe":
+		a, b := mplextest.Pipe()
+		return a, b, nil
+	case "tcp":
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return nil, nil, err
+		}
+		defer l.Close()
+		a, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return nil, nil, err
+		}
+		b, err := l.Accept()
+		if err != nil {
+			a.Close()
+			return nil, nil, err
+		}
+		return a, b, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown transport %q", transport)
+	}
+}
+
+func parseInts(s string) ([]int, error) {
+	var out []int
+	for _, f := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil {
+			return nil, err
+		}
+		if n <= 0 {
+			return nil, fmt.Errorf("%d isn't positive", n)
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "mplexsoak:", err)
+	os.Exit(1)
+}
@@ -0,0 +1,300 @@
+package multiplex
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/libp2p/go-mplex/frame"
+)
+
+// ProtocolVersion is the version of the protocol supported by this
+// implementation. Version 0 is the classic mplex protocol. From version 1 on,
+// peers announce the extensions they support (see Capability) along with
+// their version.
+const ProtocolVersion = 1
+
+// maxControlFrameSize is the maximum size of an extension frame we're willing
+// to process. Larger ones are skipped.
+const maxControlFrameSize = BufferSize
+
+var controlHeader = frame.PackHeader(frame.ControlStreamID, frame.TagExtension)
+
+// Extension message types, carried as the first uvarint of an extension
+// frame's payload.
+const (
+	ctrlHello    = 0
+	ctrlClose    = 1
+	ctrlHeaders  = 2
+	ctrlAckReq   = 3
+	ctrlAck      = 4
+	ctrlPing     = 5
+	ctrlPong     = 6
+	ctrlCloseAck = 7
+	ctrlDatagram = 8
+	ctrlGoAway   = 9
+)
+
+// maxPendingOpens bounds the number of streams the peer may send extension
+// messages for before opening them.
+const maxPendingOpens = 1024
+
+// pendingOpen holds what the peer told us about a stream it's about to open.
+type pendingOpen struct {
+	headers map[string]string
+	ack     bool
+}
+
+// closeErrorTimeout is how long CloseWithError waits for the error to be sent
+// before closing the connection anyway.
+var closeErrorTimeout = 5 * time.Second
+
+// SessionError is the error a session was closed with by CloseWithError.
+// Operations on streams of the session and Accept return it once the session
+// is closed. It matches ErrShutdown and ErrStreamReset with errors.Is.
+type SessionError struct {
+	Code    uint32
+	Message string
+	// Remote is true if the peer closed the session.
+	Remote bool
+}
+
+func (e *SessionError) Error() string {
+	side := "local"
+	if e.Remote {
+		side = "remote"
+	}
+	return fmt.Sprintf("session closed by %s side with error %d: %s", side, e.Code, e.Message)
+}
+
+func (e *SessionError) Is(target error) bool {
+	return target == ErrShutdown || target == ErrStreamReset
+}
+
+// WithVersionNegotiation enables the protocol version handshake. Both sides
+// announce the protocol version they support when the session starts, and
+// protocol extensions are only used once the peer has announced support for
+// them. Peers that don't take part in the handshake ignore the announcement,
+// and the session falls back to the classic mplex protocol.
+func WithVersionNegotiation() Option {
+	return func(c *config) error {
+		c.negotiate = true
+		return nil
+	}
+}
+
+// NegotiatedVersion returns the protocol version agreed upon with the peer.
+// It returns 0 (classic mplex) if version negotiation is disabled, the peer
+// doesn't support it, or its announcement hasn't been received yet.
+func (mp *Multiplex) NegotiatedVersion() int {
+	select {
+	case <-mp.negotiated:
+	default:
+		return 0
+	}
+
+	if mp.remoteVersion < ProtocolVersion {
+		return int(mp.remoteVersion)
+	}
+	return ProtocolVersion
+}
+
+// sendHello announces the protocol version we support, followed by the most
+// early data we accept in stream opens, the largest frame payload we accept,
+// and the extensions we support.
+func (mp *Multiplex) sendHello() error {
+	var buf [4 * binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], ProtocolVersion)
+	n += binary.PutUvarint(buf[n:], maxEarlyData)
+	n += binary.PutUvarint(buf[n:], uint64(mp.maxMessageSize))
+	n += binary.PutUvarint(buf[n:], uint64(mp.capabilities))
+	return mp.sendControl(nil, ctrlHello, buf[:n], nil)
+}
+
+// handleControl reads and processes an extension frame with the given
+// payload length.
+func (mp *Multiplex) handleControl(mlen int) error {
+	if !mp.negotiate || mlen > maxControlFrameSize {
+		mp.log.Debugw("ignoring extension frame", "length", mlen)
+		return mp.skipNextMsg(mlen)
+	}
+
+	buf := mp.pool.Get(mlen)
+	defer mp.pool.Put(buf)
+	if _, err := io.ReadFull(mp.buf, buf); err != nil {
+		return err
+	}
+
+	typ, n := binary.Uvarint(buf)
+	if n <= 0 {
+		mp.log.Debugw("received malformed extension frame")
+		return nil
+	}
+	payload := buf[n:]
+
+	handler, ok := controlHandlers[typ]
+	if !ok {
+		// Unknown extensions are ignored for forwards compatibility.
+		mp.log.Debugw("ignoring unknown extension message", "type", typ)
+		return nil
+	}
+	return handler(mp, payload)
+}
+
+// controlHandler processes the payload of an extension message. Returning an
+// error shuts the session down. Handlers run on the receive loop, they must
+// not block.
+type controlHandler func(mp *Multiplex, payload []byte) error
+
+// controlHandlers are the handlers of the extension messages, by type.
+var controlHandlers = map[uint64]controlHandler{
+	ctrlHello:    (*Multiplex).handleHello,
+	ctrlClose:    (*Multiplex).handleCloseMsg,
+	ctrlHeaders:  (*Multiplex).handleHeaders,
+	ctrlAckReq:   (*Multiplex).handleAckReq,
+	ctrlAck:      (*Multiplex).handleAck,
+	ctrlPing:     (*Multiplex).handlePing,
+	ctrlPong:     (*Multiplex).handlePong,
+	ctrlCloseAck: (*Multiplex).handleCloseAck,
+	ctrlDatagram: (*Multiplex).handleDatagram,
+	ctrlGoAway:   (*Multiplex).handleGoAway,
+}
+
+// sendControl queues an extension message of the given type. See
+// sendControlMsg.
+func (mp *Multiplex) sendControl(timeout <-chan struct{}, typ uint64, payload []byte, written chan struct{}) error {
+	buf := make([]byte, 0, binary.MaxVarintLen64+len(payload))
+	buf = appendUvarint(buf, typ)
+	buf = append(buf, payload...)
+	return mp.sendControlMsg(timeout, controlHeader, buf, written)
+}
+
+func (mp *Multiplex) handleHello(payload []byte) error {
+	version, n := binary.Uvarint(payload)
+	if n <= 0 {
+		mp.log.Debugw("received malformed hello")
+		return nil
+	}
+	select {
+	case <-mp.negotiated:
+		mp.log.Debugw("received duplicate hello")
+		return nil
+	default:
+	}
+	// Later versions may add fields after ours.
+	var fields [3]uint64
+	for i := range fields {
+		v, m := binary.Uvarint(payload[n:])
+		if m <= 0 {
+			mp.log.Debugw("received malformed hello")
+			return nil
+		}
+		fields[i] = v
+		n += m
+	}
+	mp.remoteEarlyData = fields[0]
+	mp.remoteMaxMessage = fields[1]
+	mp.remoteCapabilities = Capability(fields[2])
+	mp.remoteVersion = version
+	close(mp.negotiated)
+	return nil
+}
+
+func (mp *Multiplex) handleCloseMsg(payload []byte) error {
+	code, n := binary.Uvarint(payload)
+	if n <= 0 || code > uint64(^uint32(0)) {
+		mp.log.Debugw("received malformed close error")
+		return nil
+	}
+	// This shuts down the session.
+	return &SessionError{
+		Code:    uint32(code),
+		Message: string(payload[n:]),
+		Remote:  true,
+	}
+}
+
+// peerMaxMessageSize returns the size of the largest frame payload the peer
+// accepts.
+func (mp *Multiplex) peerMaxMessageSize() int {
+	if !mp.supports(CapMessageSize) || mp.remoteMaxMessage == 0 || mp.remoteMaxMessage > MaxMessageSize {
+		return MaxMessageSize
+	}
+	return int(mp.remoteMaxMessage)
+}
+
+// pendingOpen returns the pendingOpen of the stream the peer is about to open
+// with the given ID, creating it if needed. It returns nil if too many streams
+// are pending already.
+func (mp *Multiplex) pendingOpen(id uint64) *pendingOpen {
+	if p, ok := mp.pendingOpens[id]; ok {
+		return p
+	}
+	if len(mp.pendingOpens) >= maxPendingOpens {
+		mp.log.Debugw("ignoring extension message: too many streams pending", "stream", id)
+		return nil
+	}
+	if mp.pendingOpens == nil {
+		mp.pendingOpens = make(map[uint64]*pendingOpen)
+	}
+	p := &pendingOpen{}
+	mp.pendingOpens[id] = p
+	return p
+}
+
+// takePendingOpen returns and forgets the pendingOpen of the stream the peer
+// opened with the given ID, if any.
+func (mp *Multiplex) takePendingOpen(id uint64) *pendingOpen {
+	p, ok := mp.pendingOpens[id]
+	if !ok {
+		return &pendingOpen{}
+	}
+	delete(mp.pendingOpens, id)
+	return p
+}
+
+// CloseWithError closes the session, telling the peer why. The peer's Accept,
+// stream operations and ShutdownReason report a *SessionError with the given
+// code and message. The message is truncated to fit a single extension frame.
+//
+// The error is only sent if both sides support CapCloseErrors. Otherwise,
+// it's only reported locally.
+func (mp *Multiplex) CloseWithError(code uint32, msg string) error {
+	mp.shutdownLock.Lock()
+	if mp.closeErr == nil && !mp.isShutdown() {
+		mp.closeErr = &SessionError{Code: code, Message: msg}
+	}
+	mp.shutdownLock.Unlock()
+
+	if mp.supports(CapCloseErrors) {
+		buf := make([]byte, 0, maxControlFrameSize)
+		buf = appendUvarint(buf, ctrlClose)
+		buf = appendUvarint(buf, uint64(code))
+		if max := cap(buf) - len(buf); len(msg) > max {
+			msg = msg[:max]
+		}
+		buf = append(buf, msg...)
+
+		ctx, cancel := context.WithTimeout(context.Background(), closeErrorTimeout)
+		defer cancel()
+
+		written := make(chan struct{})
+		if err := mp.sendControlMsg(ctx.Done(), controlHeader, buf, written); err == nil {
+			select {
+			case <-written:
+			case <-ctx.Done():
+			case <-mp.shutdown:
+			}
+		}
+	}
+
+	return mp.Close()
+}
+
+func appendUvarint(buf []byte, x uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], x)
+	return append(buf, tmp[:n]...)
+}
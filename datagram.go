@@ -0,0 +1,108 @@
+package multiplex
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+
+	"github.com/libp2p/go-mplex/frame"
+)
+
+// ErrDatagramsUnsupported is returned by SendDatagram when datagrams aren't in
+// use on the session (see CapDatagrams).
+var ErrDatagramsUnsupported = errors.New("peer doesn't support datagrams")
+
+// ErrDatagramTooLarge is returned by SendDatagram for datagrams larger than
+// MaxDatagramSize.
+var ErrDatagramTooLarge = errors.New("datagram too large")
+
+// MaxDatagramSize is the size of the largest datagram that can be sent: it
+// must fit in a single extension frame.
+const MaxDatagramSize = maxControlFrameSize - 1
+
+// datagramBacklog is the number of received datagrams that can be waiting to
+// be read. The oldest are dropped to make room for new ones.
+const datagramBacklog = 64
+
+// SendDatagram sends an unreliable datagram to the peer, for heartbeats,
+// gossip and the like. Datagrams share the connection with the streams, but
+// never wait for room: if all the outbound buffers are taken, the datagram is
+// dropped, and SendDatagram returns nil all the same. The peer drops
+// datagrams too if they aren't read in time (see ReceiveDatagram). Dropped
+// datagrams are counted in Stats.
+//
+// Datagrams are a protocol extension: SendDatagram fails with
+// ErrDatagramsUnsupported unless both sides support CapDatagrams.
+func (mp *Multiplex) SendDatagram(data []byte) error {
+	if !mp.supports(CapDatagrams) {
+		return ErrDatagramsUnsupported
+	}
+	if len(data) > MaxDatagramSize {
+		return ErrDatagramTooLarge
+	}
+	if mp.isShutdown() {
+		return mp.sendErr()
+	}
+
+	select {
+	case mp.bufOut <- struct{}{}:
+		mp.outSlots.taken(false, 0)
+	default:
+		atomic.AddUint64(&mp.counters.datagramsDropped, 1)
+		return nil
+	}
+	buf := mp.getBuffer(1 + len(data) + frame.MaxHeaderSize)
+	n := frame.PutHeader(buf, controlHeader, 1+len(data))
+	buf[n] = ctrlDatagram
+	n++
+	n += copy(buf[n:], data)
+
+	if mp.isShutdown() {
+		mp.putBufferOutbound(buf)
+		return mp.sendErr()
+	}
+	// Datagrams take turns with the streams, rather than jumping ahead like
+	// the other control frames.
+	mp.writeQueue.push(frameStreamID(controlHeader), outFrame{data: buf[:n]})
+	if mp.loop != nil {
+		mp.loop.schedule(mp)
+	}
+	return nil
+}
+
+// ReceiveDatagram returns the next datagram sent by the peer, waiting for one
+// until ctx is done or the session is closed. Received datagrams are queued
+// until read; once the queue is full, the oldest are dropped, rather than
+// holding up the session.
+func (mp *Multiplex) ReceiveDatagram(ctx context.Context) ([]byte, error) {
+	select {
+	case d := <-mp.datagrams:
+		return d, nil
+	default:
+	}
+	select {
+	case d := <-mp.datagrams:
+		return d, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-mp.closed:
+		return nil, mp.shutdownErr
+	}
+}
+
+func (mp *Multiplex) handleDatagram(payload []byte) error {
+	// The payload is only valid until we return.
+	d := append([]byte(nil), payload...)
+	for {
+		select {
+		case mp.datagrams <- d:
+			return nil
+		default:
+		}
+		select {
+		case <-mp.datagrams:
+			atomic.AddUint64(&mp.counters.datagramsDropped, 1)
+		default:
+		}
+	}
+}
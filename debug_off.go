@@ -0,0 +1,6 @@
+//go:build !mplexdebug
+
+package multiplex
+
+// debugStreams is set in debug builds (see debug_on.go).
+const debugStreams = false
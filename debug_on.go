@@ -0,0 +1,8 @@
+//go:build mplexdebug
+
+package multiplex
+
+// debugStreams is set in debug builds, made with the mplexdebug build tag:
+// streams garbage collected without having been closed or reset are logged
+// along with where they were opened or accepted.
+const debugStreams = true
@@ -0,0 +1,54 @@
+package multiplex
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// ErrDraining is returned when opening a stream on a session that's being
+// drained, by us or by the peer (see Drain).
+var ErrDraining = errors.New("session draining")
+
+// Drain stops the session from taking on new streams, while the established
+// ones carry on: streams the peer opens from now on are reset, and opening
+// streams fails with ErrDraining. Once the streams left are done, the session
+// can be closed without cutting anything short, as for a rolling restart.
+// There's no going back.
+//
+// Peers supporting CapGoAway are told, so that they stop opening streams
+// too, rather than have them reset: opening streams fails with ErrDraining
+// on their side as well (see PeerDraining).
+func (mp *Multiplex) Drain() {
+	if !atomic.CompareAndSwapInt32(&mp.draining, 0, 1) || !mp.negotiate {
+		return
+	}
+	mp.spawn(func() {
+		// The peer may not have told us what it supports yet.
+		select {
+		case <-mp.negotiated:
+		case <-mp.shutdown:
+			return
+		}
+		if mp.supports(CapGoAway) {
+			mp.sendControl(nil, ctrlGoAway, nil, nil)
+		}
+	})
+}
+
+// IsDraining returns true once Drain was called.
+func (mp *Multiplex) IsDraining() bool {
+	return atomic.LoadInt32(&mp.draining) != 0
+}
+
+// PeerDraining returns true once the peer told us it's draining the session:
+// it takes on no new streams, and it's time to open a new session for them.
+// Only peers supporting CapGoAway say so.
+func (mp *Multiplex) PeerDraining() bool {
+	return atomic.LoadInt32(&mp.peerDraining) != 0
+}
+
+func (mp *Multiplex) handleGoAway(payload []byte) error {
+	mp.log.Debugw("peer is draining the session")
+	atomic.StoreInt32(&mp.peerDraining, 1)
+	return nil
+}
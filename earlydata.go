@@ -0,0 +1,109 @@
+package multiplex
+
+import (
+	"context"
+	"encoding/binary"
+)
+
+// maxEarlyData is the most early data we accept in a stream open, as
+// announced to the peer.
+const maxEarlyData = BufferSize
+
+// maxOpenFrame bounds the size of stream opens carrying early data.
+const maxOpenFrame = binary.MaxVarintLen64 + strictMaxNameLength + maxEarlyData
+
+// NewStreamWithData opens a named stream and writes data to it. If both sides
+// support CapEarlyData, as much of the data as the peer accepts (a few KiB) is sent in the frame
+// opening the stream: the peer's Accept returns the stream with that data
+// already readable. The rest, if any, is written to the stream as usual.
+//
+// If writing the data fails, the stream is reset.
+func (mp *Multiplex) NewStreamWithData(ctx context.Context, name string, data []byte) (*Stream, error) {
+	var early []byte
+	limit := mp.peerEarlyData()
+	// The name goes in the same frame: it must fit too. Streams without a
+	// name are named after their ID, up to 20 digits.
+	nameLen := len(name)
+	if nameLen == 0 {
+		nameLen = 20
+	}
+	if room := mp.peerMaxMessageSize() - binary.MaxVarintLen64 - nameLen; limit > room {
+		limit = room
+	}
+	if limit > 0 && len(data) > 0 {
+		if len(data) > limit {
+			early = data[:limit]
+		} else {
+			early = data
+		}
+	}
+	s, err := mp.newNamedStream(ctx, name, openOptions{early: early})
+	if err != nil {
+		return nil, err
+	}
+	if rest := data[len(early):]; len(rest) > 0 {
+		if _, err := s.WriteContext(ctx, rest); err != nil {
+			s.Reset()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// peerEarlyData returns how much early data the peer accepts in a stream
+// open.
+func (mp *Multiplex) peerEarlyData() int {
+	if !mp.supports(CapEarlyData) {
+		return 0
+	}
+	if mp.remoteEarlyData > maxEarlyData {
+		// We don't send more than we'd accept.
+		return maxEarlyData
+	}
+	return int(mp.remoteEarlyData)
+}
+
+// encodeOpen encodes the payload of a stream open carrying early data.
+func encodeOpen(name string, early []byte) []byte {
+	buf := make([]byte, 0, binary.MaxVarintLen64+len(name)+len(early))
+	buf = appendUvarint(buf, uint64(len(name)))
+	buf = append(buf, name...)
+	return append(buf, early...)
+}
+
+// readEarlyData reads the payload of a stream open carrying early data, and
+// returns the stream's name, if we keep them, and the data in an inbound
+// buffer, or nil if there's none. It returns errNameTooLong, with the payload
+// released, if the name is too long.
+func (mp *Multiplex) readEarlyData(mlen int) (string, []byte, error) {
+	if mlen == 0 || mlen > maxOpenFrame {
+		mp.log.Debugw("received stream open with early data of invalid size", "length", mlen)
+		return "", nil, ErrInvalidState
+	}
+	buf, err := mp.readNextChunk(mlen)
+	if err != nil {
+		return "", nil, err
+	}
+	l, n := binary.Uvarint(buf)
+	if n <= 0 || l > uint64(len(buf)-n) || len(buf)-n-int(l) > maxEarlyData {
+		mp.putBufferInbound(buf)
+		mp.log.Debugw("received malformed stream open with early data")
+		return "", nil, ErrInvalidState
+	}
+	if mp.maxNameLen > 0 && l > uint64(mp.maxNameLen) {
+		mp.putBufferInbound(buf)
+		return "", nil, errNameTooLong
+	}
+	var name string
+	if mp.keepNames && l <= uint64(mp.keptNameLimit()) {
+		name = string(buf[n : n+int(l)])
+	}
+	// Move the data to the front of the buffer, the stream releases it
+	// from there.
+	k := copy(buf, buf[n+int(l):])
+	if k == 0 {
+		mp.putBufferInbound(buf)
+		return name, nil, nil
+	}
+	return name, buf[:k], nil
+}
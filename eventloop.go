@@ -0,0 +1,187 @@
+package multiplex
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"runtime/pprof"
+	"sync"
+	"time"
+)
+
+// Event loop states of a session.
+const (
+	loopIdle = iota
+	loopQueued
+	loopRunning
+	// loopRunningDirty means the session got more work while running.
+	loopRunningDirty
+)
+
+// EventLoop drives the write side of many sessions from a fixed set of
+// goroutines, instead of each session running its own writer goroutine.
+//
+// Sessions on an event loop still use one goroutine each for reading from
+// their connection: the Go runtime's network poller already multiplexes
+// blocked reads efficiently. A worker writing to a connection whose peer
+// doesn't read blocks until the write completes, so the number of workers
+// should be chosen accordingly.
+type EventLoop struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	runq   []*Multiplex
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// NewEventLoop starts an event loop with the given number of workers.
+func NewEventLoop(workers int) *EventLoop {
+	if workers < 1 {
+		workers = 1
+	}
+	l := &EventLoop{}
+	l.cond = sync.NewCond(&l.mu)
+	l.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go l.worker()
+	}
+	return l
+}
+
+// WithEventLoop runs the session's writes on the given event loop.
+func WithEventLoop(l *EventLoop) Option {
+	return func(c *config) error {
+		c.loop = l
+		return nil
+	}
+}
+
+// Close stops the event loop and waits for its workers to exit. Sessions
+// still using the event loop are shut down the next time they try to write.
+func (l *EventLoop) Close() {
+	l.mu.Lock()
+	l.closed = true
+	runq := l.runq
+	l.runq = nil
+	l.cond.Broadcast()
+	l.mu.Unlock()
+
+	for _, mp := range runq {
+		mp.closeNoWait()
+	}
+	l.wg.Wait()
+}
+
+// schedule makes sure the session's write queue gets drained.
+func (l *EventLoop) schedule(mp *Multiplex) {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		mp.closeNoWait()
+		return
+	}
+	switch mp.loopState {
+	case loopIdle:
+		mp.loopState = loopQueued
+		l.runq = append(l.runq, mp)
+		l.cond.Signal()
+	case loopRunning:
+		mp.loopState = loopRunningDirty
+	}
+	l.mu.Unlock()
+}
+
+func (l *EventLoop) worker() {
+	defer l.wg.Done()
+
+	l.mu.Lock()
+	for {
+		for len(l.runq) == 0 && !l.closed {
+			l.cond.Wait()
+		}
+		if l.closed {
+			l.mu.Unlock()
+			return
+		}
+
+		mp := l.runq[0]
+		l.runq[0] = nil
+		l.runq = l.runq[1:]
+		mp.loopState = loopRunning
+		l.mu.Unlock()
+
+		// Label the worker as the session while writing for it.
+		pprof.Do(context.Background(), mp.labels, func(context.Context) { mp.runWrites() })
+
+		l.mu.Lock()
+		switch {
+		case mp.loopState != loopRunningDirty:
+			mp.loopState = loopIdle
+		case l.closed:
+			// We won't get to the rest of its writes.
+			mp.loopState = loopIdle
+			go mp.closeNoWait()
+		default:
+			mp.loopState = loopQueued
+			l.runq = append(l.runq, mp)
+		}
+	}
+}
+
+// runWrites is the event loop equivalent of handleOutgoing: it writes out
+// everything that's queued and arranges for coalesced frames to be flushed.
+func (mp *Multiplex) runWrites() {
+	defer func() {
+		if rerr := recover(); rerr != nil {
+			fmt.Fprintf(os.Stderr, "caught panic in runWrites: %s\n%s\n", rerr, debug.Stack())
+		}
+	}()
+
+	if mp.isShutdown() {
+		return
+	}
+
+	if err := mp.writeQueued(); err != nil {
+		mp.log.Warnw("error writing data", "error", err)
+		return
+	}
+
+	if mp.bw == nil || mp.bw.Buffered() == 0 {
+		return
+	}
+
+	wait := mp.writeCoalesceDelay() - mp.clock.Now().Sub(mp.bufferedSince)
+	if wait <= 0 {
+		if err := mp.flush(); err != nil {
+			mp.log.Warnw("error writing data", "error", err)
+		}
+		return
+	}
+
+	// Come back once the coalescing delay is over.
+	if mp.flushTimer == nil {
+		mp.flushTimer = mp.clock.AfterFunc(wait, func() {
+			if !mp.isShutdown() {
+				mp.loop.schedule(mp)
+			}
+		})
+	} else {
+		mp.flushTimer.Reset(wait)
+	}
+}
+
+// resumeWrites schedules the session again once the batch held back by the
+// bandwidth limits may be written.
+func (mp *Multiplex) resumeWrites(wait time.Duration) {
+	mp.throttledUntil = mp.clock.Now().Add(wait)
+	if mp.resumeTimer == nil {
+		mp.resumeTimer = mp.clock.AfterFunc(wait, func() {
+			if !mp.isShutdown() {
+				mp.loop.schedule(mp)
+			}
+		})
+	} else {
+		mp.resumeTimer.Reset(wait)
+	}
+}
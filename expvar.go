@@ -0,0 +1,145 @@
+package multiplex
+
+import (
+	"expvar"
+	"sync"
+)
+
+// sessions tracks all sessions once PublishExpvars was called, for aggregate
+// statistics.
+var sessions = sessionRegistry{live: make(map[*Multiplex]struct{})}
+
+type sessionRegistry struct {
+	mu sync.Mutex
+	// enabled is set once statistics are published: until then, sessions
+	// aren't tracked.
+	enabled bool
+	live    map[*Multiplex]struct{}
+	// retired holds the counters of the sessions that have been shut down.
+	retired Stats
+}
+
+func (r *sessionRegistry) enable() {
+	r.mu.Lock()
+	r.enabled = true
+	r.mu.Unlock()
+}
+
+func (r *sessionRegistry) add(mp *Multiplex) {
+	r.mu.Lock()
+	if r.enabled {
+		r.live[mp] = struct{}{}
+	}
+	r.mu.Unlock()
+}
+
+func (r *sessionRegistry) remove(mp *Multiplex) {
+	r.mu.Lock()
+	_, ok := r.live[mp]
+	r.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	st := mp.Stat()
+	// Only keep the counters, not the gauges.
+	st.ReservedMemory = 0
+	st.InboundBuffered = 0
+	st.WriteQueueDepth = 0
+
+	r.mu.Lock()
+	delete(r.live, mp)
+	r.retired.add(&st)
+	r.mu.Unlock()
+}
+
+// liveStats returns the statistics of each live session, by description.
+func (r *sessionRegistry) liveStats() map[string]Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	live := make(map[string]Stats, len(r.live))
+	for mp := range r.live {
+		live[mp.String()] = mp.Stat()
+	}
+	return live
+}
+
+// stats returns the number of live sessions, and the statistics of all
+// sessions added together.
+func (r *sessionRegistry) stats() (int, Stats) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	total := r.retired
+	// Don't add the live sessions to the retired ones' protocols.
+	if r.retired.Protocols != nil {
+		total.Protocols = make(map[string]ProtocolStats, len(r.retired.Protocols))
+		for proto, ps := range r.retired.Protocols {
+			total.Protocols[proto] = ps
+		}
+	}
+	for mp := range r.live {
+		st := mp.Stat()
+		total.add(&st)
+	}
+	return len(r.live), total
+}
+
+func (s *Stats) add(o *Stats) {
+	for tag := range s.FramesIn {
+		s.FramesIn[tag] += o.FramesIn[tag]
+		s.FramesOut[tag] += o.FramesOut[tag]
+		s.BytesIn[tag] += o.BytesIn[tag]
+		s.BytesOut[tag] += o.BytesOut[tag]
+	}
+	for b := range s.FrameSizesIn {
+		s.FrameSizesIn[b] += o.FrameSizesIn[b]
+		s.FrameSizesOut[b] += o.FrameSizesOut[b]
+	}
+	s.StreamsOpened += o.StreamsOpened
+	s.StreamsAccepted += o.StreamsAccepted
+	s.StreamsReset += o.StreamsReset
+	s.StreamsRefused += o.StreamsRefused
+	s.ReceiveTimeoutResets += o.ReceiveTimeoutResets
+	s.DroppedBytes += o.DroppedBytes
+	s.DatagramsDropped += o.DatagramsDropped
+	s.HalfClosedTimeouts += o.HalfClosedTimeouts
+	s.ReservedMemory += o.ReservedMemory
+	s.InboundBuffered += o.InboundBuffered
+	s.WriteQueueDepth += o.WriteQueueDepth
+	for proto, ps := range o.Protocols {
+		if s.Protocols == nil {
+			s.Protocols = make(map[string]ProtocolStats)
+		}
+		total := s.Protocols[proto]
+		total.Streams += ps.Streams
+		total.BytesIn += ps.BytesIn
+		total.BytesOut += ps.BytesOut
+		s.Protocols[proto] = total
+	}
+}
+
+// PublishExpvars publishes statistics aggregated over all sessions in this
+// process via expvar: the number of open sessions as prefix.sessions, and the
+// sum of all sessions' Stats as prefix.stats. Counters include the sessions
+// that have been shut down. The Stats of each open session are published as
+// prefix.live, keyed by the session's String. Like expvar.Publish, it panics if called twice
+// with the same prefix.
+//
+// Sessions are only tracked once PublishExpvars was called: the statistics
+// leave out those created before, and there's no cost to sessions otherwise.
+func PublishExpvars(prefix string) {
+	sessions.enable()
+	expvar.Publish(prefix+".sessions", expvar.Func(func() interface{} {
+		n, _ := sessions.stats()
+		return n
+	}))
+	expvar.Publish(prefix+".stats", expvar.Func(func() interface{} {
+		_, st := sessions.stats()
+		return st
+	}))
+	expvar.Publish(prefix+".live", expvar.Func(func() interface{} {
+		return sessions.liveStats()
+	}))
+}
@@ -0,0 +1,178 @@
+// Package frame implements the mplex frame codec.
+//
+// An mplex frame consists of a uvarint header, a uvarint payload length and
+// the payload itself. The header packs the stream ID and the frame's tag as
+// `streamID<<3 | tag`.
+package frame
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/multiformats/go-varint"
+)
+
+// Frame tags. Messages, closes and resets carry a different tag depending on
+// whether they're sent by the stream's initiator or by its receiver.
+const (
+	TagNewStream        = 0
+	TagMessageReceiver  = 1
+	TagMessageInitiator = 2
+	TagCloseReceiver    = 3
+	TagCloseInitiator   = 4
+	TagResetReceiver    = 5
+	TagResetInitiator   = 6
+
+	// TagExtension isn't part of the mplex specification. It's used for
+	// optional protocol extensions, sent on ControlStreamID, and for
+	// opening streams with early data, sent on the new stream's ID by its
+	// initiator. Legacy peers ignore frames with this tag on streams they
+	// don't know about.
+	TagExtension = 7
+)
+
+// MaxStreamID is the largest stream ID that can be encoded in a header.
+// Headers are limited to 63 bits.
+const MaxStreamID = 1<<60 - 1
+
+// ControlStreamID is the stream ID reserved for extension frames. It's never
+// allocated to a regular stream.
+const ControlStreamID = MaxStreamID
+
+// MaxHeaderSize is the maximum encoded size of a frame header and payload
+// length combined.
+const MaxHeaderSize = 2 * binary.MaxVarintLen64
+
+// ErrTooLarge is returned when decoding a frame whose payload exceeds the
+// maximum size.
+var ErrTooLarge = errors.New("message size too large")
+
+// Frame is a decoded mplex frame.
+type Frame struct {
+	StreamID uint64
+	Tag      uint64
+	Payload  []byte
+}
+
+// Header returns the packed header of the frame.
+func (f *Frame) Header() uint64 {
+	return PackHeader(f.StreamID, f.Tag)
+}
+
+// PackHeader packs a stream ID and a tag into a frame header.
+func PackHeader(streamID, tag uint64) uint64 {
+	return streamID<<3 | tag
+}
+
+// UnpackHeader splits a frame header into its stream ID and tag.
+func UnpackHeader(header uint64) (streamID, tag uint64) {
+	return header >> 3, header & 7
+}
+
+// PutHeader encodes a frame header and payload length into buf, which must
+// be at least MaxHeaderSize bytes long, and returns the number of bytes
+// written.
+func PutHeader(buf []byte, header uint64, length int) int {
+	n := binary.PutUvarint(buf, header)
+	n += binary.PutUvarint(buf[n:], uint64(length))
+	return n
+}
+
+// Encode appends the encoded frame to dst and returns the extended buffer.
+func Encode(dst []byte, f Frame) []byte {
+	var hdr [MaxHeaderSize]byte
+	n := PutHeader(hdr[:], f.Header(), len(f.Payload))
+	dst = append(dst, hdr[:n]...)
+	return append(dst, f.Payload...)
+}
+
+// ReadHeader reads a frame header and returns the stream ID and tag.
+func ReadHeader(r io.ByteReader) (streamID, tag uint64, err error) {
+	h, err := varint.ReadUvarint(r)
+	if err != nil {
+		return 0, 0, err
+	}
+	streamID, tag = UnpackHeader(h)
+	return streamID, tag, nil
+}
+
+// ReadLength reads a payload length, failing with ErrTooLarge if it exceeds
+// maxSize.
+func ReadLength(r io.ByteReader, maxSize int) (int, error) {
+	l, err := varint.ReadUvarint(r)
+	if err != nil {
+		return 0, err
+	}
+
+	if l > uint64(maxSize) {
+		return 0, ErrTooLarge
+	}
+
+	return int(l), nil
+}
+
+// Reader is the interface required to decode frames from a stream.
+type Reader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// Decode reads a single frame, including its payload, from r. Payloads
+// larger than maxSize are rejected with ErrTooLarge.
+func Decode(r Reader, maxSize int) (Frame, error) {
+	id, tag, err := ReadHeader(r)
+	if err != nil {
+		return Frame{}, err
+	}
+
+	l, err := ReadLength(r, maxSize)
+	if err != nil {
+		return Frame{}, unexpectedEOF(err)
+	}
+
+	f := Frame{StreamID: id, Tag: tag}
+	if l > 0 {
+		f.Payload = make([]byte, l)
+		if _, err := io.ReadFull(r, f.Payload); err != nil {
+			return Frame{}, unexpectedEOF(err)
+		}
+	}
+	return f, nil
+}
+
+// Unmarshal decodes a single frame from the beginning of b and returns it
+// along with the number of bytes consumed. The returned payload aliases b.
+// If b doesn't hold a complete frame, io.ErrUnexpectedEOF is returned.
+func Unmarshal(b []byte, maxSize int) (Frame, int, error) {
+	h, n, err := varint.FromUvarint(b)
+	if err != nil {
+		return Frame{}, 0, unexpectedEOF(err)
+	}
+	l, m, err := varint.FromUvarint(b[n:])
+	if err != nil {
+		return Frame{}, 0, unexpectedEOF(err)
+	}
+	if l > uint64(maxSize) {
+		return Frame{}, 0, ErrTooLarge
+	}
+	n += m
+
+	if uint64(len(b)-n) < l {
+		return Frame{}, 0, io.ErrUnexpectedEOF
+	}
+
+	id, tag := UnpackHeader(h)
+	f := Frame{StreamID: id, Tag: tag}
+	if l > 0 {
+		f.Payload = b[n : n+int(l)]
+	}
+	return f, n + int(l), nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF || err == varint.ErrUnderflow {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
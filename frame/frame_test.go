@@ -0,0 +1,74 @@
+package frame
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	frames := []Frame{
+		{StreamID: 0, Tag: TagNewStream, Payload: []byte("stream")},
+		{StreamID: 1 << 40, Tag: TagMessageReceiver, Payload: bytes.Repeat([]byte{42}, 300)},
+		{StreamID: 7, Tag: TagResetInitiator},
+	}
+
+	var buf []byte
+	for _, f := range frames {
+		buf = Encode(buf, f)
+	}
+
+	r := bufio.NewReader(bytes.NewReader(buf))
+	rest := buf
+	for _, expected := range frames {
+		f, err := Decode(r, 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertFrame(t, f, expected)
+
+		f, n, err := Unmarshal(rest, 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertFrame(t, f, expected)
+		rest = rest[n:]
+	}
+
+	if _, err := Decode(r, 1024); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+	if len(rest) != 0 {
+		t.Fatalf("expected all bytes to be consumed, %d left", len(rest))
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	buf := Encode(nil, Frame{StreamID: 3, Tag: TagMessageInitiator, Payload: []byte("hello")})
+	for i := 1; i < len(buf); i++ {
+		if _, _, err := Unmarshal(buf[:i], 1024); err != io.ErrUnexpectedEOF {
+			t.Fatalf("expected unexpected EOF for %d bytes, got %v", i, err)
+		}
+		if _, err := Decode(bufio.NewReader(bytes.NewReader(buf[:i])), 1024); err != io.ErrUnexpectedEOF {
+			t.Fatalf("expected unexpected EOF for %d bytes, got %v", i, err)
+		}
+	}
+}
+
+func TestTooLarge(t *testing.T) {
+	buf := Encode(nil, Frame{StreamID: 3, Tag: TagMessageInitiator, Payload: make([]byte, 100)})
+	if _, _, err := Unmarshal(buf, 99); err != ErrTooLarge {
+		t.Fatalf("expected ErrTooLarge, got %v", err)
+	}
+	if _, err := Decode(bufio.NewReader(bytes.NewReader(buf)), 99); err != ErrTooLarge {
+		t.Fatalf("expected ErrTooLarge, got %v", err)
+	}
+}
+
+func assertFrame(t *testing.T, actual, expected Frame) {
+	t.Helper()
+	if actual.StreamID != expected.StreamID || actual.Tag != expected.Tag || !bytes.Equal(actual.Payload, expected.Payload) {
+		t.Fatalf("expected frame %+v, got %+v", expected, actual)
+	}
+}
@@ -0,0 +1,73 @@
+package multiplex
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// WithHalfClosedTimeout closes the streams the peer closed that aren't closed
+// locally within grace, freeing what they hold, rather than letting streams
+// the application forgot about linger until the session goes away. Unread
+// data is discarded, and writes after that fail. onTimeout, if not nil, is
+// called with each stream just before it's closed, to report it; it must not
+// block. The streams closed this way are counted in Stats.
+func WithHalfClosedTimeout(grace time.Duration, onTimeout func(*Stream)) Option {
+	return func(c *config) error {
+		if grace <= 0 {
+			return fmt.Errorf("invalid half-closed timeout: %s", grace)
+		}
+		c.halfClosedTimeout = grace
+		c.onHalfClosedTimeout = onTimeout
+		return nil
+	}
+}
+
+// trackingHalfClosed returns true if the streams the peer closed are tracked
+// until they're done, for leak detection or the half-closed timeout.
+func (mp *Multiplex) trackingHalfClosed() bool {
+	return mp.leakInterval > 0 || mp.halfClosedTimeout > 0
+}
+
+// expireHalfClosed closes the streams left half-closed for too long, until
+// the session shuts down.
+func (mp *Multiplex) expireHalfClosed() {
+	t := mp.clock.NewTimer(mp.halfClosedTimeout)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.Chan():
+		case <-mp.shutdown:
+			return
+		}
+
+		now := mp.clock.Now()
+		next := mp.halfClosedTimeout
+		var expired []*Stream
+		mp.leakLock.Lock()
+		for s, closed := range mp.halfClosed {
+			left := mp.halfClosedTimeout - now.Sub(closed)
+			if left <= 0 {
+				expired = append(expired, s)
+				// Don't expire it again while it closes.
+				delete(mp.halfClosed, s)
+				delete(mp.leaksReported, s)
+			} else if left < next {
+				next = left
+			}
+		}
+		mp.leakLock.Unlock()
+
+		for _, s := range expired {
+			s := s
+			atomic.AddUint64(&mp.counters.halfClosedTimeouts, 1)
+			mp.log.Debugw("closing stream left half-closed", s.logFields()...)
+			if mp.onHalfClosedTimeout != nil {
+				mp.onHalfClosedTimeout(s)
+			}
+			// Closing may wait for queued data to be sent.
+			mp.spawn(func() { s.Close() })
+		}
+		t.Reset(next)
+	}
+}
@@ -0,0 +1,90 @@
+package multiplex
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+)
+
+// ErrHeadersUnsupported is returned when opening a stream with headers on a
+// session where they aren't in use (see CapStreamHeaders).
+var ErrHeadersUnsupported = errors.New("peer doesn't support stream headers")
+
+// ErrHeadersTooLarge is returned when the headers of a new stream don't fit a
+// single extension frame.
+var ErrHeadersTooLarge = errors.New("stream headers too large")
+
+// NewStreamWithHeaders opens a stream, sending the given key/value headers
+// along with the stream's name. The peer gets them from the accepted
+// stream's Headers.
+//
+// Headers are a protocol extension: unless they're empty, opening the stream
+// fails with ErrHeadersUnsupported unless both sides support
+// CapStreamHeaders. They're sent in an
+// extension frame right before the stream is opened, and must fit in
+// BufferSize bytes.
+func (mp *Multiplex) NewStreamWithHeaders(ctx context.Context, name string, headers map[string]string) (*Stream, error) {
+	return mp.newNamedStream(ctx, name, openOptions{headers: headers})
+}
+
+// Headers returns the headers the stream was opened with (see
+// NewStreamWithHeaders), if any. It must not be modified.
+func (s *Stream) Headers() map[string]string {
+	return s.headers
+}
+
+// encodeHeaders encodes the headers of the stream with the given ID into an
+// extension frame payload.
+func encodeHeaders(id uint64, headers map[string]string) ([]byte, error) {
+	buf := make([]byte, 0, 64)
+	buf = appendUvarint(buf, ctrlHeaders)
+	buf = appendUvarint(buf, id)
+	buf = appendUvarint(buf, uint64(len(headers)))
+	for k, v := range headers {
+		buf = appendUvarint(buf, uint64(len(k)))
+		buf = append(buf, k...)
+		buf = appendUvarint(buf, uint64(len(v)))
+		buf = append(buf, v...)
+	}
+	if len(buf) > maxControlFrameSize {
+		return nil, ErrHeadersTooLarge
+	}
+	return buf, nil
+}
+
+// handleHeaders processes the payload of a headers extension message, storing
+// the headers until the stream is opened.
+func (mp *Multiplex) handleHeaders(payload []byte) error {
+	id, n := binary.Uvarint(payload)
+	if n <= 0 {
+		mp.log.Debugw("received malformed stream headers")
+		return nil
+	}
+	payload = payload[n:]
+	count, n := binary.Uvarint(payload)
+	if n <= 0 || count > uint64(len(payload)) {
+		mp.log.Debugw("received malformed stream headers")
+		return nil
+	}
+	payload = payload[n:]
+
+	headers := make(map[string]string, count)
+	for i := uint64(0); i < count; i++ {
+		var kv [2]string
+		for j := range kv {
+			l, n := binary.Uvarint(payload)
+			if n <= 0 || l > uint64(len(payload)-n) {
+				mp.log.Debugw("received malformed stream headers")
+				return nil
+			}
+			kv[j] = string(payload[n : n+int(l)])
+			payload = payload[n+int(l):]
+		}
+		headers[kv[0]] = kv[1]
+	}
+
+	if p := mp.pendingOpen(id); p != nil {
+		p.headers = headers
+	}
+	return nil
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"time"
+
+	mplex "github.com/libp2p/go-mplex"
+)
+
+// Every stream opened by the test runner starts with a line naming the
+// behavior expected from the peer. The peer-side behaviors are:
+//
+//	rw      write goTestData/peerTestData lines concurrently, then close
+//	echo    echo everything back, close once the remote side closed
+//	close   close for writing immediately, then read everything
+//	reset   reset the stream right after reading the case line
+//	open N  open N streams to the runner, running "rw" on them
+//
+// The case line is used instead of the stream name because not every
+// implementation exposes the name of accepted streams.
+const (
+	goTestData   = "test data from go %d"
+	peerTestData = "test data from peer %d"
+
+	rwStreams  = 100
+	rwMessages = 100
+	largeSize  = 2<<20 + 123
+
+	caseTimeout = time.Minute
+)
+
+var defaultCases = []string{"rw", "echo", "large", "close", "reset"}
+
+var testCases = map[string]func(sess *mplex.Multiplex) error{
+	"rw":    testReadWrite,
+	"echo":  testEcho,
+	"large": testLarge,
+	"close": testClose,
+	"reset": testReset,
+}
+
+func runCases(sess *mplex.Multiplex, cases []string) error {
+	for _, name := range cases {
+		tc, ok := testCases[name]
+		if !ok {
+			return fmt.Errorf("unknown test case %q", name)
+		}
+		start := time.Now()
+		if err := tc(sess); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		fmt.Fprintf(os.Stderr, "ok   %s (%s)\n", name, time.Since(start).Round(time.Millisecond))
+	}
+	return nil
+}
+
+// openCase opens a stream and tells the peer how to behave on it.
+func openCase(sess *mplex.Multiplex, line string) (*mplex.Stream, error) {
+	s, err := sess.NewStream(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	s.SetDeadline(time.Now().Add(caseTimeout))
+	if _, err := io.WriteString(s, line+"\n"); err != nil {
+		s.Reset()
+		return nil, err
+	}
+	return s, nil
+}
+
+// readLine reads the case line from the start of a stream. It reads a byte at
+// a time so that no stream data is consumed past the line.
+func readLine(r io.Reader) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for len(line) < 64 {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		if b[0] == '\n' {
+			return string(line), nil
+		}
+		line = append(line, b[0])
+	}
+	return "", fmt.Errorf("case line too long")
+}
+
+func testReadWrite(sess *mplex.Multiplex) error {
+	errs := make(chan error, 2*rwStreams)
+	for i := 0; i < rwStreams; i++ {
+		go func() {
+			s, err := openCase(sess, "rw")
+			if err != nil {
+				errs <- err
+				return
+			}
+			errs <- readWrite(s, goTestData, peerTestData)
+		}()
+	}
+
+	ctl, err := openCase(sess, fmt.Sprintf("open %d", rwStreams))
+	if err != nil {
+		return err
+	}
+	if err := ctl.Close(); err != nil {
+		return err
+	}
+
+	for i := 0; i < rwStreams; i++ {
+		s, err := sess.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			s.SetDeadline(time.Now().Add(caseTimeout))
+			line, err := readLine(s)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if line != "rw" {
+				s.Reset()
+				errs <- fmt.Errorf("unexpected case line from peer: %q", line)
+				return
+			}
+			errs <- readWrite(s, goTestData, peerTestData)
+		}()
+	}
+
+	for i := 0; i < 2*rwStreams; i++ {
+		if err := <-errs; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readWrite concurrently writes our test data and checks the test data sent
+// by the other side.
+func readWrite(s *mplex.Stream, local, remote string) error {
+	werr := make(chan error, 1)
+	go func() {
+		for i := 0; i < rwMessages; i++ {
+			if _, err := fmt.Fprintf(s, local, i); err != nil {
+				werr <- err
+				return
+			}
+		}
+		werr <- s.CloseWrite()
+	}()
+
+	rerr := func() error {
+		for i := 0; i < rwMessages; i++ {
+			expected := fmt.Sprintf(remote, i)
+			actual := make([]byte, len(expected))
+			if _, err := io.ReadFull(s, actual); err != nil {
+				return err
+			}
+			if expected != string(actual) {
+				return fmt.Errorf("expected %q, got %q", expected, actual)
+			}
+		}
+		buf, err := ioutil.ReadAll(s)
+		if err != nil {
+			return err
+		}
+		if len(buf) > 0 {
+			return fmt.Errorf("expected EOF, got %d more bytes", len(buf))
+		}
+		return nil
+	}()
+
+	if err := <-werr; err != nil {
+		s.Reset()
+		return err
+	}
+	if rerr != nil {
+		s.Reset()
+		return rerr
+	}
+	return s.Close()
+}
+
+// echo sends msg on an echo stream and checks that it's echoed back verbatim.
+func echo(sess *mplex.Multiplex, msg []byte) error {
+	s, err := openCase(sess, "echo")
+	if err != nil {
+		return err
+	}
+
+	werr := make(chan error, 1)
+	go func() {
+		if _, err := s.Write(msg); err != nil {
+			werr <- err
+			return
+		}
+		werr <- s.CloseWrite()
+	}()
+
+	buf, err := ioutil.ReadAll(s)
+	if err != nil {
+		s.Reset()
+		return err
+	}
+	if err := <-werr; err != nil {
+		s.Reset()
+		return err
+	}
+	if !bytes.Equal(buf, msg) {
+		s.Reset()
+		return fmt.Errorf("echoed data differs: sent %d bytes, received %d", len(msg), len(buf))
+	}
+	return s.Close()
+}
+
+func testEcho(sess *mplex.Multiplex) error {
+	return echo(sess, []byte("hello interop"))
+}
+
+func testLarge(sess *mplex.Multiplex) error {
+	msg := make([]byte, largeSize)
+	rand.Read(msg)
+	return echo(sess, msg)
+}
+
+func testClose(sess *mplex.Multiplex) error {
+	s, err := openCase(sess, "close")
+	if err != nil {
+		return err
+	}
+
+	// The peer closes its side straight away.
+	buf, err := ioutil.ReadAll(s)
+	if err != nil {
+		s.Reset()
+		return err
+	}
+	if len(buf) > 0 {
+		s.Reset()
+		return fmt.Errorf("expected EOF, got %d bytes", len(buf))
+	}
+
+	// Our side must remain writable.
+	if _, err := io.WriteString(s, "still writable"); err != nil {
+		s.Reset()
+		return fmt.Errorf("write after remote close: %w", err)
+	}
+	if err := s.CloseWrite(); err != nil {
+		return err
+	}
+	if _, err := s.Write([]byte("x")); err == nil {
+		s.Reset()
+		return fmt.Errorf("write after local close succeeded")
+	}
+	return s.Close()
+}
+
+func testReset(sess *mplex.Multiplex) error {
+	s, err := openCase(sess, "reset")
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	_, err = s.Read(make([]byte, 1))
+	if !errors.Is(err, mplex.ErrStreamReset) {
+		return fmt.Errorf("expected a stream reset, got %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"io"
+	"net"
+	"time"
+)
+
+// stdioConn adapts a pair of pipes to a net.Conn.
+type stdioConn struct {
+	io.Reader
+	w    io.WriteCloser
+	wait func() error
+}
+
+var _ net.Conn = (*stdioConn)(nil)
+
+func newStdioConn(r io.Reader, w io.WriteCloser, wait func() error) *stdioConn {
+	return &stdioConn{Reader: r, w: w, wait: wait}
+}
+
+func (c *stdioConn) Write(b []byte) (int, error) {
+	return c.w.Write(b)
+}
+
+func (c *stdioConn) Close() error {
+	err := c.w.Close()
+	if c.wait != nil {
+		// The peer exits once we close its stdin.
+		if werr := c.wait(); err == nil {
+			err = werr
+		}
+	}
+	return err
+}
+
+func (c *stdioConn) LocalAddr() net.Addr  { return stdioAddr{} }
+func (c *stdioConn) RemoteAddr() net.Addr { return stdioAddr{} }
+
+func (c *stdioConn) SetDeadline(t time.Time) error      { return nil }
+func (c *stdioConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *stdioConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type stdioAddr struct{}
+
+func (stdioAddr) Network() string { return "stdio" }
+func (stdioAddr) String() string  { return "stdio" }
@@ -1,102 +1,86 @@
+// Command go runs the mplex interop test cases against a peer implementation.
+//
+// By default it dials the peer over TCP. It can also spawn the peer and talk
+// to it over the peer's stdin/stdout, or act as the peer itself (see peer.go
+// for the behavior expected from peers).
 package main
 
 import (
-	"context"
+	"flag"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"net"
-	"sync"
+	"os"
+	"os/exec"
+	"strings"
 
 	mplex "github.com/libp2p/go-mplex"
 )
 
-var jsTestData = "test data from js %d"
-var goTestData = "test data from go %d"
-
 func main() {
-	conn, err := net.Dial("tcp4", "127.0.0.1:9991")
+	var (
+		addr   = flag.String("addr", "127.0.0.1:9991", "dial the peer at this TCP address")
+		listen = flag.String("listen", "", "listen on this TCP address and wait for the peer to connect")
+		cmd    = flag.String("exec", "", "spawn this command as the peer and talk to it over its stdin/stdout")
+		stdio  = flag.Bool("stdio", false, "talk to the peer over our own stdin/stdout")
+		serve  = flag.Bool("serve", false, "act as the peer instead of running the test cases")
+		cases  = flag.String("cases", strings.Join(defaultCases, ","), "comma separated list of test cases to run")
+	)
+	flag.Parse()
+
+	conn, err := connect(*addr, *listen, *cmd, *stdio)
 	if err != nil {
-		panic(err)
+		fatal(err)
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	sess, err := mplex.NewMultiplex(conn, true, nil)
+	sess, err := mplex.NewMultiplex(conn, !*serve, nil)
 	if err != nil {
-		panic(err)
+		fatal(err)
 	}
 	defer sess.Close()
 
-	var wg sync.WaitGroup
-
-	for i := 0; i < 100; i++ {
-		wg.Add(1)
-
-		go func() {
-			defer wg.Done()
-			s, err := sess.NewStream(ctx)
-			if err != nil {
-				panic(err)
-			}
-			readWrite(s)
-		}()
+	if *serve {
+		err = servePeer(sess)
+	} else {
+		err = runCases(sess, strings.Split(*cases, ","))
 	}
-	for i := 0; i < 100; i++ {
-		s, err := sess.Accept()
-		if err != nil {
-			panic(err)
-		}
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			readWrite(s)
-		}()
+	if err != nil {
+		fatal(err)
 	}
-	wg.Wait()
 }
 
-func readWrite(s *mplex.Stream) {
-	var wg sync.WaitGroup
-	wg.Add(2)
-	go func() {
-		defer wg.Done()
-		for i := 0; i < 100; i++ {
-			_, err := fmt.Fprintf(s, goTestData, i)
-			if err != nil {
-				panic(err)
-			}
+func connect(addr, listen, cmd string, stdio bool) (net.Conn, error) {
+	switch {
+	case stdio:
+		return newStdioConn(os.Stdin, os.Stdout, nil), nil
+	case cmd != "":
+		args := strings.Fields(cmd)
+		c := exec.Command(args[0], args[1:]...)
+		c.Stderr = os.Stderr
+		stdin, err := c.StdinPipe()
+		if err != nil {
+			return nil, err
 		}
-		err := s.CloseWrite()
+		stdout, err := c.StdoutPipe()
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
-	}()
-	go func() {
-		defer wg.Done()
-		for i := 0; i < 100; i++ {
-			expected := fmt.Sprintf(jsTestData, i)
-			actual := make([]byte, len(expected))
-			_, err := io.ReadFull(s, actual)
-			if err != nil {
-				panic(err)
-			}
-			if expected != string(actual) {
-				panic("bad bytes")
-			}
+		if err := c.Start(); err != nil {
+			return nil, err
 		}
-		buf, err := ioutil.ReadAll(s)
+		return newStdioConn(stdout, stdin, c.Wait), nil
+	case listen != "":
+		l, err := net.Listen("tcp", listen)
 		if err != nil {
-			panic(err)
-		}
-		if len(buf) > 0 {
-			panic("expected EOF")
+			return nil, err
 		}
-	}()
-	wg.Wait()
-	err := s.Close()
-	if err != nil {
-		panic(err)
+		defer l.Close()
+		return l.Accept()
+	default:
+		return net.Dial("tcp", addr)
 	}
 }
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "interop:", err)
+	os.Exit(1)
+}
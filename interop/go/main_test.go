@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	mplex "github.com/libp2p/go-mplex"
+)
+
+func TestCasesAgainstGoPeer(t *testing.T) {
+	a, b := net.Pipe()
+
+	client, err := mplex.NewMultiplex(a, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	peer, err := mplex.NewMultiplex(b, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	go servePeer(peer)
+
+	if err := runCases(client, defaultCases); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	mplex "github.com/libp2p/go-mplex"
+)
+
+// servePeer implements the peer side of the test cases (see cases.go). It
+// returns once the session is closed.
+func servePeer(sess *mplex.Multiplex) error {
+	for {
+		s, err := sess.Accept()
+		if err != nil {
+			// The test runner is done.
+			return nil
+		}
+		go func() {
+			if err := handleCase(sess, s); err != nil {
+				fmt.Fprintln(os.Stderr, "peer:", err)
+				s.Reset()
+			}
+		}()
+	}
+}
+
+func handleCase(sess *mplex.Multiplex, s *mplex.Stream) error {
+	s.SetDeadline(time.Now().Add(caseTimeout))
+
+	line, err := readLine(s)
+	if err != nil {
+		return err
+	}
+
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		return fmt.Errorf("empty case line")
+	}
+
+	switch args[0] {
+	case "rw":
+		return readWrite(s, peerTestData, goTestData)
+	case "echo":
+		if _, err := io.Copy(s, s); err != nil {
+			return err
+		}
+		return s.Close()
+	case "close":
+		if err := s.CloseWrite(); err != nil {
+			return err
+		}
+		if _, err := ioutil.ReadAll(s); err != nil {
+			return err
+		}
+		return s.Close()
+	case "reset":
+		return s.Reset()
+	case "open":
+		if len(args) != 2 {
+			return fmt.Errorf("bad open case: %q", line)
+		}
+		n, err := strconv.Atoi(args[1])
+		if err != nil {
+			return err
+		}
+		s.Close()
+		for i := 0; i < n; i++ {
+			go func() {
+				rs, err := openCase(sess, "rw")
+				if err == nil {
+					err = readWrite(rs, peerTestData, goTestData)
+				}
+				if err != nil {
+					fmt.Fprintln(os.Stderr, "peer:", err)
+				}
+			}()
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown case %q", line)
+	}
+}
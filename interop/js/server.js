@@ -1,45 +1,125 @@
-const assert = require('assert')
-
 const Mplex = require('libp2p-mplex')
 const pipe = require('it-pipe')
-const { collect } = require('streaming-iterables')
 const tcp = require('tcp')
 const { BufferList } = require('bl')
 const toConnection = require('libp2p-tcp/src/socket-to-conn')
 
-const jsTestData = 'test data from js'
+// See interop/go/cases.go for a description of the test cases.
 const goTestData = 'test data from go'
+const peerTestData = 'test data from peer'
+const rwMessages = 100
+
+// readLine reads the case line from the start of a stream. It returns the
+// line and an iterable over the rest of the stream.
+async function readLine (stream) {
+  const source = stream.source[Symbol.asyncIterator]()
+  const buf = new BufferList()
+  while (true) {
+    const { done, value } = await source.next()
+    if (done) {
+      throw new Error('stream ended before the case line')
+    }
+    buf.append(value)
+    const idx = buf.indexOf('\n')
+    if (idx >= 0) {
+      const rest = buf.shallowSlice(idx + 1)
+      return {
+        line: buf.slice(0, idx).toString(),
+        rest: (async function * () {
+          if (rest.length > 0) {
+            yield rest
+          }
+          while (true) {
+            const { done, value } = await source.next()
+            if (done) {
+              return
+            }
+            yield value
+          }
+        })()
+      }
+    }
+  }
+}
+
+async function collect (source) {
+  const buf = new BufferList()
+  for await (const chunk of source) {
+    buf.append(chunk)
+  }
+  return buf
+}
 
-async function readWrite (stream) {
+async function readWrite (stream, source, prefix) {
   await Promise.all([
     (async () => {
-      let data = new BufferList(await pipe(stream, collect))
+      const data = await collect(source)
       let offset = 0
-      for (let i = 0; i < 100; i++) {
-        let expected = goTestData + ' ' + i
-        assert.equal(data.slice(offset, offset + expected.length).toString(), expected)
+      for (let i = 0; i < rwMessages; i++) {
+        const expected = goTestData + ' ' + i
+        const actual = data.slice(offset, offset + expected.length).toString()
+        if (actual !== expected) {
+          throw new Error(`expected "${expected}", got "${actual}"`)
+        }
         offset += expected.length
       }
+      if (offset !== data.length) {
+        throw new Error('expected EOF')
+      }
     })(),
-    stream.sink((async function* (data) {
-      for (let i = 0; i < 100; i++) {
-        yield jsTestData + ' ' + i
+    stream.sink((async function * () {
+      if (prefix) {
+        yield prefix
+      }
+      for (let i = 0; i < rwMessages; i++) {
+        yield peerTestData + ' ' + i
       }
     })())
   ])
 }
 
+async function handleCase (muxer, stream) {
+  const { line, rest } = await readLine(stream)
+  const args = line.split(' ')
+  switch (args[0]) {
+    case 'rw':
+      return readWrite(stream, rest)
+    case 'echo':
+      return pipe(rest, stream)
+    case 'close':
+      await stream.sink([])
+      await collect(rest)
+      return
+    case 'reset':
+      return stream.reset()
+    case 'open': {
+      await stream.sink([])
+      const promises = []
+      for (let i = 0; i < parseInt(args[1]); i++) {
+        const s = muxer.newStream()
+        promises.push(readWrite(s, s.source, 'rw\n'))
+      }
+      return Promise.all(promises)
+    }
+    default:
+      throw new Error(`unknown case "${line}"`)
+  }
+}
+
 const listener = tcp.createServer(async socket => {
   socket.on('close', () => listener.close())
 
-  let muxer = new Mplex({onStream: readWrite})
-  let conn = toConnection(socket)
-  let promises = [pipe(conn, muxer, conn)]
-  for (let i = 0; i < 100; i++) {
-    const stream = muxer.newStream()
-    promises.push(readWrite(stream))
-  }
-  await Promise.all(promises)
+  const muxer = new Mplex({
+    onStream: stream => {
+      handleCase(muxer, stream).catch(err => {
+        console.error('peer:', err)
+        process.exitCode = 1
+        stream.reset()
+      })
+    }
+  })
+  const conn = toConnection(socket)
+  await pipe(conn, muxer, conn)
 })
 
 listener.listen(9991)
@@ -0,0 +1,241 @@
+//! A rust-libp2p mplex peer for the interop tests. It waits for the Go test
+//! runner to connect over TCP, and implements the peer side of the test cases
+//! described in interop/go/cases.go.
+
+use std::collections::VecDeque;
+use std::env;
+use std::future::Future;
+use std::io;
+use std::process;
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::task::Poll;
+use std::time::Duration;
+
+use futures::channel::{mpsc, oneshot};
+use futures::future::{poll_fn, try_join};
+use futures::{AsyncReadExt, AsyncWriteExt, StreamExt};
+use libp2p_core::muxing::StreamMuxerExt;
+use libp2p_core::upgrade::InboundConnectionUpgrade;
+use libp2p_mplex::{Config, MaxBufferBehaviour, Multiplex};
+use tokio::net::{TcpListener, TcpStream};
+use tokio_util::compat::{Compat, TokioAsyncReadCompatExt};
+
+const GO_TEST_DATA: &str = "test data from go";
+const PEER_TEST_DATA: &str = "test data from peer";
+const RW_MESSAGES: usize = 100;
+const CASE_TIMEOUT: Duration = Duration::from_secs(60);
+
+type Conn = Compat<TcpStream>;
+type Substream = libp2p_mplex::Substream<Conn>;
+
+/// Requests to the task driving the session.
+enum Request {
+    /// Open a stream to the runner.
+    Open(oneshot::Sender<Substream>),
+    /// Send the frames queued by dropping streams, which the session only
+    /// does when it's polled.
+    Flush,
+}
+
+type Requests = mpsc::UnboundedSender<Request>;
+
+/// Set once a test case failed.
+static FAILED: AtomicBool = AtomicBool::new(false);
+
+#[tokio::main]
+async fn main() {
+    let addr = env::args()
+        .nth(1)
+        .unwrap_or_else(|| "127.0.0.1:9991".into());
+    if let Err(err) = run(&addr).await {
+        eprintln!("peer: {}", err);
+        process::exit(1);
+    }
+    if FAILED.load(Ordering::SeqCst) {
+        process::exit(1);
+    }
+}
+
+async fn run(addr: &str) -> io::Result<()> {
+    let listener = TcpListener::bind(addr).await?;
+    let (socket, _) = listener.accept().await?;
+
+    let mut config = Config::new();
+    // The runner has two hundred streams open at once in the rw case, and
+    // doesn't read them all at the same pace.
+    config.set_max_num_streams(1024);
+    config.set_max_buffer_behaviour(MaxBufferBehaviour::Block);
+    let muxer = config
+        .upgrade_inbound(socket.compat(), "/mplex/6.7.0")
+        .await?;
+    serve(muxer).await
+}
+
+/// serve drives the session, running a test case on each stream the runner
+/// opens and opening the streams the cases ask for, until the runner is done.
+async fn serve(mut muxer: Multiplex<Conn>) -> io::Result<()> {
+    let (requests, mut incoming) = mpsc::unbounded();
+    let mut opening: VecDeque<oneshot::Sender<Substream>> = VecDeque::new();
+    poll_fn(|cx| -> Poll<io::Result<()>> {
+        loop {
+            let mut progress = false;
+            match muxer.poll_inbound_unpin(cx) {
+                Poll::Ready(Ok(s)) => {
+                    let requests = requests.clone();
+                    tokio::spawn(run_case(requests.clone(), handle_case(s, requests)));
+                    progress = true;
+                }
+                // The runner is done.
+                Poll::Ready(Err(_)) => return Poll::Ready(Ok(())),
+                Poll::Pending => {}
+            }
+            while let Poll::Ready(Some(req)) = incoming.poll_next_unpin(cx) {
+                match req {
+                    Request::Open(tx) => opening.push_back(tx),
+                    // Polling the session again sends the frames.
+                    Request::Flush => {}
+                }
+                progress = true;
+            }
+            if !opening.is_empty() {
+                if let Poll::Ready(res) = muxer.poll_outbound_unpin(cx) {
+                    // The case gave up if it's gone, dropping the stream
+                    // resets it.
+                    let _ = opening.pop_front().unwrap().send(res?);
+                    progress = true;
+                }
+            }
+            if let Poll::Ready(res) = muxer.poll_unpin(cx) {
+                res?;
+                progress = true;
+            }
+            if !progress {
+                return Poll::Pending;
+            }
+        }
+    })
+    .await
+}
+
+/// run_case runs a test case, reporting it if it fails. The streams it leaves
+/// open are reset.
+async fn run_case<F>(requests: Requests, case: F)
+where
+    F: Future<Output = io::Result<()>>,
+{
+    let res = match tokio::time::timeout(CASE_TIMEOUT, case).await {
+        Ok(res) => res,
+        Err(_) => Err(io::Error::new(io::ErrorKind::TimedOut, "case timed out")),
+    };
+    if let Err(err) = res {
+        eprintln!("peer: {}", err);
+        FAILED.store(true, Ordering::SeqCst);
+    }
+    // Dropping the case's streams may have queued a close or a reset.
+    let _ = requests.unbounded_send(Request::Flush);
+}
+
+async fn handle_case(mut s: Substream, requests: Requests) -> io::Result<()> {
+    let line = read_line(&mut s).await?;
+    let args: Vec<&str> = line.split_whitespace().collect();
+    match args.as_slice() {
+        ["rw"] => read_write(s, PEER_TEST_DATA, GO_TEST_DATA).await,
+        ["echo"] => {
+            let (mut r, mut w) = s.split();
+            futures::io::copy(&mut r, &mut w).await?;
+            w.close().await
+        }
+        ["close"] => {
+            s.close().await?;
+            s.read_to_end(&mut Vec::new()).await?;
+            Ok(())
+        }
+        // Dropping a stream that isn't closed resets it.
+        ["reset"] => Ok(()),
+        ["open", n] => {
+            let n: usize = n
+                .parse()
+                .map_err(|_| invalid(format!("bad open case: {:?}", line)))?;
+            s.close().await?;
+            for _ in 0..n {
+                tokio::spawn(run_case(
+                    requests.clone(),
+                    open_read_write(requests.clone()),
+                ));
+            }
+            Ok(())
+        }
+        _ => Err(invalid(format!("unknown case {:?}", line))),
+    }
+}
+
+/// open_read_write opens a stream to the runner and runs the rw case on it.
+async fn open_read_write(requests: Requests) -> io::Result<()> {
+    let (tx, rx) = oneshot::channel();
+    requests
+        .unbounded_send(Request::Open(tx))
+        .map_err(|_| closed())?;
+    let mut s = rx.await.map_err(|_| closed())?;
+    s.write_all(b"rw\n").await?;
+    read_write(s, PEER_TEST_DATA, GO_TEST_DATA).await
+}
+
+/// read_line reads the case line from the start of a stream. It reads a byte
+/// at a time so that no stream data is consumed past the line.
+async fn read_line(s: &mut Substream) -> io::Result<String> {
+    let mut line = Vec::new();
+    let mut b = [0u8; 1];
+    while line.len() < 64 {
+        s.read_exact(&mut b).await?;
+        if b[0] == b'\n' {
+            return String::from_utf8(line).map_err(|_| invalid("case line isn't UTF-8".into()));
+        }
+        line.push(b[0]);
+    }
+    Err(invalid("case line too long".into()))
+}
+
+/// read_write concurrently writes our test data and checks the test data sent
+/// by the runner, then closes the stream.
+async fn read_write(s: Substream, local: &str, remote: &str) -> io::Result<()> {
+    let (mut r, mut w) = s.split();
+    let write = async {
+        for i in 0..RW_MESSAGES {
+            w.write_all(format!("{} {}", local, i).as_bytes()).await?;
+        }
+        w.close().await
+    };
+    let read = async {
+        for i in 0..RW_MESSAGES {
+            let expected = format!("{} {}", remote, i);
+            let mut actual = vec![0; expected.len()];
+            r.read_exact(&mut actual).await?;
+            if actual != expected.as_bytes() {
+                return Err(invalid(format!(
+                    "expected {:?}, got {:?}",
+                    expected,
+                    String::from_utf8_lossy(&actual)
+                )));
+            }
+        }
+        let mut rest = Vec::new();
+        r.read_to_end(&mut rest).await?;
+        if !rest.is_empty() {
+            return Err(invalid(format!(
+                "expected EOF, got {} more bytes",
+                rest.len()
+            )));
+        }
+        Ok(())
+    };
+    try_join(write, read).await?;
+    Ok(())
+}
+
+fn invalid(msg: String) -> io::Error {
+    io::Error::new(io::ErrorKind::InvalidData, msg)
+}
+
+fn closed() -> io::Error {
+    io::Error::new(io::ErrorKind::BrokenPipe, "session closed")
+}
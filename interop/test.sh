@@ -1,18 +1,37 @@
 #!/bin/sh
 
-(
-    cd "js"
-    npm install
-)
+# Usage: ./test.sh [js|rust]
+peer=${1:-js}
 
-(
-    cd "js" && npm start
-) &
+case "$peer" in
+js)
+    (
+        cd "js"
+        npm install
+    )
+
+    (
+        cd "js" && npm start
+    ) &
+    ;;
+rust)
+    (
+        cd "rust"
+        cargo build --release
+    ) || exit 1
+
+    ./rust/target/release/mplex-interop &
+    ;;
+*)
+    echo "unknown peer: $peer" >&2
+    exit 2
+    ;;
+esac
 
 sleep 1
 
 (
-    cd "go" && go run main.go
+    cd "go" && go run .
 ) &
 
 wait
@@ -0,0 +1,40 @@
+package multiplex
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrIOURingUnsupported is returned by NewIOURing when io_uring isn't
+// available: on platforms other than Linux, on architectures it's not
+// supported on here, and on kernels that don't support it or forbid its use.
+var ErrIOURingUnsupported = errors.New("io_uring not supported")
+
+// ErrIOURingClosed is returned by I/O going through an IOURing that was
+// closed.
+var ErrIOURingClosed = errors.New("io_uring closed")
+
+// WithIOURing makes the session read from and write to its connection
+// through the given io_uring, which may be shared by many sessions. The
+// submissions of all the sessions sharing the ring are batched, and frames
+// written together (see WithWriteCoalescing) go out with a single vectored
+// write, without being copied into one buffer first. Sessions whose
+// connection isn't backed by a socket (it doesn't implement syscall.Conn),
+// and all sessions on platforms where io_uring isn't supported (see
+// ErrIOURingUnsupported), use the regular I/O path.
+//
+// The ring must not be closed before the sessions using it: their I/O fails
+// once it is.
+func WithIOURing(r *IOURing) Option {
+	return func(c *config) error {
+		c.ring = r
+		return nil
+	}
+}
+
+// vectoredConn is the connection of a session doing its I/O through an
+// IOURing. writeBuffers writes several buffers with a single call.
+type vectoredConn interface {
+	io.ReadWriter
+	writeBuffers(bufs [][]byte) (int, error)
+}
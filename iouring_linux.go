@@ -0,0 +1,535 @@
+//go:build linux && (386 || amd64 || arm || arm64 || ppc64 || ppc64le || riscv64 || s390x)
+
+package multiplex
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// The system call numbers are the same on all the architectures this
+	// file is built for, but not on some others (alpha, mips).
+	sysIOURingSetup = 425
+	sysIOURingEnter = 426
+
+	ioringOffSQRing = 0
+	ioringOffCQRing = 0x8000000
+	ioringOffSQEs   = 0x10000000
+
+	ioringEnterGetEvents = 1
+
+	ioringOpSendmsg = 9
+	ioringOpRecv    = 27
+
+	// maxRingEntries is the largest submission queue the kernel accepts.
+	maxRingEntries = 32768
+	// maxIovecs is the most buffers passed to a single sendmsg.
+	maxIovecs = 1024
+)
+
+// The io_uring ABI, see linux/io_uring.h.
+type (
+	ioURingParams struct {
+		sqEntries, cqEntries, flags uint32
+		sqThreadCPU, sqThreadIdle   uint32
+		features, wqFD              uint32
+		resv                        [3]uint32
+		sqOff                       ioSQRingOffsets
+		cqOff                       ioCQRingOffsets
+	}
+	ioSQRingOffsets struct {
+		head, tail, ringMask, ringEntries uint32
+		flags, dropped, array, resv1      uint32
+		userAddr                          uint64
+	}
+	ioCQRingOffsets struct {
+		head, tail, ringMask, ringEntries uint32
+		overflow, cqes, flags, resv1      uint32
+		userAddr                          uint64
+	}
+	ioURingSQE struct {
+		opcode, flags uint8
+		ioprio        uint16
+		fd            int32
+		off, addr     uint64
+		len, opFlags  uint32
+		userData      uint64
+		bufIndex      uint16
+		personality   uint16
+		spliceFDIn    int32
+		addr3, pad    uint64
+	}
+	ioURingCQE struct {
+		userData uint64
+		res      int32
+		flags    uint32
+	}
+	// msghdr is struct msghdr, whose iovlen is a size_t on all
+	// architectures.
+	msghdr struct {
+		name       *byte
+		namelen    uint32
+		iov        *syscall.Iovec
+		iovlen     uintptr
+		control    *byte
+		controllen uintptr
+		flags      int32
+	}
+)
+
+// IOURing is an io_uring instance, for sessions to do their I/O through (see
+// WithIOURing). It's safe for concurrent use.
+//
+// Operations are submitted without blocking (MSG_DONTWAIT): when a socket
+// isn't ready, the operation fails right away, and is retried once the Go
+// runtime's network poller reports the socket ready. Deadlines set on the
+// connection keep working as usual.
+type IOURing struct {
+	fd                    int
+	sqRing, cqRing, sqMem []byte
+
+	sqHead, sqTail *uint32
+	sqMask         uint32
+	sqArray        []uint32
+	sqes           []ioURingSQE
+	cqHead, cqTail *uint32
+	cqMask         uint32
+	cqes           []ioURingCQE
+
+	// mu guards the submission queue, and the fields below. unsubmitted
+	// is the number of queued entries the kernel wasn't told about yet.
+	mu          sync.Mutex
+	unsubmitted uint32
+	ops         map[uint64]*ringOp
+	nextID      uint64
+	closed      bool
+
+	// submitting is set while someone is submitting the queued entries on
+	// behalf of everybody. cqLock guards the completion queue.
+	submitting int32
+	cqLock     sync.Mutex
+
+	// closeLock is held for reading by operations in flight, and for
+	// writing by Close.
+	closeLock sync.RWMutex
+}
+
+// ringOp is an operation submitted to an IOURing.
+type ringOp struct {
+	res  int32
+	done chan struct{}
+	// keep holds on to the memory the kernel works with until the
+	// operation completes.
+	keep interface{}
+}
+
+// NewIOURing sets up an io_uring with a submission queue of the given size,
+// for sessions to share with WithIOURing. It returns ErrIOURingUnsupported if
+// the kernel doesn't support io_uring, or forbids its use.
+func NewIOURing(entries int) (*IOURing, error) {
+	if entries < 1 || entries > maxRingEntries {
+		return nil, fmt.Errorf("invalid io_uring size: %d", entries)
+	}
+
+	var p ioURingParams
+	fd, _, errno := syscall.Syscall(sysIOURingSetup, uintptr(entries), uintptr(unsafe.Pointer(&p)), 0)
+	switch errno {
+	case 0:
+	case syscall.ENOSYS, syscall.EPERM, syscall.EACCES:
+		return nil, ErrIOURingUnsupported
+	default:
+		return nil, os.NewSyscallError("io_uring_setup", errno)
+	}
+
+	r := &IOURing{fd: int(fd), ops: make(map[uint64]*ringOp)}
+	if err := r.mmap(&p); err != nil {
+		r.unmap()
+		syscall.Close(r.fd)
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *IOURing) mmap(p *ioURingParams) error {
+	var err error
+	mmap := func(offset int64, size uint32) []byte {
+		if err != nil {
+			return nil
+		}
+		var mem []byte
+		mem, err = syscall.Mmap(r.fd, offset, int(size), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE)
+		if err != nil {
+			err = os.NewSyscallError("mmap", err)
+		}
+		return mem
+	}
+	r.sqRing = mmap(ioringOffSQRing, p.sqOff.array+p.sqEntries*4)
+	r.cqRing = mmap(ioringOffCQRing, p.cqOff.cqes+p.cqEntries*uint32(unsafe.Sizeof(ioURingCQE{})))
+	r.sqMem = mmap(ioringOffSQEs, p.sqEntries*uint32(unsafe.Sizeof(ioURingSQE{})))
+	if err != nil {
+		return err
+	}
+
+	r.sqHead = (*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.head]))
+	r.sqTail = (*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.tail]))
+	r.sqMask = *(*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.ringMask]))
+	r.sqArray = unsafe.Slice((*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.array])), p.sqEntries)
+	r.sqes = unsafe.Slice((*ioURingSQE)(unsafe.Pointer(&r.sqMem[0])), p.sqEntries)
+	r.cqHead = (*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.head]))
+	r.cqTail = (*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.tail]))
+	r.cqMask = *(*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.ringMask]))
+	r.cqes = unsafe.Slice((*ioURingCQE)(unsafe.Pointer(&r.cqRing[p.cqOff.cqes])), p.cqEntries)
+	return nil
+}
+
+func (r *IOURing) unmap() {
+	for _, mem := range [][]byte{r.sqRing, r.cqRing, r.sqMem} {
+		if mem != nil {
+			syscall.Munmap(mem)
+		}
+	}
+}
+
+// Close waits for the operations in flight to complete, and releases the
+// ring. Operations submitted afterwards fail with ErrIOURingClosed.
+func (r *IOURing) Close() error {
+	r.mu.Lock()
+	closed := r.closed
+	r.closed = true
+	r.mu.Unlock()
+	if closed {
+		return nil
+	}
+
+	r.closeLock.Lock()
+	defer r.closeLock.Unlock()
+	r.unmap()
+	return syscall.Close(r.fd)
+}
+
+// do submits an operation, prepared by prep, and waits for it to complete. It
+// returns the result of the operation, or the error it failed with.
+func (r *IOURing) do(prep func(sqe *ioURingSQE), keep interface{}) (int, error) {
+	r.closeLock.RLock()
+	defer r.closeLock.RUnlock()
+
+	// Should we fail before the operation completes, the kernel may still
+	// be working with its memory: op.keep holds on to it until then.
+	op := &ringOp{done: make(chan struct{}), keep: keep}
+	if err := r.push(op, prep); err != nil {
+		return 0, err
+	}
+	if err := r.submit(); err != nil {
+		return 0, err
+	}
+	select {
+	case <-op.done:
+	default:
+		if err := r.await(op); err != nil {
+			return 0, err
+		}
+	}
+
+	if op.res < 0 {
+		return 0, syscall.Errno(-op.res)
+	}
+	return int(op.res), nil
+}
+
+// push queues an operation.
+func (r *IOURing) push(op *ringOp, prep func(sqe *ioURingSQE)) error {
+	r.mu.Lock()
+	for {
+		if r.closed {
+			r.mu.Unlock()
+			return ErrIOURingClosed
+		}
+		tail := *r.sqTail
+		if tail-atomic.LoadUint32(r.sqHead) < uint32(len(r.sqes)) {
+			break
+		}
+		// The queue is full: make room.
+		r.mu.Unlock()
+		if err := r.submit(); err != nil {
+			return err
+		}
+		r.mu.Lock()
+	}
+
+	id := r.nextID
+	r.nextID++
+	r.ops[id] = op
+
+	tail := *r.sqTail
+	idx := tail & r.sqMask
+	sqe := &r.sqes[idx]
+	*sqe = ioURingSQE{}
+	prep(sqe)
+	sqe.userData = id
+	r.sqArray[idx] = idx
+	atomic.StoreUint32(r.sqTail, tail+1)
+	r.unsubmitted++
+	r.mu.Unlock()
+	return nil
+}
+
+// submit hands the queued operations to the kernel, unless someone else is
+// doing so already: operations queued concurrently by different sessions go
+// out with a single system call. If the kernel is short of resources, the
+// operations it didn't take are left for the next submission; other errors
+// are returned.
+func (r *IOURing) submit() error {
+	for atomic.CompareAndSwapInt32(&r.submitting, 0, 1) {
+		r.mu.Lock()
+		n := r.unsubmitted
+		r.unsubmitted = 0
+		r.mu.Unlock()
+
+		var err error
+		failed := false
+		if n > 0 {
+			var submitted uint32
+			submitted, err = r.enter(n, 0, 0)
+			if failed = err != nil || submitted < n; failed {
+				// Try again with the next submission.
+				r.mu.Lock()
+				r.unsubmitted += n - submitted
+				r.mu.Unlock()
+			}
+			// Operations that don't have to wait complete during
+			// submission.
+			r.cqLock.Lock()
+			r.reap()
+			r.cqLock.Unlock()
+		}
+
+		atomic.StoreInt32(&r.submitting, 0)
+		if err != nil && !ringBusy(err) {
+			return err
+		}
+		r.mu.Lock()
+		more := r.unsubmitted > 0 && !failed
+		r.mu.Unlock()
+		if !more {
+			return nil
+		}
+	}
+	return nil
+}
+
+// await waits for an operation that didn't complete during submission.
+func (r *IOURing) await(op *ringOp) error {
+	for {
+		if err := r.submit(); err != nil {
+			return err
+		}
+
+		r.cqLock.Lock()
+		r.reap()
+		select {
+		case <-op.done:
+			r.cqLock.Unlock()
+			return nil
+		default:
+		}
+		// Whoever else completes meanwhile is dispatched by us.
+		_, err := r.enter(0, 1, ioringEnterGetEvents)
+		r.reap()
+		r.cqLock.Unlock()
+		if err != nil && !ringBusy(err) {
+			return err
+		}
+	}
+}
+
+// ringBusy returns true if io_uring_enter failed because the kernel is short
+// of resources for the moment: it's worth trying again once operations
+// completed.
+func ringBusy(err error) bool {
+	return errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EBUSY)
+}
+
+// reap dispatches the completed operations. cqLock must be held.
+func (r *IOURing) reap() {
+	head := *r.cqHead
+	tail := atomic.LoadUint32(r.cqTail)
+	if head == tail {
+		return
+	}
+	for ; head != tail; head++ {
+		cqe := r.cqes[head&r.cqMask]
+		r.mu.Lock()
+		op := r.ops[cqe.userData]
+		delete(r.ops, cqe.userData)
+		r.mu.Unlock()
+		if op != nil {
+			op.res = cqe.res
+			close(op.done)
+		}
+	}
+	atomic.StoreUint32(r.cqHead, head)
+}
+
+func (r *IOURing) enter(toSubmit, minComplete, flags uint32) (uint32, error) {
+	for {
+		n, _, errno := syscall.Syscall6(sysIOURingEnter, uintptr(r.fd), uintptr(toSubmit), uintptr(minComplete), uintptr(flags), 0, 0)
+		if errno == syscall.EINTR {
+			continue
+		}
+		if errno != 0 {
+			return 0, os.NewSyscallError("io_uring_enter", errno)
+		}
+		return uint32(n), nil
+	}
+}
+
+// recv reads from the socket without blocking.
+func (r *IOURing) recv(fd uintptr, b []byte) (int, error) {
+	return r.do(func(sqe *ioURingSQE) {
+		sqe.opcode = ioringOpRecv
+		sqe.fd = int32(fd)
+		sqe.addr = uint64(uintptr(unsafe.Pointer(&b[0])))
+		sqe.len = uint32(len(b))
+		sqe.opFlags = syscall.MSG_DONTWAIT
+	}, b)
+}
+
+// sendmsg writes the given buffers to the socket without blocking.
+func (r *IOURing) sendmsg(fd uintptr, iovs []syscall.Iovec) (int, error) {
+	msg := &msghdr{iov: &iovs[0], iovlen: uintptr(len(iovs))}
+	return r.do(func(sqe *ioURingSQE) {
+		sqe.opcode = ioringOpSendmsg
+		sqe.fd = int32(fd)
+		sqe.addr = uint64(uintptr(unsafe.Pointer(msg)))
+		sqe.len = 1
+		sqe.opFlags = syscall.MSG_DONTWAIT | syscall.MSG_NOSIGNAL
+	}, msg)
+}
+
+// conn wraps the connection to do its I/O through the ring, if it's backed by
+// a socket.
+func (r *IOURing) conn(con net.Conn) vectoredConn {
+	sc, ok := con.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	var isSocket bool
+	rc.Control(func(fd uintptr) {
+		_, err := syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_TYPE)
+		isSocket = err == nil
+	})
+	if !isSocket {
+		return nil
+	}
+	return &ringConn{ring: r, rc: rc}
+}
+
+// ringConn does the I/O of a socket through an IOURing, waiting for the
+// socket to be ready with the Go runtime's network poller.
+type ringConn struct {
+	ring *IOURing
+	rc   syscall.RawConn
+}
+
+func (c *ringConn) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	var (
+		n   int
+		err error
+	)
+	if rerr := c.rc.Read(func(fd uintptr) bool {
+		n, err = c.ring.recv(fd, b)
+		return err != syscall.EAGAIN
+	}); rerr != nil {
+		return 0, rerr
+	}
+	if err != nil {
+		if errno, ok := err.(syscall.Errno); ok {
+			err = os.NewSyscallError("recv", errno)
+		}
+		return 0, err
+	}
+	if n == 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+func (c *ringConn) Write(b []byte) (int, error) {
+	return c.writeBuffers([][]byte{b})
+}
+
+func (c *ringConn) writeBuffers(bufs [][]byte) (int, error) {
+	iovs := make([]syscall.Iovec, 0, len(bufs))
+	for _, b := range bufs {
+		if len(b) == 0 {
+			continue
+		}
+		iov := syscall.Iovec{Base: &b[0]}
+		iov.SetLen(len(b))
+		iovs = append(iovs, iov)
+	}
+
+	var (
+		written int
+		err     error
+	)
+	werr := c.rc.Write(func(fd uintptr) bool {
+		for len(iovs) > 0 {
+			batch := iovs
+			if len(batch) > maxIovecs {
+				batch = batch[:maxIovecs]
+			}
+			var n int
+			n, err = c.ring.sendmsg(fd, batch)
+			if err == syscall.EAGAIN {
+				return false
+			}
+			if err != nil {
+				return true
+			}
+			written += n
+			iovs = consumeIovecs(iovs, n)
+		}
+		return true
+	})
+	if werr != nil {
+		return written, werr
+	}
+	if err != nil {
+		if errno, ok := err.(syscall.Errno); ok {
+			err = os.NewSyscallError("sendmsg", errno)
+		}
+		return written, err
+	}
+	return written, nil
+}
+
+// consumeIovecs drops the first n bytes written from iovs.
+func consumeIovecs(iovs []syscall.Iovec, n int) []syscall.Iovec {
+	for n > 0 && len(iovs) > 0 {
+		l := int(iovs[0].Len)
+		if n < l {
+			iovs[0].Base = (*byte)(unsafe.Add(unsafe.Pointer(iovs[0].Base), n))
+			iovs[0].SetLen(l - n)
+			return iovs
+		}
+		n -= l
+		iovs = iovs[1:]
+	}
+	return iovs
+}
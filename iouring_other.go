@@ -0,0 +1,25 @@
+//go:build !linux || !(386 || amd64 || arm || arm64 || ppc64 || ppc64le || riscv64 || s390x)
+
+package multiplex
+
+import "net"
+
+// IOURing is an io_uring instance, for sessions to do their I/O through (see
+// WithIOURing). io_uring is only available on Linux, on the most common
+// architectures.
+type IOURing struct{}
+
+// NewIOURing returns ErrIOURingUnsupported: io_uring is only available on
+// Linux, on the most common architectures.
+func NewIOURing(entries int) (*IOURing, error) {
+	return nil, ErrIOURingUnsupported
+}
+
+// Close does nothing.
+func (r *IOURing) Close() error {
+	return nil
+}
+
+func (r *IOURing) conn(con net.Conn) vectoredConn {
+	return nil
+}
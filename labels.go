@@ -0,0 +1,74 @@
+package multiplex
+
+import (
+	"context"
+	"fmt"
+	"runtime/pprof"
+	"strconv"
+	"sync/atomic"
+)
+
+// lastSessionID is used to number sessions, for logs and profiling.
+var lastSessionID uint64
+
+// identify assigns the session its ID, and sets up its logger and pprof
+// labels, so that it can be told apart from the others.
+func (mp *Multiplex) identify(label string, logger Logger) {
+	mp.id = atomic.AddUint64(&lastSessionID, 1)
+	mp.label = label
+	if addr := mp.con.RemoteAddr(); addr != nil {
+		mp.remote = addr.String()
+	}
+
+	fields := []interface{}{"session", mp.id, "remote", mp.remote, "initiator", mp.initiator}
+	labels := []string{
+		"mplex.session", strconv.FormatUint(mp.id, 10),
+		"mplex.remote", mp.remote,
+	}
+	if label != "" {
+		fields = append(fields, "label", label)
+		labels = append(labels, "mplex.label", label)
+	}
+	mp.log = &sessionLogger{Logger: logger, fields: fields}
+	mp.labels = pprof.Labels(labels...)
+}
+
+// ID returns the session's ID, unique within the process.
+func (mp *Multiplex) ID() uint64 {
+	return mp.id
+}
+
+// Label returns the label given with WithLabel, if any.
+func (mp *Multiplex) Label() string {
+	return mp.label
+}
+
+// IsInitiator returns true if we're the initiator of the session, i.e., we
+// dialed the connection.
+func (mp *Multiplex) IsInitiator() bool {
+	return mp.initiator
+}
+
+// String describes the session: its ID, label, role and peer.
+func (mp *Multiplex) String() string {
+	s := "mplex session " + strconv.FormatUint(mp.id, 10)
+	if mp.label != "" {
+		s += fmt.Sprintf(" %q", mp.label)
+	}
+	if mp.initiator {
+		s += " (initiator)"
+	} else {
+		s += " (responder)"
+	}
+	if mp.remote != "" {
+		s += " with " + mp.remote
+	}
+	return s
+}
+
+// goLabeled runs f in a new goroutine, labeled with the session's labels.
+func (mp *Multiplex) goLabeled(f func()) {
+	mp.spawn(func() {
+		pprof.Do(context.Background(), mp.labels, func(context.Context) { f() })
+	})
+}
@@ -0,0 +1,147 @@
+package multiplex
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// WithLeakDetection tracks the streams the peer closed that are never closed
+// or reset locally, which leak their resources. Streams still open on our side
+// more than interval after the peer closed them are logged, once, with the
+// stack trace of where they were opened or accepted; LeakedStreams lists
+// them. Recording stack traces isn't free: it's meant for debugging.
+func WithLeakDetection(interval time.Duration) Option {
+	return func(c *config) error {
+		if interval <= 0 {
+			return fmt.Errorf("invalid leak detection interval: %s", interval)
+		}
+		c.leakInterval = interval
+		return nil
+	}
+}
+
+// LeakedStream describes a stream the peer closed, but that wasn't closed or
+// reset locally in time (see WithLeakDetection).
+type LeakedStream struct {
+	Stream *Stream
+	// RemoteClosed is when the peer closed the stream.
+	RemoteClosed time.Time
+	// Stack is the stack trace of where the stream was opened or
+	// accepted.
+	Stack string
+}
+
+// LeakedStreams returns the streams considered leaked, if leak detection is
+// enabled.
+func (mp *Multiplex) LeakedStreams() []LeakedStream {
+	if mp.leakInterval <= 0 {
+		return nil
+	}
+	now := mp.clock.Now()
+	mp.leakLock.Lock()
+	defer mp.leakLock.Unlock()
+	var leaked []LeakedStream
+	for s, closed := range mp.halfClosed {
+		if now.Sub(closed) >= mp.leakInterval {
+			leaked = append(leaked, LeakedStream{Stream: s, RemoteClosed: closed, Stack: s.stackTrace()})
+		}
+	}
+	return leaked
+}
+
+// captureStack records where the stream was handed to the user, with leak
+// detection enabled or in debug builds. Debug builds also watch for the
+// stream being garbage collected without having been closed.
+func (s *Stream) captureStack() {
+	if s.mp.leakInterval <= 0 && !debugStreams {
+		return
+	}
+	pcs := make([]uintptr, 32)
+	s.stack = pcs[:runtime.Callers(3, pcs)]
+	if debugStreams {
+		runtime.SetFinalizer(s, finalizeStream)
+	}
+}
+
+// finalizeStream warns about streams garbage collected before they were closed
+// or reset, in debug builds.
+func finalizeStream(s *Stream) {
+	if isClosedChan(s.done) {
+		return
+	}
+	s.mp.log.Warnw("stream garbage collected without being closed or reset",
+		append(s.logFields(), "stack", s.stackTrace())...)
+}
+
+func (s *Stream) stackTrace() string {
+	var b strings.Builder
+	frames := runtime.CallersFrames(s.stack)
+	for {
+		f, more := frames.Next()
+		if f.Function != "" {
+			fmt.Fprintf(&b, "%s\n\t%s:%d\n", f.Function, f.File, f.Line)
+		}
+		if !more {
+			return b.String()
+		}
+	}
+}
+
+// trackHalfClosed starts watching a stream the peer closed, until it's done.
+func (mp *Multiplex) trackHalfClosed(s *Stream) {
+	if !mp.trackingHalfClosed() {
+		return
+	}
+	mp.leakLock.Lock()
+	if !isClosedChan(s.done) {
+		if mp.halfClosed == nil {
+			mp.halfClosed = make(map[*Stream]time.Time)
+		}
+		mp.halfClosed[s] = mp.clock.Now()
+	}
+	mp.leakLock.Unlock()
+}
+
+// untrackHalfClosed stops watching a stream, once it's done.
+func (mp *Multiplex) untrackHalfClosed(s *Stream) {
+	if !mp.trackingHalfClosed() {
+		return
+	}
+	mp.leakLock.Lock()
+	delete(mp.halfClosed, s)
+	delete(mp.leaksReported, s)
+	mp.leakLock.Unlock()
+}
+
+// detectLeaks logs the leaked streams every leak detection interval, until
+// the session shuts down.
+func (mp *Multiplex) detectLeaks() {
+	t := mp.clock.NewTimer(mp.leakInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.Chan():
+		case <-mp.shutdown:
+			return
+		}
+		for _, l := range mp.LeakedStreams() {
+			mp.leakLock.Lock()
+			_, open := mp.halfClosed[l.Stream]
+			report := open && !mp.leaksReported[l.Stream]
+			if report {
+				if mp.leaksReported == nil {
+					mp.leaksReported = make(map[*Stream]bool)
+				}
+				mp.leaksReported[l.Stream] = true
+			}
+			mp.leakLock.Unlock()
+			if report {
+				mp.log.Warnw("stream closed by the peer was never closed: leaked?",
+					append(l.Stream.logFields(), "remoteClosed", l.RemoteClosed, "stack", l.Stack)...)
+			}
+		}
+		t.Reset(mp.leakInterval)
+	}
+}
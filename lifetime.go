@@ -0,0 +1,63 @@
+package multiplex
+
+import (
+	"fmt"
+	"time"
+)
+
+// WithMaxLifetime recycles the session once it's maxAge old: it's drained (see
+// Drain), so that it takes on no new streams, then closed once the streams
+// left are done, or grace later at the latest. Peers supporting CapGoAway are
+// told, and stop opening streams meanwhile. Recycling long-lived sessions
+// keeps leaked streams and stale state from piling up, without cutting off
+// streams abruptly; it's up to the application to open a new session in its
+// place. A zero grace period closes the session only once all its streams are
+// done.
+func WithMaxLifetime(maxAge, grace time.Duration) Option {
+	return func(c *config) error {
+		if maxAge <= 0 || grace < 0 {
+			return fmt.Errorf("invalid max lifetime: %s (grace period %s)", maxAge, grace)
+		}
+		c.maxLifetime = maxAge
+		c.lifetimeGrace = grace
+		return nil
+	}
+}
+
+// expire drains, then closes, the session once it reaches its max lifetime.
+func (mp *Multiplex) expire() {
+	t := mp.clock.NewTimer(mp.maxLifetime)
+	defer t.Stop()
+	select {
+	case <-t.Chan():
+	case <-mp.shutdown:
+		return
+	}
+
+	mp.log.Debugw("session reached its max lifetime, draining")
+	mp.Drain()
+	var grace <-chan time.Time
+	if mp.lifetimeGrace > 0 {
+		t.Reset(mp.lifetimeGrace)
+		grace = t.Chan()
+	}
+	for !mp.noStreams() {
+		select {
+		case <-mp.streamDone:
+		case <-grace:
+			mp.log.Debugw("closing expired session with streams left")
+			mp.Close()
+			return
+		case <-mp.shutdown:
+			return
+		}
+	}
+	mp.Close()
+}
+
+// noStreams returns true if the session has no streams left.
+func (mp *Multiplex) noStreams() bool {
+	mp.chLock.Lock()
+	defer mp.chLock.Unlock()
+	return mp.inboundStreams == 0 && mp.outboundStreams == 0
+}
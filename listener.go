@@ -0,0 +1,56 @@
+package multiplex
+
+import (
+	"net"
+	"sync"
+)
+
+var _ net.Conn = (*Stream)(nil)
+
+// LocalAddr returns the local address of the session's connection. Along with
+// RemoteAddr, it lets streams be used as net.Conns.
+func (s *Stream) LocalAddr() net.Addr {
+	return s.mp.con.LocalAddr()
+}
+
+// RemoteAddr returns the remote address of the session's connection.
+func (s *Stream) RemoteAddr() net.Addr {
+	return s.mp.con.RemoteAddr()
+}
+
+// Listener returns a net.Listener accepting the streams the peer opens, for
+// serving net.Listener based protocols (net/http, for instance) over the
+// session. Its Accept returns *Streams.
+//
+// Closing the listener doesn't close the session: streams opened by the peer
+// are left for Accept to take.
+func (mp *Multiplex) Listener() net.Listener {
+	return &listener{mp: mp, closed: make(chan struct{})}
+}
+
+type listener struct {
+	mp        *Multiplex
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case s := <-l.mp.nstreams:
+		s.captureStack()
+		return s, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	case <-l.mp.closed:
+		return nil, l.mp.shutdownErr
+	}
+}
+
+func (l *listener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *listener) Addr() net.Addr {
+	return l.mp.con.LocalAddr()
+}
@@ -0,0 +1,67 @@
+package multiplex
+
+import "fmt"
+
+// Logger is the interface sessions log through. Messages come with
+// alternating keys and values identifying the session (and the stream or
+// frame, where relevant). It's satisfied by go-log loggers, and by zap's
+// SugaredLogger.
+type Logger interface {
+	Debugw(msg string, keysAndValues ...interface{})
+	Warnw(msg string, keysAndValues ...interface{})
+}
+
+// NopLogger discards everything logged to it.
+var NopLogger Logger = nopLogger{}
+
+type nopLogger struct{}
+
+func (nopLogger) Debugw(string, ...interface{}) {}
+func (nopLogger) Warnw(string, ...interface{})  {}
+
+// WithLogger sets the logger used by the session (defaults to the package's
+// "mplex" go-log logger). Pass NopLogger to silence a session.
+func WithLogger(l Logger) Option {
+	return func(c *config) error {
+		if l == nil {
+			return fmt.Errorf("nil logger")
+		}
+		c.logger = l
+		return nil
+	}
+}
+
+// sessionLogger adds the session's fields to everything logged through it.
+type sessionLogger struct {
+	Logger
+	fields []interface{}
+}
+
+func (l *sessionLogger) Debugw(msg string, keysAndValues ...interface{}) {
+	l.Logger.Debugw(msg, l.with(keysAndValues)...)
+}
+
+func (l *sessionLogger) Warnw(msg string, keysAndValues ...interface{}) {
+	l.Logger.Warnw(msg, l.with(keysAndValues)...)
+}
+
+func (l *sessionLogger) with(keysAndValues []interface{}) []interface{} {
+	kv := make([]interface{}, 0, len(l.fields)+len(keysAndValues))
+	kv = append(kv, l.fields...)
+	return append(kv, keysAndValues...)
+}
+
+// streamFields returns the log fields identifying a stream.
+func streamFields(id streamID, name string) []interface{} {
+	return []interface{}{"stream", id.id, "initiator", id.initiator, "name", name}
+}
+
+// logFields returns the log fields identifying the stream, including its
+// protocol if it has been annotated with one.
+func (s *Stream) logFields() []interface{} {
+	fields := streamFields(s.id, s.name)
+	if proto := s.Protocol(); proto != "" {
+		fields = append(fields, "protocol", proto)
+	}
+	return fields
+}
@@ -0,0 +1,63 @@
+package multiplex
+
+import "sync/atomic"
+
+// SetLossy switches the stream to lossy mode, or back. A lossy stream never
+// holds up the session, nor gets reset, because its reader falls behind:
+// when its queue of received data is full, the oldest data waiting to be read
+// is dropped to make room for the new data. It suits live feeds, like
+// metrics, where stale data is worth less than the stream.
+//
+// Data is dropped in the chunks it was received in (see
+// WithReceiveChunkSize), so frames larger than a chunk may be cut short.
+func (s *Stream) SetLossy(lossy bool) {
+	var v int32
+	if lossy {
+		v = 1
+	}
+	atomic.StoreInt32(&s.lossy, v)
+}
+
+func (s *Stream) isLossy() bool {
+	return atomic.LoadInt32(&s.lossy) != 0
+}
+
+// DroppedBytes returns the number of received bytes the stream dropped in
+// lossy mode.
+func (s *Stream) DroppedBytes() uint64 {
+	return atomic.LoadUint64(&s.droppedBytes)
+}
+
+// deliverLossy hands a buffer to a lossy stream without waiting. The oldest
+// buffers waiting to be read are dropped until it fits, and b itself is
+// dropped if there's still no room, because of the session's limits.
+func (mp *Multiplex) deliverLossy(s *Stream, b []byte) {
+	for {
+		if mp.inboundRoom(s, len(b)) {
+			mp.accountInbound(s, len(b))
+			select {
+			case s.dataIn <- b:
+				s.notifyReadable()
+				return
+			default:
+			}
+			mp.accountInbound(s, -len(b))
+		}
+
+		select {
+		case old := <-s.dataIn:
+			s.countDropped(len(old))
+			s.releaseInbound(old)
+		default:
+			// Nothing left to make room with.
+			s.countDropped(len(b))
+			mp.putBufferInbound(b)
+			return
+		}
+	}
+}
+
+func (s *Stream) countDropped(n int) {
+	atomic.AddUint64(&s.droppedBytes, uint64(n))
+	atomic.AddUint64(&s.mp.counters.droppedBytes, uint64(n))
+}
@@ -0,0 +1,182 @@
+package multiplex
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// ErrManagerClosed is returned when creating a session with a Manager that's
+// been closed.
+var ErrManagerClosed = errors.New("session manager closed")
+
+// ManagerLimits are the limits a Manager enforces across all its sessions, on
+// top of each session's own. Zero means no limit.
+type ManagerLimits struct {
+	// Streams caps the streams open across all sessions, in either
+	// direction. Opening streams beyond it fails with
+	// ErrStreamLimitReached, and the streams the peers open are refused.
+	Streams int
+	// Memory caps the memory the sessions reserve (see MemoryManager).
+	Memory int
+	// SendRate and RecvRate cap the throughput across all sessions, in
+	// bytes per second (see WithBandwidthLimit).
+	SendRate, RecvRate int
+}
+
+// Manager owns a set of sessions, for servers handling many peers, like
+// relays: it enforces limits across them, finds them by label, and closes
+// them all when it's closed. Sessions leave the manager once they're shut
+// down.
+type Manager struct {
+	limits                   ManagerLimits
+	sendLimiter, recvLimiter *rateLimiter
+
+	mu sync.Mutex
+	// sessions holds the sessions, with the number of streams each one
+	// has open.
+	sessions map[*Multiplex]int
+	streams  int
+	reserved int
+	closed   bool
+}
+
+// NewManager returns a Manager enforcing the given limits.
+func NewManager(limits ManagerLimits) (*Manager, error) {
+	if limits.Streams < 0 || limits.Memory < 0 || limits.SendRate < 0 || limits.RecvRate < 0 {
+		return nil, fmt.Errorf("invalid session manager limits: %+v", limits)
+	}
+	return &Manager{
+		limits:      limits,
+		sendLimiter: newRateLimiter(limits.SendRate, realClock{}),
+		recvLimiter: newRateLimiter(limits.RecvRate, realClock{}),
+		sessions:    make(map[*Multiplex]int),
+	}, nil
+}
+
+// NewSession creates a session over con, like NewMultiplex, owned by the
+// manager. Its memory is reserved from the manager.
+func (m *Manager) NewSession(con net.Conn, initiator bool, opts ...Option) (*Multiplex, error) {
+	opts = append(opts[:len(opts):len(opts)], func(c *config) error {
+		c.manager = m
+		return nil
+	})
+	return NewMultiplex(con, initiator, managerMemory{m}, opts...)
+}
+
+// Sessions returns the sessions the manager owns.
+func (m *Manager) Sessions() []*Multiplex {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sessions := make([]*Multiplex, 0, len(m.sessions))
+	for mp := range m.sessions {
+		sessions = append(sessions, mp)
+	}
+	return sessions
+}
+
+// Lookup returns a session with the given label (see WithLabel), or nil if
+// the manager owns none.
+func (m *Manager) Lookup(label string) *Multiplex {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for mp := range m.sessions {
+		if mp.label == label {
+			return mp
+		}
+	}
+	return nil
+}
+
+// Streams returns the number of streams open across all sessions.
+func (m *Manager) Streams() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.streams
+}
+
+// ReservedMemory returns the memory reserved across all sessions.
+func (m *Manager) ReservedMemory() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.reserved
+}
+
+// Close closes all the sessions, and keeps new ones from being created.
+func (m *Manager) Close() error {
+	m.mu.Lock()
+	m.closed = true
+	m.mu.Unlock()
+	for _, mp := range m.Sessions() {
+		mp.Close()
+	}
+	return nil
+}
+
+// add registers a session, before it starts running.
+func (m *Manager) add(mp *Multiplex) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return ErrManagerClosed
+	}
+	m.sessions[mp] = 0
+	return nil
+}
+
+// remove unregisters a session once it's shut down, along with its streams.
+func (m *Manager) remove(mp *Multiplex) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.streams -= m.sessions[mp]
+	delete(m.sessions, mp)
+}
+
+// acquireStreams counts n new streams of the session, returning false if
+// that would exceed the limit.
+func (m *Manager) acquireStreams(mp *Multiplex, n int) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	count, ok := m.sessions[mp]
+	if !ok || m.limits.Streams > 0 && m.streams+n > m.limits.Streams {
+		return false
+	}
+	m.sessions[mp] = count + n
+	m.streams += n
+	return true
+}
+
+// releaseStream uncounts a stream of the session once it's done.
+func (m *Manager) releaseStream(mp *Multiplex) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// The session's streams are all released at once when it's removed.
+	if count, ok := m.sessions[mp]; ok && count > 0 {
+		m.sessions[mp] = count - 1
+		m.streams--
+	}
+}
+
+// managerMemory reserves the memory of a manager's sessions.
+type managerMemory struct {
+	m *Manager
+}
+
+func (mm managerMemory) ReserveMemory(size int, prio uint8) error {
+	m := mm.m
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.limits.Memory > 0 && m.reserved+size > m.limits.Memory {
+		return errors.New("session manager memory limit reached")
+	}
+	m.reserved += size
+	return nil
+}
+
+func (mm managerMemory) ReleaseMemory(size int) {
+	m := mm.m
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reserved -= size
+}
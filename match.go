@@ -0,0 +1,74 @@
+package multiplex
+
+import (
+	"context"
+	"errors"
+	pathpkg "path"
+)
+
+// ErrNamesNotKept is returned by AcceptMatching on sessions that don't keep
+// stream names (see WithStreamNames).
+var ErrNamesNotKept = errors.New("stream names aren't kept")
+
+// acceptRoute queues the streams whose names match a pattern, for
+// AcceptMatching.
+type acceptRoute struct {
+	pattern string
+	streams chan *Stream
+}
+
+// AcceptMatching accepts the next stream the peer opens with a name matching
+// the pattern, with the syntax of path.Match: "rpc/*" matches "rpc/get", for
+// instance. It lets different subsystems each accept the streams they own.
+//
+// The first call with a pattern registers it: from then on, the streams
+// matching it are queued for AcceptMatching with that pattern, rather than
+// handed to Accept, like those of a listener. Streams matching several
+// patterns go to the first one registered. Names are only known with
+// WithStreamNames: without it, AcceptMatching fails with ErrNamesNotKept.
+func (mp *Multiplex) AcceptMatching(ctx context.Context, pattern string) (*Stream, error) {
+	if !mp.keepNames {
+		return nil, ErrNamesNotKept
+	}
+	if _, err := pathpkg.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	streams := mp.acceptRoute(pattern)
+	select {
+	case s := <-streams:
+		s.captureStack()
+		return s, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-mp.closed:
+		return nil, mp.shutdownErr
+	}
+}
+
+// acceptRoute returns the queue of the streams matching the pattern,
+// registering it if needed.
+func (mp *Multiplex) acceptRoute(pattern string) chan *Stream {
+	mp.routeLock.Lock()
+	defer mp.routeLock.Unlock()
+	for _, r := range mp.routes {
+		if r.pattern == pattern {
+			return r.streams
+		}
+	}
+	r := acceptRoute{pattern: pattern, streams: make(chan *Stream, cap(mp.nstreams))}
+	mp.routes = append(mp.routes, r)
+	return r.streams
+}
+
+// acceptQueue returns the queue a stream the peer opened goes to: that of the
+// first pattern its name matches, or Accept's.
+func (mp *Multiplex) acceptQueue(name string) chan *Stream {
+	mp.routeLock.Lock()
+	defer mp.routeLock.Unlock()
+	for _, r := range mp.routes {
+		if ok, _ := pathpkg.Match(r.pattern, name); ok {
+			return r.streams
+		}
+	}
+	return mp.nstreams
+}
@@ -0,0 +1,73 @@
+package multiplex
+
+// MisbehaviorKind classifies the ways a peer can misbehave.
+type MisbehaviorKind int
+
+const (
+	// MisbehaviorMalformedFrame is a frame that can't be decoded: it's
+	// larger than allowed, or its header is malformed.
+	MisbehaviorMalformedFrame MisbehaviorKind = iota
+	// MisbehaviorUnknownTag is a frame with a tag that isn't valid on its
+	// stream.
+	MisbehaviorUnknownTag
+	// MisbehaviorDuplicateOpen is a stream opened twice.
+	MisbehaviorDuplicateOpen
+	// MisbehaviorReceiveTimeout is data sent to a stream that didn't read
+	// it in time (see ReceiveTimeout). It may be the reader's fault rather
+	// than the peer's, but a flood of them is suspect.
+	MisbehaviorReceiveTimeout
+	// MisbehaviorViolation is any other violation of the protocol, like
+	// those WithStrictValidation rejects.
+	MisbehaviorViolation
+	// MisbehaviorStreamFlood is a stream opened beyond the rate allowed
+	// with WithInboundStreamRate.
+	MisbehaviorStreamFlood
+)
+
+func (k MisbehaviorKind) String() string {
+	switch k {
+	case MisbehaviorMalformedFrame:
+		return "malformed frame"
+	case MisbehaviorUnknownTag:
+		return "unknown tag"
+	case MisbehaviorDuplicateOpen:
+		return "duplicate open"
+	case MisbehaviorReceiveTimeout:
+		return "receive timeout"
+	case MisbehaviorViolation:
+		return "protocol violation"
+	case MisbehaviorStreamFlood:
+		return "stream flood"
+	default:
+		return "unknown"
+	}
+}
+
+// Misbehavior describes something the peer did that it shouldn't have.
+type Misbehavior struct {
+	Kind MisbehaviorKind
+	// StreamID and Tag are those of the offending frame, as encoded on the
+	// wire. They're zero if the frame header couldn't be read.
+	StreamID, Tag uint64
+	// Reason describes what happened.
+	Reason string
+	// Fatal is set if the session is shut down because of it.
+	Fatal bool
+}
+
+// WithOnMisbehavior registers a function called whenever the peer misbehaves,
+// for peer scoring or banning systems to act on. It's called from the
+// session's read loop, and must not block.
+func WithOnMisbehavior(f func(Misbehavior)) Option {
+	return func(c *config) error {
+		c.onMisbehavior = f
+		return nil
+	}
+}
+
+// misbehaved reports the peer's misbehavior.
+func (mp *Multiplex) misbehaved(m Misbehavior) {
+	if mp.onMisbehavior != nil {
+		mp.onMisbehavior(m)
+	}
+}
@@ -0,0 +1,167 @@
+// Package mplexcap records the frames of an mplex session to a capture file,
+// for post-incident analysis of interop bugs, reads them back, and replays
+// them into a session to reproduce bugs in tests (see Replay).
+//
+// Captures are pcapng files, which Wireshark and tcpdump open, with the
+// LINKTYPE_USER0 link type: each packet is a byte giving the frame's
+// direction (0 for inbound, 1 for outbound) followed by the frame as on the
+// wire, its payload possibly truncated or left out. To decode them in
+// Wireshark, map DLT_USER0 to a dissector of your own; the mplexdump command
+// prints them as is.
+//
+//	w, err := mplexcap.NewWriter(f)
+//	...
+//	mp, err := multiplex.NewMultiplex(conn, true, nil, w.Option(true))
+//	...
+//	mp.Close()
+//	err = w.Flush()
+package mplexcap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	multiplex "github.com/libp2p/go-mplex"
+	"github.com/libp2p/go-mplex/frame"
+)
+
+// LinkType is the pcapng link type of the captures: LINKTYPE_USER0.
+const LinkType = 147
+
+// pcapng block types.
+const (
+	blockSectionHeader   = 0x0A0D0D0A
+	blockInterface       = 1
+	blockEnhancedPacket  = 6
+	byteOrderMagic       = 0x1A2B3C4D
+	optEnd               = 0
+	optTimestampRes      = 9
+	nanosecondResolution = 9
+)
+
+// Writer records the frames of a session to a capture. It's a
+// multiplex.FrameObserver: register it with Option, or with
+// multiplex.WithFrameObserver.
+//
+// Frames are buffered: Flush writes them out. Errors writing the capture
+// don't affect the session; Flush returns the first one.
+type Writer struct {
+	mu  sync.Mutex
+	w   *bufio.Writer
+	buf []byte
+	err error
+}
+
+// NewWriter returns a Writer recording frames to w, once it's written the
+// capture's headers.
+func NewWriter(w io.Writer) (*Writer, error) {
+	cw := &Writer{w: bufio.NewWriter(w)}
+
+	var b []byte
+	b = appendBlock(b, blockSectionHeader, func(b []byte) []byte {
+		b = appendUint32(b, byteOrderMagic)
+		b = appendUint16(b, 1) // major version
+		b = appendUint16(b, 0) // minor version
+		// The section's length isn't known.
+		return appendUint64(b, ^uint64(0))
+	})
+	b = appendBlock(b, blockInterface, func(b []byte) []byte {
+		b = appendUint16(b, LinkType)
+		b = appendUint16(b, 0) // reserved
+		b = appendUint32(b, 0) // no snap length
+		b = appendOption(b, optTimestampRes, []byte{nanosecondResolution})
+		return appendOption(b, optEnd, nil)
+	})
+	if _, err := cw.w.Write(b); err != nil {
+		return nil, err
+	}
+	return cw, nil
+}
+
+// Option returns an option registering the Writer as the session's frame
+// observer. If payloads is false, only the frames' headers are recorded.
+func (w *Writer) Option(payloads bool) multiplex.Option {
+	return multiplex.WithFrameObserver(w, payloads)
+}
+
+// ObserveFrame records the frame.
+func (w *Writer) ObserveFrame(info multiplex.FrameInfo) {
+	now := time.Now().UnixNano()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return
+	}
+	var hdr [1 + frame.MaxHeaderSize]byte
+	hdr[0] = byte(info.Direction)
+	n := 1 + frame.PutHeader(hdr[1:], frame.PackHeader(info.StreamID, info.Tag), info.Length)
+
+	w.buf = appendBlock(w.buf[:0], blockEnhancedPacket, func(b []byte) []byte {
+		b = appendUint32(b, 0) // interface
+		b = appendUint32(b, uint32(uint64(now)>>32))
+		b = appendUint32(b, uint32(now))
+		b = appendUint32(b, uint32(n+len(info.Payload)))
+		b = appendUint32(b, uint32(n+info.Length))
+		b = append(b, hdr[:n]...)
+		b = append(b, info.Payload...)
+		return pad(b)
+	})
+	_, w.err = w.w.Write(w.buf)
+}
+
+// Flush writes out the frames recorded so far, and returns the first error
+// writing the capture, if any.
+func (w *Writer) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err == nil {
+		w.err = w.w.Flush()
+	}
+	return w.err
+}
+
+// appendBlock appends a block of the given type, whose body body appends.
+func appendBlock(b []byte, typ uint32, body func([]byte) []byte) []byte {
+	start := len(b)
+	b = appendUint32(b, typ)
+	b = appendUint32(b, 0) // length, set below
+	b = body(b)
+	length := uint32(len(b) - start + 4)
+	binary.LittleEndian.PutUint32(b[start+4:], length)
+	return appendUint32(b, length)
+}
+
+func appendOption(b []byte, code uint16, value []byte) []byte {
+	b = appendUint16(b, code)
+	b = appendUint16(b, uint16(len(value)))
+	return pad(append(b, value...))
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v), byte(v>>8))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(v)), uint32(v>>32))
+}
+
+// pad pads b to a multiple of 4 bytes, as blocks and options are.
+func pad(b []byte) []byte {
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// ErrFormat is returned when reading a capture that isn't valid, or uses
+// pcapng features the Reader doesn't support.
+var ErrFormat = errors.New("mplexcap: invalid or unsupported capture")
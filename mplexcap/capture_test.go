@@ -0,0 +1,122 @@
+package mplexcap
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	multiplex "github.com/libp2p/go-mplex"
+	"github.com/libp2p/go-mplex/frame"
+	"github.com/libp2p/go-mplex/mplextest"
+)
+
+// capture records the frames of a session exchanging a message, as seen by
+// the session opening the stream.
+func capture(t *testing.T, payloads bool) []Record {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, b := mplextest.Pipe()
+	mpa, err := multiplex.NewMultiplex(a, true, nil, w.Option(payloads))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpb, err := multiplex.NewMultiplex(b, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpb.Close()
+
+	s, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		sb, err := mpb.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(sb, sb)
+		sb.Close()
+	}()
+	s.Write([]byte("hello"))
+	s.CloseWrite()
+	if data, err := ioutil.ReadAll(s); err != nil || string(data) != "hello" {
+		t.Fatalf("expected an echo, got %q, %v", data, err)
+	}
+	mpa.Close()
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	var recs []Record
+	r := NewReader(&buf)
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			return recs
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		recs = append(recs, rec)
+	}
+}
+
+func TestCapture(t *testing.T) {
+	for _, payloads := range []bool{true, false} {
+		recs := capture(t, payloads)
+
+		var messages []multiplex.FrameInfo
+		for i, rec := range recs {
+			if i > 0 && rec.Time.Before(recs[i-1].Time) {
+				t.Fatal("expected the frames in order")
+			}
+			f := rec.Frame
+			if f.Tag == frame.TagMessageInitiator || f.Tag == frame.TagMessageReceiver {
+				messages = append(messages, f)
+			}
+		}
+		if len(messages) != 2 {
+			t.Fatalf("expected a message each way, got %+v", messages)
+		}
+		for i, dir := range []multiplex.FrameDirection{multiplex.FrameOutbound, multiplex.FrameInbound} {
+			m := messages[i]
+			if m.Direction != dir || m.Length != 5 {
+				t.Fatalf("expected a 5 byte %s message, got %+v", dir, m)
+			}
+			if payloads && string(m.Payload) != "hello" {
+				t.Fatalf("expected the payload to be recorded, got %q", m.Payload)
+			}
+			if !payloads && len(m.Payload) != 0 {
+				t.Fatalf("expected the payload to be left out, got %q", m.Payload)
+			}
+		}
+	}
+}
+
+func TestReaderInvalid(t *testing.T) {
+	if _, err := NewReader(bytes.NewReader([]byte("not a capture"))).Next(); err != ErrFormat {
+		t.Fatalf("expected ErrFormat, got %v", err)
+	}
+
+	// A capture cut short.
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.ObserveFrame(multiplex.FrameInfo{StreamID: 1, Tag: frame.TagNewStream})
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	cut := buf.Bytes()[:buf.Len()-2]
+	if _, err := NewReader(bytes.NewReader(cut)).Next(); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected io.ErrUnexpectedEOF, got %v", err)
+	}
+}
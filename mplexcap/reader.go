@@ -0,0 +1,207 @@
+package mplexcap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"time"
+
+	multiplex "github.com/libp2p/go-mplex"
+	"github.com/libp2p/go-mplex/frame"
+)
+
+// maxBlockSize is the size of the largest block read from a capture: the
+// largest frame, with room to spare.
+const maxBlockSize = 16 << 20
+
+// Record is a frame read from a capture.
+type Record struct {
+	// Time is when the frame was sent or received.
+	Time time.Time
+	// Frame describes the frame. Its Payload holds what was recorded of
+	// the payload: it's shorter than Length if the payload was truncated,
+	// or left out.
+	Frame multiplex.FrameInfo
+}
+
+// Reader reads the frames recorded in a capture. Besides the captures Writer
+// writes, it reads pcapng files of either byte order and with several
+// interfaces, skipping the packets of interfaces of other link types.
+type Reader struct {
+	r      *bufio.Reader
+	order  binary.ByteOrder
+	ifaces []iface
+}
+
+// iface is an interface of the capture's current section.
+type iface struct {
+	linkType uint16
+	// tsres is the resolution of the packet timestamps, in negative
+	// powers of 10 of a second.
+	tsres byte
+}
+
+// NewReader returns a Reader reading a capture from r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r)}
+}
+
+// Next returns the next frame in the capture, or io.EOF at its end.
+func (r *Reader) Next() (Record, error) {
+	for {
+		typ, body, err := r.readBlock()
+		if err != nil {
+			return Record{}, err
+		}
+		switch typ {
+		case blockInterface:
+			if err := r.addInterface(body); err != nil {
+				return Record{}, err
+			}
+		case blockEnhancedPacket:
+			rec, ok, err := r.packet(body)
+			if err != nil || ok {
+				return rec, err
+			}
+		}
+		// Other blocks are of no interest.
+	}
+}
+
+// readBlock reads the next block, returning its type and body.
+func (r *Reader) readBlock() (uint32, []byte, error) {
+	var hdr [8]byte
+	if _, err := io.ReadFull(r.r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	// The section header's type reads the same in either byte order, and
+	// gives the byte order of the section.
+	if binary.LittleEndian.Uint32(hdr[:4]) == blockSectionHeader {
+		magic, err := r.r.Peek(4)
+		if err != nil {
+			return 0, nil, noEOF(err)
+		}
+		switch {
+		case binary.LittleEndian.Uint32(magic) == byteOrderMagic:
+			r.order = binary.LittleEndian
+		case binary.BigEndian.Uint32(magic) == byteOrderMagic:
+			r.order = binary.BigEndian
+		default:
+			return 0, nil, ErrFormat
+		}
+		r.ifaces = r.ifaces[:0]
+	}
+	if r.order == nil {
+		return 0, nil, ErrFormat
+	}
+	length := r.order.Uint32(hdr[4:])
+	if length < 12 || length%4 != 0 || length > maxBlockSize {
+		return 0, nil, ErrFormat
+	}
+	body := make([]byte, length-8)
+	if _, err := io.ReadFull(r.r, body); err != nil {
+		return 0, nil, noEOF(err)
+	}
+	return r.order.Uint32(hdr[:4]), body[:len(body)-4], nil
+}
+
+func (r *Reader) addInterface(body []byte) error {
+	if len(body) < 8 {
+		return ErrFormat
+	}
+	ifc := iface{linkType: r.order.Uint16(body), tsres: 6}
+	opts := body[8:]
+	for len(opts) >= 4 {
+		code, l := r.order.Uint16(opts), int(r.order.Uint16(opts[2:]))
+		if code == optEnd {
+			break
+		}
+		padded := (l + 3) &^ 3
+		if 4+padded > len(opts) {
+			return ErrFormat
+		}
+		if code == optTimestampRes && l == 1 {
+			ifc.tsres = opts[4]
+			// Resolutions in powers of 2 are unsupported, and
+			// those below a nanosecond need not be.
+			if ifc.tsres&0x80 != 0 || ifc.tsres > 18 {
+				return ErrFormat
+			}
+		}
+		opts = opts[4+padded:]
+	}
+	r.ifaces = append(r.ifaces, ifc)
+	return nil
+}
+
+// packet decodes an enhanced packet block. It returns false for packets of
+// other link types.
+func (r *Reader) packet(body []byte) (Record, bool, error) {
+	if len(body) < 20 {
+		return Record{}, false, ErrFormat
+	}
+	idx := r.order.Uint32(body)
+	if idx >= uint32(len(r.ifaces)) {
+		return Record{}, false, ErrFormat
+	}
+	ifc := r.ifaces[idx]
+	if ifc.linkType != LinkType {
+		return Record{}, false, nil
+	}
+	ticks := uint64(r.order.Uint32(body[4:]))<<32 | uint64(r.order.Uint32(body[8:]))
+	capLen := r.order.Uint32(body[12:])
+	if uint64(capLen) > uint64(len(body)-20) {
+		return Record{}, false, ErrFormat
+	}
+	data := body[20 : 20+capLen]
+
+	if len(data) < 1 {
+		return Record{}, false, ErrFormat
+	}
+	dir := multiplex.FrameDirection(data[0])
+	header, n := binary.Uvarint(data[1:])
+	if n <= 0 {
+		return Record{}, false, ErrFormat
+	}
+	length, m := binary.Uvarint(data[1+n:])
+	if m <= 0 || length > maxBlockSize {
+		return Record{}, false, ErrFormat
+	}
+	payload := data[1+n+m:]
+	if uint64(len(payload)) > length {
+		return Record{}, false, ErrFormat
+	}
+	id, tag := frame.UnpackHeader(header)
+	return Record{
+		Time: timestamp(ticks, ifc.tsres),
+		Frame: multiplex.FrameInfo{
+			Direction: dir,
+			StreamID:  id,
+			Tag:       tag,
+			Length:    int(length),
+			Payload:   payload,
+		},
+	}, true, nil
+}
+
+// timestamp converts a packet timestamp to a time.
+func timestamp(ticks uint64, tsres byte) time.Time {
+	if tsres <= 9 {
+		for ; tsres < 9; tsres++ {
+			ticks *= 10
+		}
+	} else {
+		for ; tsres > 9; tsres-- {
+			ticks /= 10
+		}
+	}
+	return time.Unix(0, int64(ticks))
+}
+
+// noEOF turns an EOF in the middle of a block into an io.ErrUnexpectedEOF.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
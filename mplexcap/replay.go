@@ -0,0 +1,50 @@
+package mplexcap
+
+import (
+	"io"
+
+	multiplex "github.com/libp2p/go-mplex"
+	"github.com/libp2p/go-mplex/frame"
+)
+
+// Replay writes the inbound frames recorded in a capture to w, in order, as
+// the peer that sent them did, to reproduce what happened to a session in a
+// test. w is typically the peer's end of an mplextest.Pipe, the other end of
+// which a session under test runs on, configured like the recorded one:
+//
+//	conn, peer := mplextest.Pipe()
+//	mp, err := multiplex.NewMultiplex(conn, false, nil)
+//	...
+//	err = mplexcap.Replay(mplexcap.NewReader(f), peer)
+//
+// Outbound frames are skipped: the session under test sends its own, which
+// mplextest.Pipe buffers without them having to be read. Payloads that
+// weren't recorded in full are padded with zeros, which keeps the framing,
+// and the flow of data, as recorded.
+func Replay(r *Reader, w io.Writer) error {
+	var buf []byte
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		f := rec.Frame
+		if f.Direction != multiplex.FrameInbound {
+			continue
+		}
+		if cap(buf) < frame.MaxHeaderSize+f.Length {
+			buf = make([]byte, frame.MaxHeaderSize+f.Length)
+		}
+		n := frame.PutHeader(buf[:cap(buf)], frame.PackHeader(f.StreamID, f.Tag), f.Length)
+		n += copy(buf[n:cap(buf)], f.Payload)
+		for end := n + f.Length - len(f.Payload); n < end; n++ {
+			buf[n] = 0
+		}
+		if _, err := w.Write(buf[:n]); err != nil {
+			return err
+		}
+	}
+}
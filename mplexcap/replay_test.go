@@ -0,0 +1,66 @@
+package mplexcap
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+
+	multiplex "github.com/libp2p/go-mplex"
+	"github.com/libp2p/go-mplex/mplextest"
+)
+
+func TestReplay(t *testing.T) {
+	// Record the session accepting a stream.
+	var capture bytes.Buffer
+	w, err := NewWriter(&capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := mplextest.Pipe()
+	mpa, err := multiplex.NewMultiplex(a, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	mpb, err := multiplex.NewMultiplex(b, false, nil, w.Option(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Write([]byte("hello"))
+	s.Close()
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(sb); err != nil {
+		t.Fatal(err)
+	}
+	mpb.Close()
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replay what it received into a new session.
+	conn, peer := mplextest.Pipe()
+	mp, err := multiplex.NewMultiplex(conn, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mp.Close()
+	if err := Replay(NewReader(&capture), peer); err != nil {
+		t.Fatal(err)
+	}
+	replayed, err := mp.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(replayed)
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("expected the stream to be replayed, got %q, %v", data, err)
+	}
+}
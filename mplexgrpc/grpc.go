@@ -0,0 +1,97 @@
+// Package mplexgrpc carries gRPC over the streams of an mplex session: a
+// client connection runs over a stream opened with Dialer, and a server takes
+// the streams the peer opens from Listener.
+//
+//	conn, err := grpc.DialContext(ctx, "mplex",
+//		grpc.WithContextDialer(mplexgrpc.Dialer(session)),
+//		grpc.WithTransportCredentials(insecure.NewCredentials()))
+//
+//	err := grpcServer.Serve(mplexgrpc.Listener(session))
+//
+// The package doesn't depend on gRPC itself. StatusCode maps the errors of
+// sessions and streams to gRPC status codes.
+package mplexgrpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+
+	multiplex "github.com/libp2p/go-mplex"
+)
+
+// Dialer returns a function for grpc.WithContextDialer opening a stream on
+// the session for every connection gRPC makes. The address gRPC dials is
+// ignored.
+//
+// Once the session is shut down, dialing fails with an error that isn't
+// temporary, so that gRPC gives up on the connection rather than retrying
+// it.
+func Dialer(mp *multiplex.Multiplex) func(context.Context, string) (net.Conn, error) {
+	return func(ctx context.Context, _ string) (net.Conn, error) {
+		s, err := mp.NewStream(ctx)
+		if err != nil {
+			return nil, &dialError{err}
+		}
+		return s, nil
+	}
+}
+
+type dialError struct {
+	err error
+}
+
+func (e *dialError) Error() string { return "mplexgrpc: opening a stream: " + e.err.Error() }
+func (e *dialError) Unwrap() error { return e.err }
+
+// Temporary tells gRPC whether redialing may help.
+func (e *dialError) Temporary() bool {
+	return !errors.Is(e.err, multiplex.ErrShutdown) && !errors.Is(e.err, multiplex.ErrStreamIDsExhausted)
+}
+
+// Listener returns a net.Listener for grpc.Server.Serve, accepting the
+// streams the peer opens. Serve returns the session's shutdown reason once it
+// shuts down. Stopping the server closes the listener, not the session.
+func Listener(mp *multiplex.Multiplex) net.Listener {
+	return mp.Listener()
+}
+
+// gRPC status codes, as defined by google.golang.org/grpc/codes.
+const (
+	codeOK                = 0
+	codeCanceled          = 1
+	codeUnknown           = 2
+	codeDeadlineExceeded  = 4
+	codeResourceExhausted = 8
+	codeUnavailable       = 14
+)
+
+// StatusCode returns the gRPC status code matching an error returned by a
+// session or a stream, for use with codes.Code:
+//
+//   - nil is OK;
+//   - context cancellation is Canceled, and deadlines are DeadlineExceeded;
+//   - stream limits are ResourceExhausted;
+//   - resets, closed streams and sessions that went away are Unavailable:
+//     the peer may be reached again over a new stream or session.
+//
+// Other errors are Unknown.
+func StatusCode(err error) uint32 {
+	switch {
+	case err == nil:
+		return codeOK
+	case errors.Is(err, context.Canceled):
+		return codeCanceled
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded):
+		return codeDeadlineExceeded
+	case errors.Is(err, multiplex.ErrStreamLimitReached), errors.Is(err, multiplex.ErrStreamIDsExhausted):
+		return codeResourceExhausted
+	case errors.Is(err, multiplex.ErrStreamReset), errors.Is(err, multiplex.ErrStreamClosed),
+		errors.Is(err, multiplex.ErrShutdown), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return codeUnavailable
+	default:
+		return codeUnknown
+	}
+}
@@ -0,0 +1,74 @@
+package mplexgrpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	multiplex "github.com/libp2p/go-mplex"
+	"github.com/libp2p/go-mplex/mplextest"
+)
+
+func TestDialAndListen(t *testing.T) {
+	a, b := mplextest.Pipe()
+	client, err := multiplex.NewMultiplex(a, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := multiplex.NewMultiplex(b, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	dial := Dialer(client)
+	c, err := dial(context.Background(), "mplex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := Listener(server)
+	sc, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write([]byte("PRI")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(sc, buf); err != nil || string(buf) != "PRI" {
+		t.Fatalf("got %q, %v", buf, err)
+	}
+
+	client.Close()
+	_, err = dial(context.Background(), "mplex")
+	var terr interface{ Temporary() bool }
+	if !errors.As(err, &terr) || terr.Temporary() {
+		t.Fatalf("expected a permanent dial error, got %v", err)
+	}
+	if _, err := l.Accept(); err == nil || errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected the session's shutdown reason, got %v", err)
+	}
+}
+
+func TestStatusCode(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		code uint32
+	}{
+		{nil, codeOK},
+		{context.Canceled, codeCanceled},
+		{fmt.Errorf("dialing: %w", context.DeadlineExceeded), codeDeadlineExceeded},
+		{multiplex.ErrStreamLimitReached, codeResourceExhausted},
+		{&multiplex.ResetError{Remote: true}, codeUnavailable},
+		{&multiplex.SessionError{Code: 1}, codeUnavailable},
+		{io.EOF, codeUnavailable},
+		{errors.New("boom"), codeUnknown},
+	} {
+		if code := StatusCode(tc.err); code != tc.code {
+			t.Errorf("%v: expected %d, got %d", tc.err, tc.code, code)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+// Package mplexhttp carries HTTP/1.1 over the streams of an mplex session,
+// for tunneling HTTP APIs over an existing session.
+package mplexhttp
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	multiplex "github.com/libp2p/go-mplex"
+)
+
+// NewTransport returns an http.RoundTripper sending requests over streams it
+// opens on the session. Streams are reused for later requests, like
+// connections, unless DisableKeepAlives is set on the returned transport, in
+// which case each request gets a stream of its own.
+//
+// The request URLs still need a host, but it's only used to tell pools of
+// streams apart: all requests go to the peer.
+func NewTransport(mp *multiplex.Multiplex) *http.Transport {
+	return &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return mp.NewStream(ctx)
+		},
+		MaxIdleConnsPerHost: 16,
+		IdleConnTimeout:     90 * time.Second,
+	}
+}
+
+// NewClient returns an http.Client using NewTransport.
+func NewClient(mp *multiplex.Multiplex) *http.Client {
+	return &http.Client{Transport: NewTransport(mp)}
+}
+
+// Serve serves HTTP requests sent on the streams the peer opens with h, until
+// the session shuts down, and returns the reason it did. It takes all the
+// streams the peer opens.
+func Serve(mp *multiplex.Multiplex, h http.Handler) error {
+	return (&http.Server{Handler: h}).Serve(mp.Listener())
+}
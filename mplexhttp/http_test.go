@@ -0,0 +1,70 @@
+package mplexhttp
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	multiplex "github.com/libp2p/go-mplex"
+	"github.com/libp2p/go-mplex/mplextest"
+)
+
+func TestRoundTrip(t *testing.T) {
+	a, b := mplextest.Pipe()
+	client, err := multiplex.NewMultiplex(a, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := multiplex.NewMultiplex(b, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		served <- Serve(server, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("hello " + r.URL.Path[1:]))
+		}))
+	}()
+
+	get := func(tr *http.Transport, path string) {
+		t.Helper()
+		resp, err := (&http.Client{Transport: tr}).Get("http://peer/" + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != "hello "+path {
+			t.Fatalf("got %q", body)
+		}
+	}
+
+	// Streams are reused...
+	tr := NewTransport(client)
+	for i := 0; i < 3; i++ {
+		get(tr, "reused")
+	}
+	tr.CloseIdleConnections()
+	if n := client.Stat().StreamsOpened; n != 1 {
+		t.Fatalf("expected 1 stream, got %d", n)
+	}
+
+	// ...unless keep-alives are off.
+	tr = NewTransport(client)
+	tr.DisableKeepAlives = true
+	for i := 0; i < 3; i++ {
+		get(tr, "once")
+	}
+	if n := client.Stat().StreamsOpened; n != 4 {
+		t.Fatalf("expected 4 streams, got %d", n)
+	}
+
+	client.Close()
+	if err := <-served; err == nil || err != server.ShutdownReason() {
+		t.Fatalf("expected Serve to return once the session shut down, got %v", err)
+	}
+}
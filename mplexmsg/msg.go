@@ -0,0 +1,87 @@
+// Package mplexmsg reads and writes messages prefixed with their length (an
+// unsigned varint) over streams, taking the message buffers from the
+// session's buffer pool rather than allocating one per message:
+//
+//	pool := session.BufferPool()
+//	err := mplexmsg.WriteMsg(s, pool, msg)
+//	...
+//	msg, err := mplexmsg.ReadMsg(s, pool, mplexmsg.DefaultMaxSize)
+//	...
+//	pool.Put(msg)
+package mplexmsg
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+
+	multiplex "github.com/libp2p/go-mplex"
+)
+
+// ErrTooLarge is returned by ReadMsg for messages larger than the given
+// limit, and by WriteMsg for messages larger than DefaultMaxSize.
+var ErrTooLarge = errors.New("mplexmsg: message too large")
+
+// DefaultMaxSize is the size of the largest message WriteMsg sends, and a
+// sensible limit for ReadMsg.
+const DefaultMaxSize = multiplex.MaxMessageSize
+
+// WriteMsg writes msg to w, prefixed with its length. The prefix and the
+// message go out in a single Write, so that on a stream they're sent in the
+// same frame when they fit. The buffer for that is taken from the pool, and
+// put back before WriteMsg returns.
+func WriteMsg(w io.Writer, pool multiplex.BufferPool, msg []byte) error {
+	if len(msg) > DefaultMaxSize {
+		return ErrTooLarge
+	}
+	buf := pool.Get(binary.MaxVarintLen64 + len(msg))
+	defer pool.Put(buf)
+	n := binary.PutUvarint(buf, uint64(len(msg)))
+	n += copy(buf[n:], msg)
+	_, err := w.Write(buf[:n])
+	return err
+}
+
+// ReadMsg reads the next message from r, failing with ErrTooLarge, before
+// reading it, if it's larger than max bytes. The message is returned in a
+// buffer from the pool, which the caller should put back once done with it.
+//
+// ReadMsg doesn't read ahead: the length is read a byte at a time, unless r is
+// an io.ByteReader, so that r is left at the start of the next message. It
+// returns io.EOF if r ends between messages, and io.ErrUnexpectedEOF if it
+// does so mid-message.
+func ReadMsg(r io.Reader, pool multiplex.BufferPool, max int) ([]byte, error) {
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		br = &byteReader{r: r}
+	}
+	size, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+	if size > uint64(max) {
+		return nil, ErrTooLarge
+	}
+	msg := pool.Get(int(size))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		pool.Put(msg)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return msg, nil
+}
+
+// byteReader reads one byte at a time from a reader without a ReadByte.
+type byteReader struct {
+	r   io.Reader
+	buf [1]byte
+}
+
+func (b *byteReader) ReadByte() (byte, error) {
+	if _, err := io.ReadFull(b.r, b.buf[:]); err != nil {
+		return 0, err
+	}
+	return b.buf[0], nil
+}
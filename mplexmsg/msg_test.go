@@ -0,0 +1,64 @@
+package mplexmsg
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	multiplex "github.com/libp2p/go-mplex"
+	"github.com/libp2p/go-mplex/mplextest"
+)
+
+func TestReadWriteMsg(t *testing.T) {
+	a, b := mplextest.Pair(t)
+	pool := a.BufferPool()
+
+	msgs := [][]byte{[]byte("hello"), {}, bytes.Repeat([]byte("x"), 100000)}
+	s, err := a.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for _, msg := range msgs {
+			if err := WriteMsg(s, pool, msg); err != nil {
+				t.Error(err)
+			}
+		}
+		if err := WriteMsg(s, pool, make([]byte, DefaultMaxSize+1)); err != ErrTooLarge {
+			t.Errorf("expected ErrTooLarge, got %v", err)
+		}
+		WriteMsg(s, pool, []byte("too large for the reader"))
+		s.CloseWrite()
+	}()
+
+	sb, err := b.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range msgs {
+		msg, err := ReadMsg(sb, pool, DefaultMaxSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(msg, expected) {
+			t.Fatalf("expected a %d byte message, got %d bytes", len(expected), len(msg))
+		}
+		pool.Put(msg)
+	}
+	if _, err := ReadMsg(sb, pool, 10); err != ErrTooLarge {
+		t.Fatalf("expected ErrTooLarge, got %v", err)
+	}
+}
+
+func TestReadMsgEOF(t *testing.T) {
+	pool := multiplex.NoBufferPool
+	if _, err := ReadMsg(bytes.NewReader(nil), pool, DefaultMaxSize); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+	// Cut off mid-message, through a reader without ReadByte.
+	r := io.MultiReader(bytes.NewReader([]byte{5, 'a', 'b'}))
+	if _, err := ReadMsg(r, pool, DefaultMaxSize); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected io.ErrUnexpectedEOF, got %v", err)
+	}
+}
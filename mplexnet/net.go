@@ -0,0 +1,202 @@
+// Package mplexnet uses stream names as virtual addresses on an mplex
+// session: Listen returns a net.Listener for the streams the peer opens with a
+// given name, and Dial opens a stream with that name, so that several
+// services can share a session.
+//
+//	n := mplexnet.New(session)
+//	l, err := n.Listen("service-a")
+//	...
+//	conn, err := n.Dial("service-a") // on the other side
+//
+// The receiving session must be created with multiplex.WithStreamNames:
+// without it, the names of the streams the peer opens aren't kept.
+package mplexnet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	multiplex "github.com/libp2p/go-mplex"
+)
+
+// ErrAddrInUse is returned by Listen when there's already a listener for the
+// address.
+var ErrAddrInUse = errors.New("mplexnet: address already in use")
+
+// backlog is the number of streams that can be waiting to be accepted by a
+// listener. Streams beyond that are reset.
+const backlog = 16
+
+// Addr is a virtual address: the name of the streams a service is reached
+// with.
+type Addr string
+
+// Network returns "mplex".
+func (a Addr) Network() string { return "mplex" }
+
+func (a Addr) String() string { return string(a) }
+
+// Conn is a stream to or from a service, whose address is the stream's name.
+type Conn struct {
+	*multiplex.Stream
+	local, remote net.Addr
+}
+
+// LocalAddr returns the address of the service for accepted connections, or
+// the session's local address for dialed ones.
+func (c *Conn) LocalAddr() net.Addr { return c.local }
+
+// RemoteAddr returns the address of the service for dialed connections, or
+// the session's remote address for accepted ones.
+func (c *Conn) RemoteAddr() net.Addr { return c.remote }
+
+// Net routes the streams the peer opens on a session to listeners, by name.
+type Net struct {
+	mp *multiplex.Multiplex
+
+	mu        sync.Mutex
+	listeners map[string]*listener
+	closed    bool
+}
+
+// New returns a Net for the session. It takes all the streams the peer opens,
+// from now until the session is closed: streams with no listener for their
+// name are reset.
+func New(mp *multiplex.Multiplex) *Net {
+	n := &Net{mp: mp, listeners: make(map[string]*listener)}
+	go n.route()
+	return n
+}
+
+// Listen returns a listener for the streams the peer opens with the given
+// name. There can only be one listener per name at a time.
+func (n *Net) Listen(name string) (net.Listener, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return nil, net.ErrClosed
+	}
+	if _, ok := n.listeners[name]; ok {
+		return nil, ErrAddrInUse
+	}
+	l := &listener{
+		n:       n,
+		addr:    Addr(name),
+		streams: make(chan *multiplex.Stream, backlog),
+		closed:  make(chan struct{}),
+	}
+	n.listeners[name] = l
+	return l, nil
+}
+
+// Dial opens a stream to the peer's listener for the given name.
+func (n *Net) Dial(name string) (net.Conn, error) {
+	return n.DialContext(context.Background(), name)
+}
+
+// DialContext is like Dial, but gives up on opening the stream once ctx is
+// done. Whether the peer listens on the name is only known once the stream
+// is used: if it doesn't, the peer resets the stream.
+func (n *Net) DialContext(ctx context.Context, name string) (net.Conn, error) {
+	s, err := n.mp.NewNamedStream(ctx, name)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: "mplex", Addr: Addr(name), Err: err}
+	}
+	return &Conn{Stream: s, local: s.LocalAddr(), remote: Addr(name)}, nil
+}
+
+// Close closes all the listeners. Streams the peer opens from then on are
+// reset. The session is left open.
+func (n *Net) Close() error {
+	n.mu.Lock()
+	ls := n.listeners
+	n.listeners = nil
+	n.closed = true
+	n.mu.Unlock()
+	for _, l := range ls {
+		l.close()
+	}
+	return nil
+}
+
+// route hands the streams the peer opens to the listeners.
+func (n *Net) route() {
+	for {
+		s, err := n.mp.Accept()
+		if err != nil {
+			return
+		}
+		if reason := n.deliver(s); reason != "" {
+			s.ResetWithReason("mplexnet: " + reason)
+		}
+	}
+}
+
+// deliver queues the stream for its listener, or returns why it can't.
+func (n *Net) deliver(s *multiplex.Stream) string {
+	// Holding the lock keeps the listener from being closed meanwhile,
+	// leaving the stream stranded in its queue.
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	l := n.listeners[s.Name()]
+	if l == nil {
+		return fmt.Sprintf("nobody listening on %q", s.Name())
+	}
+	select {
+	case l.streams <- s:
+		return ""
+	default:
+		return fmt.Sprintf("backlog of %q full", s.Name())
+	}
+}
+
+type listener struct {
+	n         *Net
+	addr      Addr
+	streams   chan *multiplex.Stream
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case s := <-l.streams:
+		return &Conn{Stream: s, local: l.addr, remote: s.RemoteAddr()}, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	case <-l.n.mp.CloseChan():
+		return nil, l.n.mp.ShutdownReason()
+	}
+}
+
+func (l *listener) Close() error {
+	l.n.mu.Lock()
+	if l.n.listeners[string(l.addr)] == l {
+		delete(l.n.listeners, string(l.addr))
+	}
+	l.n.mu.Unlock()
+	l.close()
+	return nil
+}
+
+// close stops the listener, resetting the streams it didn't accept.
+func (l *listener) close() {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		for {
+			select {
+			case s := <-l.streams:
+				s.Reset()
+			default:
+				return
+			}
+		}
+	})
+}
+
+func (l *listener) Addr() net.Addr {
+	return l.addr
+}
@@ -0,0 +1,77 @@
+package mplexnet
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+
+	multiplex "github.com/libp2p/go-mplex"
+	"github.com/libp2p/go-mplex/mplextest"
+)
+
+func TestDialListen(t *testing.T) {
+	a, b := mplextest.Pair(t, multiplex.WithStreamNames())
+	client, server := New(a), New(b)
+	defer server.Close()
+
+	serve := func(name string) net.Listener {
+		l, err := server.Listen(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			for {
+				c, err := l.Accept()
+				if err != nil {
+					return
+				}
+				if c.LocalAddr().String() != name {
+					t.Errorf("expected local address %q, got %q", name, c.LocalAddr())
+				}
+				c.Write([]byte(name))
+				c.Close()
+			}
+		}()
+		return l
+	}
+	serve("service-a")
+	lb := serve("service-b")
+	if _, err := server.Listen("service-a"); err != ErrAddrInUse {
+		t.Fatalf("expected ErrAddrInUse, got %v", err)
+	}
+
+	dial := func(name string) (string, error) {
+		c, err := client.Dial(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		if c.RemoteAddr().String() != name || c.RemoteAddr().Network() != "mplex" {
+			t.Fatalf("unexpected remote address %v", c.RemoteAddr())
+		}
+		data, err := ioutil.ReadAll(c)
+		return string(data), err
+	}
+	for _, name := range []string{"service-a", "service-b", "service-a"} {
+		got, err := dial(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != name {
+			t.Fatalf("dialed %q, reached %q", name, got)
+		}
+	}
+
+	// Nobody listens anymore.
+	lb.Close()
+	_, err := dial("service-b")
+	var rerr *multiplex.ResetError
+	if !errors.As(err, &rerr) || !strings.Contains(rerr.Reason, "nobody listening") {
+		t.Fatalf("expected a reset, got %v", err)
+	}
+	if _, err := lb.Accept(); err != net.ErrClosed {
+		t.Fatalf("expected net.ErrClosed, got %v", err)
+	}
+}
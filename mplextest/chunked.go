@@ -0,0 +1,97 @@
+package mplextest
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	multiplex "github.com/libp2p/go-mplex"
+)
+
+// ChunkedConn wraps a connection, splitting the data read from and written to
+// it into small chunks, the way TCP segments it, but deterministically: each
+// Read returns at most the next chunk size, and each Write goes out as one
+// write of the underlying connection per chunk. Chunk sizes are taken in turn
+// from the list given to NewChunkedConn, starting over at its end, separately
+// for reads and writes.
+//
+// This exercises the code parsing frame headers split across reads, and
+// reading frames piecemeal, which a Pipe, handing over whole writes, doesn't.
+type ChunkedConn struct {
+	net.Conn
+	sizes []int
+
+	readLock  sync.Mutex
+	nextRead  int
+	writeLock sync.Mutex
+	nextWrite int
+}
+
+// NewChunkedConn wraps conn, reading and writing in chunks of the given sizes,
+// one byte at a time if none are given.
+func NewChunkedConn(conn net.Conn, sizes ...int) *ChunkedConn {
+	for _, n := range sizes {
+		if n <= 0 {
+			panic("mplextest: chunk sizes must be positive")
+		}
+	}
+	if len(sizes) == 0 {
+		sizes = []int{1}
+	}
+	return &ChunkedConn{Conn: conn, sizes: sizes}
+}
+
+// ChunkedPair returns two sessions connected over a Pipe, the first being the
+// initiator, with both ends wrapped in a ChunkedConn with the given chunk
+// sizes. The sessions are closed when the test finishes.
+func ChunkedPair(t testing.TB, sizes []int, opts ...multiplex.Option) (*multiplex.Multiplex, *multiplex.Multiplex) {
+	t.Helper()
+
+	a, b := Pipe()
+	mpa, err := multiplex.NewMultiplex(NewChunkedConn(a, sizes...), true, nil, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpb, err := multiplex.NewMultiplex(NewChunkedConn(b, sizes...), false, nil, opts...)
+	if err != nil {
+		mpa.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		mpa.Close()
+		mpb.Close()
+	})
+	return mpa, mpb
+}
+
+func (c *ChunkedConn) Read(b []byte) (int, error) {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+	if len(b) == 0 {
+		return c.Conn.Read(b)
+	}
+	if n := c.sizes[c.nextRead]; len(b) > n {
+		b = b[:n]
+	}
+	c.nextRead = (c.nextRead + 1) % len(c.sizes)
+	return c.Conn.Read(b)
+}
+
+func (c *ChunkedConn) Write(b []byte) (int, error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	written := 0
+	for written < len(b) {
+		chunk := b[written:]
+		if n := c.sizes[c.nextWrite]; len(chunk) > n {
+			chunk = chunk[:n]
+		}
+		c.nextWrite = (c.nextWrite + 1) % len(c.sizes)
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
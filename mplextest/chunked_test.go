@@ -0,0 +1,71 @@
+package mplextest
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+func TestChunkedConn(t *testing.T) {
+	a, b := Pipe()
+	ca := NewChunkedConn(a, 1, 3)
+	if _, err := ca.Write([]byte("hello world")); err != nil {
+		t.Fatal(err)
+	}
+	cb := NewChunkedConn(b, 2, 5)
+	buf := make([]byte, 100)
+	for _, expected := range []string{"he", "llo w", "or", "ld"} {
+		n, err := cb.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != expected {
+			t.Fatalf("expected %q, got %q", expected, buf[:n])
+		}
+	}
+}
+
+func TestChunkedPair(t *testing.T) {
+	a, b := ChunkedPair(t, []int{1, 2, 3, 7, 100})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s, err := a.NewStream(context.Background())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			msg := make([]byte, 5000)
+			rand.Read(msg)
+			s.Write(msg)
+			s.CloseWrite()
+			reply, err := io.ReadAll(s)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if !bytes.Equal(reply, msg) {
+				t.Error("got wrong data")
+			}
+		}()
+	}
+	go func() {
+		for {
+			s, err := b.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(s, s)
+				s.Close()
+			}()
+		}
+	}()
+	wg.Wait()
+}
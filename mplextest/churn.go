@@ -0,0 +1,246 @@
+package mplextest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	multiplex "github.com/libp2p/go-mplex"
+)
+
+// ChurnConfig configures a Churn run.
+type ChurnConfig struct {
+	// Rate is the number of streams opened per second. Zero means as fast
+	// as possible.
+	Rate int
+	// Concurrency bounds the number of streams in flight (defaults to 64).
+	Concurrency int
+	// MessageSizes are the sizes of the messages sent on the streams, picked
+	// at random (defaults to 1 byte, 1KiB, 16KiB and 256KiB).
+	MessageSizes []int
+	// ResetRatio is the fraction of the streams reset instead of being
+	// closed, between 0 and 1.
+	ResetRatio float64
+	// StreamTimeout is the deadline set on every stream (defaults to 10s).
+	StreamTimeout time.Duration
+
+	// OnReport, if set, is called every ReportInterval (defaults to 10s)
+	// with the progress so far.
+	OnReport       func(ChurnReport)
+	ReportInterval time.Duration
+}
+
+// ChurnReport describes the progress of a Churn run, along with the resources
+// used by the process, to spot leaks.
+type ChurnReport struct {
+	Elapsed time.Duration
+	// Streams counts the streams done with, Resets those that were reset
+	// on purpose, and Bytes the bytes echoed back on them.
+	Streams, Resets, Bytes uint64
+
+	// Goroutines is the number of goroutines in the process, and HeapInUse
+	// the bytes in in-use heap spans.
+	Goroutines int
+	HeapInUse  uint64
+
+	// Client and Server are the statistics of the two sessions.
+	Client, Server multiplex.Stats
+}
+
+// Churn opens and closes streams from client to server at the configured
+// rate, with messages of mixed sizes, until ctx is done. The server echoes
+// every message back, and the client checks it. Long runs exercise the
+// sessions' bookkeeping (streams, buffers, deadlines), and the reports make
+// leaks stand out.
+//
+// Churn serves the streams the server accepts until it's closed. It returns
+// the final report once ctx is done and the streams in flight are done, or
+// the first unexpected error.
+func Churn(ctx context.Context, client, server *multiplex.Multiplex, cfg ChurnConfig) (ChurnReport, error) {
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = 64
+	}
+	if len(cfg.MessageSizes) == 0 {
+		cfg.MessageSizes = []int{1, 1 << 10, 16 << 10, 256 << 10}
+	}
+	if cfg.StreamTimeout <= 0 {
+		cfg.StreamTimeout = 10 * time.Second
+	}
+	if cfg.ReportInterval <= 0 {
+		cfg.ReportInterval = 10 * time.Second
+	}
+
+	c := &churn{cfg: cfg, client: client, server: server, start: time.Now()}
+	go c.serve()
+
+	var tick <-chan time.Time
+	if cfg.Rate > 0 {
+		t := time.NewTicker(time.Second / time.Duration(cfg.Rate))
+		defer t.Stop()
+		tick = t.C
+	}
+	report := time.NewTicker(cfg.ReportInterval)
+	defer report.Stop()
+
+	var (
+		wg     sync.WaitGroup
+		errs   = make(chan error, 1)
+		tokens = make(chan struct{}, cfg.Concurrency)
+		rng    = rand.New(rand.NewSource(time.Now().UnixNano()))
+		err    error
+	)
+loop:
+	for {
+		if tick != nil {
+			select {
+			case <-tick:
+			case <-ctx.Done():
+				break loop
+			}
+		}
+		select {
+		case tokens <- struct{}{}:
+		case <-ctx.Done():
+			break loop
+		case err = <-errs:
+			break loop
+		case <-report.C:
+			if cfg.OnReport != nil {
+				cfg.OnReport(c.report())
+			}
+			continue
+		}
+
+		size := cfg.MessageSizes[rng.Intn(len(cfg.MessageSizes))]
+		reset := rng.Float64() < cfg.ResetRatio
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-tokens }()
+			if err := c.stream(size, reset); err != nil {
+				select {
+				case errs <- err:
+				default:
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err == nil {
+		select {
+		case err = <-errs:
+		default:
+		}
+	}
+	return c.report(), err
+}
+
+type churn struct {
+	// streams, resets and bytes are updated atomically. They must stay the
+	// first fields, so that they're 64-bit aligned on 32-bit platforms.
+	streams, resets, bytes uint64
+
+	cfg            ChurnConfig
+	client, server *multiplex.Multiplex
+	start          time.Time
+}
+
+func (c *churn) report() ChurnReport {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return ChurnReport{
+		Elapsed:    time.Since(c.start),
+		Streams:    atomic.LoadUint64(&c.streams),
+		Resets:     atomic.LoadUint64(&c.resets),
+		Bytes:      atomic.LoadUint64(&c.bytes),
+		Goroutines: runtime.NumGoroutine(),
+		HeapInUse:  ms.HeapInuse,
+		Client:     c.client.Stat(),
+		Server:     c.server.Stat(),
+	}
+}
+
+// serve echoes back what's sent on the server's streams.
+func (c *churn) serve() {
+	for {
+		s, err := c.server.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			s.SetDeadline(time.Now().Add(c.cfg.StreamTimeout))
+			if _, err := io.Copy(s, s); err != nil {
+				s.Reset()
+				return
+			}
+			s.Close()
+		}()
+	}
+}
+
+// stream runs a single stream: it sends a message of the given size and
+// checks it's echoed back, or resets the stream midway.
+func (c *churn) stream(size int, reset bool) error {
+	s, err := c.client.NewStream(context.Background())
+	if err != nil {
+		return err
+	}
+	s.SetDeadline(time.Now().Add(c.cfg.StreamTimeout))
+
+	msg := make([]byte, size)
+	rand.Read(msg)
+
+	// Always read what's echoed back: mplex has no flow control, so a
+	// stream that isn't read from eventually stalls the whole session.
+	type echoed struct {
+		data []byte
+		err  error
+	}
+	echo := make(chan echoed, 1)
+	go func() {
+		data, err := io.ReadAll(s)
+		echo <- echoed{data, err}
+	}()
+
+	if reset {
+		_, err := s.Write(msg[:size/2])
+		s.Reset()
+		<-echo
+		if err != nil {
+			return fmt.Errorf("stream %s: %w", s.Name(), err)
+		}
+		atomic.AddUint64(&c.resets, 1)
+		atomic.AddUint64(&c.streams, 1)
+		return nil
+	}
+
+	_, err = s.Write(msg)
+	if err == nil {
+		err = s.CloseWrite()
+	}
+	res := <-echo
+	if err == nil {
+		err = res.err
+	}
+	if err != nil {
+		s.Reset()
+		return fmt.Errorf("stream %s: %w", s.Name(), err)
+	}
+	if !bytes.Equal(res.data, msg) {
+		s.Reset()
+		return errors.New("message wasn't echoed back correctly")
+	}
+	s.Close()
+
+	atomic.AddUint64(&c.bytes, uint64(size))
+	atomic.AddUint64(&c.streams, 1)
+	return nil
+}
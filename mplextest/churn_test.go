@@ -0,0 +1,35 @@
+package mplextest
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestChurn(t *testing.T) {
+	client, server := Pair(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	var reports int
+	report, err := Churn(ctx, client, server, ChurnConfig{
+		Concurrency:    16,
+		MessageSizes:   []int{1, 1000, 100000},
+		ResetRatio:     0.2,
+		OnReport:       func(ChurnReport) { reports++ },
+		ReportInterval: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Streams == 0 || report.Bytes == 0 || report.Resets == 0 {
+		t.Fatalf("expected some streams to be echoed and reset, got %+v", report)
+	}
+	if reports == 0 {
+		t.Fatal("expected progress reports")
+	}
+	// Streams reset early may never reach the server.
+	if report.Client.StreamsOpened < report.Server.StreamsAccepted {
+		t.Fatalf("opened %d streams, but %d were accepted", report.Client.StreamsOpened, report.Server.StreamsAccepted)
+	}
+}
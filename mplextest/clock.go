@@ -0,0 +1,137 @@
+package mplextest
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	multiplex "github.com/libp2p/go-mplex"
+)
+
+// FakeClock is a multiplex.Clock whose time only moves when told to, so that
+// tests can trigger timeouts instantly and reproducibly.
+type FakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers map[*fakeTimer]struct{}
+	// changed is closed (and replaced) whenever a timer is armed.
+	changed chan struct{}
+}
+
+var _ multiplex.Clock = (*FakeClock)(nil)
+
+// NewFakeClock returns a fake clock, set to an arbitrary time.
+func NewFakeClock() *FakeClock {
+	return &FakeClock{
+		now:     time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		timers:  make(map[*fakeTimer]struct{}),
+		changed: make(chan struct{}),
+	}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) NewTimer(d time.Duration) multiplex.Timer {
+	t := &fakeTimer{clock: c, ch: make(chan time.Time, 1)}
+	t.Reset(d)
+	return t
+}
+
+func (c *FakeClock) AfterFunc(d time.Duration, f func()) multiplex.Timer {
+	t := &fakeTimer{clock: c, f: f}
+	t.Reset(d)
+	return t
+}
+
+// Advance moves the clock forward, firing the timers that expire on the way,
+// in order.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	var due []*fakeTimer
+	for t := range c.timers {
+		if !t.at.After(end) {
+			due = append(due, t)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].at.Before(due[j].at) })
+	for _, t := range due {
+		c.now = t.at
+		c.fire(t)
+	}
+	c.now = end
+	c.mu.Unlock()
+}
+
+// Timers returns the number of armed timers.
+func (c *FakeClock) Timers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+// BlockUntil waits until at least n timers are armed.
+func (c *FakeClock) BlockUntil(n int) {
+	c.mu.Lock()
+	for len(c.timers) < n {
+		changed := c.changed
+		c.mu.Unlock()
+		<-changed
+		c.mu.Lock()
+	}
+	c.mu.Unlock()
+}
+
+// fire fires a timer. It must be called with mu held.
+func (c *FakeClock) fire(t *fakeTimer) {
+	delete(c.timers, t)
+	if t.f != nil {
+		go t.f()
+		return
+	}
+	select {
+	case t.ch <- c.now:
+	default:
+	}
+}
+
+type fakeTimer struct {
+	clock *FakeClock
+	ch    chan time.Time
+	f     func()
+	// at is guarded by the clock's mu.
+	at time.Time
+}
+
+func (t *fakeTimer) Chan() <-chan time.Time {
+	return t.ch
+}
+
+func (t *fakeTimer) Stop() bool {
+	c := t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, armed := c.timers[t]
+	delete(c.timers, t)
+	return armed
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	c := t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, armed := c.timers[t]
+	t.at = c.now.Add(d)
+	if d <= 0 {
+		c.fire(t)
+		return armed
+	}
+	c.timers[t] = struct{}{}
+	close(c.changed)
+	c.changed = make(chan struct{})
+	return armed
+}
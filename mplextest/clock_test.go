@@ -0,0 +1,40 @@
+package mplextest
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"testing"
+
+	multiplex "github.com/libp2p/go-mplex"
+)
+
+func TestFakeClockReceiveTimeout(t *testing.T) {
+	clock := NewFakeClock()
+	a, b := Pair(t, multiplex.WithClock(clock))
+
+	s, err := a.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := b.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Don't read on sb, so that its session times out delivering data.
+	for i := 0; i < 3; i++ {
+		if _, err := s.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for b.Stat().ReceiveTimeoutResets == 0 {
+		clock.Advance(multiplex.ReceiveTimeout)
+		runtime.Gosched()
+	}
+
+	if _, err := s.Read(make([]byte, 1)); !errors.Is(err, multiplex.ErrStreamReset) {
+		t.Fatalf("expected a stream reset, got %v", err)
+	}
+	sb.Close()
+}
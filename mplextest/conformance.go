@@ -0,0 +1,440 @@
+package mplextest
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	multiplex "github.com/libp2p/go-mplex"
+	"github.com/libp2p/go-mplex/frame"
+)
+
+const testTimeout = 10 * time.Second
+
+// RunConformance runs the conformance test suite against the sessions started
+// by the given muxer: multiplex.NewMuxer() for this module's implementation,
+// or any other mplex implementation wrapped as a Muxer. Most tests drive a
+// single session with hand-crafted frames to check the wire-level behavior,
+// others connect two sessions.
+func RunConformance(t *testing.T, m multiplex.Muxer) {
+	tests := []struct {
+		name string
+		test func(*testing.T, multiplex.Muxer)
+	}{
+		{"AcceptStream", testAcceptStream},
+		{"OpenStream", testOpenStream},
+		{"RemoteClose", testRemoteClose},
+		{"LocalClose", testLocalClose},
+		{"RemoteReset", testRemoteReset},
+		{"LocalReset", testLocalReset},
+		{"ResetOnUnknownTag", testResetOnUnknownTag},
+		{"IgnoreUnknownStream", testIgnoreUnknownStream},
+		{"Echo", testEcho},
+		{"ManyStreams", testManyStreams},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			tc.test(t, m)
+		})
+	}
+}
+
+// rawPeer speaks the mplex wire protocol frame by frame.
+type rawPeer struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// newRawPeer starts a session of the muxer under test connected to a raw
+// peer. The session under test is the receiver.
+func newRawPeer(t *testing.T, m multiplex.Muxer) (*rawPeer, multiplex.Session) {
+	a, b := net.Pipe()
+	sess, err := m.NewConn(a, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		b.Close()
+		sess.Close()
+	})
+	return &rawPeer{t: t, conn: b, r: bufio.NewReader(b)}, sess
+}
+
+func (p *rawPeer) send(id, tag uint64, payload []byte) {
+	p.t.Helper()
+	p.conn.SetWriteDeadline(time.Now().Add(testTimeout))
+	if _, err := p.conn.Write(frame.Encode(nil, frame.Frame{StreamID: id, Tag: tag, Payload: payload})); err != nil {
+		p.t.Fatalf("failed to send frame: %s", err)
+	}
+}
+
+func (p *rawPeer) next() frame.Frame {
+	p.t.Helper()
+	p.conn.SetReadDeadline(time.Now().Add(testTimeout))
+	f, err := frame.Decode(p.r, 1<<20)
+	if err != nil {
+		p.t.Fatalf("failed to read frame: %s", err)
+	}
+	return f
+}
+
+// expect reads frames until it finds one on the given stream and checks its
+// tag and payload (if non-nil). Frames for other streams are skipped.
+func (p *rawPeer) expect(id, tag uint64, payload []byte) frame.Frame {
+	p.t.Helper()
+	for {
+		f := p.next()
+		if f.StreamID != id || f.Tag == frame.TagExtension {
+			continue
+		}
+		if f.Tag != tag {
+			p.t.Fatalf("expected tag %d on stream %d, got %d", tag, id, f.Tag)
+		}
+		if payload != nil && !bytes.Equal(f.Payload, payload) {
+			p.t.Fatalf("expected payload %q on stream %d, got %q", payload, id, f.Payload)
+		}
+		return f
+	}
+}
+
+// expectData reads message frames on the given stream until len(data) bytes
+// have been received, and compares them to data.
+func (p *rawPeer) expectData(id, tag uint64, data []byte) {
+	p.t.Helper()
+	var got []byte
+	for len(got) < len(data) {
+		f := p.expect(id, tag, nil)
+		got = append(got, f.Payload...)
+	}
+	if !bytes.Equal(got, data) {
+		p.t.Fatalf("expected data %q on stream %d, got %q", data, id, got)
+	}
+}
+
+func accept(t *testing.T, sess multiplex.Session) multiplex.MuxedStream {
+	t.Helper()
+	res := make(chan multiplex.MuxedStream, 1)
+	errs := make(chan error, 1)
+	go func() {
+		s, err := sess.AcceptStream()
+		if err != nil {
+			errs <- err
+			return
+		}
+		res <- s
+	}()
+	select {
+	case s := <-res:
+		s.SetDeadline(time.Now().Add(testTimeout))
+		return s
+	case err := <-errs:
+		t.Fatalf("failed to accept stream: %s", err)
+	case <-time.After(testTimeout):
+		t.Fatal("timed out accepting stream")
+	}
+	return nil
+}
+
+func open(t *testing.T, sess multiplex.Session) multiplex.MuxedStream {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	s, err := sess.OpenStream(ctx)
+	if err != nil {
+		t.Fatalf("failed to open stream: %s", err)
+	}
+	s.SetDeadline(time.Now().Add(testTimeout))
+	return s
+}
+
+func readFull(t *testing.T, s multiplex.MuxedStream, expected []byte) {
+	t.Helper()
+	buf := make([]byte, len(expected))
+	if _, err := io.ReadFull(s, buf); err != nil {
+		t.Fatalf("failed to read: %s", err)
+	}
+	if !bytes.Equal(buf, expected) {
+		t.Fatalf("expected %q, got %q", expected, buf)
+	}
+}
+
+func write(t *testing.T, s multiplex.MuxedStream, data []byte) {
+	t.Helper()
+	if _, err := s.Write(data); err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+}
+
+// expectReadError waits for reads on s to fail with something other than
+// EOF.
+func expectReadError(t *testing.T, s multiplex.MuxedStream) {
+	t.Helper()
+	_, err := ioutil.ReadAll(s)
+	if err == nil {
+		t.Fatal("expected read to fail, got EOF")
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		t.Fatal("expected read to fail, timed out")
+	}
+}
+
+// A stream opened by the peer is delivered with its data, and replies use the
+// receiver tags.
+func testAcceptStream(t *testing.T, m multiplex.Muxer) {
+	p, sess := newRawPeer(t, m)
+
+	p.send(3, frame.TagNewStream, []byte("three"))
+	p.send(3, frame.TagMessageInitiator, []byte("hello"))
+
+	s := accept(t, sess)
+	readFull(t, s, []byte("hello"))
+
+	write(t, s, []byte("world"))
+	p.expectData(3, frame.TagMessageReceiver, []byte("world"))
+}
+
+// Streams we open are announced with a new stream frame and use the
+// initiator tags.
+func testOpenStream(t *testing.T, m multiplex.Muxer) {
+	p, sess := newRawPeer(t, m)
+
+	s := open(t, sess)
+	go s.Write([]byte("hello"))
+
+	f := p.expectNewStream()
+	p.expectData(f.StreamID, frame.TagMessageInitiator, []byte("hello"))
+
+	p.send(f.StreamID, frame.TagMessageReceiver, []byte("world"))
+	readFull(t, s, []byte("world"))
+}
+
+// expectNewStream returns the next new stream frame. It relies on the
+// session under test sending nothing else first, apart from extension frames.
+func (p *rawPeer) expectNewStream() frame.Frame {
+	p.t.Helper()
+	for {
+		f := p.next()
+		if f.Tag == frame.TagExtension {
+			continue
+		}
+		if f.Tag != frame.TagNewStream {
+			p.t.Fatalf("expected a new stream frame, got tag %d", f.Tag)
+		}
+		return f
+	}
+}
+
+// After the peer closes its side, reads return EOF but writes still work.
+func testRemoteClose(t *testing.T, m multiplex.Muxer) {
+	p, sess := newRawPeer(t, m)
+
+	p.send(1, frame.TagNewStream, nil)
+	p.send(1, frame.TagMessageInitiator, []byte("bye"))
+	p.send(1, frame.TagCloseInitiator, nil)
+
+	s := accept(t, sess)
+	data, err := ioutil.ReadAll(s)
+	if err != nil {
+		t.Fatalf("expected EOF, got %s", err)
+	}
+	if string(data) != "bye" {
+		t.Fatalf("expected %q, got %q", "bye", data)
+	}
+
+	go s.Write([]byte("still here"))
+	p.expectData(1, frame.TagMessageReceiver, []byte("still here"))
+}
+
+// Closing our side sends a close frame and stops writes, but reads continue.
+func testLocalClose(t *testing.T, m multiplex.Muxer) {
+	p, sess := newRawPeer(t, m)
+
+	p.send(1, frame.TagNewStream, nil)
+	s := accept(t, sess)
+
+	go s.CloseWrite()
+	p.expect(1, frame.TagCloseReceiver, []byte{})
+
+	if _, err := s.Write([]byte("nope")); err == nil {
+		t.Fatal("expected write after close to fail")
+	}
+
+	p.send(1, frame.TagMessageInitiator, []byte("more"))
+	readFull(t, s, []byte("more"))
+}
+
+// After the peer resets a stream, reads and writes fail.
+func testRemoteReset(t *testing.T, m multiplex.Muxer) {
+	p, sess := newRawPeer(t, m)
+
+	p.send(1, frame.TagNewStream, nil)
+	s := accept(t, sess)
+	p.send(1, frame.TagResetInitiator, nil)
+
+	expectReadError(t, s)
+	deadline := time.Now().Add(testTimeout)
+	for {
+		if _, err := s.Write([]byte("x")); err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected writes to fail after a reset")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Resetting a stream sends a reset frame.
+func testLocalReset(t *testing.T, m multiplex.Muxer) {
+	p, sess := newRawPeer(t, m)
+
+	p.send(1, frame.TagNewStream, nil)
+	s := accept(t, sess)
+	s.Reset()
+
+	p.expect(1, frame.TagResetReceiver, nil)
+}
+
+// Frames with an unknown tag reset the stream they're sent on.
+func testResetOnUnknownTag(t *testing.T, m multiplex.Muxer) {
+	p, sess := newRawPeer(t, m)
+
+	p.send(1, frame.TagNewStream, nil)
+	s := accept(t, sess)
+
+	// Tag 7 is not part of the protocol. Note that the stream ID in the
+	// header refers to a stream opened by the *receiver* of the frame, as
+	// for all odd tags, so we send it on a stream opened by the session.
+	s2 := open(t, sess)
+	id := p.expectNewStream().StreamID
+	p.send(id, 7, []byte("garbage"))
+
+	p.expect(id, frame.TagResetInitiator, nil)
+	expectReadError(t, s2)
+
+	// The other stream is unaffected.
+	p.send(1, frame.TagMessageInitiator, []byte("ok"))
+	readFull(t, s, []byte("ok"))
+}
+
+// Data and control frames for streams that don't exist are ignored.
+func testIgnoreUnknownStream(t *testing.T, m multiplex.Muxer) {
+	p, sess := newRawPeer(t, m)
+
+	p.send(42, frame.TagMessageInitiator, []byte("lost"))
+	p.send(43, frame.TagCloseInitiator, nil)
+	p.send(44, frame.TagResetInitiator, nil)
+
+	p.send(1, frame.TagNewStream, nil)
+	p.send(1, frame.TagMessageInitiator, []byte("found"))
+	s := accept(t, sess)
+	readFull(t, s, []byte("found"))
+}
+
+func newSessionPair(t *testing.T, m multiplex.Muxer) (multiplex.Session, multiplex.Session) {
+	a, b := net.Pipe()
+	sa, err := m.NewConn(a, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := m.NewConn(b, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		sa.Close()
+		sb.Close()
+	})
+	return sa, sb
+}
+
+func testEcho(t *testing.T, m multiplex.Muxer) {
+	sa, sb := newSessionPair(t, m)
+
+	go func() {
+		s, err := sb.AcceptStream()
+		if err != nil {
+			return
+		}
+		defer s.Close()
+		io.Copy(s, s)
+	}()
+
+	msg := make([]byte, 256*1024)
+	rand.Read(msg)
+
+	s := open(t, sa)
+	go func() {
+		s.Write(msg)
+		s.CloseWrite()
+	}()
+
+	data, err := ioutil.ReadAll(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, msg) {
+		t.Fatalf("echoed data differs: sent %d bytes, received %d", len(msg), len(data))
+	}
+	s.Close()
+}
+
+func testManyStreams(t *testing.T, m multiplex.Muxer) {
+	sa, sb := newSessionPair(t, m)
+
+	const streams = 50
+	go func() {
+		for i := 0; i < streams; i++ {
+			s, err := sb.AcceptStream()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer s.Close()
+				io.Copy(s, s)
+			}()
+		}
+	}()
+
+	errs := make(chan error, streams)
+	for i := 0; i < streams; i++ {
+		go func(i int) {
+			ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+			defer cancel()
+			s, err := sa.OpenStream(ctx)
+			if err != nil {
+				errs <- err
+				return
+			}
+			s.SetDeadline(time.Now().Add(testTimeout))
+			msg := []byte(fmt.Sprintf("stream %d", i))
+			if _, err := s.Write(msg); err != nil {
+				errs <- err
+				return
+			}
+			s.CloseWrite()
+			data, err := ioutil.ReadAll(s)
+			if err == nil && !bytes.Equal(data, msg) {
+				err = fmt.Errorf("expected %q, got %q", msg, data)
+			}
+			s.Close()
+			errs <- err
+		}(i)
+	}
+	for i := 0; i < streams; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,11 @@
+package mplextest
+
+import (
+	"testing"
+
+	multiplex "github.com/libp2p/go-mplex"
+)
+
+func TestMplexConformance(t *testing.T) {
+	RunConformance(t, multiplex.NewMuxer())
+}
@@ -0,0 +1,204 @@
+package mplextest
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	multiplex "github.com/libp2p/go-mplex"
+)
+
+// Faults configures the faults a FaultyConn injects into the data written to
+// it. The zero value injects none.
+type Faults struct {
+	// Latency delays the delivery of every write.
+	Latency time.Duration
+	// Bandwidth limits the delivery rate, in bytes per second.
+	Bandwidth int
+	// MaxWriteSize splits writes into pieces of at most this many bytes, so
+	// the other end sees short reads.
+	MaxWriteSize int
+	// CloseAfter abruptly closes the connection once that many bytes have
+	// been delivered, possibly in the middle of a write.
+	CloseAfter int
+}
+
+// FaultyConn wraps a connection, injecting faults into the data written to
+// it. Writes never block: they're queued, and delivered in the background.
+type FaultyConn struct {
+	net.Conn
+	faults Faults
+
+	mu        sync.Mutex
+	queue     []delivery
+	err       error
+	closing   bool
+	delivered int
+	wake      chan struct{}
+	done      chan struct{}
+}
+
+type delivery struct {
+	at   time.Time
+	data []byte
+}
+
+// NewFaultyConn wraps conn, injecting the given faults.
+func NewFaultyConn(conn net.Conn, faults Faults) *FaultyConn {
+	c := &FaultyConn{
+		Conn:   conn,
+		faults: faults,
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	go c.deliver()
+	return c
+}
+
+// FaultyPair returns two sessions connected over a Pipe, the first being the
+// initiator. Faults in ab are injected into the data going from the first to
+// the second, and faults in ba the other way around. The sessions are closed
+// when the test finishes.
+func FaultyPair(t testing.TB, ab, ba Faults, opts ...multiplex.Option) (*multiplex.Multiplex, *multiplex.Multiplex) {
+	t.Helper()
+
+	a, b := Pipe()
+	mpa, err := multiplex.NewMultiplex(NewFaultyConn(a, ab), true, nil, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpb, err := multiplex.NewMultiplex(NewFaultyConn(b, ba), false, nil, opts...)
+	if err != nil {
+		mpa.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		mpa.Close()
+		mpb.Close()
+	})
+	return mpa, mpb
+}
+
+func (c *FaultyConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return 0, c.err
+	}
+	if c.closing {
+		return 0, net.ErrClosed
+	}
+	c.queue = append(c.queue, delivery{
+		at:   time.Now().Add(c.faults.Latency),
+		data: append([]byte(nil), b...),
+	})
+	c.signal()
+	return len(b), nil
+}
+
+// Close closes the connection once everything written so far has been
+// delivered.
+func (c *FaultyConn) Close() error {
+	c.mu.Lock()
+	c.closing = true
+	c.signal()
+	c.mu.Unlock()
+	return nil
+}
+
+// Break closes the connection right away, dropping anything not delivered
+// yet.
+func (c *FaultyConn) Break() {
+	c.mu.Lock()
+	c.fail(net.ErrClosed)
+	c.mu.Unlock()
+}
+
+func (c *FaultyConn) signal() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// fail closes the underlying connection. It must be called with mu held.
+func (c *FaultyConn) fail(err error) {
+	if c.err == nil {
+		c.err = err
+		c.queue = nil
+		c.Conn.Close()
+		close(c.done)
+	}
+}
+
+func (c *FaultyConn) deliver() {
+	for {
+		c.mu.Lock()
+		if c.err != nil {
+			c.mu.Unlock()
+			return
+		}
+		if len(c.queue) == 0 {
+			if c.closing {
+				c.fail(net.ErrClosed)
+				c.mu.Unlock()
+				return
+			}
+			c.mu.Unlock()
+			select {
+			case <-c.wake:
+			case <-c.done:
+			}
+			continue
+		}
+		next := c.queue[0]
+		c.mu.Unlock()
+
+		if wait := time.Until(next.at); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-c.done:
+				return
+			}
+		}
+
+		data := next.data
+		if max := c.faults.MaxWriteSize; max > 0 && len(data) > max {
+			data = data[:max]
+		}
+		if c.faults.CloseAfter > 0 && c.delivered+len(data) > c.faults.CloseAfter {
+			data = data[:c.faults.CloseAfter-c.delivered]
+		}
+		if c.faults.Bandwidth > 0 {
+			select {
+			case <-time.After(time.Duration(len(data)) * time.Second / time.Duration(c.faults.Bandwidth)):
+			case <-c.done:
+				return
+			}
+		}
+
+		_, err := c.Conn.Write(data)
+
+		c.mu.Lock()
+		if err != nil {
+			c.fail(err)
+			c.mu.Unlock()
+			return
+		}
+		c.delivered += len(data)
+		if c.faults.CloseAfter > 0 && c.delivered >= c.faults.CloseAfter {
+			c.fail(net.ErrClosed)
+			c.mu.Unlock()
+			return
+		}
+		if len(c.queue) > 0 {
+			if rest := c.queue[0].data[len(data):]; len(rest) > 0 {
+				c.queue[0].data = rest
+			} else {
+				c.queue = c.queue[1:]
+			}
+		}
+		c.mu.Unlock()
+	}
+}
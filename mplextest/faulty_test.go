@@ -0,0 +1,57 @@
+package mplextest
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestFaultyPair(t *testing.T) {
+	faults := Faults{Latency: 50 * time.Millisecond, MaxWriteSize: 7}
+	a, b := FaultyPair(t, faults, faults)
+
+	start := time.Now()
+	s, err := a.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := make([]byte, 10000)
+	rand.Read(msg)
+	go s.Write(msg)
+
+	sb, err := b.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := make([]byte, len(msg))
+	if _, err := io.ReadFull(sb, out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, msg) {
+		t.Fatal("got wrong data")
+	}
+	if time.Since(start) < faults.Latency {
+		t.Fatal("expected the data to be delayed")
+	}
+}
+
+func TestFaultyCloseAfter(t *testing.T) {
+	a, b := FaultyPair(t, Faults{CloseAfter: 100}, Faults{})
+
+	s, err := a.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Write(make([]byte, 1000))
+
+	sb, err := b.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(sb, make([]byte, 1000)); err == nil {
+		t.Fatal("expected the connection to break")
+	}
+}
@@ -0,0 +1,4 @@
+// Package mplextest provides testing utilities for mplex, including a
+// conformance test suite which can be run against any implementation of the
+// protocol.
+package mplextest
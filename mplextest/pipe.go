@@ -0,0 +1,181 @@
+package mplextest
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	multiplex "github.com/libp2p/go-mplex"
+)
+
+// Pair returns two sessions connected over a Pipe, the first being the
+// initiator. They're closed when the test finishes, which waits for their
+// goroutines to exit.
+func Pair(t testing.TB, opts ...multiplex.Option) (*multiplex.Multiplex, *multiplex.Multiplex) {
+	t.Helper()
+
+	a, b := Pipe()
+	mpa, err := multiplex.NewMultiplex(a, true, nil, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpb, err := multiplex.NewMultiplex(b, false, nil, opts...)
+	if err != nil {
+		mpa.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		mpa.Close()
+		mpb.Close()
+		// Leave nothing running behind.
+		mpa.Wait()
+		mpb.Wait()
+	})
+	return mpa, mpb
+}
+
+// Pipe returns the two ends of an in-memory connection. Unlike net.Pipe,
+// writes are buffered without limit and never block: once Write returns, the
+// data is available to the other end. This makes tests independent of how
+// the two ends happen to be scheduled.
+func Pipe() (net.Conn, net.Conn) {
+	ab, ba := newPipeBuffer(), newPipeBuffer()
+	return &pipeConn{r: ba, w: ab, local: pipeAddr("a"), remote: pipeAddr("b")},
+		&pipeConn{r: ab, w: ba, local: pipeAddr("b"), remote: pipeAddr("a")}
+}
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "pipe" }
+func (a pipeAddr) String() string  { return string(a) }
+
+// pipeBuffer is one direction of a pipe.
+type pipeBuffer struct {
+	mu     sync.Mutex
+	data   []byte
+	closed bool
+	// changed is closed (and replaced) whenever data is written, or the
+	// buffer is closed.
+	changed chan struct{}
+}
+
+func newPipeBuffer() *pipeBuffer {
+	return &pipeBuffer{changed: make(chan struct{})}
+}
+
+func (b *pipeBuffer) notify() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+func (b *pipeBuffer) write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return 0, io.ErrClosedPipe
+	}
+	b.data = append(b.data, p...)
+	b.notify()
+	return len(p), nil
+}
+
+func (b *pipeBuffer) read(p []byte, deadline <-chan time.Time) (int, error) {
+	b.mu.Lock()
+	for len(b.data) == 0 {
+		if b.closed {
+			b.mu.Unlock()
+			return 0, io.EOF
+		}
+		changed := b.changed
+		b.mu.Unlock()
+		select {
+		case <-changed:
+		case <-deadline:
+			return 0, os.ErrDeadlineExceeded
+		}
+		b.mu.Lock()
+	}
+	n := copy(p, b.data)
+	b.data = b.data[n:]
+	if len(b.data) == 0 {
+		// Don't hold on to the memory of a burst.
+		b.data = nil
+	}
+	b.mu.Unlock()
+	return n, nil
+}
+
+func (b *pipeBuffer) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.closed {
+		b.closed = true
+		b.notify()
+	}
+}
+
+type pipeConn struct {
+	r, w          *pipeBuffer
+	local, remote net.Addr
+
+	mu           sync.Mutex
+	readDeadline time.Time
+	closed       bool
+}
+
+func (c *pipeConn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return 0, io.ErrClosedPipe
+	}
+	deadline := c.readDeadline
+	c.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	return c.r.read(p, timeout)
+}
+
+func (c *pipeConn) Write(p []byte) (int, error) {
+	return c.w.write(p)
+}
+
+// Close closes the connection. The other end reads whatever was written
+// before, then EOF.
+func (c *pipeConn) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	c.w.close()
+	c.r.close()
+	return nil
+}
+
+func (c *pipeConn) LocalAddr() net.Addr  { return c.local }
+func (c *pipeConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *pipeConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline. It only applies to reads started
+// afterwards.
+func (c *pipeConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	return nil
+}
+
+// SetWriteDeadline does nothing, writes never block.
+func (c *pipeConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,35 @@
+package mplextest
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+)
+
+func TestPair(t *testing.T) {
+	a, b := Pair(t)
+
+	s, err := a.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Writes don't wait for the peer.
+	if _, err := s.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+
+	sb, err := b.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(sb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Fatalf("expected hello, got %q", data)
+	}
+}
@@ -0,0 +1,573 @@
+package multiplex
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// multipathSegmentSize is the maximum amount of data sent as a single
+	// segment over one path.
+	multipathSegmentSize = 16 * 1024
+	// multipathWindow is the maximum number of segments sent but not yet
+	// consumed by the peer. It bounds the memory needed for retransmission
+	// and reordering on both sides.
+	multipathWindow = 64
+)
+
+// Segment types.
+const (
+	segmentData = iota
+	segmentAck
+	// segmentClose tells the peer the connection was closed, as opposed to
+	// a path failing.
+	segmentClose
+)
+
+// ErrNoPaths is returned by a bonded connection once all its paths failed.
+var ErrNoPaths = errors.New("all paths failed")
+
+// errMultipathProtocol is what a bonded connection fails with when the peer
+// sends something it can't have sent if it followed the protocol.
+var errMultipathProtocol = errors.New("multipath protocol violation")
+
+// multipathMaxPending is the most received data held until the segments
+// before it arrive: a window's worth.
+const multipathMaxPending = multipathWindow * multipathSegmentSize
+
+// NewMultipathMultiplex creates a session backed by several connections to
+// the same peer, which must bond its ends of the connections too (in any
+// order). See BondConns.
+func NewMultipathMultiplex(conns []net.Conn, initiator bool, memoryManager MemoryManager, opts ...Option) (*Multiplex, error) {
+	con, err := BondConns(conns...)
+	if err != nil {
+		return nil, err
+	}
+	mp, err := NewMultiplex(con, initiator, memoryManager, opts...)
+	if err != nil {
+		con.Close()
+		return nil, err
+	}
+	return mp, nil
+}
+
+// BondConns bonds several connections ("paths") to the same peer into a
+// single connection. Written data is split into segments spread round-robin
+// over the paths, and put back in order on the receiving end. When a path
+// fails, the segments the peer hasn't acknowledged yet are sent again over the
+// remaining ones, so the bonded connection survives as long as one path does.
+//
+// The peer must bond the other ends of the connections, in any order. The
+// local and remote addresses are the first path's.
+func BondConns(conns ...net.Conn) (net.Conn, error) {
+	if len(conns) == 0 {
+		return nil, fmt.Errorf("no connections to bond")
+	}
+	return newBondedConn(conns, 0, nil), nil
+}
+
+// newBondedConn bonds the connections. If grace is positive, the bonded
+// connection waits that long for a new path when the last one fails, instead
+// of failing right away. onClose, if not nil, is called once the connection
+// fails or is closed.
+func newBondedConn(conns []net.Conn, grace time.Duration, onClose func()) *bondedConn {
+	c := &bondedConn{
+		grace:     grace,
+		onClose:   onClose,
+		unacked:   make(map[uint64]*segment),
+		pending:   make(map[uint64][]byte),
+		changed:   make(chan struct{}),
+		rDeadline: makePipeDeadline(),
+		wDeadline: makePipeDeadline(),
+	}
+	for _, con := range conns {
+		c.paths = append(c.paths, &path{conn: con})
+	}
+	for _, p := range c.paths {
+		go c.readPath(p)
+	}
+	return c
+}
+
+type path struct {
+	conn net.Conn
+	// wmu serializes writes to the connection.
+	wmu sync.Mutex
+	// dead is guarded by the bondedConn's mu.
+	dead bool
+}
+
+type segment struct {
+	seq  uint64
+	data []byte
+	// path is the path the segment was last sent over.
+	path *path
+}
+
+type bondedConn struct {
+	paths []*path
+
+	mu sync.Mutex
+	// changed is closed (and replaced) whenever the state changes, to wake
+	// up blocked readers and writers.
+	changed chan struct{}
+	err     error
+	closed  bool
+	rr      int
+
+	// grace is how long to wait for a new path once all failed, and
+	// graceTimer fails the connection when that time is up.
+	grace      time.Duration
+	graceTimer *time.Timer
+	// onClose, if set, is called once the connection fails or is closed.
+	onClose func()
+
+	// Send side: the next sequence number, and the segments the peer
+	// hasn't consumed yet.
+	nextSeq uint64
+	acked   uint64
+	unacked map[uint64]*segment
+
+	// Receive side: the next sequence number expected, the segments
+	// received out of order and their total size, and the ones ready to be
+	// read.
+	recvNext     uint64
+	pending      map[uint64][]byte
+	pendingBytes int
+	ready        [][]byte
+	// consumed is the number of segments read so far, and ackedUpTo the
+	// number we told the peer about.
+	consumed, ackedUpTo uint64
+
+	rDeadline, wDeadline pipeDeadline
+}
+
+var _ net.Conn = (*bondedConn)(nil)
+
+// notify wakes up everyone waiting for a state change. It must be called with
+// mu held.
+func (c *bondedConn) notify() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// nextPath picks the path to send the next segment over. It must be called
+// with mu held.
+func (c *bondedConn) nextPath() *path {
+	for i := 0; i < len(c.paths); i++ {
+		p := c.paths[c.rr%len(c.paths)]
+		c.rr++
+		if !p.dead {
+			return p
+		}
+	}
+	return nil
+}
+
+func (c *bondedConn) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		n := len(b) - written
+		if n > multipathSegmentSize {
+			n = multipathSegmentSize
+		}
+
+		c.mu.Lock()
+		for c.err == nil && len(c.unacked) >= multipathWindow {
+			changed := c.changed
+			c.mu.Unlock()
+			select {
+			case <-changed:
+			case <-c.wDeadline.wait():
+				return written, errTimeout
+			}
+			c.mu.Lock()
+		}
+		if c.err != nil {
+			err := c.err
+			c.mu.Unlock()
+			return written, err
+		}
+		seg := &segment{
+			seq:  c.nextSeq,
+			data: append([]byte(nil), b[written:written+n]...),
+			path: c.nextPath(),
+		}
+		p := seg.path
+		c.nextSeq++
+		c.unacked[seg.seq] = seg
+		c.mu.Unlock()
+
+		// If there's no path, the segment will be sent once we get a
+		// new one.
+		if p != nil {
+			c.send(p, seg)
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// send sends a segment over a path. If that fails, the path is given up on,
+// and the segment is sent again over another one.
+func (c *bondedConn) send(p *path, seg *segment) {
+	buf := make([]byte, 0, 1+2*binary.MaxVarintLen64+len(seg.data))
+	buf = append(buf, segmentData)
+	buf = appendUvarint(buf, seg.seq)
+	buf = appendUvarint(buf, uint64(len(seg.data)))
+	buf = append(buf, seg.data...)
+
+	if err := c.writePath(p, buf); err != nil {
+		c.pathFailed(p, err)
+	}
+}
+
+func (c *bondedConn) sendAck(upTo uint64) {
+	c.mu.Lock()
+	p := c.nextPath()
+	c.mu.Unlock()
+	if p == nil {
+		return
+	}
+
+	buf := appendUvarint([]byte{segmentAck}, upTo)
+	if err := c.writePath(p, buf); err != nil {
+		c.pathFailed(p, err)
+		// Acks are cumulative, try again over another path.
+		c.sendAck(upTo)
+	}
+}
+
+func (c *bondedConn) writePath(p *path, buf []byte) error {
+	p.wmu.Lock()
+	defer p.wmu.Unlock()
+	_, err := p.conn.Write(buf)
+	return err
+}
+
+// pathFailed gives up on a path, and sends the segments last sent over it
+// again over the remaining ones.
+func (c *bondedConn) pathFailed(p *path, err error) {
+	c.mu.Lock()
+	if p.dead {
+		c.mu.Unlock()
+		return
+	}
+	p.dead = true
+	p.conn.Close()
+
+	if c.nextPath() == nil {
+		if c.grace > 0 && c.err == nil {
+			// Wait for a new path.
+			if c.graceTimer == nil {
+				c.graceTimer = time.AfterFunc(c.grace, func() {
+					c.mu.Lock()
+					defer c.mu.Unlock()
+					if c.graceTimer != nil && c.nextPath() == nil {
+						c.fail(ErrNoPaths)
+					}
+				})
+			}
+			c.mu.Unlock()
+			return
+		}
+		c.fail(ErrNoPaths)
+		c.mu.Unlock()
+		return
+	}
+
+	var resend []*segment
+	for _, seg := range c.unacked {
+		if seg.path == p {
+			resend = append(resend, seg)
+		}
+	}
+	sort.Slice(resend, func(i, j int) bool { return resend[i].seq < resend[j].seq })
+	paths := make([]*path, len(resend))
+	for i, seg := range resend {
+		seg.path = c.nextPath()
+		paths[i] = seg.path
+	}
+	c.mu.Unlock()
+
+	for i, seg := range resend {
+		c.send(paths[i], seg)
+	}
+}
+
+// readPath reads the segments arriving over a path.
+func (c *bondedConn) readPath(p *path) {
+	r := bufio.NewReader(p.conn)
+	for {
+		typ, err := r.ReadByte()
+		if err != nil {
+			c.pathFailed(p, err)
+			return
+		}
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			c.pathFailed(p, err)
+			return
+		}
+
+		switch typ {
+		case segmentData:
+			length, err := binary.ReadUvarint(r)
+			if err != nil {
+				c.pathFailed(p, err)
+				return
+			}
+			if length == 0 || length > multipathSegmentSize {
+				c.protocolError(fmt.Errorf("%w: segment of %d bytes", errMultipathProtocol, length))
+				return
+			}
+			data := make([]byte, length)
+			if _, err := io.ReadFull(r, data); err != nil {
+				c.pathFailed(p, err)
+				return
+			}
+			if err := c.received(n, data); err != nil {
+				c.protocolError(err)
+				return
+			}
+		case segmentAck:
+			if err := c.ackReceived(n); err != nil {
+				c.protocolError(err)
+				return
+			}
+		case segmentClose:
+			if n != 0 {
+				c.protocolError(fmt.Errorf("%w: close segment with value %d", errMultipathProtocol, n))
+				return
+			}
+			c.mu.Lock()
+			c.fail(io.EOF)
+			c.mu.Unlock()
+			return
+		default:
+			c.protocolError(fmt.Errorf("%w: unknown segment type %d", errMultipathProtocol, typ))
+			return
+		}
+	}
+}
+
+// protocolError fails the connection because the peer broke the protocol:
+// giving up on a path alone would have it send the same again over another.
+func (c *bondedConn) protocolError(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.fail(err)
+}
+
+// fail fails the connection, unless it already failed. It must be called with
+// mu held.
+func (c *bondedConn) fail(err error) {
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	if c.graceTimer != nil {
+		c.graceTimer.Stop()
+		c.graceTimer = nil
+	}
+	for _, p := range c.paths {
+		if !p.dead {
+			p.dead = true
+			p.conn.Close()
+		}
+	}
+	if c.onClose != nil {
+		go c.onClose()
+	}
+	c.notify()
+}
+
+// addPath adds a new path to the connection, and sends everything the peer
+// hasn't acknowledged yet over it, in case it was lost with the old paths.
+func (c *bondedConn) addPath(conn net.Conn) error {
+	c.mu.Lock()
+	if c.err != nil {
+		err := c.err
+		c.mu.Unlock()
+		return err
+	}
+	if c.graceTimer != nil {
+		c.graceTimer.Stop()
+		c.graceTimer = nil
+	}
+
+	p := &path{conn: conn}
+	c.paths = append(c.paths, p)
+	resend := make([]*segment, 0, len(c.unacked))
+	for _, seg := range c.unacked {
+		resend = append(resend, seg)
+	}
+	sort.Slice(resend, func(i, j int) bool { return resend[i].seq < resend[j].seq })
+	for _, seg := range resend {
+		seg.path = p
+	}
+	ack := c.ackedUpTo
+	c.mu.Unlock()
+
+	go c.readPath(p)
+	// Our last acknowledgment may have been lost too.
+	if ack > 0 {
+		if err := c.writePath(p, appendUvarint([]byte{segmentAck}, ack)); err != nil {
+			c.pathFailed(p, err)
+			return nil
+		}
+	}
+	for _, seg := range resend {
+		c.send(p, seg)
+	}
+	return nil
+}
+
+// received handles a data segment, failing if it's beyond the window.
+func (c *bondedConn) received(seq uint64, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Drop duplicates, sent again after a path failed.
+	if _, ok := c.pending[seq]; ok || seq < c.recvNext {
+		return nil
+	}
+	// The peer waits for our acks before sending more than a window past
+	// what we consumed.
+	if seq-c.consumed >= multipathWindow {
+		return fmt.Errorf("%w: segment %d beyond the window (%d consumed)", errMultipathProtocol, seq, c.consumed)
+	}
+	if c.pendingBytes+len(data) > multipathMaxPending {
+		return fmt.Errorf("%w: more than %d bytes out of order", errMultipathProtocol, multipathMaxPending)
+	}
+	c.pending[seq] = data
+	c.pendingBytes += len(data)
+	for {
+		data, ok := c.pending[c.recvNext]
+		if !ok {
+			break
+		}
+		delete(c.pending, c.recvNext)
+		c.pendingBytes -= len(data)
+		c.ready = append(c.ready, data)
+		c.recvNext++
+	}
+	c.notify()
+	return nil
+}
+
+// ackReceived handles an ack, failing if it's for segments we didn't send.
+func (c *bondedConn) ackReceived(upTo uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if upTo > c.nextSeq {
+		return fmt.Errorf("%w: ack of %d segments, %d sent", errMultipathProtocol, upTo, c.nextSeq)
+	}
+	for ; c.acked < upTo; c.acked++ {
+		delete(c.unacked, c.acked)
+	}
+	c.notify()
+	return nil
+}
+
+func (c *bondedConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	for len(c.ready) == 0 {
+		if c.err != nil {
+			err := c.err
+			c.mu.Unlock()
+			return 0, err
+		}
+		changed := c.changed
+		c.mu.Unlock()
+		select {
+		case <-changed:
+		case <-c.rDeadline.wait():
+			return 0, errTimeout
+		}
+		c.mu.Lock()
+	}
+
+	n := 0
+	for len(c.ready) > 0 && n < len(b) {
+		read := copy(b[n:], c.ready[0])
+		n += read
+		if read < len(c.ready[0]) {
+			c.ready[0] = c.ready[0][read:]
+			break
+		}
+		c.ready[0] = nil
+		c.ready = c.ready[1:]
+		c.consumed++
+	}
+
+	// Let the peer know what we've consumed, so it can free up its window.
+	var ack uint64
+	if c.consumed-c.ackedUpTo >= multipathWindow/2 || (len(c.ready) == 0 && c.consumed > c.ackedUpTo) {
+		ack = c.consumed
+		c.ackedUpTo = c.consumed
+	}
+	c.mu.Unlock()
+
+	if ack > 0 {
+		go c.sendAck(ack)
+	}
+	return n, nil
+}
+
+func (c *bondedConn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	p := c.nextPath()
+	c.mu.Unlock()
+
+	// Tell the peer we're gone, so it doesn't wait for us to come back.
+	if p != nil {
+		c.writePath(p, []byte{segmentClose, 0})
+	}
+
+	c.mu.Lock()
+	c.fail(net.ErrClosed)
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *bondedConn) LocalAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.paths[0].conn.LocalAddr()
+}
+
+func (c *bondedConn) RemoteAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.paths[0].conn.RemoteAddr()
+}
+
+func (c *bondedConn) SetDeadline(t time.Time) error {
+	c.rDeadline.set(t)
+	c.wDeadline.set(t)
+	return nil
+}
+
+func (c *bondedConn) SetReadDeadline(t time.Time) error {
+	c.rDeadline.set(t)
+	return nil
+}
+
+func (c *bondedConn) SetWriteDeadline(t time.Time) error {
+	c.wDeadline.set(t)
+	return nil
+}
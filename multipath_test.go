@@ -0,0 +1,132 @@
+package multiplex
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"testing"
+)
+
+func bondedPair(t *testing.T, n int) (net.Conn, net.Conn, []net.Conn) {
+	var as, bs []net.Conn
+	for i := 0; i < n; i++ {
+		a, b := net.Pipe()
+		as = append(as, a)
+		// The peer may bond the connections in any order.
+		bs = append([]net.Conn{b}, bs...)
+	}
+	a, err := BondConns(as...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := BondConns(bs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, b, as
+}
+
+func TestMultipath(t *testing.T) {
+	a, b, _ := bondedPair(t, 3)
+
+	mpa, err := NewMultiplex(a, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpb, err := NewMultiplex(b, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	defer mpb.Close()
+
+	s, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := make([]byte, 4<<20)
+	rand.Read(msg)
+	go func() {
+		s.Write(msg)
+		s.Close()
+	}()
+	out, err := ioutil.ReadAll(sb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, msg) {
+		t.Fatal("got wrong data")
+	}
+}
+
+func TestMultipathFailover(t *testing.T) {
+	a, b, paths := bondedPair(t, 2)
+	defer a.Close()
+	defer b.Close()
+
+	msg := make([]byte, 4<<20)
+	rand.Read(msg)
+	go func() {
+		for i := 0; i < len(msg); i += 64 * 1024 {
+			if i == len(msg)/2 {
+				// Kill a path halfway through.
+				paths[0].Close()
+			}
+			if _, err := a.Write(msg[i : i+64*1024]); err != nil {
+				return
+			}
+		}
+	}()
+
+	out := make([]byte, len(msg))
+	if _, err := io.ReadFull(b, out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, msg) {
+		t.Fatal("got wrong data")
+	}
+
+	// Once the last path is gone, so is the connection.
+	paths[1].Close()
+	if _, err := b.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestMultipathProtocolViolations(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		segment []byte
+	}{
+		// An ack for segments never sent, which would have us walk up to
+		// 2^64 sequence numbers.
+		{"ack", appendUvarint([]byte{segmentAck}, 1<<63)},
+		// A segment far beyond the window, which we'd hold forever.
+		{"window", append(appendUvarint(appendUvarint([]byte{segmentData}, 1<<40), 1), 'x')},
+		{"empty", appendUvarint(appendUvarint([]byte{segmentData}, 0), 0)},
+		{"close", []byte{segmentClose, 1}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			a, b := net.Pipe()
+			defer b.Close()
+			c, err := BondConns(a)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			go b.Write(tc.segment)
+			if _, err := c.Read(make([]byte, 1)); !errors.Is(err, errMultipathProtocol) {
+				t.Fatalf("expected a protocol violation, got %v", err)
+			}
+		})
+	}
+}
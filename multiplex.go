@@ -3,20 +3,21 @@ package multiplex
 import (
 	"bufio"
 	"context"
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"runtime/debug"
+	"runtime/pprof"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
-	pool "github.com/libp2p/go-buffer-pool"
-
 	logging "github.com/ipfs/go-log/v2"
-	"github.com/multiformats/go-varint"
+
+	"github.com/libp2p/go-mplex/frame"
 )
 
 var log = logging.Logger("mplex")
@@ -34,8 +35,10 @@ var (
 )
 
 // Max time to block waiting for a slow reader to read from a stream before
-// resetting it. Preferably, we'd have some form of back-pressure mechanism but
-// we don't have that in this protocol.
+// resetting it (see WithOnSlowReader). Preferably, we'd have some form of
+// back-pressure mechanism but we don't have that in this protocol. Sessions
+// take it when they're created: see SetReceiveTimeout to change it on a live
+// one.
 var ReceiveTimeout = 5 * time.Second
 
 // ErrShutdown is returned when operating on a shutdown session
@@ -44,21 +47,83 @@ var ErrShutdown = errors.New("session shut down")
 // ErrTwoInitiators is returned when both sides think they're the initiator
 var ErrTwoInitiators = errors.New("two initiators")
 
+// ErrStreamLimitReached is returned when opening a stream would exceed the
+// configured limit on outbound streams.
+var ErrStreamLimitReached = errors.New("stream limit reached")
+
+// ErrStreamIDsExhausted is returned when opening a stream after all stream IDs
+// have been used up. Stream IDs aren't reused, so a new session is needed.
+var ErrStreamIDsExhausted = errors.New("stream IDs exhausted")
+
+// ErrMessageTooLarge is returned when opening a stream whose name doesn't fit
+// in the largest frame the peer accepts (see WithMaxMessageSize), and by
+// Channel for messages larger than MaxMessageSize.
+var ErrMessageTooLarge = errors.New("message larger than the peer accepts")
+
+// maxStreamID is the largest ID we'll use for a stream. The very largest one
+// is reserved for control frames.
+const maxStreamID = frame.ControlStreamID - 1
+
+// maxKeptName is the longest stream name kept with WithStreamNames. Longer
+// ones are discarded rather than held on to for the life of the stream.
+const maxKeptName = 1024
+
+// ErrRawConnUnsupported is returned by SyscallConn when the underlying
+// connection doesn't give raw access.
+var ErrRawConnUnsupported = errors.New("connection doesn't support raw access")
+
 // ErrInvalidState is returned when the other side does something it shouldn't.
+// Sessions shut down because of it give a *ProtocolViolationError, describing
+// what was received, as their ShutdownReason.
 // In this case, we close the connection to be safe.
 var ErrInvalidState = errors.New("received an unexpected message from the peer")
 
+// WriteError is returned by operations sending data once the session died
+// because writing to the connection failed, and by the streams of such a
+// session. It matches ErrShutdown and ErrStreamReset with errors.Is.
+type WriteError struct {
+	Err error
+}
+
+func (e *WriteError) Error() string {
+	return "error writing to connection: " + e.Err.Error()
+}
+
+func (e *WriteError) Unwrap() error {
+	return e.Err
+}
+
+func (e *WriteError) Is(target error) bool {
+	return target == ErrShutdown || target == ErrStreamReset
+}
+
 var errTimeout = timeout{}
 
+// errCanceled is returned internally when a context passed to an operation is
+// done. Callers translate it to the context's error.
+var errCanceled = errors.New("canceled")
+
+// ResetStreamTimeout is how long sending a stream's close or reset may take.
+// Sessions take it when they're created: see SetResetStreamTimeout to change
+// it on a live one.
 var ResetStreamTimeout = 2 * time.Minute
 
+// controlBuffers is the number of control frames that can be waiting to be
+// written at once. Control frames are tiny, so this isn't charged to the
+// memory manager.
+const controlBuffers = 16
+
 var getInputBufferTimeout = time.Minute
 
+// timeout is returned when a deadline expires. It implements net.Error and
+// matches os.ErrDeadlineExceeded with errors.Is, like the errors returned by
+// net.Conn implementations.
 type timeout struct{}
 
 func (timeout) Error() string   { return "i/o deadline exceeded" }
 func (timeout) Temporary() bool { return true }
 func (timeout) Timeout() bool   { return true }
+func (timeout) Unwrap() error   { return os.ErrDeadlineExceeded }
 
 // The MemoryManager allows management of memory allocations.
 type MemoryManager interface {
@@ -75,88 +140,381 @@ func (m *nullMemoryManager) ReleaseMemory(size int)                   {}
 
 // +1 for initiator
 const (
-	newStreamTag = 0
-	messageTag   = 2
-	closeTag     = 4
-	resetTag     = 6
+	newStreamTag = frame.TagNewStream
+	messageTag   = frame.TagMessageInitiator
+	closeTag     = frame.TagCloseInitiator
+	resetTag     = frame.TagResetInitiator
 )
 
 // Multiplex is a mplex session.
 type Multiplex struct {
-	con       net.Conn
+	// sessionInboundLimit is the limit on received bytes buffered waiting
+	// to be read in the whole session (see streamInboundLimit below). It's
+	// accessed atomically. The fields accessed with 64-bit atomic
+	// operations must come first, so that they're 64-bit aligned on 32-bit
+	// platforms.
+	sessionInboundLimit int64
+	// coalesceDelay, recvTimeout and resetTimeout are the session's write
+	// coalescing delay, ReceiveTimeout and ResetStreamTimeout, in
+	// nanoseconds (see SetWriteCoalesceDelay and friends). They're accessed
+	// atomically.
+	coalesceDelay, recvTimeout, resetTimeout int64
+
+	con net.Conn
+	// w is what we write to: the connection, or its IOURing wrapper. vc is
+	// set in the latter case.
+	w         io.Writer
+	vc        vectoredConn
 	buf       *bufio.Reader
 	nextID    uint64
 	initiator bool
 
 	memoryManager MemoryManager
+	pool          BufferPool
+	clock         Clock
+	log           Logger
+	recvChunkSize int
+	// maxMessageSize is the largest frame payload we accept.
+	maxMessageSize int
+	writeTimeout   time.Duration
 
 	closed       chan struct{}
 	shutdown     chan struct{}
 	shutdownErr  error
 	shutdownLock sync.Mutex
-
-	writeCh  chan []byte
-	nstreams chan *Stream
+	// closeErr is the error we closed the session with, if any.
+	closeErr error
+	// writeErr is set if the session died because writing to the
+	// connection failed.
+	writeErr *WriteError
+
+	writeQueue *writeQueue
+	nstreams   chan *Stream
+	// routes holds the patterns registered with AcceptMatching, guarded
+	// by routeLock.
+	routeLock sync.Mutex
+	routes    []acceptRoute
+
+	// bw buffers outbound frames when write coalescing is enabled.
+	bw *bufio.Writer
+	// bufferedSince is when the oldest frame held back by bw was buffered.
+	bufferedSince time.Time
+
+	// batch and vbufs are scratch space for the writer.
+	batch []outFrame
+	vbufs [][]byte
+
+	// loop drives our writes if we're running on an event loop.
+	loop       *EventLoop
+	loopState  int
+	flushTimer Timer
+	// throttled is set while the frames in batch, throttledSize bytes, are
+	// held back by the bandwidth limits until throttledUntil, on an event
+	// loop. They're written out when resumeTimer schedules the session
+	// again, or when the limit changes, closing throttledRate.
+	throttled      bool
+	throttledSize  int
+	throttledUntil time.Time
+	throttledRate  <-chan struct{}
+	resumeTimer    Timer
 
 	channels map[streamID]*Stream
 	chLock   sync.Mutex
 
-	bufIn, bufOut  chan struct{}
-	bufInTimer     *time.Timer
+	// Number of open streams in each direction, and their limits. Guarded
+	// by chLock.
+	inboundStreams, outboundStreams int
+	maxInbound, maxOutbound         int
+
+	counters *counters
+	// id, label and remote identify the session in logs and profiles.
+	// labels are the pprof labels of the session's goroutines.
+	id     uint64
+	label  string
+	remote string
+	labels pprof.LabelSet
+
+	// Limit on received bytes buffered waiting to be read in each stream,
+	// and a signal for handleIncoming that some were consumed.
+	// sessionInboundBytes is the configured session-wide limit.
+	streamInboundLimit  int64
+	sessionInboundBytes int
+	inboundFreed        chan struct{}
+
+	// bufIn and bufOut are the channels of inSlots and outSlots, the
+	// budgets of buffer slots. inPriority and outPriority are the
+	// priorities their memory is reserved with.
+	bufIn, bufOut           chan struct{}
+	inSlots, outSlots       *bufferSlots
+	inPriority, outPriority uint8
+	// ctrlOut is the budget of control frames (closes and resets) waiting
+	// to be written, separate from bufOut so that they don't get stuck
+	// behind data.
+	ctrlOut    chan struct{}
+	bufInTimer Timer
+	// reservedMemory is guarded by shutdownLock once the session runs.
 	reservedMemory int
+
+	sendLimiter, recvLimiter *rateLimiter
+
+	frameObserver   FrameObserver
+	observePayloads bool
+
+	// negotiate is true if we take part in the version handshake. Once
+	// negotiated is closed, remoteVersion holds the peer's version.
+	negotiate     bool
+	negotiated    chan struct{}
+	remoteVersion uint64
+	// capabilities are the extensions we announce, remoteCapabilities
+	// those the peer announced, valid once negotiated is closed.
+	capabilities, remoteCapabilities Capability
+	// remoteEarlyData is the most early data the peer accepts in stream
+	// opens, and remoteMaxMessage the largest frame payload it accepts (zero
+	// if it didn't say). They're also valid once negotiated is closed.
+	remoteEarlyData, remoteMaxMessage uint64
+	// values is the user data attached to the session.
+	values values
+
+	// pings are the channels of the pings waiting for an answer, by ID.
+	// lastPing is the ID of the last ping sent. Both are guarded by
+	// pingLock.
+	pingLock sync.Mutex
+	pings    map[uint64]chan struct{}
+	lastPing uint64
+
+	// goroutines counts the goroutines started with spawn that are still
+	// running. idle, if set, is closed once there are none left. Both are
+	// guarded by goLock.
+	goLock     sync.Mutex
+	goroutines int
+	idle       chan struct{}
+
+	// datagrams holds the datagrams received but not read yet.
+	datagrams chan []byte
+
+	// outboundFreed, if set, is closed once an outbound buffer is freed
+	// (see Writable). It's guarded by readyLock.
+	readyLock     sync.Mutex
+	outboundFreed chan struct{}
+
+	// closeAcks are the channels of the streams waiting for the peer to
+	// acknowledge their close, by stream ID. It's guarded by chLock.
+	closeAcks map[streamID]chan struct{}
+
+	// pendingOpens holds what we were told about the streams the peer is
+	// about to open, by stream ID. It's only used by handleIncoming.
+	pendingOpens map[uint64]*pendingOpen
+
+	// strict enables strict validation. maxRemoteID is the largest ID of
+	// the streams opened by the peer, if remoteOpened. They're only used
+	// by handleIncoming.
+	strict       bool
+	remoteOpened bool
+	maxRemoteID  uint64
+
+	// keepNames keeps the names of the streams the peer opens.
+	keepNames bool
+
+	// draining is set once the session is drained (see Drain), and
+	// peerDraining once the peer told us it's draining. They're accessed
+	// atomically.
+	draining, peerDraining int32
+
+	// maxLifetime and lifetimeGrace are set with WithMaxLifetime.
+	// streamDone, if set, is signaled when a stream is done.
+	maxLifetime, lifetimeGrace time.Duration
+	streamDone                 chan struct{}
+
+	// maxNameLen is the longest name allowed for the streams the peer
+	// opens, or 0 (see WithMaxStreamNameLength).
+	maxNameLen int
+
+	// onSlowReader is set with WithOnSlowReader.
+	onSlowReader SlowReaderFunc
+
+	// manager is the Manager owning the session, if any.
+	manager *Manager
+	// onMisbehavior is set with WithOnMisbehavior.
+	onMisbehavior func(Misbehavior)
+	// halfClosedTimeout and onHalfClosedTimeout are set with
+	// WithHalfClosedTimeout.
+	halfClosedTimeout   time.Duration
+	onHalfClosedTimeout func(*Stream)
+	// streamBucket limits the rate of inbound streams, if set (see
+	// WithInboundStreamRate).
+	streamBucket *streamBucket
+
+	// leakInterval enables leak detection (see WithLeakDetection).
+	// halfClosed holds the streams the peer closed that aren't done yet,
+	// with when the peer closed them, with leak detection or the
+	// half-closed timeout. leaksReported holds the ones logged already.
+	// Both are guarded by leakLock.
+	leakInterval  time.Duration
+	leakLock      sync.Mutex
+	halfClosed    map[*Stream]time.Time
+	leaksReported map[*Stream]bool
+
+	injector frameInjector
 }
 
 // NewMultiplex creates a new multiplexer session.
-func NewMultiplex(con net.Conn, initiator bool, memoryManager MemoryManager) (*Multiplex, error) {
+func NewMultiplex(con net.Conn, initiator bool, memoryManager MemoryManager, opts ...Option) (*Multiplex, error) {
 	if memoryManager == nil {
 		memoryManager = &nullMemoryManager{}
 	}
+	cfg := defaultConfig()
+	for _, opt := range opts {
+		if err := opt(&cfg); err != nil {
+			return nil, err
+		}
+	}
 	mp := &Multiplex{
-		con:           con,
-		initiator:     initiator,
-		channels:      make(map[streamID]*Stream),
-		closed:        make(chan struct{}),
-		shutdown:      make(chan struct{}),
-		nstreams:      make(chan *Stream, 16),
-		memoryManager: memoryManager,
+		con:            con,
+		initiator:      initiator,
+		channels:       make(map[streamID]*Stream),
+		closed:         make(chan struct{}),
+		shutdown:       make(chan struct{}),
+		writeQueue:     newWriteQueue(),
+		nstreams:       make(chan *Stream, cfg.acceptBacklog),
+		memoryManager:  memoryManager,
+		pool:           cfg.bufferPool,
+		clock:          cfg.clock,
+		recvChunkSize:  cfg.recvChunkSize,
+		maxMessageSize: cfg.maxMessageSize,
+		writeTimeout:   cfg.writeTimeout,
+		sendLimiter:    newRateLimiter(cfg.sendRate, cfg.clock),
+		recvLimiter:    newRateLimiter(cfg.recvRate, cfg.clock),
+
+		frameObserver:   cfg.frameObserver,
+		observePayloads: cfg.observePayloads,
+
+		negotiate:    cfg.negotiate,
+		capabilities: cfg.capabilities,
+		strict:       cfg.strict,
+		keepNames:    cfg.keepNames,
+		leakInterval: cfg.leakInterval,
+		injector:     cfg.injector,
+		negotiated:   make(chan struct{}),
+
+		maxLifetime:   cfg.maxLifetime,
+		lifetimeGrace: cfg.lifetimeGrace,
+		maxNameLen:    cfg.maxNameLen,
+		onSlowReader:  cfg.onSlowReader,
+		recvTimeout:   int64(ReceiveTimeout),
+		resetTimeout:  int64(ResetStreamTimeout),
+		manager:       cfg.manager,
+		onMisbehavior: cfg.onMisbehavior,
+
+		halfClosedTimeout:   cfg.halfClosedTimeout,
+		onHalfClosedTimeout: cfg.onHalfClosedTimeout,
+
+		loop: cfg.loop,
+
+		maxInbound:  cfg.maxInboundStreams,
+		maxOutbound: cfg.maxOutboundStreams,
+		counters:    &counters{},
+
+		streamInboundLimit: int64(cfg.streamInboundBytes),
+		inboundFreed:       make(chan struct{}, 1),
 	}
+	mp.identify(cfg.label, cfg.logger)
 
 	// up-front reserve memory for the essential buffers (1 input, 1 output + the reader buffer)
-	if err := mp.memoryManager.ReserveMemory(MinMemoryReservation, 255); err != nil {
+	minReservation := MinMemoryReservation - BufferSize + cfg.readBufferSize + cfg.coalesceThreshold
+	if err := mp.memoryManager.ReserveMemory(minReservation, 255); err != nil {
 		return nil, err
 	}
 
-	mp.reservedMemory += MinMemoryReservation
-	bufs := 1
+	mp.reservedMemory += minReservation
+	inBufs, outBufs := 1, 1
 
-	// reserve some more memory for buffers if possible
-	for i := 1; i < MaxBuffers; i++ {
-		var prio uint8
-		if bufs < 2 {
+	// reserve some more memory for buffers if possible, alternating between
+	// directions until each runs out of slots or memory.
+	reserve := func(bufs *int, max int, prio uint8) bool {
+		if *bufs >= max {
+			return false
+		}
+		if *bufs < 2 {
 			prio = 192
-		} else {
-			prio = 128
 		}
-
-		// 2xBufferSize -- one for input and one for output
-		if err := mp.memoryManager.ReserveMemory(2*BufferSize, prio); err != nil {
-			break
+		if err := mp.memoryManager.ReserveMemory(BufferSize, prio); err != nil {
+			return false
+		}
+		mp.reservedMemory += BufferSize
+		*bufs++
+		return true
+	}
+	for moreIn, moreOut := true, true; moreIn || moreOut; {
+		if moreIn {
+			moreIn = reserve(&inBufs, cfg.inBuffers, cfg.inPriority)
+		}
+		if moreOut {
+			moreOut = reserve(&outBufs, cfg.outBuffers, cfg.outPriority)
 		}
-		mp.reservedMemory += 2 * BufferSize
-		bufs++
 	}
 
-	mp.buf = bufio.NewReaderSize(con, BufferSize)
-	mp.writeCh = make(chan []byte, bufs)
-	mp.bufIn = make(chan struct{}, bufs)
-	mp.bufOut = make(chan struct{}, bufs)
-	mp.bufInTimer = time.NewTimer(0)
+	var rw io.ReadWriter = con
+	if cfg.ring != nil {
+		if vc := cfg.ring.conn(con); vc != nil {
+			rw = vc
+			mp.vc = vc
+		}
+	}
+	mp.w = rw
+	mp.buf = bufio.NewReaderSize(rw, cfg.readBufferSize)
+	if cfg.coalesceThreshold > 0 {
+		mp.bw = bufio.NewWriterSize(rw, cfg.coalesceThreshold)
+		mp.coalesceDelay = int64(cfg.coalesceDelay)
+	}
+	mp.inSlots = newBufferSlots(inBufs, cfg.inBuffers)
+	mp.bufIn = mp.inSlots.c
+	mp.sessionInboundBytes = cfg.sessionInboundBytes
+	mp.sessionInboundLimit = mp.inboundLimit(inBufs)
+	mp.outSlots = newBufferSlots(outBufs, cfg.outBuffers)
+	mp.bufOut = mp.outSlots.c
+	mp.inPriority, mp.outPriority = cfg.inPriority, cfg.outPriority
+	mp.ctrlOut = make(chan struct{}, controlBuffers)
+	mp.datagrams = make(chan []byte, datagramBacklog)
+	mp.bufInTimer = mp.clock.NewTimer(0)
 	if !mp.bufInTimer.Stop() {
-		<-mp.bufInTimer.C
+		<-mp.bufInTimer.Chan()
+	}
+	if cfg.streamRate > 0 {
+		mp.streamBucket = newStreamBucket(cfg.streamRate, cfg.streamBurst, mp.clock.Now())
+	}
+	if mp.maxLifetime > 0 {
+		mp.streamDone = make(chan struct{}, 1)
 	}
 
-	go mp.handleIncoming()
-	go mp.handleOutgoing()
+	if mp.negotiate {
+		// This is the first frame we send, so the peer will know which
+		// extensions we support before it sees any of them.
+		if err := mp.sendHello(); err != nil {
+			mp.memoryManager.ReleaseMemory(mp.reservedMemory)
+			return nil, err
+		}
+	}
+
+	if mp.manager != nil {
+		if err := mp.manager.add(mp); err != nil {
+			mp.memoryManager.ReleaseMemory(mp.reservedMemory)
+			return nil, err
+		}
+	}
+	sessions.add(mp)
+	mp.goLabeled(mp.handleIncoming)
+	if mp.leakInterval > 0 {
+		mp.goLabeled(mp.detectLeaks)
+	}
+	if mp.halfClosedTimeout > 0 {
+		mp.goLabeled(mp.expireHalfClosed)
+	}
+	if mp.maxLifetime > 0 {
+		mp.goLabeled(mp.expire)
+	}
+	if mp.loop == nil {
+		mp.goLabeled(mp.handleOutgoing)
+	}
 
 	return mp, nil
 }
@@ -171,17 +529,20 @@ func (mp *Multiplex) newStream(id streamID, name string) (s *Stream) {
 		mp:          mp,
 		writeCancel: make(chan struct{}),
 		readCancel:  make(chan struct{}),
+		done:        make(chan struct{}),
 	}
 	return
 }
 
-// Accept accepts the next stream from the connection.
+// Accept accepts the next stream from the connection, but those kept for
+// AcceptMatching.
 func (m *Multiplex) Accept() (*Stream, error) {
 	select {
 	case s, ok := <-m.nstreams:
 		if !ok {
 			return nil, errors.New("multiplex closed")
 		}
+		s.captureStack()
 		return s, nil
 	case <-m.closed:
 		return nil, m.shutdownErr
@@ -210,6 +571,18 @@ func (mp *Multiplex) closeNoWait() {
 	mp.shutdownLock.Unlock()
 }
 
+// ShutdownReason returns the error the session was shut down with, or nil if
+// it's still open. If either side closed the session with CloseWithError, a
+// *SessionError is returned.
+func (mp *Multiplex) ShutdownReason() error {
+	select {
+	case <-mp.closed:
+		return mp.shutdownErr
+	default:
+		return nil
+	}
+}
+
 // IsClosed returns true if the session is closed.
 func (mp *Multiplex) IsClosed() bool {
 	select {
@@ -225,30 +598,120 @@ func (mp *Multiplex) CloseChan() <-chan struct{} {
 	return mp.closed
 }
 
+// Conn returns the connection underlying the session. Reading from or writing
+// to it will corrupt the session; it's meant for inspecting the connection and
+// tuning it.
+func (mp *Multiplex) Conn() net.Conn {
+	return mp.con
+}
+
+// SyscallConn gives raw access to the underlying connection, for setting
+// socket options on a live session. It fails with ErrRawConnUnsupported if the
+// connection doesn't implement syscall.Conn.
+func (mp *Multiplex) SyscallConn() (syscall.RawConn, error) {
+	sc, ok := mp.con.(syscall.Conn)
+	if !ok {
+		return nil, ErrRawConnUnsupported
+	}
+	return sc.SyscallConn()
+}
+
 func (mp *Multiplex) sendMsg(timeout, cancel <-chan struct{}, header uint64, data []byte) error {
-	buf, err := mp.getBufferOutbound(len(data)+20, timeout, cancel)
+	return mp.sendMsgContext(nil, timeout, cancel, header, data, nil, false)
+}
+
+// sendMsgContext is like sendMsg, but also gives up with errCanceled once done
+// is closed. If written is non-nil, it's closed once the frame has been
+// written to the connection. With noDelay, the frame isn't held back by write
+// coalescing.
+func (mp *Multiplex) sendMsgContext(done, timeout, cancel <-chan struct{}, header uint64, data []byte, written chan struct{}, noDelay bool) error {
+	buf, err := mp.getBufferOutbound(len(data)+frame.MaxHeaderSize, done, timeout, cancel)
 	if err != nil {
 		return err
 	}
 
-	n := 0
-	n += binary.PutUvarint(buf[n:], header)
-	n += binary.PutUvarint(buf[n:], uint64(len(data)))
+	n := frame.PutHeader(buf, header, len(data))
 	n += copy(buf[n:], data)
 
-	select {
-	case mp.writeCh <- buf[:n]:
-		return nil
-	case <-mp.shutdown:
-		mp.putBufferOutbound(buf)
-		return ErrShutdown
-	case <-timeout:
+	if mp.isShutdown() {
 		mp.putBufferOutbound(buf)
-		return errTimeout
-	case <-cancel:
+		return mp.sendErr()
+	}
+	if isClosedChan(cancel) {
+		// The stream may have been reset while we waited, don't queue
+		// frames behind the reset's back.
 		mp.putBufferOutbound(buf)
 		return ErrStreamClosed
 	}
+
+	// We already hold an outbound buffer slot so queueing never blocks.
+	mp.writeQueue.push(frameStreamID(header), outFrame{data: buf[:n], written: written, noDelay: noDelay})
+	if mp.loop != nil {
+		mp.loop.schedule(mp)
+	}
+	return nil
+}
+
+// sendControlMsg queues a control frame: a close, a reset, or a frame on the
+// control stream. Control frames draw on a small budget of their own, so they
+// can be queued even when data frames have used up the outbound buffers.
+// Resets and control stream frames also skip ahead of the queued data; resets
+// drop the data still queued for the stream, which the peer would discard
+// anyway. Closes stay behind the stream's data.
+func (mp *Multiplex) sendControlMsg(timeout <-chan struct{}, header uint64, data []byte, written chan struct{}) error {
+	select {
+	case mp.ctrlOut <- struct{}{}:
+	case <-timeout:
+		return errTimeout
+	case <-mp.shutdown:
+		return mp.sendErr()
+	}
+
+	buf := mp.getBuffer(len(data) + frame.MaxHeaderSize)
+	n := frame.PutHeader(buf, header, len(data))
+	n += copy(buf[n:], data)
+
+	if mp.isShutdown() {
+		mp.putBuffer(buf, mp.ctrlOut)
+		return mp.sendErr()
+	}
+
+	f := outFrame{data: buf[:n], written: written, control: true}
+	id := frameStreamID(header)
+	switch header {
+	case controlHeader:
+		mp.writeQueue.pushUrgent(f)
+	case id.header(resetTag):
+		mp.dropQueued(id)
+		mp.writeQueue.pushUrgent(f)
+	default:
+		mp.writeQueue.push(id, f)
+	}
+	if mp.loop != nil {
+		mp.loop.schedule(mp)
+	}
+	return nil
+}
+
+// dropQueued drops the frames of the given stream still waiting to be
+// written, once the stream is reset.
+func (mp *Multiplex) dropQueued(id streamID) {
+	for _, dropped := range mp.writeQueue.drop(id) {
+		// Nobody should wait for frames the reset supersedes.
+		if dropped.written != nil {
+			close(dropped.written)
+		}
+		mp.releaseFrame(dropped)
+	}
+}
+
+// releaseFrame returns the buffer of a frame that was written, or dropped.
+func (mp *Multiplex) releaseFrame(f outFrame) {
+	if f.control {
+		mp.putBuffer(f.data, mp.ctrlOut)
+	} else {
+		mp.putBufferOutbound(f.data)
+	}
 }
 
 func (mp *Multiplex) handleOutgoing() {
@@ -258,36 +721,294 @@ func (mp *Multiplex) handleOutgoing() {
 		}
 	}()
 
+	flushTimer := mp.clock.NewTimer(0)
+	defer flushTimer.Stop()
+	if !flushTimer.Stop() {
+		<-flushTimer.Chan()
+	}
+	flushPending := false
+
 	for {
+		if err := mp.writeQueued(); err != nil {
+			// the connection is closed by this time
+			mp.log.Warnw("error writing data", "error", err)
+			return
+		}
+
+		if mp.bw != nil && mp.bw.Buffered() > 0 {
+			delay := mp.writeCoalesceDelay()
+			if delay <= 0 {
+				if err := mp.flush(); err != nil {
+					mp.log.Warnw("error writing data", "error", err)
+					return
+				}
+				continue
+			}
+			if !flushPending {
+				flushTimer.Reset(delay)
+				flushPending = true
+			}
+		}
+
 		select {
 		case <-mp.shutdown:
 			return
-
-		case data := <-mp.writeCh:
-			err := mp.doWriteMsg(data)
-			mp.putBufferOutbound(data)
-			if err != nil {
-				// the connection is closed by this time
-				log.Warnf("error writing data: %s", err.Error())
+		case <-mp.writeQueue.ready:
+		case <-flushTimer.Chan():
+			flushPending = false
+			if err := mp.flush(); err != nil {
+				mp.log.Warnw("error writing data", "error", err)
 				return
 			}
 		}
 	}
 }
 
+// writeQueued writes out all queued frames. Frames that are queued at the
+// same time are written out together.
+func (mp *Multiplex) writeQueued() error {
+	for {
+		batch := mp.batch
+		var err error
+		if !mp.throttled {
+			// Opportunistically pick up everything that's already
+			// queued, so we can write it all at once.
+			batch = batch[:0]
+			for {
+				f, ok := mp.writeQueue.pop()
+				if !ok {
+					break
+				}
+				if mp.injector != nil && !f.injected && !mp.inject(&f) {
+					continue
+				}
+				batch = append(batch, f)
+			}
+			mp.batch = batch
+
+			if len(batch) == 0 {
+				return nil
+			}
+
+			var wait time.Duration
+			wait, err = mp.limitSend(batch)
+			if err == nil && wait > 0 {
+				// On an event loop, come back once the bandwidth limit
+				// lets the batch through rather than holding up the
+				// worker.
+				mp.throttled = true
+				mp.resumeWrites(wait)
+				return nil
+			}
+		} else if mp.clock.Now().Before(mp.throttledUntil) {
+			select {
+			case <-mp.throttledRate:
+				// The limit changed, the batch is up against the new
+				// one.
+				var wait time.Duration
+				wait, mp.throttledRate = mp.sendLimiter.reserve(mp.throttledSize)
+				if wait > 0 {
+					mp.resumeWrites(wait)
+					return nil
+				}
+			default:
+				// Scheduled early for other frames; they'll go out
+				// after the batch held back.
+				return nil
+			}
+		}
+		mp.throttled = false
+
+		urgent := false
+		for _, f := range batch {
+			urgent = urgent || f.written != nil || f.noDelay
+		}
+		if err == nil {
+			err = mp.writeBatch(batch)
+		}
+		if err == nil && urgent && mp.bw != nil {
+			// Somebody is waiting for these, don't hold them back.
+			err = mp.flush()
+		}
+		for i, f := range batch {
+			mp.releaseFrame(f)
+			if f.written != nil && err == nil {
+				close(f.written)
+			}
+			batch[i] = outFrame{}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// limitSend accounts for a batch of frames about to be written against the
+// bandwidth limits. It waits until the batch may be written, or, on an event
+// loop, returns how long the batch must be held back.
+func (mp *Multiplex) limitSend(batch []outFrame) (time.Duration, error) {
+	size := 0
+	for _, f := range batch {
+		for c := 0; c <= f.copies; c++ {
+			size += len(f.data)
+			mp.observeOutbound(f.data)
+		}
+	}
+
+	if mp.loop != nil {
+		wait, changed := mp.sendLimiter.reserve(size)
+		if mp.manager != nil {
+			if w, _ := mp.manager.sendLimiter.reserve(size); w > wait {
+				wait = w
+			}
+		}
+		mp.throttledSize, mp.throttledRate = size, changed
+		return wait, nil
+	}
+
+	if err := mp.sendLimiter.wait(size, mp.shutdown); err != nil {
+		return 0, err
+	}
+	if mp.manager != nil {
+		if err := mp.manager.sendLimiter.wait(size, mp.shutdown); err != nil {
+			return 0, err
+		}
+	}
+	return 0, nil
+}
+
+// writeBatch writes a batch of frames to the connection with a single call to
+// Write.
+func (mp *Multiplex) writeBatch(batch []outFrame) error {
+	if mp.bw != nil {
+		// The buffered writer takes care of flushing once it's full.
+		for _, f := range batch {
+			for c := 0; c <= f.copies; c++ {
+				if err := mp.doWriteMsg(f.data); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	if len(batch) == 1 && batch[0].copies == 0 {
+		return mp.doWriteMsg(batch[0].data)
+	}
+
+	if mp.vc != nil {
+		// No need to copy: the frames go out with a vectored write.
+		bufs := mp.vbufs[:0]
+		for _, f := range batch {
+			for c := 0; c <= f.copies; c++ {
+				bufs = append(bufs, f.data)
+			}
+		}
+		err := mp.doWriteBuffers(bufs)
+		for i := range bufs {
+			bufs[i] = nil
+		}
+		mp.vbufs = bufs
+		return err
+	}
+
+	size := 0
+	for _, f := range batch {
+		size += len(f.data) * (f.copies + 1)
+	}
+	buf := mp.pool.Get(size)
+	defer mp.pool.Put(buf)
+	n := 0
+	for _, f := range batch {
+		for c := 0; c <= f.copies; c++ {
+			n += copy(buf[n:], f.data)
+		}
+	}
+	return mp.doWriteMsg(buf)
+}
+
 func (mp *Multiplex) doWriteMsg(data []byte) error {
 	if mp.isShutdown() {
 		return ErrShutdown
 	}
 
-	_, err := mp.con.Write(data)
+	mp.setWriteDeadline()
+	var err error
+	if mp.bw != nil {
+		if mp.bw.Buffered() == 0 {
+			mp.bufferedSince = mp.clock.Now()
+		}
+		_, err = mp.bw.Write(data)
+	} else {
+		_, err = mp.w.Write(data)
+	}
+	if err != nil {
+		mp.writeFailed(err)
+	}
+
+	return err
+}
+
+// doWriteBuffers is like doWriteMsg, for several buffers written with a single
+// vectored write.
+func (mp *Multiplex) doWriteBuffers(bufs [][]byte) error {
+	if mp.isShutdown() {
+		return ErrShutdown
+	}
+
+	mp.setWriteDeadline()
+	_, err := mp.vc.writeBuffers(bufs)
 	if err != nil {
-		mp.closeNoWait()
+		mp.writeFailed(err)
+	}
+	return err
+}
+
+// flush writes out any frames held back by write coalescing.
+func (mp *Multiplex) flush() error {
+	if mp.isShutdown() {
+		return ErrShutdown
 	}
 
+	mp.setWriteDeadline()
+	err := mp.bw.Flush()
+	if err != nil {
+		mp.writeFailed(err)
+	}
 	return err
 }
 
+// setWriteDeadline bounds the next write to the connection, if a write
+// timeout is configured.
+func (mp *Multiplex) setWriteDeadline() {
+	if mp.writeTimeout > 0 {
+		// Connections that don't support deadlines just won't time out.
+		_ = mp.con.SetWriteDeadline(time.Now().Add(mp.writeTimeout))
+	}
+}
+
+// writeFailed shuts the session down after writing to the connection failed,
+// failing everyone sending data with a *WriteError.
+func (mp *Multiplex) writeFailed(err error) {
+	mp.shutdownLock.Lock()
+	if !mp.isShutdown() {
+		mp.writeErr = &WriteError{Err: err}
+	}
+	mp.shutdownLock.Unlock()
+	mp.closeNoWait()
+}
+
+// sendErr returns the error sending data fails with once the session is shut
+// down.
+func (mp *Multiplex) sendErr() error {
+	mp.shutdownLock.Lock()
+	defer mp.shutdownLock.Unlock()
+	if mp.writeErr != nil {
+		return mp.writeErr
+	}
+	return ErrShutdown
+}
+
 func (mp *Multiplex) nextChanID() uint64 {
 	out := mp.nextID
 	mp.nextID++
@@ -301,6 +1022,27 @@ func (mp *Multiplex) NewStream(ctx context.Context) (*Stream, error) {
 
 // NewNamedStream creates a new named stream.
 func (mp *Multiplex) NewNamedStream(ctx context.Context, name string) (*Stream, error) {
+	return mp.newNamedStream(ctx, name, openOptions{})
+}
+
+// openOptions are the protocol extensions used when opening a stream.
+type openOptions struct {
+	headers map[string]string
+	// early is the early data, if not nil.
+	early []byte
+	// ack requests an acknowledgement from the peer.
+	ack bool
+}
+
+func (mp *Multiplex) newNamedStream(ctx context.Context, name string, opts openOptions) (*Stream, error) {
+	headers := opts.headers
+	if len(headers) > 0 && !mp.supports(CapStreamHeaders) {
+		return nil, ErrHeadersUnsupported
+	}
+	if opts.ack && !mp.supports(CapStreamAcks) {
+		return nil, ErrAcksUnsupported
+	}
+
 	mp.chLock.Lock()
 
 	// We could call IsClosed but this is faster (given that we already have
@@ -310,32 +1052,155 @@ func (mp *Multiplex) NewNamedStream(ctx context.Context, name string) (*Stream,
 		return nil, ErrShutdown
 	}
 
+	if mp.IsDraining() || mp.PeerDraining() {
+		mp.chLock.Unlock()
+		return nil, ErrDraining
+	}
+	if mp.maxOutbound > 0 && mp.outboundStreams >= mp.maxOutbound {
+		mp.chLock.Unlock()
+		return nil, ErrStreamLimitReached
+	}
+	// We never reuse stream IDs: the peer may still be holding on to a
+	// stream we consider gone.
+	if mp.nextID > maxStreamID {
+		mp.chLock.Unlock()
+		return nil, ErrStreamIDsExhausted
+	}
 	sid := mp.nextChanID()
-	header := (sid << 3) | newStreamTag
+	header := frame.PackHeader(sid, newStreamTag)
 
+	var headerMsg []byte
+	if len(headers) > 0 {
+		var err error
+		if headerMsg, err = encodeHeaders(sid, headers); err != nil {
+			mp.chLock.Unlock()
+			return nil, err
+		}
+	}
 	if name == "" {
 		name = fmt.Sprint(sid)
 	}
+	if max := mp.peerMaxMessageSize(); len(name) > max {
+		mp.chLock.Unlock()
+		return nil, ErrMessageTooLarge
+	}
+	if mp.manager != nil && !mp.manager.acquireStreams(mp, 1) {
+		mp.chLock.Unlock()
+		return nil, ErrStreamLimitReached
+	}
+	mp.outboundStreams++
+
 	s := mp.newStream(streamID{
 		id:        sid,
 		initiator: true,
 	}, name)
+	s.headers = headers
+	s.captureStack()
+	if opts.ack {
+		s.acked = make(chan struct{})
+	}
 	mp.channels[s.id] = s
 	mp.chLock.Unlock()
 
-	err := mp.sendMsg(ctx.Done(), nil, header, []byte(name))
+	var err error
+	if headerMsg != nil {
+		// The headers go out first: control frames are written ahead of
+		// data.
+		err = mp.sendControlMsg(ctx.Done(), controlHeader, headerMsg, nil)
+	}
+	if err == nil && opts.ack {
+		err = mp.sendControl(ctx.Done(), ctrlAckReq, appendUvarint(nil, sid), nil)
+	}
+	if err == nil {
+		if opts.early != nil {
+			header = frame.PackHeader(sid, frame.TagExtension)
+			err = mp.sendMsg(ctx.Done(), nil, header, encodeOpen(name, opts.early))
+		} else {
+			err = mp.sendMsg(ctx.Done(), nil, header, []byte(name))
+		}
+	}
 	if err != nil {
+		// The peer never heard of the stream, forget it.
+		s.abandon(ErrStreamReset)
 		if err == errTimeout {
 			return nil, ctx.Err()
 		}
 		return nil, err
 	}
+	atomic.AddUint64(&mp.counters.streamsOpened, 1)
 
 	return s, nil
 }
 
+// inboundRoom returns true if n more received bytes may be buffered for the
+// stream. A stream or session with nothing buffered can always take a buffer,
+// however large.
+func (mp *Multiplex) inboundRoom(s *Stream, n int) bool {
+	if mp.streamInboundLimit > 0 {
+		if buffered := atomic.LoadInt64(&s.inboundBuffered); buffered > 0 && buffered+int64(n) > mp.streamInboundLimit {
+			return false
+		}
+	}
+	buffered := atomic.LoadInt64(&mp.counters.inboundBuffered)
+	return buffered <= 0 || buffered+int64(n) <= atomic.LoadInt64(&mp.sessionInboundLimit)
+}
+
+// inboundLimit returns the limit on received bytes buffered across the
+// session, given the number of inbound buffer slots: we don't buffer more than
+// the inbound share of the memory we got.
+func (mp *Multiplex) inboundLimit(slots int) int64 {
+	limit := int64(slots * BufferSize)
+	if mp.sessionInboundBytes > 0 && int64(mp.sessionInboundBytes) < limit {
+		limit = int64(mp.sessionInboundBytes)
+	}
+	return limit
+}
+
+// accountInbound adjusts the number of received bytes buffered for the
+// stream by n.
+func (mp *Multiplex) accountInbound(s *Stream, n int) {
+	atomic.AddInt64(&s.inboundBuffered, int64(n))
+	atomic.AddInt64(&mp.counters.inboundBuffered, int64(n))
+}
+
+// streamFinished is called once a stream is done in both directions.
+func (mp *Multiplex) streamFinished(s *Stream) {
+	mp.chLock.Lock()
+	if s.id.initiator {
+		mp.outboundStreams--
+	} else {
+		mp.inboundStreams--
+	}
+	mp.chLock.Unlock()
+	mp.untrackHalfClosed(s)
+	if mp.manager != nil {
+		mp.manager.releaseStream(mp)
+	}
+	if !s.id.initiator {
+		mp.releaseName(s.name)
+	}
+	if mp.streamDone != nil {
+		select {
+		case mp.streamDone <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// streamShutdownErr returns the error streams fail with once the session is
+// shut down: why the session was closed, if we know.
+func (mp *Multiplex) streamShutdownErr() error {
+	switch mp.shutdownErr.(type) {
+	case *SessionError, *WriteError:
+		return mp.shutdownErr
+	}
+	return ErrStreamReset
+}
+
 func (mp *Multiplex) cleanup() {
 	mp.closeNoWait()
+	// Writes fail from now on, without blocking.
+	mp.notifyOutboundFreed()
 
 	// Take the channels.
 	mp.chLock.Lock()
@@ -343,16 +1208,30 @@ func (mp *Multiplex) cleanup() {
 	mp.channels = nil
 	mp.chLock.Unlock()
 
+	mp.shutdownLock.Lock()
+	if mp.closeErr != nil {
+		mp.shutdownErr = mp.closeErr
+	} else if mp.writeErr != nil {
+		mp.shutdownErr = mp.writeErr
+	}
+	mp.shutdownLock.Unlock()
+	if mp.shutdownErr == nil {
+		mp.shutdownErr = ErrShutdown
+	}
+
 	// Cancel any reads/writes
+	streamErr := mp.streamShutdownErr()
 	for _, msch := range channels {
-		msch.cancelRead(ErrStreamReset)
-		msch.cancelWrite(ErrStreamReset)
+		msch.cancelRead(streamErr)
+		msch.cancelWrite(streamErr)
 	}
 
-	// And... shutdown!
-	if mp.shutdownErr == nil {
-		mp.shutdownErr = ErrShutdown
+	sessions.remove(mp)
+	if mp.manager != nil {
+		mp.manager.remove(mp)
 	}
+
+	// And... shutdown!
 	close(mp.closed)
 }
 
@@ -365,7 +1244,7 @@ func (mp *Multiplex) handleIncoming() {
 
 	defer mp.cleanup()
 
-	recvTimeout := time.NewTimer(0)
+	recvTimeout := mp.clock.NewTimer(0)
 	defer recvTimeout.Stop()
 	recvTimeoutFired := false
 
@@ -373,11 +1252,15 @@ loop:
 	for {
 		chID, tag, err := mp.readNextHeader()
 		if err != nil {
-			mp.shutdownErr = err
+			mp.shutdownErr = mp.strictReadError(err)
 			return
 		}
 
-		remoteIsInitiator := tag&1 == 0
+		wireTag := tag
+		// Streams are opened with an extension frame when they carry
+		// early data.
+		opening := tag == frame.TagExtension && chID != frame.ControlStreamID && mp.negotiate
+		remoteIsInitiator := tag&1 == 0 || opening
 		ch := streamID{
 			// true if *I'm* the initiator.
 			initiator: !remoteIsInitiator,
@@ -390,13 +1273,31 @@ loop:
 		// 3 -> 4
 		// etc...
 		tag += (tag & 1)
+		if opening {
+			tag = newStreamTag
+		}
 
 		mlen, err := mp.readNextMsgLen()
 		if err != nil {
+			mp.shutdownErr = mp.strictReadError(err)
+			return
+		}
+
+		mp.observeInbound(chID, wireTag, mlen)
+
+		if err := mp.validateFrame(ch, wireTag, mlen); err != nil {
 			mp.shutdownErr = err
 			return
 		}
 
+		if wireTag == frame.TagExtension && chID == frame.ControlStreamID {
+			if err := mp.handleControl(mlen); err != nil {
+				mp.shutdownErr = err
+				return
+			}
+			continue
+		}
+
 		mp.chLock.Lock()
 		msch, ok := mp.channels[ch]
 		mp.chLock.Unlock()
@@ -404,42 +1305,115 @@ loop:
 		switch tag {
 		case newStreamTag:
 			if ok {
-				log.Debugf("received NewStream message for existing stream: %d", ch)
-				mp.shutdownErr = ErrInvalidState
+				mp.shutdownErr = mp.violation(MisbehaviorDuplicateOpen, chID, wireTag, true, "stream opened twice")
 				return
 			}
 
-			// skip stream name, this is not at all useful in the context of libp2p streams
-			if err := mp.skipNextMsg(mlen); err != nil {
+			var (
+				name  string
+				early []byte
+			)
+			if opening {
+				name, early, err = mp.readEarlyData(mlen)
+			} else {
+				name, err = mp.readStreamName(mlen)
+			}
+			var (
+				refusal string
+				flood   bool
+			)
+			switch {
+			case err == errNameTooLong:
+				refusal = err.Error()
+			case err != nil:
+				if err == ErrInvalidState {
+					err = mp.violation(MisbehaviorViolation, chID, wireTag, false, "malformed stream open")
+				}
 				mp.shutdownErr = err
 				return
+			case !mp.reserveName(name):
+				refusal = "no memory for stream name"
+				name = ""
 			}
 
-			msch = mp.newStream(ch, "")
+			pending := mp.takePendingOpen(ch.id)
 			mp.chLock.Lock()
+			switch {
+			case refusal != "":
+				// Already refused.
+			case mp.IsDraining():
+				refusal = "session draining"
+			case mp.maxInbound > 0 && mp.inboundStreams >= mp.maxInbound:
+				refusal = "inbound stream limit reached"
+			case mp.streamBucket != nil && !mp.streamBucket.take(mp.clock.Now()):
+				refusal = "inbound stream rate limit reached"
+				flood = true
+			case mp.manager != nil && !mp.manager.acquireStreams(mp, 1):
+				refusal = "session manager stream limit reached"
+			}
+			if refusal != "" {
+				mp.chLock.Unlock()
+				// Refuse the stream. We don't register it, so we'll
+				// ignore anything else the peer sends on it.
+				atomic.AddUint64(&mp.counters.streamsRefused, 1)
+				mp.log.Debugw("refusing stream: "+refusal, streamFields(ch, "")...)
+				if flood {
+					mp.misbehaved(Misbehavior{Kind: MisbehaviorStreamFlood, StreamID: chID, Tag: wireTag, Reason: refusal})
+				}
+				header := ch.header(resetTag)
+				mp.spawn(func() { mp.sendResetMsg(header, false, refusal) })
+				mp.releaseName(name)
+				if early != nil {
+					mp.putBufferInbound(early)
+				}
+				continue
+			}
+			mp.inboundStreams++
+			msch = mp.newStream(ch, name)
+			msch.headers = pending.headers
 			mp.channels[ch] = msch
 			mp.chLock.Unlock()
+			if pending.ack {
+				payload := appendUvarint(nil, ch.id)
+				mp.spawn(func() { mp.sendControl(nil, ctrlAck, payload, nil) })
+			}
+			if early != nil {
+				// The stream is new, there's room for it.
+				mp.accountInbound(msch, len(early))
+				msch.dataIn <- early
+			}
+			atomic.AddUint64(&mp.counters.streamsAccepted, 1)
 			select {
-			case mp.nstreams <- msch:
+			case mp.acceptQueue(name) <- msch:
 			case <-mp.shutdown:
 				return
 			}
 
 		case resetTag:
-			if err := mp.skipNextMsg(mlen); err != nil {
-				mp.shutdownErr = err
-				return
-			}
-
 			if !ok {
 				// This is *ok*. We forget the stream on reset.
+				if err := mp.skipNextMsg(mlen); err != nil {
+					mp.shutdownErr = err
+					return
+				}
 				continue
 			}
 
+			reason, err := mp.readResetReason(mlen)
+			if err != nil {
+				mp.shutdownErr = err
+				return
+			}
+			resetErr := &ResetError{Reason: reason, Remote: true}
+
 			// Cancel any ongoing reads/writes.
-			msch.cancelRead(ErrStreamReset)
-			msch.cancelWrite(ErrStreamReset)
+			atomic.AddUint64(&mp.counters.streamsReset, 1)
+			msch.cancelRead(resetErr)
+			msch.cancelWrite(resetErr)
 		case closeTag:
+			// Closes asking to be acknowledged carry a payload, that
+			// legacy peers skip.
+			closeAck := mlen > 0 && mp.supports(CapCloseAcks)
 			if err := mp.skipNextMsg(mlen); err != nil {
 				mp.shutdownErr = err
 				return
@@ -456,7 +1430,15 @@ loop:
 			mp.chLock.Unlock()
 
 			// close data channel, there will be no more data.
+			msch.closeAck = closeAck
 			close(msch.dataIn)
+			msch.remoteClosed()
+			msch.notifyReadable()
+			if msch.isPushMode() {
+				msch.pushLock.Lock()
+				msch.pushQueued()
+				msch.pushLock.Unlock()
+			}
 
 			// We intentionally don't cancel any deadlines, cancel reads, cancel
 			// writes, etc. We just deliver the EOF by closing the
@@ -474,12 +1456,24 @@ loop:
 				}
 				continue
 			}
+			if msch.isRecordMode() && mlen > maxRecordSize {
+				// A record is read whole into a single inbound
+				// buffer: larger ones would get around the memory
+				// budget.
+				mp.log.Debugw("record too large", append(msch.logFields(), "length", mlen)...)
+				msch.reset(&ResetError{Reason: "record too large"}, "record too large")
+				if err := mp.skipNextMsg(mlen); err != nil {
+					mp.shutdownErr = err
+					return
+				}
+				continue
+			}
 
 		read:
 			for rd := 0; rd < mlen; {
 				nextChunk := mlen - rd
-				if nextChunk > BufferSize {
-					nextChunk = BufferSize
+				if nextChunk > mp.recvChunkSize && !msch.isRecordMode() {
+					nextChunk = mp.recvChunkSize
 				}
 
 				b, err := mp.readNextChunk(nextChunk)
@@ -490,46 +1484,125 @@ loop:
 
 				rd += nextChunk
 
+				if err := mp.recvLimiter.wait(nextChunk, mp.shutdown); err != nil {
+					mp.putBufferInbound(b)
+					return
+				}
+				if mp.manager != nil {
+					if err := mp.manager.recvLimiter.wait(nextChunk, mp.shutdown); err != nil {
+						mp.putBufferInbound(b)
+						return
+					}
+				}
+
 				if !recvTimeout.Stop() && !recvTimeoutFired {
-					<-recvTimeout.C
+					<-recvTimeout.Chan()
 				}
-				recvTimeout.Reset(ReceiveTimeout)
+				recvTimeout.Reset(mp.receiveTimeout())
 				recvTimeoutFired = false
 
-				select {
-				case msch.dataIn <- b:
+				if msch.isPushMode() && !isClosedChan(msch.readCancel) {
+					if err := msch.push(b); err != nil {
+						if err := mp.skipNextMsg(mlen - rd); err != nil {
+							mp.shutdownErr = err
+							return
+						}
+						continue loop
+					}
+					continue
+				}
+				if msch.isLossy() && !isClosedChan(msch.readCancel) {
+					mp.deliverLossy(msch, b)
+					continue
+				}
 
-				case <-msch.readCancel:
-					// the user has canceled reading. walk away.
-					mp.putBufferInbound(b)
-					if err := mp.skipNextMsg(mlen - rd); err != nil {
-						mp.shutdownErr = err
-						return
+			deliver:
+				for {
+					// Only hand over the buffer if it fits within the
+					// limits on buffered data; otherwise, wait for the
+					// reader to consume some.
+					var dataIn chan []byte
+					if mp.inboundRoom(msch, len(b)) {
+						dataIn = msch.dataIn
+						// Account for it up front, the reader may
+						// release it as soon as it's sent.
+						mp.accountInbound(msch, len(b))
 					}
-					break read
 
-				case <-recvTimeout.C:
-					recvTimeoutFired = true
-					mp.putBufferInbound(b)
-					log.Warnf("timed out receiving message into stream queue.")
-					// Do not do this asynchronously. Otherwise, we
-					// could drop a message, then receive a message,
-					// then reset.
-					msch.Reset()
-					if err := mp.skipNextMsg(mlen - rd); err != nil {
-						mp.shutdownErr = err
+					select {
+					case dataIn <- b:
+						if isClosedChan(msch.readCancel) {
+							// Reading was canceled as we
+							// delivered, make sure the buffer
+							// isn't left behind.
+							msch.drainInbound()
+						}
+						if msch.isPushMode() {
+							// A data handler was set as we
+							// delivered.
+							msch.pushLock.Lock()
+							msch.pushQueued()
+							msch.pushLock.Unlock()
+						}
+						msch.notifyReadable()
+						break deliver
+
+					case <-mp.inboundFreed:
+						// Check the limits again.
+						if dataIn != nil {
+							mp.accountInbound(msch, -len(b))
+						}
+						continue
+
+					case <-msch.readCancel:
+						// the user has canceled reading. walk away.
+						if dataIn != nil {
+							mp.accountInbound(msch, -len(b))
+						}
+						mp.putBufferInbound(b)
+						if err := mp.skipNextMsg(mlen - rd); err != nil {
+							mp.shutdownErr = err
+							return
+						}
+						break read
+
+					case <-recvTimeout.Chan():
+						recvTimeoutFired = true
+						if dataIn != nil {
+							mp.accountInbound(msch, -len(b))
+						}
+						if grace := mp.slowReaderGrace(msch); grace > 0 {
+							recvTimeout.Reset(grace)
+							recvTimeoutFired = false
+							continue
+						}
+						mp.putBufferInbound(b)
+						mp.log.Warnw("timed out receiving message into stream queue", msch.logFields()...)
+						atomic.AddUint64(&mp.counters.recvTimeouts, 1)
+						mp.misbehaved(Misbehavior{Kind: MisbehaviorReceiveTimeout, StreamID: chID, Tag: wireTag, Reason: "stream didn't read its data in time"})
+						// Do not do this asynchronously. Otherwise, we
+						// could drop a message, then receive a message,
+						// then reset.
+						msch.reset(&ResetError{Reason: "receive timeout"}, "receive timeout")
+						if err := mp.skipNextMsg(mlen - rd); err != nil {
+							mp.shutdownErr = err
+							return
+						}
+						continue loop
+
+					case <-mp.shutdown:
+						if dataIn != nil {
+							mp.accountInbound(msch, -len(b))
+						}
+						mp.putBufferInbound(b)
 						return
 					}
-					continue loop
-
-				case <-mp.shutdown:
-					mp.putBufferInbound(b)
-					return
 				}
 			}
 
 		default:
-			log.Debugf("message with unknown header on stream %s", ch)
+			mp.log.Debugw("message with unknown header", "stream", ch.id, "tag", tag)
+			mp.misbehaved(Misbehavior{Kind: MisbehaviorUnknownTag, StreamID: chID, Tag: wireTag, Reason: "unknown tag"})
 			mp.skipNextMsg(mlen)
 			if ok {
 				msch.Reset()
@@ -547,50 +1620,57 @@ func (mp *Multiplex) isShutdown() bool {
 	}
 }
 
-func (mp *Multiplex) sendResetMsg(header uint64, hard bool) {
-	ctx, cancel := context.WithTimeout(context.Background(), ResetStreamTimeout)
+func (mp *Multiplex) sendResetMsg(header uint64, hard bool, reason string) {
+	ctx, cancel := context.WithTimeout(context.Background(), mp.resetStreamTimeout())
 	defer cancel()
 
-	err := mp.sendMsg(ctx.Done(), nil, header, nil)
+	var payload []byte
+	if reason != "" {
+		payload = []byte(reason)
+	}
+	err := mp.sendControlMsg(ctx.Done(), header, payload, nil)
+	if err != nil {
+		// Whether or not the peer hears of the reset, frames that made it
+		// into the queue meanwhile mustn't be sent.
+		mp.dropQueued(frameStreamID(header))
+	}
 	if err != nil && !mp.isShutdown() {
 		if hard {
-			log.Warnf("error sending reset message: %s; killing connection", err.Error())
+			mp.log.Warnw("error sending reset message; killing connection", "stream", header>>3, "tag", header&7, "error", err)
 			mp.Close()
 		} else {
-			log.Debugf("error sending reset message: %s", err.Error())
+			mp.log.Debugw("error sending reset message", "stream", header>>3, "tag", header&7, "error", err)
 		}
 	}
 }
 
-func (mp *Multiplex) readNextHeader() (uint64, uint64, error) {
-	h, err := varint.ReadUvarint(mp.buf)
-	if err != nil {
-		return 0, 0, err
+// readResetReason reads the (optional) reason from the payload of a reset
+// frame.
+func (mp *Multiplex) readResetReason(mlen int) (string, error) {
+	if mlen == 0 {
+		return "", nil
 	}
 
-	// get channel ID
-	ch := h >> 3
-
-	rem := h & 7
-
-	return ch, rem, nil
-}
-
-func (mp *Multiplex) readNextMsgLen() (int, error) {
-	l, err := varint.ReadUvarint(mp.buf)
-	if err != nil {
-		return 0, err
+	n := mlen
+	if n > MaxResetReasonLength {
+		n = MaxResetReasonLength
 	}
-
-	if l > uint64(MaxMessageSize) {
-		return 0, fmt.Errorf("message size too large")
+	reason := make([]byte, n)
+	if _, err := io.ReadFull(mp.buf, reason); err != nil {
+		return "", err
 	}
-
-	if l == 0 {
-		return 0, nil
+	if err := mp.skipNextMsg(mlen - n); err != nil {
+		return "", err
 	}
+	return string(reason), nil
+}
 
-	return int(l), nil
+func (mp *Multiplex) readNextHeader() (uint64, uint64, error) {
+	return frame.ReadHeader(mp.buf)
+}
+
+func (mp *Multiplex) readNextMsgLen() (int, error) {
+	return frame.ReadLength(mp.buf, mp.maxMessageSize)
 }
 
 func (mp *Multiplex) readNextChunk(mlen int) ([]byte, error) {
@@ -608,6 +1688,26 @@ func (mp *Multiplex) readNextChunk(mlen int) ([]byte, error) {
 	return buf, nil
 }
 
+// readStreamName reads the name of a stream the peer opens, if we keep them.
+// It returns errNameTooLong, once the name is skipped, if it's too long.
+func (mp *Multiplex) readStreamName(mlen int) (string, error) {
+	if mp.maxNameLen > 0 && mlen > mp.maxNameLen {
+		if err := mp.skipNextMsg(mlen); err != nil {
+			return "", err
+		}
+		return "", errNameTooLong
+	}
+	if !mp.keepNames || mlen > mp.keptNameLimit() {
+		// skip stream name, this is not at all useful in the context of libp2p streams
+		return "", mp.skipNextMsg(mlen)
+	}
+	name := make([]byte, mlen)
+	if _, err := io.ReadFull(mp.buf, name); err != nil {
+		return "", err
+	}
+	return string(name), nil
+}
+
 func (mp *Multiplex) skipNextMsg(mlen int) error {
 	if mlen == 0 {
 		return nil
@@ -618,17 +1718,25 @@ func (mp *Multiplex) skipNextMsg(mlen int) error {
 }
 
 func (mp *Multiplex) getBufferInbound(length int) ([]byte, error) {
+	select {
+	case mp.bufIn <- struct{}{}:
+		mp.inSlots.taken(false, 0)
+		return mp.getBuffer(length), nil
+	default:
+	}
+
 	timerFired := false
 	defer func() {
 		if !mp.bufInTimer.Stop() && !timerFired {
-			<-mp.bufInTimer.C
+			<-mp.bufInTimer.Chan()
 		}
 	}()
+	start := mp.clock.Now()
 	mp.bufInTimer.Reset(getInputBufferTimeout)
-
 	select {
 	case mp.bufIn <- struct{}{}:
-	case <-mp.bufInTimer.C:
+		mp.inSlots.taken(true, mp.clock.Now().Sub(start))
+	case <-mp.bufInTimer.Chan():
 		timerFired = true
 		return nil, errTimeout
 	case <-mp.shutdown:
@@ -638,22 +1746,33 @@ func (mp *Multiplex) getBufferInbound(length int) ([]byte, error) {
 	return mp.getBuffer(length), nil
 }
 
-func (mp *Multiplex) getBufferOutbound(length int, timeout, cancel <-chan struct{}) ([]byte, error) {
+func (mp *Multiplex) getBufferOutbound(length int, done, timeout, cancel <-chan struct{}) ([]byte, error) {
 	select {
 	case mp.bufOut <- struct{}{}:
+		mp.outSlots.taken(false, 0)
+		return mp.getBuffer(length), nil
+	default:
+	}
+
+	start := mp.clock.Now()
+	select {
+	case mp.bufOut <- struct{}{}:
+		mp.outSlots.taken(true, mp.clock.Now().Sub(start))
+	case <-done:
+		return nil, errCanceled
 	case <-timeout:
 		return nil, errTimeout
 	case <-cancel:
 		return nil, ErrStreamClosed
 	case <-mp.shutdown:
-		return nil, ErrShutdown
+		return nil, mp.sendErr()
 	}
 
 	return mp.getBuffer(length), nil
 }
 
 func (mp *Multiplex) getBuffer(length int) []byte {
-	return pool.Get(length)
+	return mp.pool.Get(length)
 }
 
 func (mp *Multiplex) putBufferInbound(b []byte) {
@@ -662,9 +1781,10 @@ func (mp *Multiplex) putBufferInbound(b []byte) {
 
 func (mp *Multiplex) putBufferOutbound(b []byte) {
 	mp.putBuffer(b, mp.bufOut)
+	mp.notifyOutboundFreed()
 }
 
 func (mp *Multiplex) putBuffer(slice []byte, putBuf chan struct{}) {
 	<-putBuf
-	pool.Put(slice)
+	mp.pool.Put(slice)
 }
@@ -1,16 +1,28 @@
 package multiplex
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math/rand"
 	"net"
 	"os"
+	"reflect"
+	"runtime"
+	"runtime/pprof"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/libp2p/go-mplex/frame"
 )
 
 func TestSlowReader(t *testing.T) {
@@ -808,9 +820,14 @@ func TestResetAfterEOF(t *testing.T) {
 	sb.Reset()
 
 	n, err = sa.Read([]byte{0})
-	if n != 0 || err != ErrStreamReset {
+	if n != 0 || !errors.Is(err, ErrStreamReset) {
 		t.Fatal(err)
 	}
+	// A reset without a reason still tells who reset the stream.
+	var rerr *ResetError
+	if !errors.As(err, &rerr) || !rerr.Remote || rerr.Reason != "" {
+		t.Fatalf("expected a remote reset, got %v", err)
+	}
 }
 
 func TestOpenAfterClose(t *testing.T) {
@@ -884,6 +901,12 @@ func TestDeadline(t *testing.T) {
 	if err != errTimeout {
 		t.Fatal("expected timeout")
 	}
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("expected the timeout to match os.ErrDeadlineExceeded")
+	}
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatal("expected the timeout to be a net.Error")
+	}
 }
 
 func TestReadAfterClose(t *testing.T) {
@@ -1094,3 +1117,4586 @@ func arrComp(a, b []byte) error {
 	}
 	return nil
 }
+
+func TestBandwidthLimit(t *testing.T) {
+	a, b := net.Pipe()
+
+	mpa, err := NewMultiplex(a, false, nil, WithBandwidthLimit(64*1024, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpb, err := NewMultiplex(b, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer mpa.Close()
+	defer mpb.Close()
+
+	msg := make([]byte, 64*1024)
+	rand.Read(msg)
+
+	go func() {
+		s, err := mpb.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer s.Close()
+		io.Copy(ioutil.Discard, s)
+	}()
+
+	s, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	start := time.Now()
+	if _, err := s.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(start); took < 400*time.Millisecond {
+		t.Fatalf("expected write to be throttled, took %s", took)
+	}
+
+	// lifting the limit should let the next write through quickly
+	mpa.SetBandwidthLimit(0, 0)
+	start = time.Now()
+	if _, err := s.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(start); took > 300*time.Millisecond {
+		t.Fatalf("expected unthrottled write, took %s", took)
+	}
+}
+
+func TestBandwidthLimitChange(t *testing.T) {
+	loop := NewEventLoop(1)
+	defer loop.Close()
+
+	for _, tc := range []struct {
+		name string
+		opts []Option
+	}{
+		{"writer", nil},
+		{"event loop", []Option{WithEventLoop(loop)}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			a, b := net.Pipe()
+			mpa, err := NewMultiplex(a, false, nil, append(tc.opts, WithBandwidthLimit(1024, 0))...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mpa.Close()
+			mpb, err := NewMultiplex(b, true, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mpb.Close()
+			const size = 64 * 1024
+			received := make(chan error, 1)
+			go func() {
+				s, err := mpb.Accept()
+				if err != nil {
+					received <- err
+					return
+				}
+				defer s.Close()
+				_, err = io.ReadFull(s, make([]byte, size))
+				received <- err
+			}()
+
+			s, err := mpa.NewStream(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			// At the initial rate, this takes a minute to go through.
+			go s.Write(make([]byte, size))
+			time.Sleep(100 * time.Millisecond)
+
+			// Lifting the limit wakes up the throttled writes.
+			mpa.SetBandwidthLimit(0, 0)
+			select {
+			case err := <-received:
+				if err != nil {
+					t.Fatal(err)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("expected the data to go through once the limit was lifted")
+			}
+		})
+	}
+}
+
+func TestWriteQueueRoundRobin(t *testing.T) {
+	q := newWriteQueue()
+	a := streamID{id: 1, initiator: true}
+	b := streamID{id: 2, initiator: true}
+
+	for i := 0; i < 3; i++ {
+		q.push(a, outFrame{data: []byte{'a', byte('0' + i)}})
+	}
+	q.push(b, outFrame{data: []byte("b0")})
+	q.push(b, outFrame{data: []byte("b1")})
+
+	var got []string
+	for {
+		frame, ok := q.pop()
+		if !ok {
+			break
+		}
+		got = append(got, string(frame.data))
+	}
+
+	expected := []string{"a0", "b0", "a1", "b1", "a2"}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Fatalf("expected frames in order %v, got %v", expected, got)
+	}
+}
+
+func TestChannelDepthOptions(t *testing.T) {
+	a, _ := net.Pipe()
+
+	if _, err := NewMultiplex(a, false, nil, WithMaxBuffers(0)); err == nil {
+		t.Fatal("expected an error for an invalid buffer count")
+	}
+
+	mp, err := NewMultiplex(a, false, nil, WithMaxBuffers(8), WithAcceptBacklog(64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mp.Close()
+
+	if cap(mp.bufIn) != 8 || cap(mp.bufOut) != 8 {
+		t.Fatalf("expected 8 buffer slots, got %d/%d", cap(mp.bufIn), cap(mp.bufOut))
+	}
+	if cap(mp.nstreams) != 64 {
+		t.Fatalf("expected an accept backlog of 64, got %d", cap(mp.nstreams))
+	}
+}
+
+type priorityMemoryManager struct {
+	mu    sync.Mutex
+	prios map[uint8]int
+}
+
+func (m *priorityMemoryManager) ReserveMemory(size int, prio uint8) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.prios[prio]++
+	return nil
+}
+
+func (m *priorityMemoryManager) ReleaseMemory(size int) {}
+
+func TestSeparateBufferBudgets(t *testing.T) {
+	a, _ := net.Pipe()
+
+	mm := &priorityMemoryManager{prios: make(map[uint8]int)}
+	mp, err := NewMultiplex(a, false, mm, WithInboundBuffers(6, 100), WithOutboundBuffers(2, 50))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mp.Close()
+
+	if cap(mp.bufIn) != 6 || cap(mp.bufOut) != 2 {
+		t.Fatalf("expected 6/2 buffer slots, got %d/%d", cap(mp.bufIn), cap(mp.bufOut))
+	}
+	// The second slot in each direction is reserved with a high priority,
+	// the remaining inbound ones with the configured priority.
+	if mm.prios[192] != 2 || mm.prios[100] != 4 || mm.prios[50] != 0 {
+		t.Fatalf("unexpected reservations: %v", mm.prios)
+	}
+}
+
+type frameRecorder struct {
+	mu     sync.Mutex
+	frames []FrameInfo
+}
+
+func (r *frameRecorder) ObserveFrame(f FrameInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f.Payload = append([]byte(nil), f.Payload...)
+	r.frames = append(r.frames, f)
+}
+
+func (r *frameRecorder) find(dir FrameDirection, tag uint64) *FrameInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range r.frames {
+		if r.frames[i].Direction == dir && r.frames[i].Tag == tag {
+			return &r.frames[i]
+		}
+	}
+	return nil
+}
+
+func TestFrameObserver(t *testing.T) {
+	a, b := net.Pipe()
+
+	var ra, rb frameRecorder
+	mpa, err := NewMultiplex(a, true, nil, WithFrameObserver(&ra, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpb, err := NewMultiplex(b, false, nil, WithFrameObserver(&rb, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	defer mpb.Close()
+
+	s, err := mpa.NewNamedStream(context.Background(), "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(sb, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	f := ra.find(FrameOutbound, newStreamTag)
+	if f == nil || string(f.Payload) != "foo" || f.Length != 3 {
+		t.Fatalf("expected outbound new stream frame, got %+v", f)
+	}
+	f = ra.find(FrameOutbound, messageTag)
+	if f == nil || string(f.Payload) != "hello" {
+		t.Fatalf("expected outbound message frame, got %+v", f)
+	}
+	f = rb.find(FrameInbound, messageTag)
+	if f == nil || f.Length != 5 || f.Payload != nil {
+		t.Fatalf("expected inbound message frame without payload, got %+v", f)
+	}
+}
+
+func TestVersionNegotiation(t *testing.T) {
+	for _, legacy := range []bool{false, true} {
+		a, b := net.Pipe()
+
+		mpa, err := NewMultiplex(a, true, nil, WithVersionNegotiation())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var opts []Option
+		if !legacy {
+			opts = append(opts, WithVersionNegotiation())
+		}
+		mpb, err := NewMultiplex(b, false, nil, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Make sure the session still works and the handshake made it through.
+		s, err := mpa.NewStream(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Write([]byte("foo")); err != nil {
+			t.Fatal(err)
+		}
+		sb, err := mpb.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 3)
+		if _, err := io.ReadFull(sb, buf); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := sb.Write([]byte("bar")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(s, buf); err != nil {
+			t.Fatal(err)
+		}
+
+		expected := ProtocolVersion
+		if legacy {
+			expected = 0
+		}
+		if v := mpa.NegotiatedVersion(); v != expected {
+			t.Fatalf("expected version %d, got %d", expected, v)
+		}
+		if v := mpb.NegotiatedVersion(); v != expected {
+			t.Fatalf("expected version %d, got %d", expected, v)
+		}
+
+		mpa.Close()
+		mpb.Close()
+	}
+}
+
+type countingMemoryManager struct {
+	mu       sync.Mutex
+	reserved int
+}
+
+func (m *countingMemoryManager) ReserveMemory(size int, prio uint8) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reserved += size
+	return nil
+}
+
+func (m *countingMemoryManager) ReleaseMemory(size int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reserved -= size
+}
+
+func TestReadBufferSize(t *testing.T) {
+	a, b := net.Pipe()
+
+	if _, err := NewMultiplex(a, false, nil, WithReadBufferSize(16)); err == nil {
+		t.Fatal("expected an error for a tiny read buffer")
+	}
+
+	var mm countingMemoryManager
+	mpa, err := NewMultiplex(a, false, &mm, WithReadBufferSize(64*1024), WithMaxBuffers(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpb, err := NewMultiplex(b, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpb.Close()
+
+	if mpa.buf.Size() != 64*1024 {
+		t.Fatalf("expected a 64KiB read buffer, got %d", mpa.buf.Size())
+	}
+	if expected := 2*BufferSize + 64*1024; mm.reserved != expected {
+		t.Fatalf("expected %d bytes to be reserved, got %d", expected, mm.reserved)
+	}
+
+	mpa.Close()
+	if mm.reserved != 0 {
+		t.Fatalf("expected all memory to be released, %d bytes still reserved", mm.reserved)
+	}
+}
+
+type countingConn struct {
+	net.Conn
+
+	mu     sync.Mutex
+	writes int
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	c.writes++
+	c.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+func TestWriteBatching(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+
+	conn := &countingConn{Conn: a}
+	mp, err := NewMultiplex(conn, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mp.Close()
+
+	s, err := mp.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nobody is reading from the pipe yet, so the frames pile up behind the
+	// new stream frame.
+	const msgs = 4
+	for i := 0; i < msgs; i++ {
+		go s.Write([]byte("hello"))
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// 3 bytes for the new stream frame, 7 for each message.
+	buf := make([]byte, 3+msgs*7)
+	if _, err := io.ReadFull(b, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.mu.Lock()
+	writes := conn.writes
+	conn.mu.Unlock()
+	if writes >= 1+msgs {
+		t.Fatalf("expected queued frames to be batched, got %d writes", writes)
+	}
+}
+
+func TestWriteCoalescing(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+
+	conn := &countingConn{Conn: a}
+	mp, err := NewMultiplex(conn, true, nil, WithWriteCoalescing(50*time.Millisecond, 4096))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mp.Close()
+
+	const msgs = 10
+	done := make(chan error, 1)
+	go func() {
+		// 3 bytes for the new stream frame, 7 for each message.
+		buf := make([]byte, 3+msgs*7)
+		_, err := io.ReadFull(b, buf)
+		done <- err
+	}()
+
+	s, err := mp.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < msgs; i++ {
+		if _, err := s.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the coalesced frames")
+	}
+
+	conn.mu.Lock()
+	writes := conn.writes
+	conn.mu.Unlock()
+	if writes > 2 {
+		t.Fatalf("expected frames to be coalesced, got %d writes", writes)
+	}
+}
+
+func TestEventLoop(t *testing.T) {
+	loop := NewEventLoop(2)
+	defer loop.Close()
+
+	const pairs = 20
+	before := runtime.NumGoroutine()
+
+	var sessions []*Multiplex
+	for i := 0; i < pairs; i++ {
+		a, b := net.Pipe()
+		mpa, err := NewMultiplex(a, true, nil, WithEventLoop(loop))
+		if err != nil {
+			t.Fatal(err)
+		}
+		mpb, err := NewMultiplex(b, false, nil, WithEventLoop(loop), WithWriteCoalescing(time.Millisecond, 4096))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sessions = append(sessions, mpa, mpb)
+
+		go func() {
+			s, err := mpb.Accept()
+			if err != nil {
+				return
+			}
+			defer s.Close()
+			io.Copy(s, s)
+		}()
+	}
+	defer func() {
+		for _, mp := range sessions {
+			mp.Close()
+		}
+	}()
+
+	// One reader per session, one echo goroutine per pair.
+	if n := runtime.NumGoroutine() - before; n > 3*pairs {
+		t.Fatalf("expected no writer goroutines, got %d goroutines for %d sessions", n, 2*pairs)
+	}
+
+	errs := make(chan error, pairs)
+	for i := 0; i < pairs; i++ {
+		go func(mp *Multiplex) {
+			s, err := mp.NewStream(context.Background())
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer s.Close()
+
+			msg := make([]byte, 20000)
+			rand.Read(msg)
+			go s.Write(msg)
+
+			buf := make([]byte, len(msg))
+			if _, err := io.ReadFull(s, buf); err != nil {
+				errs <- err
+				return
+			}
+			errs <- arrComp(buf, msg)
+		}(sessions[2*i])
+	}
+	for i := 0; i < pairs; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestEventLoopBandwidthLimit(t *testing.T) {
+	// A single worker, shared by a throttled session and another one.
+	loop := NewEventLoop(1)
+	defer loop.Close()
+
+	pair := func(opts ...Option) *Multiplex {
+		a, b := net.Pipe()
+		mpa, err := NewMultiplex(a, true, nil, append(opts, WithEventLoop(loop))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mpb, err := NewMultiplex(b, false, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			mpa.Close()
+			mpb.Close()
+		})
+		go func() {
+			s, err := mpb.Accept()
+			if err != nil {
+				return
+			}
+			defer s.Close()
+			io.Copy(ioutil.Discard, s)
+		}()
+		return mpa
+	}
+	slow := pair(WithBandwidthLimit(64*1024, 0))
+	fast := pair()
+
+	s, err := slow.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Reset()
+	slowDone := make(chan error, 1)
+	go func() {
+		_, err := s.Write(make([]byte, 256*1024))
+		slowDone <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// The throttled session doesn't hold up the worker.
+	start := time.Now()
+	fs, err := fast.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	if _, err := fs.Write(make([]byte, 64*1024)); err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(start); took > 500*time.Millisecond {
+		t.Fatalf("expected the other session's write to go through, took %s", took)
+	}
+	select {
+	case err := <-slowDone:
+		t.Fatalf("expected the throttled write to still be blocked, got %v", err)
+	default:
+	}
+
+	select {
+	case err := <-slowDone:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("expected the throttled write to complete")
+	}
+}
+
+func TestWriteContext(t *testing.T) {
+	a, b := net.Pipe()
+
+	mpa, err := NewMultiplex(a, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpb, err := NewMultiplex(b, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	defer mpb.Close()
+
+	s, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sb.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if n, err := s.WriteContext(ctx, []byte("foo")); err != context.Canceled || n != 0 {
+		t.Fatalf("expected a canceled write, got %d, %v", n, err)
+	}
+
+	// Nobody reads on the other side, so we eventually block.
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	msg := make([]byte, 1<<20)
+	n, err := s.WriteContext(ctx, msg)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected the write to time out, got %v", err)
+	}
+	if n == 0 || n >= len(msg) || n%ChunkSize != 0 {
+		t.Fatalf("expected a partial write of whole chunks, got %d bytes", n)
+	}
+}
+
+func TestReadContext(t *testing.T) {
+	a, b := net.Pipe()
+
+	mpa, err := NewMultiplex(a, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpb, err := NewMultiplex(b, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	defer mpb.Close()
+
+	s, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sb.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	buf := make([]byte, 10)
+	if _, err := sb.ReadContext(ctx, buf); err != context.DeadlineExceeded {
+		t.Fatalf("expected the read to time out, got %v", err)
+	}
+
+	// The stream is still usable afterwards.
+	if _, err := s.Write([]byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+	n, err := sb.ReadContext(context.Background(), buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "foo" {
+		t.Fatalf("expected foo, got %q", buf[:n])
+	}
+}
+
+func TestCloseWithError(t *testing.T) {
+	a, b := net.Pipe()
+
+	mpa, err := NewMultiplex(a, true, nil, WithVersionNegotiation())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpb, err := NewMultiplex(b, false, nil, WithVersionNegotiation())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpb.Close()
+
+	// Make sure the handshake went through.
+	s, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write([]byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(sb, make([]byte, 3)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sb.Write([]byte("bar")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(s, make([]byte, 3)); err != nil {
+		t.Fatal(err)
+	}
+
+	if mpa.ShutdownReason() != nil {
+		t.Fatal("expected no shutdown reason for an open session")
+	}
+	if err := mpa.CloseWithError(42, "going away"); err != nil {
+		t.Fatal(err)
+	}
+
+	var serr *SessionError
+	if !errors.As(mpa.ShutdownReason(), &serr) || serr.Remote || serr.Code != 42 {
+		t.Fatalf("expected a local session error, got %v", mpa.ShutdownReason())
+	}
+
+	_, err = mpb.Accept()
+	if !errors.As(err, &serr) || !serr.Remote || serr.Code != 42 || serr.Message != "going away" {
+		t.Fatalf("expected a remote session error from Accept, got %v", err)
+	}
+	if _, err := sb.Read(make([]byte, 1)); !errors.As(err, &serr) || !errors.Is(err, ErrStreamReset) {
+		t.Fatalf("expected a remote session error from Read, got %v", err)
+	}
+	if !errors.As(mpb.ShutdownReason(), &serr) || !serr.Remote {
+		t.Fatalf("expected a remote shutdown reason, got %v", mpb.ShutdownReason())
+	}
+}
+
+func TestResetWithReason(t *testing.T) {
+	a, b := net.Pipe()
+
+	mpa, err := NewMultiplex(a, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpb, err := NewMultiplex(b, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	defer mpb.Close()
+
+	s, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.ResetWithReason("not interested"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Read(make([]byte, 1)); err != ErrStreamReset {
+		t.Fatalf("expected a plain stream reset locally, got %v", err)
+	}
+
+	_, err = sb.Read(make([]byte, 1))
+	var rerr *ResetError
+	if !errors.As(err, &rerr) || rerr.Reason != "not interested" {
+		t.Fatalf("expected a reset error with the reason, got %v", err)
+	}
+	if !errors.Is(err, ErrStreamReset) {
+		t.Fatal("expected the reset error to match ErrStreamReset")
+	}
+}
+
+func TestStreamLimits(t *testing.T) {
+	a, b := net.Pipe()
+
+	mpa, err := NewMultiplex(a, false, nil, WithStreamLimits(1, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpb, err := NewMultiplex(b, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	defer mpb.Close()
+
+	s1, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb1, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mpa.NewStream(context.Background()); err != ErrStreamLimitReached {
+		t.Fatalf("expected ErrStreamLimitReached, got %v", err)
+	}
+
+	t1, err := mpb.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer t1.Reset()
+	if _, err := mpa.Accept(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second inbound stream is over mpa's limit.
+	t2, err := mpb.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := t2.Read(make([]byte, 1)); !errors.Is(err, ErrStreamReset) {
+		t.Fatalf("expected the stream to be reset, got %v", err)
+	}
+	if n := mpa.RefusedStreams(); n != 1 {
+		t.Fatalf("expected 1 refused stream, got %d", n)
+	}
+
+	// Half-closing the outbound stream isn't enough to free up its slot.
+	s1.CloseWrite()
+	if _, err := sb1.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+	if _, err := mpa.NewStream(context.Background()); err != ErrStreamLimitReached {
+		t.Fatalf("expected ErrStreamLimitReached, got %v", err)
+	}
+	sb1.Close()
+	if _, err := s1.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+
+	s2, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Reset()
+}
+
+func TestInboundBufferLimits(t *testing.T) {
+	a, b := net.Pipe()
+
+	mpa, err := NewMultiplex(a, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpb, err := NewMultiplex(b, true, nil, WithInboundBufferLimits(100, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	defer mpb.Close()
+
+	s, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Reset()
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sb.Reset()
+
+	msg := make([]byte, 80)
+	rand.Read(msg)
+	go func() {
+		for i := 0; i < 3; i++ {
+			s.Write(msg)
+		}
+	}()
+
+	// Hold on to part of the first message; the second one doesn't fit.
+	buf := make([]byte, 3*len(msg))
+	if _, err := io.ReadFull(sb, buf[:1]); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt64(&sb.inboundBuffered); n != int64(len(msg)) {
+		t.Fatalf("expected %d bytes buffered, got %d", len(msg), n)
+	}
+
+	if _, err := io.ReadFull(sb, buf[1:]); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if !bytes.Equal(buf[i*len(msg):(i+1)*len(msg)], msg) {
+			t.Fatal("got wrong data")
+		}
+	}
+	if n := atomic.LoadInt64(&mpb.counters.inboundBuffered); n != 0 {
+		t.Fatalf("expected nothing buffered, got %d bytes", n)
+	}
+}
+
+type countingPool struct {
+	gets, puts int64
+	largest    int64
+}
+
+func (p *countingPool) Get(length int) []byte {
+	atomic.AddInt64(&p.gets, 1)
+	for {
+		largest := atomic.LoadInt64(&p.largest)
+		if int64(length) <= largest || atomic.CompareAndSwapInt64(&p.largest, largest, int64(length)) {
+			break
+		}
+	}
+	return NoBufferPool.Get(length)
+}
+
+func (p *countingPool) Put(buf []byte) {
+	atomic.AddInt64(&p.puts, 1)
+	NoBufferPool.Put(buf)
+}
+
+func TestBufferPool(t *testing.T) {
+	a, b := net.Pipe()
+
+	if _, err := NewMultiplex(a, false, nil, WithBufferPool(nil)); err == nil {
+		t.Fatal("expected an error for a nil pool")
+	}
+
+	var pa, pb countingPool
+	mpa, err := NewMultiplex(a, false, nil, WithBufferPool(&pa))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpb, err := NewMultiplex(b, true, nil, WithBufferPool(&pb))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	defer mpb.Close()
+
+	s, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := make([]byte, 3*BufferSize)
+	rand.Read(msg)
+	go func() {
+		s.Write(msg)
+		s.CloseWrite()
+	}()
+	// Buffers are scribbled over as soon as they're returned, so this fails
+	// if we return a buffer that's still in use.
+	out, err := ioutil.ReadAll(sb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, msg) {
+		t.Fatal("got wrong data")
+	}
+
+	if atomic.LoadInt64(&pa.gets) == 0 || atomic.LoadInt64(&pb.gets) == 0 {
+		t.Fatal("expected the sessions to use the buffer pools")
+	}
+	if gets, puts := atomic.LoadInt64(&pb.gets), atomic.LoadInt64(&pb.puts); gets != puts {
+		t.Fatalf("expected all inbound buffers to be returned, got %d gets and %d puts", gets, puts)
+	}
+}
+
+func TestReceiveChunkSize(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+
+	if _, err := NewMultiplex(b, true, nil, WithReceiveChunkSize(BufferSize+1)); err == nil {
+		t.Fatal("expected an error for an oversized chunk size")
+	}
+
+	var p countingPool
+	mp, err := NewMultiplex(b, true, nil, WithReceiveChunkSize(1024), WithBufferPool(&p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mp.Close()
+
+	// Send a single large message, like some other implementations do.
+	msg := make([]byte, 256*1024)
+	rand.Read(msg)
+	go func() {
+		a.Write(frame.Encode(nil, frame.Frame{StreamID: 0, Tag: frame.TagNewStream}))
+		a.Write(frame.Encode(nil, frame.Frame{StreamID: 0, Tag: frame.TagMessageInitiator, Payload: msg}))
+		a.Write(frame.Encode(nil, frame.Frame{StreamID: 0, Tag: frame.TagCloseInitiator}))
+	}()
+
+	s, err := mp.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadAll(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, msg) {
+		t.Fatal("got wrong data")
+	}
+	if largest := atomic.LoadInt64(&p.largest); largest > 1024 {
+		t.Fatalf("expected buffers of at most 1024 bytes, got %d", largest)
+	}
+}
+
+func TestStat(t *testing.T) {
+	a, b := net.Pipe()
+
+	mpa, err := NewMultiplex(a, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpb, err := NewMultiplex(b, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	defer mpb.Close()
+
+	s, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(sb, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	s.Reset()
+	if _, err := sb.Read(make([]byte, 1)); !errors.Is(err, ErrStreamReset) {
+		t.Fatalf("expected a stream reset, got %v", err)
+	}
+
+	sa, sbs := mpa.Stat(), mpb.Stat()
+	if sa.StreamsOpened != 1 || sbs.StreamsAccepted != 1 {
+		t.Fatalf("expected 1 stream opened and accepted, got %d/%d", sa.StreamsOpened, sbs.StreamsAccepted)
+	}
+	if sa.StreamsReset != 1 || sbs.StreamsReset != 1 {
+		t.Fatalf("expected 1 stream reset on each side, got %d/%d", sa.StreamsReset, sbs.StreamsReset)
+	}
+	for _, tag := range []uint64{frame.TagNewStream, frame.TagMessageInitiator, frame.TagResetInitiator} {
+		if sa.FramesOut[tag] != 1 || sbs.FramesIn[tag] != 1 {
+			t.Fatalf("expected 1 frame with tag %d each way, got %d/%d", tag, sa.FramesOut[tag], sbs.FramesIn[tag])
+		}
+	}
+	if sa.BytesOut[frame.TagMessageInitiator] != 5 || sbs.BytesIn[frame.TagMessageInitiator] != 5 {
+		t.Fatal("expected 5 message bytes each way")
+	}
+	// The message goes in the 4-7 bytes bucket.
+	if b := FrameSizeBucket(5); b != 3 || sa.FrameSizesOut[b] != 1 || sbs.FrameSizesIn[b] != 1 {
+		t.Fatalf("expected the message to be counted in bucket 3, got %v/%v", sa.FrameSizesOut, sbs.FrameSizesIn)
+	}
+	if FrameSizeBucket(0) != 0 || FrameSizeBucket(MaxMessageSize) != FrameSizeBuckets-1 {
+		t.Fatal("wrong bucket bounds")
+	}
+	if sa.ReservedMemory == 0 {
+		t.Fatal("expected some reserved memory")
+	}
+}
+
+func TestPublishExpvars(t *testing.T) {
+	if expvar.Get("mplex_test.sessions") == nil {
+		PublishExpvars("mplex_test")
+	}
+
+	a, b := net.Pipe()
+	mpa, err := NewMultiplex(a, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpb, err := NewMultiplex(b, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpb.Close()
+
+	if _, err := mpa.NewStream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	live := func() map[string]Stats {
+		var live map[string]Stats
+		if err := json.Unmarshal([]byte(expvar.Get("mplex_test.live").String()), &live); err != nil {
+			t.Fatal(err)
+		}
+		return live
+	}
+	if _, ok := live()[mpa.String()]; !ok {
+		t.Fatalf("expected %s to be published", mpa)
+	}
+	var open int
+	if err := json.Unmarshal([]byte(expvar.Get("mplex_test.sessions").String()), &open); err != nil {
+		t.Fatal(err)
+	}
+	if open < 2 {
+		t.Fatalf("expected at least two open sessions, got %d", open)
+	}
+
+	mpa.Close()
+	if _, ok := live()[mpa.String()]; ok {
+		t.Fatalf("expected %s to be gone", mpa)
+	}
+
+	// Closed sessions still count.
+	var st Stats
+	if err := json.Unmarshal([]byte(expvar.Get("mplex_test.stats").String()), &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.StreamsOpened < 1 {
+		t.Fatalf("expected at least one stream opened, got %d", st.StreamsOpened)
+	}
+}
+
+func TestSessionRegistryOptIn(t *testing.T) {
+	r := sessionRegistry{live: make(map[*Multiplex]struct{})}
+	a, b := net.Pipe()
+	defer b.Close()
+	mp, err := NewMultiplex(a, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mp.Close()
+
+	// Sessions aren't tracked until statistics are published.
+	r.add(mp)
+	if n, _ := r.stats(); n != 0 {
+		t.Fatalf("expected no tracked sessions, got %d", n)
+	}
+	r.enable()
+	r.add(mp)
+	if n, _ := r.stats(); n != 1 {
+		t.Fatalf("expected 1 tracked session, got %d", n)
+	}
+}
+
+func TestAggregateStatsStable(t *testing.T) {
+	r := sessionRegistry{enabled: true, live: make(map[*Multiplex]struct{})}
+	r.retired.Protocols = map[string]ProtocolStats{"/echo": {Streams: 1}}
+
+	a, b := net.Pipe()
+	mpa, err := NewMultiplex(a, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	mpb, err := NewMultiplex(b, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpb.Close()
+	r.add(mpa)
+
+	s, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetProtocol("/echo"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reading the stats doesn't change them.
+	for i := 0; i < 2; i++ {
+		_, st := r.stats()
+		if n := st.Protocols["/echo"].Streams; n != 2 {
+			t.Fatalf("read %d: expected 2 streams, got %d", i, n)
+		}
+	}
+	if n := r.retired.Protocols["/echo"].Streams; n != 1 {
+		t.Fatalf("expected the retired stats to be left alone, got %d streams", n)
+	}
+}
+
+func TestSessionIdentity(t *testing.T) {
+	a, b := net.Pipe()
+	mpa, err := NewMultiplex(a, true, nil, WithLabel("client"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	mpb, err := NewMultiplex(b, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpb.Close()
+
+	if !mpa.IsInitiator() || mpb.IsInitiator() {
+		t.Fatal("wrong roles")
+	}
+	if mpa.Label() != "client" || mpb.Label() != "" {
+		t.Fatalf("wrong labels: %q, %q", mpa.Label(), mpb.Label())
+	}
+	if mpa.ID() == mpb.ID() {
+		t.Fatal("expected sessions to have distinct IDs")
+	}
+	if s := mpa.String(); s != fmt.Sprintf("mplex session %d \"client\" (initiator) with pipe", mpa.ID()) {
+		t.Fatalf("unexpected description: %s", s)
+	}
+	if s := mpb.String(); s != fmt.Sprintf("mplex session %d (responder) with pipe", mpb.ID()) {
+		t.Fatalf("unexpected description: %s", s)
+	}
+}
+
+func TestPprofLabels(t *testing.T) {
+	a, b := net.Pipe()
+
+	mpa, err := NewMultiplex(a, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpb, err := NewMultiplex(b, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	defer mpb.Close()
+
+	var buf bytes.Buffer
+	if err := pprof.Lookup("goroutine").WriteTo(&buf, 1); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `"mplex.session":`) {
+		t.Fatal("expected the session goroutines to be labeled")
+	}
+}
+
+type recordingLogger struct {
+	mu   sync.Mutex
+	logs [][]interface{}
+}
+
+func (l *recordingLogger) Debugw(msg string, keysAndValues ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.logs = append(l.logs, append([]interface{}{msg}, keysAndValues...))
+}
+
+func (l *recordingLogger) Warnw(msg string, keysAndValues ...interface{}) {
+	l.Debugw(msg, keysAndValues...)
+}
+
+func TestLogger(t *testing.T) {
+	a, b := net.Pipe()
+
+	var logger recordingLogger
+	mpa, err := NewMultiplex(a, false, nil, WithLogger(&logger), WithStreamLimits(1, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpb, err := NewMultiplex(b, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	defer mpb.Close()
+
+	for i := 0; i < 2; i++ {
+		if _, err := mpb.NewStream(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := mpa.Accept(); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	var entry []interface{}
+	for entry == nil {
+		logger.mu.Lock()
+		if len(logger.logs) > 0 {
+			entry = logger.logs[0]
+		}
+		logger.mu.Unlock()
+		if time.Now().After(deadline) {
+			t.Fatal("expected the session to log through the logger")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The message comes with the session's and the stream's fields.
+	fields := make(map[interface{}]interface{})
+	for i := 1; i+1 < len(entry); i += 2 {
+		fields[entry[i]] = entry[i+1]
+	}
+	if fields["session"] != mpa.id || fields["remote"] != a.RemoteAddr().String() {
+		t.Fatalf("expected the session's fields, got %v", entry)
+	}
+	if fields["stream"] != uint64(1) {
+		t.Fatalf("expected the stream's fields, got %v", entry)
+	}
+}
+
+func TestResetOrigin(t *testing.T) {
+	oldTimeout := ReceiveTimeout
+	ReceiveTimeout = 50 * time.Millisecond
+	defer func() { ReceiveTimeout = oldTimeout }()
+
+	a, b := net.Pipe()
+
+	mpa, err := NewMultiplex(a, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpb, err := NewMultiplex(b, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	defer mpb.Close()
+
+	s, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Don't read on sb, so that mpb resets the stream.
+	for i := 0; i < 3; i++ {
+		if _, err := s.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = s.Read(make([]byte, 1))
+	var rerr *ResetError
+	if !errors.As(err, &rerr) || !rerr.Remote || rerr.Reason != "receive timeout" {
+		t.Fatalf("expected a remote reset, got %v", err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if _, err := sb.Write([]byte("hello")); !errors.As(err, &rerr) || rerr.Remote {
+		t.Fatalf("expected a local reset, got %v", err)
+	}
+}
+
+func TestStreamIDExhaustion(t *testing.T) {
+	a, b := net.Pipe()
+
+	mpa, err := NewMultiplex(a, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpb, err := NewMultiplex(b, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	defer mpb.Close()
+
+	mpa.chLock.Lock()
+	mpa.nextID = maxStreamID
+	mpa.chLock.Unlock()
+
+	s, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Reset()
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sb.Reset()
+	if _, err := s.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(sb, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := mpa.NewStream(context.Background()); err != ErrStreamIDsExhausted {
+		t.Fatalf("expected ErrStreamIDsExhausted, got %v", err)
+	}
+}
+
+func TestConn(t *testing.T) {
+	a, _ := net.Pipe()
+	mp, err := NewMultiplex(a, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mp.Close()
+	if mp.Conn() != a {
+		t.Fatal("expected the session's connection")
+	}
+	if _, err := mp.SyscallConn(); err != ErrRawConnUnsupported {
+		t.Fatalf("expected ErrRawConnUnsupported, got %v", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			defer c.Close()
+			io.Copy(ioutil.Discard, c)
+		}
+	}()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpt, err := NewMultiplex(c, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpt.Close()
+	rc, err := mpt.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rc.Control(func(fd uintptr) {}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStreamCloseChan(t *testing.T) {
+	a, b := net.Pipe()
+
+	mpa, err := NewMultiplex(a, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpb, err := NewMultiplex(b, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	defer mpb.Close()
+
+	waitDone := func(s *Stream) {
+		t.Helper()
+		select {
+		case <-s.CloseChan():
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the stream to be done")
+		}
+	}
+
+	// Closed on both sides.
+	s, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := s.Context()
+	s.CloseWrite()
+	select {
+	case <-s.CloseChan():
+		t.Fatal("stream done before the peer closed it")
+	case <-time.After(50 * time.Millisecond):
+	}
+	sb.Close()
+	waitDone(s)
+	if err := ctx.Err(); !errors.Is(err, context.Canceled) || !errors.Is(err, ErrStreamClosed) {
+		t.Fatalf("expected a closed stream, got %v", err)
+	}
+
+	// Reset by the peer.
+	s, err = mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err = mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb.Reset()
+	waitDone(s)
+	if err := s.Context().Err(); !errors.Is(err, ErrStreamReset) {
+		t.Fatalf("expected a reset stream, got %v", err)
+	}
+
+	// Session closed while we're only writing.
+	s, err = mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.CloseRead()
+	if s.Context().Err() != nil {
+		t.Fatal("stream done too early")
+	}
+	mpa.Close()
+	waitDone(s)
+	if _, err := s.Write([]byte("x")); err == nil {
+		t.Fatal("expected the write to fail")
+	}
+}
+
+func TestStreamLinger(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+
+	mp, err := NewMultiplex(a, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mp.Close()
+
+	// Nobody reads from the connection, so closing can't complete.
+	s, err := mp.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	s.SetLinger(50 * time.Millisecond)
+	err = s.CloseWrite()
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+
+	go io.Copy(ioutil.Discard, b)
+
+	s, err = mp.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	s.SetLinger(-1)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := mp.Stat().WriteQueueDepth; n != 0 {
+		t.Fatalf("expected the data to be sent, %d frames still queued", n)
+	}
+}
+
+func TestControlFramesBypassData(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+
+	mp, err := NewMultiplex(a, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mp.Close()
+
+	closing, err := mp.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bulk, err := mp.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nobody reads from the connection, so this uses up the outbound
+	// buffers.
+	go func() {
+		buf := make([]byte, ChunkSize)
+		for {
+			if _, err := bulk.Write(buf); err != nil {
+				return
+			}
+		}
+	}()
+	for mp.Stat().WriteQueueDepth < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	closed := make(chan error, 1)
+	go func() { closed <- closing.CloseWrite() }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("close got stuck behind data")
+	}
+
+	// The reset drops the queued data, and skips ahead of whatever is
+	// still queued: the close.
+	bulk.Reset()
+	deadline := time.Now().Add(5 * time.Second)
+	for mp.Stat().WriteQueueDepth > 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the reset to drop the queued data, %d frames still queued", mp.Stat().WriteQueueDepth)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	fr := bufio.NewReader(b)
+	for {
+		f, err := frame.Decode(fr, MaxMessageSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.StreamID == bulk.id.id && f.Tag == frame.TagResetInitiator {
+			break
+		}
+	}
+}
+
+type failingConn struct {
+	net.Conn
+	fail int32
+}
+
+var errWriteFailed = errors.New("write failed")
+
+func (c *failingConn) Write(b []byte) (int, error) {
+	if atomic.LoadInt32(&c.fail) != 0 {
+		return 0, errWriteFailed
+	}
+	return c.Conn.Write(b)
+}
+
+func TestWriteError(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	go io.Copy(ioutil.Discard, b)
+
+	conn := &failingConn{Conn: a}
+	mp, err := NewMultiplex(conn, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mp.Close()
+
+	s, err := mp.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreInt32(&conn.fail, 1)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err = s.Write([]byte("hello"))
+		if err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("writes kept succeeding")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	var werr *WriteError
+	if !errors.As(err, &werr) || !errors.Is(err, errWriteFailed) || !errors.Is(err, ErrShutdown) {
+		t.Fatalf("expected a write error, got %v", err)
+	}
+
+	<-mp.CloseChan()
+	if !errors.As(mp.ShutdownReason(), &werr) {
+		t.Fatalf("expected the session to be shut down by the write error, got %v", mp.ShutdownReason())
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+
+	mp, err := NewMultiplex(a, true, nil, WithWriteTimeout(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mp.Close()
+
+	// Nobody reads from the connection.
+	if _, err := mp.NewStream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-mp.CloseChan():
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the session to time out")
+	}
+	var werr *WriteError
+	if err := mp.ShutdownReason(); !errors.As(err, &werr) || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected a write timeout, got %v", err)
+	}
+
+	if _, err := NewMultiplex(a, true, nil, WithWriteTimeout(-1)); err == nil {
+		t.Fatal("expected a negative write timeout to be rejected")
+	}
+}
+
+func TestStreamProtocol(t *testing.T) {
+	a, b := net.Pipe()
+	mpa, err := NewMultiplex(a, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	mpb, err := NewMultiplex(b, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpb.Close()
+
+	s, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Protocol() != "" {
+		t.Fatal("expected no protocol")
+	}
+	// Not counted.
+	if _, err := s.Write([]byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	s.SetProtocol("/echo/1.0.0")
+	if s.Protocol() != "/echo/1.0.0" {
+		t.Fatalf("unexpected protocol %q", s.Protocol())
+	}
+	if _, err := s.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sb.Protocol() != "" {
+		t.Fatal("the protocol shouldn't be sent to the peer")
+	}
+	sb.SetProtocol("/echo/1.0.0")
+	buf := make([]byte, 7)
+	if _, err := io.ReadFull(sb, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	want := ProtocolStats{Streams: 1, BytesOut: 5}
+	if ps := mpa.Stat().Protocols["/echo/1.0.0"]; ps != want {
+		t.Fatalf("expected %+v, got %+v", want, ps)
+	}
+	want = ProtocolStats{Streams: 1, BytesIn: 7}
+	if ps := mpb.Stat().Protocols["/echo/1.0.0"]; ps != want {
+		t.Fatalf("expected %+v, got %+v", want, ps)
+	}
+}
+
+func TestStrictValidation(t *testing.T) {
+	enc := func(id, tag uint64, payload []byte) []byte {
+		return frame.Encode(nil, frame.Frame{StreamID: id, Tag: tag, Payload: payload})
+	}
+	opened := enc(0, frame.TagNewStream, nil)
+
+	for _, tc := range []struct {
+		name  string
+		input [][]byte
+		valid bool
+	}{
+		{"valid", [][]byte{opened, enc(0, frame.TagMessageInitiator, []byte("hi")), enc(0, frame.TagCloseInitiator, nil), enc(0, frame.TagResetInitiator, nil)}, true},
+		{"non-minimal varint", [][]byte{{0x80, 0x00, 0x00}}, false},
+		{"oversized frame", [][]byte{{0x02, 0xff, 0xff, 0xff, 0x7f}}, false},
+		{"reserved stream ID", [][]byte{enc(frame.ControlStreamID, frame.TagNewStream, nil)}, false},
+		{"extension on data stream", [][]byte{opened, enc(0, frame.TagExtension, nil)}, false},
+		{"long name", [][]byte{enc(0, frame.TagNewStream, make([]byte, 2000))}, false},
+		{"never opened by the peer", [][]byte{opened, enc(1, frame.TagMessageInitiator, []byte("hi"))}, false},
+		{"never opened by us", [][]byte{enc(0, frame.TagMessageReceiver, []byte("hi"))}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			a, b := net.Pipe()
+			defer a.Close()
+			mp, err := NewMultiplex(b, false, nil, WithStrictValidation())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mp.Close()
+			go io.Copy(ioutil.Discard, a)
+
+			for _, f := range tc.input {
+				if _, err := a.Write(f); err != nil {
+					break
+				}
+			}
+			if tc.valid {
+				// Make sure everything was processed.
+				a.Write(enc(1, frame.TagNewStream, nil))
+				for i := 0; i < 2; i++ {
+					if _, err := mp.Accept(); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if mp.IsClosed() {
+					t.Fatalf("session closed: %v", mp.ShutdownReason())
+				}
+				return
+			}
+
+			select {
+			case <-mp.CloseChan():
+			case <-time.After(5 * time.Second):
+				t.Fatal("expected the session to be closed")
+			}
+			var verr *ProtocolViolationError
+			if err := mp.ShutdownReason(); !errors.As(err, &verr) || !errors.Is(err, ErrInvalidState) {
+				t.Fatalf("expected a protocol violation, got %v", err)
+			}
+		})
+	}
+}
+
+// withFrameInjector makes the session run every outbound frame by i before
+// writing it.
+func withFrameInjector(i frameInjector) Option {
+	return func(c *config) error {
+		c.injector = i
+		return nil
+	}
+}
+
+type payloadInjector map[string]frameAction
+
+func (i payloadInjector) injectFrame(info FrameInfo) frameAction {
+	if info.Tag != frame.TagMessageInitiator {
+		return frameAction{}
+	}
+	return i[string(info.Payload)]
+}
+
+func TestFrameInjector(t *testing.T) {
+	a, b := net.Pipe()
+	mpa, err := NewMultiplex(a, true, nil, withFrameInjector(payloadInjector{
+		"late": {Delay: 100 * time.Millisecond},
+		"dup":  {Duplicate: 1},
+		"drop": {Drop: true},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	mpb, err := NewMultiplex(b, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpb.Close()
+
+	s, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range []string{"late", "dup", "drop", "end"} {
+		if _, err := s.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len("dupdupendlate"))
+	if _, err := io.ReadFull(sb, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "dupdupendlate" {
+		t.Fatalf("unexpected data: %q", buf)
+	}
+}
+
+func TestFrameInjectorDelayAfterClose(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	go io.Copy(ioutil.Discard, b)
+	delay := 50 * time.Millisecond
+	mp, err := NewMultiplex(a, true, nil, withFrameInjector(payloadInjector{
+		"late": {Delay: delay},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := mp.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write([]byte("late")); err != nil {
+		t.Fatal(err)
+	}
+	mp.Close()
+
+	// The frame held back is released rather than queued once the delay
+	// is up.
+	time.Sleep(2 * delay)
+	if n := mp.Stat().WriteQueueDepth; n != 0 {
+		t.Fatalf("expected an empty write queue, got %d frames", n)
+	}
+}
+
+func TestListener(t *testing.T) {
+	a, b := net.Pipe()
+	mpa, err := NewMultiplex(a, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	mpb, err := NewMultiplex(b, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpb.Close()
+
+	s, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := mpb.Listener()
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.LocalAddr() != b.LocalAddr() || c.RemoteAddr() != b.RemoteAddr() || l.Addr() != b.LocalAddr() {
+		t.Fatal("expected the addresses of the connection")
+	}
+	if _, err := s.Write([]byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// Closing the listener leaves the session alone.
+	l.Close()
+	if _, err := l.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected net.ErrClosed, got %v", err)
+	}
+	if mpb.IsClosed() {
+		t.Fatal("closing the listener closed the session")
+	}
+
+	l = mpb.Listener()
+	mpa.Close()
+	if _, err := l.Accept(); err == nil || err != mpb.ShutdownReason() {
+		t.Fatalf("expected the shutdown reason, got %v", err)
+	}
+}
+
+func TestMuxerRegistry(t *testing.T) {
+	m, err := LookupMuxer(MplexMuxerName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LookupMuxer("other"); err == nil {
+		t.Fatal("expected an error for an unknown muxer")
+	}
+	RegisterMuxer("other", NewMuxer(WithLabel("other")))
+	defer func() {
+		muxers.Lock()
+		delete(muxers.m, "other")
+		muxers.Unlock()
+	}()
+	if names := Muxers(); len(names) != 2 || names[0] != MplexMuxerName || names[1] != "other" {
+		t.Fatalf("unexpected muxers %v", names)
+	}
+
+	a, b := net.Pipe()
+	client, err := m.NewConn(a, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := m.NewConn(b, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	s, err := client.OpenStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write([]byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	ss, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(ss, buf); err != nil || string(buf) != "hi" {
+		t.Fatalf("got %q, %v", buf, err)
+	}
+
+	client.Close()
+	if !client.IsClosed() {
+		t.Fatal("expected the session to be closed")
+	}
+	if _, err := server.AcceptStream(); err == nil {
+		t.Fatal("expected accepting to fail")
+	}
+}
+
+func TestStreamHeaders(t *testing.T) {
+	a, b := net.Pipe()
+	mpa, err := NewMultiplex(a, true, nil, WithVersionNegotiation())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	mpb, err := NewMultiplex(b, false, nil, WithVersionNegotiation())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpb.Close()
+
+	// The peer's hello arrives before anything it sends on a stream.
+	sb, err := mpb.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb.Write([]byte("x"))
+	sa, err := mpa.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sa.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if sa.Headers() != nil {
+		t.Fatal("expected no headers")
+	}
+
+	headers := map[string]string{"route": "/echo", "tenant": "7", "": ""}
+	s, err := mpa.NewStreamWithHeaders(context.Background(), "", headers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(accepted.Headers(), headers) || !reflect.DeepEqual(s.Headers(), headers) {
+		t.Fatalf("expected %v, got %v", headers, accepted.Headers())
+	}
+
+	if _, err := mpa.NewStreamWithHeaders(context.Background(), "", map[string]string{"big": string(make([]byte, BufferSize))}); err != ErrHeadersTooLarge {
+		t.Fatalf("expected ErrHeadersTooLarge, got %v", err)
+	}
+
+	// Peers that don't negotiate don't get headers.
+	c, d := net.Pipe()
+	mpc, err := NewMultiplex(c, true, nil, WithVersionNegotiation())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpc.Close()
+	mpd, err := NewMultiplex(d, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpd.Close()
+	if _, err := mpc.NewStreamWithHeaders(context.Background(), "", headers); err != ErrHeadersUnsupported {
+		t.Fatalf("expected ErrHeadersUnsupported, got %v", err)
+	}
+}
+
+func TestProtocolNegotiation(t *testing.T) {
+	a, b := net.Pipe()
+	mpa, err := NewMultiplex(a, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	mpb, err := NewMultiplex(b, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpb.Close()
+
+	type negotiated struct {
+		s     *Stream
+		proto string
+		err   error
+	}
+	accepted := make(chan negotiated, 1)
+	accept := func() {
+		s, proto, err := mpb.AcceptProtocol(context.Background(), "/echo/1.0.0", "/chat/1.0.0")
+		accepted <- negotiated{s, proto, err}
+	}
+
+	go accept()
+	s, proto, err := mpa.NewStreamProtocol(context.Background(), "/chat/2.0.0", "/chat/1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proto != "/chat/1.0.0" || s.Protocol() != proto {
+		t.Fatalf("expected /chat/1.0.0, got %q (annotated %q)", proto, s.Protocol())
+	}
+	// Data sent right after the negotiation isn't swallowed by it.
+	if _, err := s.Write([]byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	n := <-accepted
+	if n.err != nil {
+		t.Fatal(n.err)
+	}
+	if n.proto != "/chat/1.0.0" || n.s.Protocol() != n.proto {
+		t.Fatalf("expected /chat/1.0.0, got %q (annotated %q)", n.proto, n.s.Protocol())
+	}
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(n.s, buf); err != nil || string(buf) != "hi" {
+		t.Fatalf("got %q, %v", buf, err)
+	}
+
+	go accept()
+	if _, _, err := mpa.NewStreamProtocol(context.Background(), "/nope"); err != ErrProtocolNotSupported {
+		t.Fatalf("expected ErrProtocolNotSupported, got %v", err)
+	}
+	if n := <-accepted; n.err == nil {
+		t.Fatal("expected the negotiation to fail on the accepting side")
+	}
+}
+
+func TestProtocolNegotiationWire(t *testing.T) {
+	if msg := appendMultistreamMsg(appendMultistreamMsg(nil, MultistreamID), "/a"); string(msg) != "\x13/multistream/1.0.0\n\x03/a\n" {
+		t.Fatalf("unexpected encoding %q", msg)
+	}
+}
+
+func TestEarlyData(t *testing.T) {
+	for _, negotiate := range []bool{true, false} {
+		a, b := net.Pipe()
+		mpa, err := NewMultiplex(a, true, nil, WithVersionNegotiation())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var opts []Option
+		if negotiate {
+			opts = append(opts, WithVersionNegotiation(), WithStrictValidation())
+		}
+		mpb, err := NewMultiplex(b, false, nil, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if negotiate {
+			<-mpa.negotiated
+		}
+
+		for _, size := range []int{10, maxEarlyData + 10} {
+			data := make([]byte, size)
+			rand.Read(data)
+			done := make(chan error, 1)
+			go func() {
+				_, err := mpa.NewStreamWithData(context.Background(), "early", data)
+				done <- err
+			}()
+			s, err := mpb.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			// It's readable as soon as the stream is accepted.
+			if negotiate && len(s.dataIn) != 1 {
+				t.Fatalf("size %d: expected early data", size)
+			}
+			buf := make([]byte, size)
+			if _, err := io.ReadFull(s, buf); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf, data) {
+				t.Fatal("data mismatch")
+			}
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		mpa.Close()
+		mpb.Close()
+	}
+}
+
+func TestNewStreamSync(t *testing.T) {
+	a, b := net.Pipe()
+	mpa, err := NewMultiplex(a, true, nil, WithVersionNegotiation())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	mpb, err := NewMultiplex(b, false, nil, WithVersionNegotiation(), WithStreamLimits(1, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpb.Close()
+	<-mpa.negotiated
+
+	s, err := mpa.NewStreamSync(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write([]byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The peer is at its limit: it refuses the next stream.
+	_, err = mpa.NewStreamSync(context.Background())
+	var rerr *ResetError
+	if !errors.As(err, &rerr) || !rerr.Remote {
+		t.Fatalf("expected a reset by the peer, got %v", err)
+	}
+
+	// Peers that don't negotiate don't acknowledge streams.
+	c, d := net.Pipe()
+	mpc, err := NewMultiplex(c, true, nil, WithVersionNegotiation())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpc.Close()
+	mpd, err := NewMultiplex(d, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpd.Close()
+	if _, err := mpc.NewStreamSync(context.Background()); err != ErrAcksUnsupported {
+		t.Fatalf("expected ErrAcksUnsupported, got %v", err)
+	}
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	if _, err := NewMultiplex(nil, true, nil, WithMaxMessageSize(MaxMessageSize+1)); err == nil {
+		t.Fatal("expected an error for a limit above MaxMessageSize")
+	}
+
+	oldChunkSize := ChunkSize
+	ChunkSize = 64 << 10
+	defer func() { ChunkSize = oldChunkSize }()
+
+	a, b := net.Pipe()
+	mpa, err := NewMultiplex(a, true, nil, WithVersionNegotiation())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	mpb, err := NewMultiplex(b, false, nil, WithVersionNegotiation(), WithMaxMessageSize(BufferSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpb.Close()
+	<-mpa.negotiated
+
+	// Larger frames than the peer accepts would kill the session: writes
+	// are split up further.
+	s, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 32<<10)
+	rand.Read(data)
+	go s.Write(data)
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(data))
+	if _, err := io.ReadFull(sb, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Fatal("data mismatch")
+	}
+
+	if _, err := mpa.NewNamedStream(context.Background(), strings.Repeat("x", BufferSize+1)); err != ErrMessageTooLarge {
+		t.Fatalf("expected ErrMessageTooLarge, got %v", err)
+	}
+	if mpa.IsClosed() || mpb.IsClosed() {
+		t.Fatal("expected the sessions to survive")
+	}
+}
+
+func TestPing(t *testing.T) {
+	a, b := net.Pipe()
+	mpa, err := NewMultiplex(a, true, nil, WithVersionNegotiation())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	mpb, err := NewMultiplex(b, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mpa.Ping(context.Background()); err != ErrPingUnsupported {
+		t.Fatalf("expected ErrPingUnsupported, got %v", err)
+	}
+	mpb.Close()
+
+	c, d := net.Pipe()
+	mpc, err := NewMultiplex(c, true, nil, WithVersionNegotiation())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpc.Close()
+	mpd, err := NewMultiplex(d, false, nil, WithVersionNegotiation())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpd.Close()
+	<-mpc.negotiated
+	<-mpd.negotiated
+
+	for _, mp := range []*Multiplex{mpc, mpd} {
+		rtt, err := mp.Ping(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rtt <= 0 {
+			t.Fatalf("unexpected round-trip time %s", rtt)
+		}
+	}
+	mpc.pingLock.Lock()
+	defer mpc.pingLock.Unlock()
+	if len(mpc.pings) != 0 {
+		t.Fatal("expected the ping to be forgotten")
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	if _, err := NewMultiplex(nil, true, nil, WithCapabilities(1<<40)); err == nil {
+		t.Fatal("expected an error for unknown capabilities")
+	}
+	if s := (CapPing | CapEarlyData | 1<<40).String(); s != "early-data|ping|0x10000000000" {
+		t.Fatalf("unexpected string %q", s)
+	}
+
+	a, b := net.Pipe()
+	mpa, err := NewMultiplex(a, true, nil, WithVersionNegotiation(), WithCapabilities(CapPing|CapStreamAcks))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	mpb, err := NewMultiplex(b, false, nil, WithVersionNegotiation(), WithCapabilities(CapPing|CapEarlyData))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpb.Close()
+	<-mpa.negotiated
+	<-mpb.negotiated
+
+	// Only the extensions both sides support are used.
+	if c := mpa.Capabilities(); c != CapPing {
+		t.Fatalf("expected ping, got %s", c)
+	}
+	if c := mpb.Capabilities(); c != CapPing {
+		t.Fatalf("expected ping, got %s", c)
+	}
+	if _, err := mpa.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mpa.NewStreamSync(context.Background()); err != ErrAcksUnsupported {
+		t.Fatalf("expected ErrAcksUnsupported, got %v", err)
+	}
+}
+
+type peerIDKey struct{}
+
+func TestUserValues(t *testing.T) {
+	a, b := net.Pipe()
+	mpa, err := NewMultiplex(a, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	mpb, err := NewMultiplex(b, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpb.Close()
+
+	if mpa.Value(peerIDKey{}) != nil {
+		t.Fatal("expected no value")
+	}
+	mpa.SetValue(peerIDKey{}, "peer-b")
+	mpa.SetValue("other", 1)
+	if v := mpa.Value(peerIDKey{}); v != "peer-b" {
+		t.Fatalf("unexpected value %v", v)
+	}
+	if mpb.Value(peerIDKey{}) != nil {
+		t.Fatal("values leaked to the other session")
+	}
+	mpa.SetValue(peerIDKey{}, nil)
+	if mpa.Value(peerIDKey{}) != nil || mpa.Value("other") != 1 {
+		t.Fatal("expected the value to be removed, and only it")
+	}
+
+	s, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Value(peerIDKey{}) != nil {
+		t.Fatal("expected streams not to inherit the session's values")
+	}
+	s.SetValue(peerIDKey{}, "stream")
+	if v := s.Value(peerIDKey{}); v != "stream" {
+		t.Fatalf("unexpected stream value %v", v)
+	}
+	s.Reset()
+	if v := s.Value(peerIDKey{}); v != "stream" {
+		t.Fatal("expected values to outlive the stream")
+	}
+}
+
+func TestNewStreamAsync(t *testing.T) {
+	a, b := net.Pipe()
+	mpa, err := NewMultiplex(a, true, nil, WithMaxBuffers(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	mpb, err := NewMultiplex(b, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpb.Close()
+
+	// Nobody reads: the write queue backs up, and opening streams has to
+	// wait.
+	s, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Write(make([]byte, 64<<10))
+	time.Sleep(50 * time.Millisecond)
+
+	res := mpa.NewStreamAsync(context.Background(), "async")
+	select {
+	case <-res:
+		t.Fatal("expected the open to wait for room")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	go func() {
+		for {
+			sb, err := mpb.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(ioutil.Discard, sb)
+		}
+	}()
+	r := <-res
+	if r.Err != nil {
+		t.Fatal(r.Err)
+	}
+	if r.Stream.Name() != "async" {
+		t.Fatalf("unexpected stream %q", r.Stream.Name())
+	}
+}
+
+func TestNewStreams(t *testing.T) {
+	a, b := net.Pipe()
+	mpa, err := NewMultiplex(a, true, nil, WithMaxBuffers(2), WithStreamLimits(0, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	mpb, err := NewMultiplex(b, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpb.Close()
+
+	names := []string{"a", "", "c", "d", "e", "f", "g", "h"}
+	streams, err := mpa.NewStreams(context.Background(), names)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(streams) != len(names) {
+		t.Fatalf("expected %d streams, got %d", len(names), len(streams))
+	}
+	for i, s := range streams {
+		name := names[i]
+		if name == "" {
+			name = fmt.Sprint(s.id.id)
+		}
+		if s.Name() != name {
+			t.Fatalf("expected stream %d to be named %q, got %q", i, name, s.Name())
+		}
+	}
+
+	// There's room for two more streams, not three: none get opened.
+	if _, err := mpa.NewStreams(context.Background(), []string{"x", "y", "z"}); err != ErrStreamLimitReached {
+		t.Fatalf("expected ErrStreamLimitReached, got %v", err)
+	}
+	more, err := mpa.NewStreams(context.Background(), []string{"x", "y"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	streams = append(streams, more...)
+
+	for _, s := range streams {
+		go func(s *Stream) {
+			s.Write([]byte(s.Name()))
+			s.Close()
+		}(s)
+	}
+
+	errs := make(chan error, len(streams))
+	for range streams {
+		sb, err := mpb.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			_, err := ioutil.ReadAll(sb)
+			sb.Close()
+			errs <- err
+		}()
+	}
+	for range streams {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAcceptBatch(t *testing.T) {
+	a, b := net.Pipe()
+	mpa, err := NewMultiplex(a, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	mpb, err := NewMultiplex(b, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpb.Close()
+
+	streams, err := mpa.NewStreams(context.Background(), make([]string, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for len(mpb.nstreams) < len(streams) {
+		time.Sleep(time.Millisecond)
+	}
+
+	var accepted []*Stream
+	for _, want := range []int{4, 4, 2} {
+		batch := mpb.AcceptBatch(4)
+		if len(batch) != want {
+			t.Fatalf("expected a batch of %d streams, got %d", want, len(batch))
+		}
+		accepted = append(accepted, batch...)
+	}
+	for i, s := range accepted {
+		if s.id.id != streams[i].id.id {
+			t.Fatalf("expected stream %d, got %d", streams[i].id.id, s.id.id)
+		}
+	}
+
+	mpa.Close()
+	if batch := mpb.AcceptBatch(0); batch != nil {
+		t.Fatalf("expected no streams once closed, got %d", len(batch))
+	}
+}
+
+func TestCloseSync(t *testing.T) {
+	a, b := net.Pipe()
+	mpa, err := NewMultiplex(a, true, nil, WithVersionNegotiation())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	mpb, err := NewMultiplex(b, false, nil, WithVersionNegotiation())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpb.Close()
+	<-mpa.negotiated
+	<-mpb.negotiated
+
+	s, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write([]byte("bye")); err != nil {
+		t.Fatal(err)
+	}
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	closed := make(chan error, 1)
+	go func() { closed <- s.CloseSync(context.Background()) }()
+	select {
+	case err := <-closed:
+		t.Fatalf("expected CloseSync to wait for the peer to read, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	data, err := ioutil.ReadAll(sb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "bye" {
+		t.Fatalf("unexpected data %q", data)
+	}
+	if err := <-closed; err != nil {
+		t.Fatal(err)
+	}
+	sb.Close()
+
+	// The peer never reads: the stream gets reset.
+	s, err = mpb.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sa, err := mpa.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.CloseSync(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	select {
+	case <-s.CloseChan():
+	default:
+		t.Fatal("expected the stream to be done")
+	}
+	sa.Close()
+
+	// Peers that don't negotiate don't acknowledge closes.
+	c, d := net.Pipe()
+	mpc, err := NewMultiplex(c, true, nil, WithVersionNegotiation())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpc.Close()
+	mpd, err := NewMultiplex(d, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpd.Close()
+	s, err = mpc.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CloseSync(context.Background()); err != ErrCloseAcksUnsupported {
+		t.Fatalf("expected ErrCloseAcksUnsupported, got %v", err)
+	}
+}
+
+func TestWritable(t *testing.T) {
+	a, b := net.Pipe()
+	mpa, err := NewMultiplex(a, true, nil, WithMaxBuffers(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	mpb, err := NewMultiplex(b, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpb.Close()
+
+	s, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Once the open frame is out, the buffer is free.
+	select {
+	case <-s.Writable():
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the stream to be writable")
+	}
+
+	// Nobody reads: the write queue backs up.
+	go s.Write(make([]byte, 64<<10))
+	time.Sleep(50 * time.Millisecond)
+	writable := s.Writable()
+	select {
+	case <-writable:
+		t.Fatal("expected the stream not to be writable")
+	default:
+	}
+
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go io.Copy(ioutil.Discard, sb)
+	select {
+	case <-writable:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the stream to become writable")
+	}
+
+	s.Reset()
+	select {
+	case <-s.Writable():
+	default:
+		t.Fatal("expected a reset stream to be writable")
+	}
+}
+
+func TestReadable(t *testing.T) {
+	a, b := net.Pipe()
+	mpa, err := NewMultiplex(a, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	mpb, err := NewMultiplex(b, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpb.Close()
+
+	s, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readable := sb.Readable()
+	select {
+	case <-readable:
+		t.Fatal("expected the stream not to be readable")
+	default:
+	}
+
+	if _, err := s.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-readable:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the stream to become readable")
+	}
+
+	// Partially read: there's more.
+	buf := make([]byte, 2)
+	if _, err := sb.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-sb.Readable():
+	default:
+		t.Fatal("expected the stream to stay readable")
+	}
+	if _, err := io.ReadFull(sb, make([]byte, 3)); err != nil {
+		t.Fatal(err)
+	}
+
+	readable = sb.Readable()
+	select {
+	case <-readable:
+		t.Fatal("expected the stream not to be readable")
+	default:
+	}
+	s.Close()
+	select {
+	case <-readable:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected EOF to make the stream readable")
+	}
+	if _, err := sb.Read(buf); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
+
+func TestIOURing(t *testing.T) {
+	ring, err := NewIOURing(64)
+	if err == ErrIOURingUnsupported {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ring.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- c
+	}()
+	a, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := <-accepted
+	if b == nil {
+		t.Fatal("accept failed")
+	}
+
+	mpa, err := NewMultiplex(a, true, nil, WithIOURing(ring))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	mpb, err := NewMultiplex(b, false, nil, WithIOURing(ring), WithWriteCoalescing(time.Millisecond, 16<<10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpb.Close()
+	if mpa.vc == nil || mpb.vc == nil {
+		t.Fatal("expected the sessions to use the ring")
+	}
+
+	// Echo a few streams at once, so that frames get batched.
+	go func() {
+		for {
+			s, err := mpb.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(s, s)
+				s.Close()
+			}()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s, err := mpa.NewStream(context.Background())
+			if err != nil {
+				errs <- err
+				return
+			}
+			data := bytes.Repeat([]byte{byte(i)}, 256<<10)
+			go func() {
+				s.Write(data)
+				s.CloseWrite()
+			}()
+			echoed, err := ioutil.ReadAll(s)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if !bytes.Equal(echoed, data) {
+				errs <- fmt.Errorf("stream %d: data mismatch", i)
+			}
+			s.Close()
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	// Sessions on other connections use the regular path.
+	c, d := net.Pipe()
+	mpc, err := NewMultiplex(c, true, nil, WithIOURing(ring))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpc.Close()
+	defer d.Close()
+	if mpc.vc != nil {
+		t.Fatal("expected a pipe not to use the ring")
+	}
+}
+
+func TestBufferSlots(t *testing.T) {
+	a, b := net.Pipe()
+	mpa, err := NewMultiplex(a, true, nil, WithMaxBuffers(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	mpb, err := NewMultiplex(b, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpb.Close()
+
+	if err := mpa.SetBufferSlots(1, 5); err == nil {
+		t.Fatal("expected an error growing beyond the maximum")
+	}
+	if err := mpa.SetBufferSlots(1, 1); err != nil {
+		t.Fatal(err)
+	}
+	st := mpa.Stat().OutboundBuffers
+	if st.Slots != 1 || st.MaxSlots != 4 {
+		t.Fatalf("unexpected outbound buffers: %+v", st)
+	}
+
+	// Nobody reads: the single slot is taken, and writers wait.
+	s, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Write(make([]byte, 64<<10))
+	time.Sleep(50 * time.Millisecond)
+	st = mpa.Stat().OutboundBuffers
+	if st.InUse != 1 || st.HighWater != 1 || st.Waits == 0 {
+		t.Fatalf("unexpected outbound buffers: %+v", st)
+	}
+
+	// More slots let more frames queue up.
+	if err := mpa.SetBufferSlots(4, 4); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	st = mpa.Stat().OutboundBuffers
+	if st.Slots != 4 || st.InUse != 4 || st.HighWater != 4 {
+		t.Fatalf("unexpected outbound buffers: %+v", st)
+	}
+
+	// Shrinking retires the slots as they're released.
+	if err := mpa.SetBufferSlots(4, 2); err != nil {
+		t.Fatal(err)
+	}
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(sb, make([]byte, 64<<10)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100 && mpa.Stat().OutboundBuffers.InUse > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	st = mpa.Stat().OutboundBuffers
+	if st.Slots != 2 || st.InUse != 0 {
+		t.Fatalf("unexpected outbound buffers: %+v", st)
+	}
+}
+
+func TestProxy(t *testing.T) {
+	// An upper-casing echo server to forward streams to.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				data, _ := ioutil.ReadAll(c)
+				c.Write(bytes.ToUpper(data))
+			}()
+		}
+	}()
+
+	a, b := net.Pipe()
+	mpa, err := NewMultiplex(a, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	mpb, err := NewMultiplex(b, true, nil, WithStreamNames())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpb.Close()
+
+	proxy := NewProxy(mpb, func(ctx context.Context, name string) (net.Conn, error) {
+		if name != "upper" {
+			return nil, fmt.Errorf("unknown destination %q", name)
+		}
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", l.Addr().String())
+	})
+	served := make(chan error, 1)
+	go func() { served <- proxy.Serve() }()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s, err := mpa.NewNamedStream(context.Background(), "upper")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			msg := fmt.Sprintf("hello %d", i)
+			if _, err := s.Write([]byte(msg)); err != nil {
+				t.Error(err)
+				return
+			}
+			s.CloseWrite()
+			reply, err := ioutil.ReadAll(s)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if string(reply) != strings.ToUpper(msg) {
+				t.Errorf("expected %q, got %q", strings.ToUpper(msg), reply)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// Streams that can't be forwarded are reset.
+	s, err := mpa.NewNamedStream(context.Background(), "elsewhere")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Read(make([]byte, 1))
+	var rerr *ResetError
+	if !errors.As(err, &rerr) || !strings.Contains(rerr.Reason, "unknown destination") {
+		t.Fatalf("expected a reset with the dial error, got %v", err)
+	}
+
+	mpb.Close()
+	select {
+	case err := <-served:
+		if err == nil {
+			t.Fatal("expected Serve to return why the session was closed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve didn't return")
+	}
+}
+
+func TestLossyStream(t *testing.T) {
+	a, b := net.Pipe()
+	mpa, err := NewMultiplex(a, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	mpb, err := NewMultiplex(b, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpb.Close()
+
+	sa, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sa.Write([]byte{0}); err != nil {
+		t.Fatal(err)
+	}
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb.SetLossy(true)
+
+	// Nobody reads: all but the latest update are dropped, rather than
+	// holding up the session.
+	for i := byte(1); i <= 100; i++ {
+		if _, err := sa.Write([]byte{i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 100 && sb.DroppedBytes() < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := sb.DroppedBytes(); n != 100 {
+		t.Fatalf("expected 100 bytes dropped, got %d", n)
+	}
+	if n := mpb.Stat().DroppedBytes; n != 100 {
+		t.Fatalf("expected 100 bytes dropped in the session stats, got %d", n)
+	}
+	buf := make([]byte, 10)
+	n, err := sb.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || buf[0] != 100 {
+		t.Fatalf("expected the latest update, got %v", buf[:n])
+	}
+}
+
+func TestDatagrams(t *testing.T) {
+	a, b := net.Pipe()
+	mpa, err := NewMultiplex(a, true, nil, WithVersionNegotiation())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	mpb, err := NewMultiplex(b, false, nil, WithVersionNegotiation())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpb.Close()
+	<-mpa.negotiated
+	<-mpb.negotiated
+
+	if err := mpa.SendDatagram(make([]byte, MaxDatagramSize+1)); err != ErrDatagramTooLarge {
+		t.Fatalf("expected ErrDatagramTooLarge, got %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := mpa.SendDatagram([]byte(fmt.Sprint("heartbeat ", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		d, err := mpb.ReceiveDatagram(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(d) != fmt.Sprint("heartbeat ", i) {
+			t.Fatalf("unexpected datagram %q", d)
+		}
+	}
+
+	// Unread datagrams are dropped, oldest first, without disturbing the
+	// session.
+	for i := 0; i < datagramBacklog+10; i++ {
+		if err := mpa.SendDatagram([]byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+		// Don't let the sender drop them for lack of buffers.
+		for mpa.Stat().OutboundBuffers.InUse > 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if n := mpa.Stat().DatagramsDropped; n != 0 {
+		t.Fatalf("expected no datagrams dropped by the sender, got %d", n)
+	}
+	for i := 0; i < 100 && mpb.Stat().DatagramsDropped < 10; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := mpb.Stat().DatagramsDropped; n != 10 {
+		t.Fatalf("expected 10 datagrams dropped, got %d", n)
+	}
+	d, err := mpb.ReceiveDatagram(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d[0] != 10 {
+		t.Fatalf("expected datagram 10 to be the oldest left, got %d", d[0])
+	}
+}
+
+func TestRecordMode(t *testing.T) {
+	a, b := net.Pipe()
+	mpa, err := NewMultiplex(a, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	mpb, err := NewMultiplex(b, true, nil, WithReceiveChunkSize(16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpb.Close()
+
+	sa, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sa.Write([]byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb.SetRecordMode(true)
+
+	records := []string{`{"a":1}`, `{"b":"a record larger than a receive chunk"}`, `{"c":3}`}
+	go func() {
+		for _, r := range records {
+			sa.Write([]byte(r))
+		}
+		sa.Close()
+	}()
+
+	buf := make([]byte, 64)
+	n, err := sb.Read(buf)
+	if err != nil || string(buf[:n]) != "{}" {
+		t.Fatalf("expected the first record, got %q, %v", buf[:n], err)
+	}
+	// Wait for everything to be queued: records still come one at a time.
+	time.Sleep(50 * time.Millisecond)
+	if _, err := sb.Read(buf[:3]); err != io.ErrShortBuffer {
+		t.Fatalf("expected io.ErrShortBuffer, got %v", err)
+	}
+	n, err = sb.Read(buf)
+	if err != nil || string(buf[:n]) != records[0] {
+		t.Fatalf("expected %q, got %q, %v", records[0], buf[:n], err)
+	}
+	for _, r := range records[1:] {
+		rec, err := sb.ReadRecord()
+		if err != nil || string(rec) != r {
+			t.Fatalf("expected %q, got %q, %v", r, rec, err)
+		}
+	}
+	if _, err := sb.ReadRecord(); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+}
+
+func TestNoDelay(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+
+	// Long enough for the test to time out if anything is held back.
+	mp, err := NewMultiplex(a, true, nil, WithWriteCoalescing(time.Minute, 4096))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mp.Close()
+
+	received := make(chan error, 1)
+	go func() {
+		// 3 bytes for the new stream frame, 7 for the message.
+		_, err := io.ReadFull(b, make([]byte, 10))
+		received <- err
+	}()
+
+	s, err := mp.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetNoDelay(true)
+	if _, err := s.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-received:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("write was held back")
+	}
+}
+
+func TestWriteDeadlineBetweenChunks(t *testing.T) {
+	a, b := net.Pipe()
+	mpa, err := NewMultiplex(a, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	mpb, err := NewMultiplex(b, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpb.Close()
+
+	s, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// There are buffers to spare, but the deadline has passed already.
+	s.SetWriteDeadline(time.Now().Add(-time.Second))
+	n, err := s.Write(make([]byte, 4*ChunkSize))
+	if !errors.Is(err, os.ErrDeadlineExceeded) || n != 0 {
+		t.Fatalf("expected the write to time out before the first frame, got %d, %v", n, err)
+	}
+
+	// Nobody reads: the deadline passes part way through.
+	s.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	msg := make([]byte, 1<<20)
+	n, err = s.Write(msg)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected the write to time out, got %v", err)
+	}
+	if n == 0 || n >= len(msg) || n%ChunkSize != 0 {
+		t.Fatalf("expected a partial write of whole chunks, got %d bytes", n)
+	}
+
+	// The frames counted as written make it to the peer.
+	s.SetWriteDeadline(time.Time{})
+	s.Close()
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(sb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != n {
+		t.Fatalf("expected %d bytes, got %d", n, len(data))
+	}
+}
+
+func TestWriteAll(t *testing.T) {
+	a, b := net.Pipe()
+	mpa, err := NewMultiplex(a, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	mpb, err := NewMultiplex(b, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpb.Close()
+
+	s, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WriteAll(context.Background(), []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nobody reads: the write times out part way through.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	msg := make([]byte, 1<<20)
+	err = s.WriteAll(ctx, msg)
+	var perr *PartialWriteError
+	if !errors.As(err, &perr) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected a partial write error, got %v", err)
+	}
+	if perr.Written == 0 || perr.Written >= len(msg) {
+		t.Fatalf("unexpected byte count %d", perr.Written)
+	}
+
+	// Resume where the write stopped.
+	go func() {
+		sb, err := mpb.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(ioutil.Discard, sb)
+	}()
+	if err := s.WriteAll(context.Background(), msg[perr.Written:]); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing was written: the error is returned as is.
+	s.Reset()
+	if err := s.WriteAll(context.Background(), msg); !errors.Is(err, ErrStreamReset) || errors.As(err, &perr) {
+		t.Fatalf("expected a reset, got %v", err)
+	}
+}
+
+func TestFailedOpenUnregisters(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	// Nobody reads on the other side: writes block, and the outbound
+	// buffers fill up.
+	mp, err := NewMultiplex(a, true, nil, WithStreamLimits(0, 8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mp.Close()
+
+	opened := 0
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		_, err := mp.NewStream(ctx)
+		cancel()
+		if err != nil {
+			if err != context.DeadlineExceeded {
+				t.Fatalf("expected the open to time out, got %v", err)
+			}
+			break
+		}
+		opened++
+		if opened == 8 {
+			t.Fatal("expected an open to fail")
+		}
+	}
+
+	mp.chLock.Lock()
+	registered, outbound := len(mp.channels), mp.outboundStreams
+	mp.chLock.Unlock()
+	if registered != opened || outbound != opened {
+		t.Fatalf("expected %d streams registered, got %d (%d counted)", opened, registered, outbound)
+	}
+	if n := mp.Stat().StreamsOpened; n != uint64(opened) {
+		t.Fatalf("expected %d streams counted as opened, got %d", opened, n)
+	}
+}
+
+func TestResetUnsentCleansUp(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	// Nobody reads on the other side: writes block, and frames pile up in
+	// the write queue.
+	mp, err := NewMultiplex(a, true, nil, WithMaxBuffers(16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mp.Close()
+
+	s, err := mp.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Let the writer block on the open frame.
+	time.Sleep(50 * time.Millisecond)
+	writeDone := make(chan struct{})
+	go func() {
+		defer close(writeDone)
+		s.Write(make([]byte, 1<<20))
+	}()
+	for i := 0; i < 100 && mp.Stat().OutboundBuffers.InUse < 16; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if mp.Stat().WriteQueueDepth == 0 {
+		t.Fatal("expected frames to be queued")
+	}
+
+	// The control frames are congested too: the reset can't be queued.
+	for i := 0; i < controlBuffers; i++ {
+		mp.ctrlOut <- struct{}{}
+	}
+	s.Reset()
+
+	select {
+	case <-writeDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("write didn't return")
+	}
+	for i := 0; i < 100 && mp.Stat().WriteQueueDepth > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := mp.Stat().WriteQueueDepth; n != 0 {
+		t.Fatalf("expected the stream's frames to be dropped, %d left", n)
+	}
+	// Only the frames already being written hold on to buffers.
+	if st := mp.Stat().OutboundBuffers; st.InUse == st.Slots {
+		t.Fatalf("expected outbound buffers to be released: %+v", st)
+	}
+	mp.chLock.Lock()
+	_, registered := mp.channels[s.id]
+	outbound := mp.outboundStreams
+	mp.chLock.Unlock()
+	if registered || outbound != 0 {
+		t.Fatal("expected the stream to be unregistered")
+	}
+}
+
+func TestLeakDetection(t *testing.T) {
+	a, b := net.Pipe()
+	mpa, err := NewMultiplex(a, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	mpb, err := NewMultiplex(b, true, nil, WithLeakDetection(20*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpb.Close()
+
+	for i := 0; i < 2; i++ {
+		sa, err := mpa.NewStream(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		sa.Close()
+	}
+	leaky, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []*Stream{leaky, closed} {
+		if _, err := s.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("expected io.EOF, got %v", err)
+		}
+	}
+	closed.Close()
+
+	time.Sleep(50 * time.Millisecond)
+	leaked := mpb.LeakedStreams()
+	if len(leaked) != 1 || leaked[0].Stream != leaky {
+		t.Fatalf("expected the unclosed stream to be reported, got %v", leaked)
+	}
+	if !strings.Contains(leaked[0].Stack, "TestLeakDetection") {
+		t.Fatalf("expected the stack trace of the Accept call, got:\n%s", leaked[0].Stack)
+	}
+
+	leaky.Close()
+	if leaked := mpb.LeakedStreams(); len(leaked) != 0 {
+		t.Fatalf("expected no leaks once closed, got %v", leaked)
+	}
+}
+
+func TestFinalizeUnclosedStream(t *testing.T) {
+	a, b := net.Pipe()
+	var logger recordingLogger
+	mpa, err := NewMultiplex(a, false, nil, WithLogger(&logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	mpb, err := NewMultiplex(b, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpb.Close()
+
+	closed, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Reset()
+	unclosed, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The finalizer is only set in debug builds: call it directly.
+	finalizeStream(closed)
+	finalizeStream(unclosed)
+
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	var warnings int
+	for _, entry := range logger.logs {
+		if strings.Contains(entry[0].(string), "garbage collected") {
+			warnings++
+		}
+	}
+	if warnings != 1 {
+		t.Fatalf("expected a warning for the unclosed stream only, got %d", warnings)
+	}
+}
+
+func TestWaitClosed(t *testing.T) {
+	a, b := net.Pipe()
+	mpa, err := NewMultiplex(a, false, nil, WithLeakDetection(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpb, err := NewMultiplex(b, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpb.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := mpa.WaitClosed(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected WaitClosed to wait for the session to close, got %v", err)
+	}
+
+	// Leave frames queued, and goroutines running.
+	s, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.CloseChan()
+	go s.Write(make([]byte, 1<<20))
+	for i := 0; i < 100 && mpa.Stat().OutboundBuffers.InUse < 4; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.Reset()
+
+	mpa.Close()
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := mpa.WaitClosed(ctx); err != nil {
+		t.Fatal(err)
+	}
+	mpa.goLock.Lock()
+	running := mpa.goroutines
+	mpa.goLock.Unlock()
+	if running != 0 {
+		t.Fatalf("expected no goroutines left, got %d", running)
+	}
+	if st := mpa.Stat(); st.OutboundBuffers.InUse != 0 || st.WriteQueueDepth != 0 {
+		t.Fatalf("expected all the buffers to be returned: %+v", st.OutboundBuffers)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	a, b := net.Pipe()
+	mpa, err := NewMultiplex(a, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	mpb, err := NewMultiplex(b, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpb.Close()
+
+	established, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mpb.Drain()
+	if !mpb.IsDraining() {
+		t.Fatal("expected the session to be draining")
+	}
+	if _, err := mpb.NewStream(context.Background()); err != ErrDraining {
+		t.Fatalf("expected ErrDraining, got %v", err)
+	}
+	if _, err := mpb.NewStreams(context.Background(), []string{"a"}); err != ErrDraining {
+		t.Fatalf("expected ErrDraining, got %v", err)
+	}
+
+	// New streams from the peer are reset.
+	refused, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = refused.Read(make([]byte, 1))
+	var rerr *ResetError
+	if !errors.As(err, &rerr) || rerr.Reason != "session draining" {
+		t.Fatalf("expected the stream to be refused, got %v", err)
+	}
+
+	// The established stream carries on.
+	go func() {
+		established.Write([]byte("still here"))
+		established.Close()
+	}()
+	data, err := ioutil.ReadAll(sb)
+	if err != nil || string(data) != "still here" {
+		t.Fatalf("expected the established stream to work, got %q, %v", data, err)
+	}
+	if n := mpb.RefusedStreams(); n != 1 {
+		t.Fatalf("expected 1 refused stream, got %d", n)
+	}
+}
+
+func TestMaxLifetime(t *testing.T) {
+	pair := func(opts ...Option) (*Multiplex, *Multiplex) {
+		a, b := net.Pipe()
+		mpa, err := NewMultiplex(a, false, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { mpa.Close() })
+		mpb, err := NewMultiplex(b, true, nil, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { mpb.Close() })
+		return mpa, mpb
+	}
+	waitClosed := func(mp *Multiplex) {
+		select {
+		case <-mp.CloseChan():
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the session to be closed")
+		}
+	}
+
+	// Without a grace period, the session is closed once its streams are
+	// done.
+	mpa, mpb := pair(WithMaxLifetime(20*time.Millisecond, 0))
+	sa, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if !mpb.IsDraining() {
+		t.Fatal("expected the session to be draining")
+	}
+	if mpb.IsClosed() {
+		t.Fatal("expected the session to stay open while it has streams")
+	}
+	go func() {
+		sa.Write([]byte("done"))
+		sa.Close()
+	}()
+	data, err := ioutil.ReadAll(sb)
+	if err != nil || string(data) != "done" {
+		t.Fatalf("expected the stream to work, got %q, %v", data, err)
+	}
+	sb.Close()
+	waitClosed(mpb)
+
+	// With one, streams left are cut off.
+	mpa, mpb = pair(WithMaxLifetime(20*time.Millisecond, 50*time.Millisecond))
+	if _, err := mpa.NewStream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mpb.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	waitClosed(mpb)
+
+	if _, err := NewMultiplex(nil, false, nil, WithMaxLifetime(0, 0)); err == nil {
+		t.Fatal("expected an invalid max lifetime to be rejected")
+	}
+}
+
+func TestMaxStreamNameLength(t *testing.T) {
+	a, b := net.Pipe()
+	mpa, err := NewMultiplex(a, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	var mm countingMemoryManager
+	mpb, err := NewMultiplex(b, true, &mm, WithStreamNames(), WithMaxStreamNameLength(2048))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpb.Close()
+	mm.mu.Lock()
+	base := mm.reserved
+	mm.mu.Unlock()
+
+	// Names up to the limit are kept, and accounted for.
+	name := strings.Repeat("a", 1500)
+	sa, err := mpa.NewNamedStream(context.Background(), name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sb.Name() != name {
+		t.Fatalf("expected the name to be kept, got %d bytes", len(sb.Name()))
+	}
+	mm.mu.Lock()
+	if mm.reserved != base+len(name) {
+		t.Fatalf("expected %d bytes reserved for the name, got %d", len(name), mm.reserved-base)
+	}
+	mm.mu.Unlock()
+
+	// Longer ones are refused.
+	refused, err := mpa.NewNamedStream(context.Background(), strings.Repeat("b", 4096))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = refused.Read(make([]byte, 1))
+	var rerr *ResetError
+	if !errors.As(err, &rerr) || rerr.Reason != "stream name too long" {
+		t.Fatalf("expected the stream to be refused, got %v", err)
+	}
+
+	// The memory is released with the stream.
+	sa.Reset()
+	sb.Reset()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mm.mu.Lock()
+		reserved := mm.reserved
+		mm.mu.Unlock()
+		if reserved == base {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the name's memory to be released, %d bytes still reserved", reserved-base)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := mpb.RefusedStreams(); n != 1 {
+		t.Fatalf("expected 1 refused stream, got %d", n)
+	}
+}
+
+func TestOnSlowReader(t *testing.T) {
+	oldTimeout := ReceiveTimeout
+	ReceiveTimeout = 50 * time.Millisecond
+	defer func() { ReceiveTimeout = oldTimeout }()
+
+	slow := make(chan int, 1)
+	onSlowReader := func(s *Stream, queued int) time.Duration {
+		select {
+		case slow <- queued:
+		default:
+		}
+		// Give the reader all the time it needs.
+		return time.Minute
+	}
+
+	a, b := net.Pipe()
+	mpa, err := NewMultiplex(a, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	mpb, err := NewMultiplex(b, true, nil, WithOnSlowReader(onSlowReader))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpb.Close()
+
+	s, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for i := 0; i < 3; i++ {
+			s.Write([]byte("hello"))
+		}
+	}()
+
+	select {
+	case queued := <-slow:
+		if queued == 0 {
+			t.Fatal("expected data to be queued")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the slow reader to be reported")
+	}
+	// The stream wasn't reset: the reader catches up.
+	buf := make([]byte, 15)
+	if _, err := io.ReadFull(sb, buf); err != nil || string(buf) != strings.Repeat("hello", 3) {
+		t.Fatalf("expected the data, got %q, %v", buf, err)
+	}
+	if n := mpb.Stat().ReceiveTimeoutResets; n != 0 {
+		t.Fatalf("expected no receive timeout resets, got %d", n)
+	}
+}
+
+func TestSetTimeouts(t *testing.T) {
+	a, b := net.Pipe()
+	mpa, err := NewMultiplex(a, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	mpb, err := NewMultiplex(b, true, nil, WithWriteCoalescing(time.Hour, 1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpb.Close()
+
+	if err := mpa.SetWriteCoalesceDelay(0); err != ErrNotCoalescing {
+		t.Fatalf("expected ErrNotCoalescing, got %v", err)
+	}
+	if err := mpa.SetReceiveTimeout(0); err == nil {
+		t.Fatal("expected an invalid timeout to be rejected")
+	}
+
+	// Frames are no longer held back for an hour.
+	if err := mpb.SetWriteCoalesceDelay(0); err != nil {
+		t.Fatal(err)
+	}
+	sb, err := mpb.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sb.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	sa, err := mpa.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Streams that don't read are reset sooner.
+	if err := mpa.SetReceiveTimeout(50 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := mpa.SetResetStreamTimeout(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		for {
+			if _, err := sb.Write([]byte("hello")); err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("expected the stream to be reset")
+	}
+	_, err = sb.Read(make([]byte, 1))
+	var rerr *ResetError
+	if !errors.As(err, &rerr) || rerr.Reason != "receive timeout" {
+		t.Fatalf("expected a receive timeout, got %v", err)
+	}
+	sa.Reset()
+}
+
+func TestDataHandler(t *testing.T) {
+	a, b := net.Pipe()
+	mpa, err := NewMultiplex(a, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	mpb, err := NewMultiplex(b, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpb.Close()
+
+	s, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write([]byte("queued ")); err != nil {
+		t.Fatal(err)
+	}
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-sb.Readable()
+
+	var (
+		mu       sync.Mutex
+		received []byte
+	)
+	eof := make(chan struct{})
+	err = sb.SetDataHandler(func(data []byte) error {
+		if data == nil {
+			close(eof)
+			return nil
+		}
+		mu.Lock()
+		received = append(received, data...)
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sb.Read(make([]byte, 1)); err != ErrDataHandlerSet {
+		t.Fatalf("expected ErrDataHandlerSet, got %v", err)
+	}
+	if _, err := s.Write([]byte("pushed")); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	select {
+	case <-eof:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the handler to be told about the EOF")
+	}
+	mu.Lock()
+	if string(received) != "queued pushed" {
+		t.Fatalf("expected the data in order, got %q", received)
+	}
+	mu.Unlock()
+	sb.Close()
+
+	// A failing handler resets the stream.
+	s, err = mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err = mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb.SetDataHandler(func([]byte) error { return errors.New("bad data") })
+	s.Write([]byte("hello"))
+	_, err = s.Read(make([]byte, 1))
+	var rerr *ResetError
+	if !errors.As(err, &rerr) || rerr.Reason != "data handler: bad data" {
+		t.Fatalf("expected the stream to be reset, got %v", err)
+	}
+}
+
+func TestManager(t *testing.T) {
+	m, err := NewManager(ManagerLimits{Streams: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	peers := make([]*Multiplex, 2)
+	for i, label := range []string{"a", "b"} {
+		a, b := net.Pipe()
+		if _, err := m.NewSession(a, false, WithLabel(label)); err != nil {
+			t.Fatal(err)
+		}
+		peer, err := NewMultiplex(b, true, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer peer.Close()
+		peers[i] = peer
+	}
+	if len(m.Sessions()) != 2 {
+		t.Fatalf("expected 2 sessions, got %d", len(m.Sessions()))
+	}
+	ma := m.Lookup("a")
+	if ma == nil || ma.Label() != "a" {
+		t.Fatalf("expected to find session a, got %v", ma)
+	}
+	if m.Lookup("c") != nil {
+		t.Fatal("expected no session c")
+	}
+	if m.ReservedMemory() == 0 {
+		t.Fatal("expected the sessions' memory to be reserved from the manager")
+	}
+
+	// The limit on streams is shared by the sessions.
+	if _, err := ma.NewStream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	s, err := peers[1].NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Write([]byte("hello"))
+	sb, err := m.Lookup("b").Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ma.NewStream(context.Background()); err != ErrStreamLimitReached {
+		t.Fatalf("expected ErrStreamLimitReached, got %v", err)
+	}
+	refused, err := peers[0].NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = refused.Read(make([]byte, 1))
+	var rerr *ResetError
+	if !errors.As(err, &rerr) || rerr.Reason != "session manager stream limit reached" {
+		t.Fatalf("expected the stream to be refused, got %v", err)
+	}
+
+	// Streams give their slot back once done.
+	sb.Reset()
+	for m.Streams() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := ma.NewStream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	m.Close()
+	if len(m.Sessions()) != 0 || m.Streams() != 0 || m.ReservedMemory() != 0 {
+		t.Fatalf("expected everything to be released, got %d sessions, %d streams, %d bytes",
+			len(m.Sessions()), m.Streams(), m.ReservedMemory())
+	}
+	a, _ := net.Pipe()
+	if _, err := m.NewSession(a, false); err != ErrManagerClosed {
+		t.Fatalf("expected ErrManagerClosed, got %v", err)
+	}
+}
+
+func TestOnMisbehavior(t *testing.T) {
+	enc := func(id, tag uint64, payload []byte) []byte {
+		return frame.Encode(nil, frame.Frame{StreamID: id, Tag: tag, Payload: payload})
+	}
+	opened := enc(0, frame.TagNewStream, nil)
+
+	for _, tc := range []struct {
+		name   string
+		input  [][]byte
+		strict bool
+		want   Misbehavior
+	}{
+		{"oversized frame", [][]byte{{0x02, 0xff, 0xff, 0xff, 0x7f}}, false,
+			Misbehavior{Kind: MisbehaviorMalformedFrame, Reason: fmt.Sprintf("frame larger than %d bytes", MaxMessageSize), Fatal: true}},
+		{"duplicate open", [][]byte{opened, opened}, false,
+			Misbehavior{Kind: MisbehaviorDuplicateOpen, Reason: "stream opened twice", Fatal: true}},
+		{"unknown tag", [][]byte{opened, enc(0, frame.TagExtension, nil)}, false,
+			Misbehavior{Kind: MisbehaviorUnknownTag, Tag: frame.TagExtension, Reason: "unknown tag"}},
+		{"strict violation", [][]byte{enc(3, frame.TagMessageReceiver, nil)}, true,
+			Misbehavior{Kind: MisbehaviorViolation, StreamID: 3, Tag: frame.TagMessageReceiver, Reason: "frame on a stream that was never opened", Fatal: true}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			reported := make(chan Misbehavior, 1)
+			opts := []Option{WithOnMisbehavior(func(m Misbehavior) { reported <- m })}
+			if tc.strict {
+				opts = append(opts, WithStrictValidation())
+			}
+			a, b := net.Pipe()
+			defer a.Close()
+			mp, err := NewMultiplex(b, false, nil, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mp.Close()
+			go io.Copy(ioutil.Discard, a)
+
+			for _, f := range tc.input {
+				if _, err := a.Write(f); err != nil {
+					break
+				}
+			}
+			select {
+			case m := <-reported:
+				if m != tc.want {
+					t.Fatalf("expected %+v, got %+v", tc.want, m)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("expected the misbehavior to be reported")
+			}
+		})
+	}
+}
+
+func TestProtocolViolationDetails(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	mp, err := NewMultiplex(b, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mp.Close()
+	go io.Copy(ioutil.Discard, a)
+
+	opened := frame.Encode(nil, frame.Frame{StreamID: 5, Tag: frame.TagNewStream})
+	a.Write(opened)
+	a.Write(opened)
+	select {
+	case <-mp.CloseChan():
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the session to be closed")
+	}
+
+	err = mp.ShutdownReason()
+	var verr *ProtocolViolationError
+	if !errors.As(err, &verr) || !errors.Is(err, ErrInvalidState) {
+		t.Fatalf("expected a protocol violation, got %v", err)
+	}
+	want := ProtocolViolationError{StreamID: 5, Tag: frame.TagNewStream, StreamExisted: true, Reason: "stream opened twice"}
+	if *verr != want {
+		t.Fatalf("expected %+v, got %+v", want, *verr)
+	}
+	if msg := err.Error(); msg != "protocol violation on open stream 5 (tag 0): stream opened twice" {
+		t.Fatalf("unexpected message %q", msg)
+	}
+}
+
+func TestHalfClosedTimeout(t *testing.T) {
+	timedOut := make(chan *Stream, 8)
+	a, b := net.Pipe()
+	mpa, err := NewMultiplex(a, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	mpb, err := NewMultiplex(b, true, nil, WithHalfClosedTimeout(50*time.Millisecond, func(s *Stream) { timedOut <- s }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpb.Close()
+
+	open := func() (*Stream, *Stream) {
+		sa, err := mpa.NewStream(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		sa.Write([]byte("hello"))
+		sa.CloseWrite()
+		sb, err := mpb.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sa, sb
+	}
+
+	// A stream closed in time isn't affected.
+	_, closed := open()
+	if _, err := ioutil.ReadAll(closed); err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	// Forgotten ones are closed for us, even when several expire at once.
+	const n = 4
+	forgotten := make(map[*Stream]*Stream)
+	for i := 0; i < n; i++ {
+		sa, sb := open()
+		forgotten[sb] = sa
+	}
+	for i := 0; i < n; i++ {
+		select {
+		case s := <-timedOut:
+			if _, ok := forgotten[s]; !ok {
+				t.Fatal("expected a forgotten stream to time out")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the streams to time out")
+		}
+	}
+	for sb, sa := range forgotten {
+		select {
+		case <-sb.CloseChan():
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the stream to be closed")
+		}
+		if _, err := ioutil.ReadAll(sa); err != nil {
+			t.Fatalf("expected the peer to see a close, got %v", err)
+		}
+	}
+	if got := mpb.Stat().HalfClosedTimeouts; got != n {
+		t.Fatalf("expected %d half-closed timeouts, got %d", n, got)
+	}
+}
+
+func TestInboundStreamRate(t *testing.T) {
+	floods := make(chan Misbehavior, 10)
+	a, b := net.Pipe()
+	mpa, err := NewMultiplex(a, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	mpb, err := NewMultiplex(b, true, nil, WithInboundStreamRate(1, 2),
+		WithOnMisbehavior(func(m Misbehavior) { floods <- m }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpb.Close()
+
+	var streams []*Stream
+	for i := 0; i < 3; i++ {
+		s, err := mpa.NewStream(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		streams = append(streams, s)
+	}
+	// The burst goes through.
+	for i := 0; i < 2; i++ {
+		if _, err := mpb.Accept(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = streams[2].Read(make([]byte, 1))
+	var rerr *ResetError
+	if !errors.As(err, &rerr) || rerr.Reason != "inbound stream rate limit reached" {
+		t.Fatalf("expected the stream to be refused, got %v", err)
+	}
+	select {
+	case m := <-floods:
+		if m.Kind != MisbehaviorStreamFlood || m.StreamID != streams[2].id.id {
+			t.Fatalf("unexpected misbehavior %+v", m)
+		}
+	default:
+		t.Fatal("expected the flood to be reported")
+	}
+	if n := mpb.Stat().StreamsRefused; n != 1 {
+		t.Fatalf("expected 1 refused stream, got %d", n)
+	}
+}
+
+func TestAcceptMatching(t *testing.T) {
+	a, b := net.Pipe()
+	mpa, err := NewMultiplex(a, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	mpb, err := NewMultiplex(b, true, nil, WithStreamNames())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpb.Close()
+
+	if _, err := mpa.AcceptMatching(context.Background(), "*"); err != ErrNamesNotKept {
+		t.Fatalf("expected ErrNamesNotKept, got %v", err)
+	}
+	if _, err := mpb.AcceptMatching(context.Background(), "["); err == nil {
+		t.Fatal("expected an invalid pattern to be rejected")
+	}
+
+	// Register the patterns.
+	for _, pattern := range []string{"rpc/*", "pubsub/*"} {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := mpb.AcceptMatching(ctx, pattern); err != context.Canceled {
+			t.Fatalf("expected context.Canceled, got %v", err)
+		}
+	}
+
+	for _, name := range []string{"pubsub/topic", "other", "rpc/get"} {
+		if _, err := mpa.NewNamedStream(context.Background(), name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for pattern, name := range map[string]string{"rpc/*": "rpc/get", "pubsub/*": "pubsub/topic"} {
+		s, err := mpb.AcceptMatching(context.Background(), pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.Name() != name {
+			t.Fatalf("expected %q for %q, got %q", name, pattern, s.Name())
+		}
+	}
+	s, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Name() != "other" {
+		t.Fatalf("expected the unmatched stream to be accepted, got %q", s.Name())
+	}
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+func TestChannel(t *testing.T) {
+	a, b := net.Pipe()
+	mpa, err := NewMultiplex(a, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	mpb, err := NewMultiplex(b, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpb.Close()
+
+	type msg struct {
+		Seq  int
+		Text string
+	}
+	s, err := mpa.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := NewChannel(s, jsonCodec{})
+	go func() {
+		for i := 0; i < 3; i++ {
+			if err := ca.Send(msg{Seq: i, Text: strings.Repeat("x", i*100)}); err != nil {
+				t.Error(err)
+			}
+		}
+		if err := ca.Send(strings.Repeat("x", MaxMessageSize)); err != ErrMessageTooLarge {
+			t.Errorf("expected ErrMessageTooLarge, got %v", err)
+		}
+		s.CloseWrite()
+	}()
+
+	sb, err := mpb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cb := NewChannel(sb, jsonCodec{})
+	for i := 0; i < 3; i++ {
+		var m msg
+		if err := cb.Recv(&m); err != nil {
+			t.Fatal(err)
+		}
+		if m.Seq != i || len(m.Text) != i*100 {
+			t.Fatalf("unexpected message %+v", m)
+		}
+	}
+	var m msg
+	if err := cb.Recv(&m); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+}
+
+func TestPipe(t *testing.T) {
+	// An upper-casing echo server to pipe streams to.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				data, _ := ioutil.ReadAll(c)
+				c.Write(bytes.ToUpper(data))
+			}()
+		}
+	}()
+
+	a, b := net.Pipe()
+	mpa, err := NewMultiplex(a, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	mpb, err := NewMultiplex(b, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpb.Close()
+
+	pipeStream := func(ctx context.Context) (*Stream, <-chan PipeResult) {
+		s, err := mpa.NewStream(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		sb, err := mpb.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := make(chan PipeResult, 1)
+		go func() { res <- Pipe(ctx, sb, conn) }()
+		return s, res
+	}
+
+	s, res := pipeStream(context.Background())
+	s.Write([]byte("hello"))
+	s.CloseWrite()
+	reply, err := ioutil.ReadAll(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != "HELLO" {
+		t.Fatalf("unexpected reply %q", reply)
+	}
+	r := <-res
+	if r.AToB != (PipeDirection{Bytes: 5}) || r.BToA != (PipeDirection{Bytes: 5}) {
+		t.Fatalf("unexpected result %+v", r)
+	}
+
+	// Canceling resets the stream.
+	ctx, cancel := context.WithCancel(context.Background())
+	s, res = pipeStream(ctx)
+	s.Write([]byte("hello"))
+	cancel()
+	_, err = ioutil.ReadAll(s)
+	var rerr *ResetError
+	if !errors.As(err, &rerr) || rerr.Reason != "pipe: context canceled" {
+		t.Fatalf("expected a reset, got %v", err)
+	}
+	r = <-res
+	if r.AToB.Err != context.Canceled || r.BToA.Err != context.Canceled {
+		t.Fatalf("unexpected result %+v", r)
+	}
+}
+
+func TestNewStreamsCountsQueuedOpens(t *testing.T) {
+	// Nobody reads from the other end, so the first open takes the only
+	// outbound buffer for good.
+	a, b := net.Pipe()
+	defer b.Close()
+	mp, err := NewMultiplex(a, true, nil, WithMaxBuffers(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mp.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := mp.NewStreams(ctx, []string{"a", "b", "c"}); err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if n := mp.Stat().StreamsOpened; n != 1 {
+		t.Fatalf("expected 1 stream opened, got %d", n)
+	}
+}
+
+func TestRecordTooLarge(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	mp, err := NewMultiplex(b, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mp.Close()
+	go io.Copy(ioutil.Discard, a)
+
+	a.Write(frame.Encode(nil, frame.Frame{StreamID: 5, Tag: frame.TagNewStream}))
+	s, err := mp.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetRecordMode(true)
+	go func() {
+		a.Write(frame.Encode(nil, frame.Frame{StreamID: 5, Tag: frame.TagMessageInitiator, Payload: make([]byte, BufferSize)}))
+		a.Write(frame.Encode(nil, frame.Frame{StreamID: 5, Tag: frame.TagMessageInitiator, Payload: make([]byte, BufferSize+1)}))
+	}()
+
+	if rec, err := s.ReadRecord(); err != nil || len(rec) != BufferSize {
+		t.Fatalf("expected a record of %d bytes, got %d, %v", BufferSize, len(rec), err)
+	}
+	_, err = s.ReadRecord()
+	var rerr *ResetError
+	if !errors.As(err, &rerr) || rerr.Remote || rerr.Reason != "record too large" {
+		t.Fatalf("expected the stream to be reset, got %v", err)
+	}
+}
+
+func TestMaxLifetimeGoAway(t *testing.T) {
+	a, b := net.Pipe()
+	mpa, err := NewMultiplex(a, false, nil, WithVersionNegotiation())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpa.Close()
+	mpb, err := NewMultiplex(b, true, nil, WithVersionNegotiation(), WithMaxLifetime(20*time.Millisecond, time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpb.Close()
+
+	// Keep a stream open, so that the expired session lingers.
+	if _, err := mpa.NewStream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mpb.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !mpa.PeerDraining() {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the peer to learn the session is draining")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if mpa.IsClosed() {
+		t.Fatal("expected the session to stay open while it has streams")
+	}
+	if _, err := mpa.NewStream(context.Background()); err != ErrDraining {
+		t.Fatalf("expected ErrDraining, got %v", err)
+	}
+	if mpb.PeerDraining() {
+		t.Fatal("expected only the expired side to be draining")
+	}
+}
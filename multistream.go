@@ -0,0 +1,186 @@
+package multiplex
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// MultistreamID is the ID of the multistream-select protocol spoken by
+// SelectProtocol and NegotiateProtocol.
+const MultistreamID = "/multistream/1.0.0"
+
+// maxMultistreamMessage is the maximum length of a multistream-select message.
+const maxMultistreamMessage = 64 << 10
+
+// ErrProtocolNotSupported is returned when the peer supports none of the
+// protocols offered to it, or offers none of the supported ones.
+var ErrProtocolNotSupported = errors.New("protocol not supported")
+
+// NewStreamProtocol opens a stream and negotiates one of the given protocols
+// over it with SelectProtocol. The stream is reset if negotiation fails.
+func (mp *Multiplex) NewStreamProtocol(ctx context.Context, protocols ...string) (*Stream, string, error) {
+	s, err := mp.NewStream(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	proto, err := SelectProtocol(ctx, s, protocols...)
+	if err != nil {
+		s.Reset()
+		return nil, "", err
+	}
+	return s, proto, nil
+}
+
+// AcceptProtocol accepts the next stream and negotiates one of the given
+// protocols over it with NegotiateProtocol. The stream is reset if
+// negotiation fails.
+//
+// Negotiation happens before the next stream can be accepted: to keep a slow
+// peer from holding up the others, servers should rather Accept streams and
+// call NegotiateProtocol in their own goroutines.
+func (mp *Multiplex) AcceptProtocol(ctx context.Context, protocols ...string) (*Stream, string, error) {
+	s, err := mp.Accept()
+	if err != nil {
+		return nil, "", err
+	}
+	proto, err := NegotiateProtocol(ctx, s, protocols...)
+	if err != nil {
+		s.Reset()
+		return nil, "", err
+	}
+	return s, proto, nil
+}
+
+// SelectProtocol runs multistream-select 1.0 on a stream we opened, offering
+// the given protocols to the peer in order of preference, and returns the
+// first one it agrees to. The stream is annotated with it (see SetProtocol).
+// It fails with ErrProtocolNotSupported if the peer agrees to none.
+func SelectProtocol(ctx context.Context, s *Stream, protocols ...string) (string, error) {
+	if len(protocols) == 0 {
+		return "", ErrProtocolNotSupported
+	}
+	// Our header and first offer go out together, saving a round trip.
+	msg := appendMultistreamMsg(nil, MultistreamID)
+	msg = appendMultistreamMsg(msg, protocols[0])
+	if _, err := s.WriteContext(ctx, msg); err != nil {
+		return "", err
+	}
+	if err := readMultistreamHeader(ctx, s); err != nil {
+		return "", err
+	}
+	for i, proto := range protocols {
+		if i > 0 {
+			if _, err := s.WriteContext(ctx, appendMultistreamMsg(nil, proto)); err != nil {
+				return "", err
+			}
+		}
+		resp, err := readMultistreamMsg(ctx, s)
+		if err != nil {
+			return "", err
+		}
+		switch resp {
+		case proto:
+			s.SetProtocol(proto)
+			return proto, nil
+		case "na":
+		default:
+			return "", fmt.Errorf("unexpected multistream-select response %q to %q", resp, proto)
+		}
+	}
+	return "", ErrProtocolNotSupported
+}
+
+// NegotiateProtocol runs multistream-select 1.0 on a stream the peer opened,
+// agreeing to the first of the peer's offers that's among the given
+// protocols, and returns it. The stream is annotated with it (see
+// SetProtocol). It fails with ErrProtocolNotSupported if the peer gives up
+// before offering a supported protocol.
+func NegotiateProtocol(ctx context.Context, s *Stream, protocols ...string) (string, error) {
+	if _, err := s.WriteContext(ctx, appendMultistreamMsg(nil, MultistreamID)); err != nil {
+		return "", err
+	}
+	if err := readMultistreamHeader(ctx, s); err != nil {
+		return "", err
+	}
+	for {
+		offer, err := readMultistreamMsg(ctx, s)
+		if err == io.EOF {
+			return "", ErrProtocolNotSupported
+		}
+		if err != nil {
+			return "", err
+		}
+		for _, proto := range protocols {
+			if offer == proto {
+				if _, err := s.WriteContext(ctx, appendMultistreamMsg(nil, proto)); err != nil {
+					return "", err
+				}
+				s.SetProtocol(proto)
+				return proto, nil
+			}
+		}
+		if _, err := s.WriteContext(ctx, appendMultistreamMsg(nil, "na")); err != nil {
+			return "", err
+		}
+	}
+}
+
+func appendMultistreamMsg(buf []byte, msg string) []byte {
+	buf = appendUvarint(buf, uint64(len(msg)+1))
+	buf = append(buf, msg...)
+	return append(buf, '\n')
+}
+
+func readMultistreamHeader(ctx context.Context, s *Stream) error {
+	header, err := readMultistreamMsg(ctx, s)
+	if err != nil {
+		return err
+	}
+	if header != MultistreamID {
+		return fmt.Errorf("unexpected multistream-select header %q", header)
+	}
+	return nil
+}
+
+// readMultistreamMsg reads a message, without reading anything past it: the
+// peer may follow up with data right away.
+func readMultistreamMsg(ctx context.Context, s *Stream) (string, error) {
+	length, err := binary.ReadUvarint(byteReader{ctx, s})
+	if err != nil {
+		return "", err
+	}
+	if length == 0 || length > maxMultistreamMessage {
+		return "", fmt.Errorf("invalid multistream-select message length %d", length)
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(contextReader{ctx, s}, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	if buf[length-1] != '\n' {
+		return "", errors.New("multistream-select message without a trailing newline")
+	}
+	return string(buf[:length-1]), nil
+}
+
+type contextReader struct {
+	ctx context.Context
+	s   *Stream
+}
+
+func (r contextReader) Read(b []byte) (int, error) {
+	return r.s.ReadContext(r.ctx, b)
+}
+
+type byteReader contextReader
+
+func (r byteReader) ReadByte() (byte, error) {
+	var b [1]byte
+	_, err := io.ReadFull(contextReader(r), b[:])
+	return b[0], err
+}
@@ -0,0 +1,133 @@
+package multiplex
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Muxer starts multiplexed sessions over connections. Along with Session and
+// MuxedStream, it abstracts over stream multiplexers, so that applications can
+// switch between mplex and others (yamux, wrapped to implement it, for
+// instance), and pick one by name at runtime with LookupMuxer.
+type Muxer interface {
+	// NewConn starts a session over the connection. Exactly one side of
+	// the connection must be the server.
+	NewConn(c net.Conn, isServer bool) (Session, error)
+}
+
+// Session is a multiplexed session, as started by a Muxer.
+type Session interface {
+	// OpenStream opens a stream to the peer.
+	OpenStream(ctx context.Context) (MuxedStream, error)
+	// AcceptStream accepts the next stream opened by the peer.
+	AcceptStream() (MuxedStream, error)
+	// Close closes the session and all of its streams.
+	Close() error
+	// IsClosed returns true if the session is closed.
+	IsClosed() bool
+}
+
+// MuxedStream is a stream of a Session.
+type MuxedStream interface {
+	io.Reader
+	io.Writer
+	io.Closer
+
+	// CloseWrite closes the stream for writing, sending an EOF to the peer.
+	CloseWrite() error
+	// CloseRead closes the stream for reading.
+	CloseRead() error
+	// Reset aborts the stream in both directions.
+	Reset() error
+
+	SetDeadline(time.Time) error
+	SetReadDeadline(time.Time) error
+	SetWriteDeadline(time.Time) error
+}
+
+// NewMuxer returns the Muxer of this package, starting sessions with the
+// given options. The server side of the connections isn't the initiator.
+func NewMuxer(opts ...Option) Muxer {
+	return muxer(opts)
+}
+
+type muxer []Option
+
+func (m muxer) NewConn(c net.Conn, isServer bool) (Session, error) {
+	mp, err := NewMultiplex(c, !isServer, nil, m...)
+	if err != nil {
+		return nil, err
+	}
+	return session{mp}, nil
+}
+
+// Session returns the session as a Session, for use alongside other
+// multiplexers.
+func (mp *Multiplex) Session() Session {
+	return session{mp}
+}
+
+type session struct {
+	*Multiplex
+}
+
+func (s session) OpenStream(ctx context.Context) (MuxedStream, error) {
+	st, err := s.NewStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+func (s session) AcceptStream() (MuxedStream, error) {
+	st, err := s.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// MplexMuxerName is the name this package's Muxer is registered under.
+const MplexMuxerName = "mplex"
+
+var muxers = struct {
+	sync.RWMutex
+	m map[string]Muxer
+}{m: map[string]Muxer{MplexMuxerName: NewMuxer()}}
+
+// RegisterMuxer makes a Muxer available under the given name, replacing the
+// one registered under that name, if any. This package's is registered as
+// MplexMuxerName.
+func RegisterMuxer(name string, m Muxer) {
+	muxers.Lock()
+	muxers.m[name] = m
+	muxers.Unlock()
+}
+
+// LookupMuxer returns the Muxer registered under the given name.
+func LookupMuxer(name string) (Muxer, error) {
+	muxers.RLock()
+	m, ok := muxers.m[name]
+	muxers.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("no muxer registered as %q", name)
+	}
+	return m, nil
+}
+
+// Muxers returns the names of the registered Muxers, sorted.
+func Muxers() []string {
+	muxers.RLock()
+	names := make([]string, 0, len(muxers.m))
+	for name := range muxers.m {
+		names = append(names, name)
+	}
+	muxers.RUnlock()
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,71 @@
+package multiplex
+
+import (
+	"errors"
+	"fmt"
+)
+
+// errNameTooLong is returned when reading the name of a stream the peer opens
+// if it's longer than allowed (see WithMaxStreamNameLength). The stream is
+// refused, but the session carries on.
+var errNameTooLong = errors.New("stream name too long")
+
+// WithMaxStreamNameLength sets the longest name the peer may give the streams
+// it opens: streams with longer names are refused, by resetting them. This is
+// independent of WithMaxMessageSize, which also bounds the names. By default,
+// names of any length are accepted, but those longer than 1KiB aren't kept
+// with WithStreamNames; with a limit set, all accepted names are kept.
+//
+// The names kept are accounted for with the MemoryManager, at the priority
+// inbound buffers are reserved with, for as long as their stream lives.
+// Streams are refused if the memory for their name isn't granted.
+func WithMaxStreamNameLength(n int) Option {
+	return func(c *config) error {
+		if n < 0 {
+			return fmt.Errorf("invalid max stream name length: %d", n)
+		}
+		c.maxNameLen = n
+		return nil
+	}
+}
+
+// keptNameLimit returns the longest stream name kept with WithStreamNames.
+func (mp *Multiplex) keptNameLimit() int {
+	if mp.maxNameLen > 0 {
+		return mp.maxNameLen
+	}
+	return maxKeptName
+}
+
+// reserveName reserves memory for keeping the name of a stream the peer
+// opens. It returns false if the memory isn't granted.
+func (mp *Multiplex) reserveName(name string) bool {
+	if name == "" {
+		return true
+	}
+	mp.shutdownLock.Lock()
+	defer mp.shutdownLock.Unlock()
+	if mp.isShutdown() {
+		return false
+	}
+	if err := mp.memoryManager.ReserveMemory(len(name), mp.inPriority); err != nil {
+		return false
+	}
+	mp.reservedMemory += len(name)
+	return true
+}
+
+// releaseName releases the memory reserved with reserveName.
+func (mp *Multiplex) releaseName(name string) {
+	if name == "" {
+		return
+	}
+	mp.shutdownLock.Lock()
+	defer mp.shutdownLock.Unlock()
+	if mp.isShutdown() {
+		// It was released with the rest when the session was closed.
+		return
+	}
+	mp.memoryManager.ReleaseMemory(len(name))
+	mp.reservedMemory -= len(name)
+}
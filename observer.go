@@ -0,0 +1,117 @@
+package multiplex
+
+import (
+	"encoding/binary"
+
+	"github.com/libp2p/go-mplex/frame"
+)
+
+// FrameDirection is the direction of a frame relative to the local session.
+type FrameDirection int
+
+const (
+	// FrameInbound frames were received from the peer.
+	FrameInbound FrameDirection = iota
+	// FrameOutbound frames were sent to the peer.
+	FrameOutbound
+)
+
+func (d FrameDirection) String() string {
+	switch d {
+	case FrameInbound:
+		return "inbound"
+	case FrameOutbound:
+		return "outbound"
+	default:
+		return "unknown"
+	}
+}
+
+// FrameInfo describes a single frame sent or received by a session.
+type FrameInfo struct {
+	Direction FrameDirection
+	// StreamID is the stream ID as encoded on the wire.
+	StreamID uint64
+	// Tag is the raw tag as encoded on the wire (0-7).
+	Tag uint64
+	// Length is the length of the frame's payload.
+	Length int
+	// Payload is only set when the observer was registered with payloads
+	// enabled. It's only valid for the duration of the ObserveFrame call.
+	//
+	// Inbound payloads are truncated to the size of the session's read buffer.
+	Payload []byte
+}
+
+// FrameObserver is notified of every frame sent and received by a session.
+//
+// ObserveFrame is called synchronously from the session's read and write
+// loops and must not block.
+type FrameObserver interface {
+	ObserveFrame(FrameInfo)
+}
+
+// WithFrameObserver registers an observer for all frames sent and received
+// by the session. If payloads is true, the observer is also handed the frame
+// payloads.
+func WithFrameObserver(o FrameObserver, payloads bool) Option {
+	return func(c *config) error {
+		c.frameObserver = o
+		c.observePayloads = payloads
+		return nil
+	}
+}
+
+// observeInbound counts and reports an inbound frame whose header has just
+// been read.
+func (mp *Multiplex) observeInbound(chID, tag uint64, mlen int) {
+	mp.counters.countFrame(FrameInbound, tag, mlen)
+	if mp.frameObserver == nil {
+		return
+	}
+
+	info := FrameInfo{
+		Direction: FrameInbound,
+		StreamID:  chID,
+		Tag:       tag,
+		Length:    mlen,
+	}
+	if mp.observePayloads && mlen > 0 {
+		n := mlen
+		if n > mp.buf.Size() {
+			n = mp.buf.Size()
+		}
+		// On error, we'll find out when actually reading the payload.
+		info.Payload, _ = mp.buf.Peek(n)
+	}
+	mp.frameObserver.ObserveFrame(info)
+}
+
+// outboundFrameInfo describes an encoded outbound frame, leaving out the
+// payload.
+func outboundFrameInfo(data []byte) FrameInfo {
+	header, n := binary.Uvarint(data)
+	mlen, _ := binary.Uvarint(data[n:])
+	id, tag := frame.UnpackHeader(header)
+	return FrameInfo{
+		Direction: FrameOutbound,
+		StreamID:  id,
+		Tag:       tag,
+		Length:    int(mlen),
+	}
+}
+
+// observeOutbound counts and reports an encoded outbound frame.
+func (mp *Multiplex) observeOutbound(data []byte) {
+	info := outboundFrameInfo(data)
+
+	mp.counters.countFrame(FrameOutbound, info.Tag, info.Length)
+	if mp.frameObserver == nil {
+		return
+	}
+
+	if mp.observePayloads {
+		info.Payload = data[len(data)-info.Length:]
+	}
+	mp.frameObserver.ObserveFrame(info)
+}
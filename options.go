@@ -0,0 +1,309 @@
+package multiplex
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-mplex/frame"
+)
+
+// Option configures optional behavior of a Multiplex session.
+type Option func(*config) error
+
+type config struct {
+	// sendRate and recvRate are bandwidth caps in bytes per second. Zero
+	// means unlimited.
+	sendRate, recvRate int
+
+	// inBuffers and outBuffers are the maximum number of inbound and
+	// outbound buffer slots. The latter also bounds the depth of the write
+	// queue. inPriority and outPriority are the priorities used to reserve
+	// memory for the optional slots.
+	inBuffers, outBuffers   int
+	inPriority, outPriority uint8
+	// acceptBacklog is the number of inbound streams that may be queued
+	// waiting for Accept.
+	acceptBacklog int
+	// readBufferSize is the size of the buffered reader over the connection.
+	readBufferSize int
+	// recvChunkSize is the size of the pieces message payloads are
+	// delivered to streams in.
+	recvChunkSize int
+	// maxMessageSize is the size of the largest frame payload we accept.
+	maxMessageSize int
+
+	// coalesceDelay is how long outbound frames may be held back, waiting for
+	// more frames to write with them. coalesceThreshold is the amount of
+	// buffered data that triggers an immediate flush. Coalescing is disabled
+	// if the threshold is zero.
+	coalesceDelay     time.Duration
+	coalesceThreshold int
+
+	// writeTimeout bounds each write to the connection. Zero means no
+	// bound.
+	writeTimeout time.Duration
+
+	loop *EventLoop
+	ring *IOURing
+
+	bufferPool BufferPool
+	clock      Clock
+	logger     Logger
+	label      string
+
+	maxInboundStreams, maxOutboundStreams int
+
+	// streamInboundBytes and sessionInboundBytes cap the number of received
+	// bytes buffered waiting to be read. Zero means no limit beyond the
+	// buffer slots.
+	streamInboundBytes, sessionInboundBytes int
+
+	frameObserver   FrameObserver
+	observePayloads bool
+
+	negotiate    bool
+	capabilities Capability
+	strict       bool
+
+	keepNames bool
+
+	leakInterval time.Duration
+
+	maxLifetime, lifetimeGrace time.Duration
+
+	maxNameLen int
+
+	onSlowReader SlowReaderFunc
+
+	manager *Manager
+
+	onMisbehavior func(Misbehavior)
+
+	halfClosedTimeout   time.Duration
+	onHalfClosedTimeout func(*Stream)
+
+	streamRate  float64
+	streamBurst int
+
+	injector frameInjector
+}
+
+func defaultConfig() config {
+	return config{
+		inBuffers:      MaxBuffers,
+		outBuffers:     MaxBuffers,
+		inPriority:     128,
+		outPriority:    128,
+		acceptBacklog:  16,
+		readBufferSize: BufferSize,
+		recvChunkSize:  BufferSize,
+		maxMessageSize: MaxMessageSize,
+		capabilities:   AllCapabilities,
+		bufferPool:     defaultBufferPool,
+		clock:          realClock{},
+		logger:         log,
+	}
+}
+
+// WithBandwidthLimit caps the session-wide outbound and inbound throughput,
+// in bytes per second. A limit of zero disables throttling in that direction.
+func WithBandwidthLimit(send, recv int) Option {
+	return func(c *config) error {
+		c.sendRate = send
+		c.recvRate = recv
+		return nil
+	}
+}
+
+// WithMaxBuffers sets the maximum number of buffer slots reserved in each
+// direction (defaults to MaxBuffers). The outbound slot count is also the
+// maximum number of frames waiting in the write queue. Additional slots are
+// only used if the MemoryManager grants the memory for them.
+func WithMaxBuffers(n int) Option {
+	return func(c *config) error {
+		if n < 1 {
+			return fmt.Errorf("invalid buffer count: %d", n)
+		}
+		c.inBuffers = n
+		c.outBuffers = n
+		return nil
+	}
+}
+
+// WithInboundBuffers sets the maximum number of inbound buffer slots, and the
+// priority used to ask the MemoryManager for the memory of all but the first
+// two. Sessions that mostly receive can use it to reserve more memory for
+// reading than for writing.
+func WithInboundBuffers(n int, prio uint8) Option {
+	return func(c *config) error {
+		if n < 1 {
+			return fmt.Errorf("invalid buffer count: %d", n)
+		}
+		c.inBuffers = n
+		c.inPriority = prio
+		return nil
+	}
+}
+
+// WithOutboundBuffers is like WithInboundBuffers, but for outbound buffer
+// slots. It also bounds the depth of the write queue.
+func WithOutboundBuffers(n int, prio uint8) Option {
+	return func(c *config) error {
+		if n < 1 {
+			return fmt.Errorf("invalid buffer count: %d", n)
+		}
+		c.outBuffers = n
+		c.outPriority = prio
+		return nil
+	}
+}
+
+// WithAcceptBacklog sets the number of inbound streams that may be queued
+// waiting for Accept (defaults to 16). Once the backlog is full, the session
+// stops reading from the connection until Accept is called.
+func WithAcceptBacklog(n int) Option {
+	return func(c *config) error {
+		if n < 0 {
+			return fmt.Errorf("invalid accept backlog: %d", n)
+		}
+		c.acceptBacklog = n
+		return nil
+	}
+}
+
+// WithReadBufferSize sets the size of the buffer used to read from the
+// connection (defaults to BufferSize). A larger buffer reduces the number of
+// reads needed to receive large messages on high-bandwidth links. Sizes beyond
+// MaxMessageSize plus a frame header are capped.
+func WithReadBufferSize(n int) Option {
+	return func(c *config) error {
+		if n < BufferSize {
+			return fmt.Errorf("read buffer size must be at least %d bytes: %d", BufferSize, n)
+		}
+		if max := MaxMessageSize + frame.MaxHeaderSize; n > max {
+			n = max
+		}
+		c.readBufferSize = n
+		return nil
+	}
+}
+
+// WithWriteCoalescing buffers outbound frames, so that many small frames
+// (e.g., closes and resets) end up in a single write to the connection. The
+// buffer is flushed once it holds flushThreshold bytes, or delay after the
+// first frame was buffered, whichever comes first. With a zero delay, the
+// buffer is flushed as soon as there are no more frames waiting to be sent.
+func WithWriteCoalescing(delay time.Duration, flushThreshold int) Option {
+	return func(c *config) error {
+		if delay < 0 {
+			return fmt.Errorf("invalid write coalescing delay: %s", delay)
+		}
+		if flushThreshold < 1 {
+			return fmt.Errorf("invalid flush threshold: %d", flushThreshold)
+		}
+		c.coalesceDelay = delay
+		c.coalesceThreshold = flushThreshold
+		return nil
+	}
+}
+
+// WithStreamLimits limits the number of concurrently open streams in each
+// direction. Streams the peer opens beyond the inbound limit are reset
+// without being delivered to Accept. Opening streams beyond the outbound
+// limit fails with ErrStreamLimitReached. A stream stays open until it has
+// been closed or reset in both directions. A limit of zero means unlimited.
+func WithStreamLimits(inbound, outbound int) Option {
+	return func(c *config) error {
+		if inbound < 0 || outbound < 0 {
+			return fmt.Errorf("invalid stream limits: %d/%d", inbound, outbound)
+		}
+		c.maxInboundStreams = inbound
+		c.maxOutboundStreams = outbound
+		return nil
+	}
+}
+
+// WithInboundBufferLimits caps the number of received bytes buffered waiting
+// to be read, per stream and across the session. Once a limit is reached, the
+// session stops reading from the connection until the data is consumed; if a
+// stream doesn't catch up within ReceiveTimeout, it's reset. The session-wide
+// limit never exceeds the inbound memory granted by the MemoryManager. A
+// limit of zero means no limit beyond the buffer slots.
+func WithInboundBufferLimits(perStream, perSession int) Option {
+	return func(c *config) error {
+		if perStream < 0 || perSession < 0 {
+			return fmt.Errorf("invalid inbound buffer limits: %d/%d", perStream, perSession)
+		}
+		c.streamInboundBytes = perStream
+		c.sessionInboundBytes = perSession
+		return nil
+	}
+}
+
+// WithReceiveChunkSize sets the size of the pieces large messages are
+// delivered to streams in (defaults to, and may not exceed, BufferSize).
+// Messages are never buffered whole: their payload is handed to the stream as
+// it's read off the connection, one chunk at a time. Smaller chunks bound the
+// memory held per stream more tightly, at the cost of more overhead per byte.
+func WithReceiveChunkSize(n int) Option {
+	return func(c *config) error {
+		if n < 1 || n > BufferSize {
+			return fmt.Errorf("invalid receive chunk size: %d", n)
+		}
+		c.recvChunkSize = n
+		return nil
+	}
+}
+
+// WithMaxMessageSize sets the size of the largest frame payload accepted from
+// the peer (defaults to, and may not exceed, MaxMessageSize). The session is
+// shut down if the peer sends a larger one.
+//
+// With version negotiation (see WithVersionNegotiation), the limit is
+// announced to the peer, and peers supporting CapMessageSize keep their
+// frames within it: they split data into smaller frames, and fail to
+// open streams whose name doesn't fit with ErrMessageTooLarge.
+func WithMaxMessageSize(n int) Option {
+	return func(c *config) error {
+		if n < BufferSize || n > MaxMessageSize {
+			return fmt.Errorf("invalid max message size: %d (must be between %d and %d)", n, BufferSize, MaxMessageSize)
+		}
+		c.maxMessageSize = n
+		return nil
+	}
+}
+
+// WithWriteTimeout bounds how long a single write to the connection may take,
+// using write deadlines on the connection. A peer that stops reading
+// eventually fills up the connection's buffers, blocking writes forever; with
+// a write timeout, the session is shut down with a *WriteError instead. It's
+// disabled (zero) by default.
+func WithWriteTimeout(d time.Duration) Option {
+	return func(c *config) error {
+		if d < 0 {
+			return fmt.Errorf("invalid write timeout: %s", d)
+		}
+		c.writeTimeout = d
+		return nil
+	}
+}
+
+// WithLabel gives the session a label, included in its logs, profiles,
+// published statistics and String, to tell it apart from the others.
+func WithLabel(label string) Option {
+	return func(c *config) error {
+		c.label = label
+		return nil
+	}
+}
+
+// WithStreamNames keeps the names the peer gives the streams it opens, for
+// Name to return. By default they're discarded, as libp2p has no use for
+// them. Names longer than 1KiB are still discarded, unless allowed with
+// WithMaxStreamNameLength.
+func WithStreamNames() Option {
+	return func(c *config) error {
+		c.keepNames = true
+		return nil
+	}
+}
@@ -0,0 +1,80 @@
+package multiplex
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// ErrPingUnsupported is returned by Ping when pings aren't in use on the
+// session (see CapPing).
+var ErrPingUnsupported = errors.New("peer doesn't support pings")
+
+// Ping measures the round-trip time to the peer, by sending it a ping on the
+// control stream and waiting for its answer. Pings are a protocol extension:
+// Ping fails with ErrPingUnsupported unless both sides support CapPing.
+func (mp *Multiplex) Ping(ctx context.Context) (time.Duration, error) {
+	if !mp.supports(CapPing) {
+		return 0, ErrPingUnsupported
+	}
+
+	pong := make(chan struct{})
+	mp.pingLock.Lock()
+	mp.lastPing++
+	id := mp.lastPing
+	if mp.pings == nil {
+		mp.pings = make(map[uint64]chan struct{})
+	}
+	mp.pings[id] = pong
+	mp.pingLock.Unlock()
+	defer func() {
+		mp.pingLock.Lock()
+		delete(mp.pings, id)
+		mp.pingLock.Unlock()
+	}()
+
+	start := mp.clock.Now()
+	if err := mp.sendControl(ctx.Done(), ctrlPing, appendUvarint(nil, id), nil); err != nil {
+		if err == errTimeout {
+			return 0, ctx.Err()
+		}
+		return 0, err
+	}
+	select {
+	case <-pong:
+		return mp.clock.Now().Sub(start), nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-mp.closed:
+		return 0, mp.shutdownErr
+	}
+}
+
+func (mp *Multiplex) handlePing(payload []byte) error {
+	id, n := binary.Uvarint(payload)
+	if n <= 0 {
+		mp.log.Debugw("received malformed ping")
+		return nil
+	}
+	mp.spawn(func() { mp.sendControl(nil, ctrlPong, appendUvarint(nil, id), nil) })
+	return nil
+}
+
+func (mp *Multiplex) handlePong(payload []byte) error {
+	id, n := binary.Uvarint(payload)
+	if n <= 0 {
+		mp.log.Debugw("received malformed pong")
+		return nil
+	}
+	mp.pingLock.Lock()
+	pong, ok := mp.pings[id]
+	delete(mp.pings, id)
+	mp.pingLock.Unlock()
+	if !ok {
+		mp.log.Debugw("received unexpected pong", "ping", id)
+		return nil
+	}
+	close(pong)
+	return nil
+}
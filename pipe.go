@@ -0,0 +1,109 @@
+package multiplex
+
+import (
+	"context"
+	"io"
+	"net"
+)
+
+// PipeDirection tells how the copy one way through a pipe went: Bytes is the
+// number of bytes copied, and Err why the copy stopped short, if it did.
+type PipeDirection struct {
+	Bytes int64
+	Err   error
+}
+
+// PipeResult is the outcome of Pipe, for each direction.
+type PipeResult struct {
+	AToB PipeDirection
+	BToA PipeDirection
+}
+
+// Pipe copies data both ways between a and b, typically a stream and the
+// connection it's tunneled to, until both sides are done, then closes both.
+//
+// The end of the data one way is forwarded as a close of the write side of
+// the other end, where supported (streams, TCP connections); otherwise, the
+// other end is closed, even if that cuts off data the other way. An error
+// either way aborts both ends: streams are reset, with the error as the
+// reason, and connections closed abruptly. So is ctx being done, in which
+// case the directions that weren't done report ctx.Err().
+func Pipe(ctx context.Context, a, b io.ReadWriteCloser) PipeResult {
+	return pipe(ctx, a, b, "pipe: ")
+}
+
+// pipe is Pipe, with the prefix of the reason streams are reset with.
+func pipe(ctx context.Context, a, b io.ReadWriteCloser, prefix string) PipeResult {
+	var res PipeResult
+	abort := func(err error) {
+		abortPipeEnd(a, prefix+err.Error())
+		abortPipeEnd(b, prefix+err.Error())
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		res.AToB = copyHalf(b, a, abort)
+	}()
+	stop := make(chan struct{})
+	canceled := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			abort(ctx.Err())
+			canceled <- true
+		case <-stop:
+			canceled <- false
+		}
+	}()
+	res.BToA = copyHalf(a, b, abort)
+	<-done
+	close(stop)
+
+	if <-canceled {
+		if res.AToB.Err != nil {
+			res.AToB.Err = ctx.Err()
+		}
+		if res.BToA.Err != nil {
+			res.BToA.Err = ctx.Err()
+		}
+	}
+	a.Close()
+	b.Close()
+	return res
+}
+
+// copyHalf copies src to dst, closing the write side of dst at the end, or
+// aborting on errors.
+func copyHalf(dst, src io.ReadWriteCloser, abort func(error)) PipeDirection {
+	n, err := io.Copy(dst, src)
+	if err != nil {
+		abort(err)
+		return PipeDirection{Bytes: n, Err: err}
+	}
+	if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+		if cw.CloseWrite() == nil {
+			return PipeDirection{Bytes: n}
+		}
+	}
+	// dst can't be half-closed: closing it is the best we can do, even if it
+	// cuts off the reply.
+	dst.Close()
+	return PipeDirection{Bytes: n}
+}
+
+// abortPipeEnd tears down one end of a pipe, telling the other side that
+// something went wrong where possible.
+func abortPipeEnd(c io.ReadWriteCloser, reason string) {
+	switch c := c.(type) {
+	case *Stream:
+		c.ResetWithReason(reason)
+	case interface{ Reset() error }:
+		// Streams of other multiplexers.
+		c.Reset()
+	case net.Conn:
+		abortConn(c)
+	default:
+		c.Close()
+	}
+}
@@ -0,0 +1,70 @@
+package multiplex
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// ProxyDialFunc dials the connection a stream opened by the peer is forwarded
+// to, given the stream's name. ctx is done if the stream is reset meanwhile.
+type ProxyDialFunc func(ctx context.Context, name string) (net.Conn, error)
+
+// Proxy forwards the streams the peer opens to connections obtained from a
+// dial function, copying data both ways until both sides are done. A close
+// is forwarded as a close of the write side of the other end, where
+// supported, and a reset or connection error on either side aborts the
+// other: the stream is reset, or the connection closed.
+//
+// Stream names are only available with WithStreamNames; without it, the dial
+// function always gets an empty name.
+type Proxy struct {
+	mp   *Multiplex
+	dial ProxyDialFunc
+	wg   sync.WaitGroup
+}
+
+// NewProxy returns a Proxy forwarding the streams of the given session to the
+// connections dial returns. It doesn't do anything until Serve is called.
+func NewProxy(mp *Multiplex, dial ProxyDialFunc) *Proxy {
+	return &Proxy{mp: mp, dial: dial}
+}
+
+// Serve accepts the streams the peer opens and forwards them, until the
+// session is closed. It then waits for the streams being forwarded to be
+// done, and returns why the session was closed.
+func (p *Proxy) Serve() error {
+	for {
+		s, err := p.mp.Accept()
+		if err != nil {
+			p.wg.Wait()
+			return err
+		}
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			p.forward(s)
+		}()
+	}
+}
+
+// forward pipes the stream to a connection dialed for it.
+func (p *Proxy) forward(s *Stream) {
+	conn, err := p.dial(s.Context(), s.Name())
+	if err != nil {
+		p.mp.log.Debugw("proxy: dial failed", append(s.logFields(), "error", err)...)
+		s.ResetWithReason("proxy: " + err.Error())
+		return
+	}
+	pipe(context.Background(), s, conn, "proxy: ")
+}
+
+// abortConn closes the connection abruptly, telling the other end that
+// something went wrong where the connection allows it.
+func abortConn(conn net.Conn) {
+	if l, ok := conn.(interface{ SetLinger(int) error }); ok {
+		// Closing with a linger of zero resets TCP connections.
+		l.SetLinger(0)
+	}
+	conn.Close()
+}
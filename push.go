@@ -0,0 +1,110 @@
+package multiplex
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// ErrDataHandlerSet is returned when reading from a stream with a data
+// handler, whose data goes to the handler instead, and when setting a second
+// handler.
+var ErrDataHandlerSet = errors.New("stream has a data handler")
+
+// SetDataHandler switches the stream to push delivery: the data received on
+// it is handed to h as it's read off the connection, by the session's read
+// loop, rather than queued for Read. This saves a copy, and a goroutine
+// reading, for consumers that process data with callbacks. The data is only
+// valid until h returns. Any data queued before the handler was set is handed
+// to it first, in order. Once the peer closes the stream, h is called one last
+// time with nil.
+//
+// The whole session waits for h while it runs: a handler that blocks holds up
+// the peer, as if it didn't read, but is never reset because of
+// ReceiveTimeout. If h returns an error, the stream is reset, with the error
+// as the reason, and h isn't called anymore.
+//
+// Once a handler is set, Read and the like fail with ErrDataHandlerSet, and
+// mustn't be running. The handler can't be removed.
+func (s *Stream) SetDataHandler(h func([]byte) error) error {
+	if h == nil {
+		return errors.New("nil data handler")
+	}
+	s.pushLock.Lock()
+	defer s.pushLock.Unlock()
+	if s.handler != nil {
+		return ErrDataHandlerSet
+	}
+	s.handler = h
+	atomic.StoreInt32(&s.pushMode, 1)
+	s.pushQueued()
+	return nil
+}
+
+func (s *Stream) isPushMode() bool {
+	return atomic.LoadInt32(&s.pushMode) != 0
+}
+
+// push hands a buffer read off the connection to the data handler, and
+// releases it. It returns the handler's error, once the stream is reset.
+func (s *Stream) push(b []byte) error {
+	s.pushLock.Lock()
+	defer s.pushLock.Unlock()
+	err := s.pushQueued()
+	if err == nil {
+		err = s.callHandler(b)
+	}
+	s.mp.putBufferInbound(b)
+	return err
+}
+
+// pushQueued hands the data queued for Read to the data handler, and the EOF
+// if the peer closed the stream. It's called with pushLock held, by
+// SetDataHandler and by the read loop whenever it may have queued data meant
+// for the handler.
+func (s *Stream) pushQueued() error {
+	if s.exbuf != nil {
+		err := s.callHandler(s.extra)
+		s.releaseInbound(s.exbuf)
+		s.extra, s.exbuf = nil, nil
+		if err != nil {
+			return err
+		}
+	}
+	for {
+		select {
+		case b, ok := <-s.dataIn:
+			if !ok {
+				if !s.pushedEOF {
+					s.pushedEOF = true
+					s.callHandler(nil)
+					s.ackClose()
+				}
+				return nil
+			}
+			if b == nil {
+				continue
+			}
+			err := s.callHandler(b)
+			s.releaseInbound(b)
+			if err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+	}
+}
+
+// callHandler calls the data handler, unless the stream was reset, and
+// resets the stream if it fails.
+func (s *Stream) callHandler(b []byte) error {
+	if isClosedChan(s.readCancel) {
+		return s.readCancelErr
+	}
+	err := s.handler(b)
+	if err != nil {
+		reason := "data handler: " + err.Error()
+		s.reset(&ResetError{Reason: reason}, reason)
+	}
+	return err
+}
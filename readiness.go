@@ -0,0 +1,87 @@
+package multiplex
+
+// closedChan is a channel that's always ready.
+var closedChan = func() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}()
+
+// Writable returns a channel that's closed once a write to the stream can
+// queue data without waiting for an outbound buffer. Outbound buffers are
+// shared by the streams of the session: by the time the caller writes,
+// another stream may have taken the buffer, in which case the write waits
+// for the next one as usual.
+//
+// The channel is closed right away if writing to the stream would fail
+// without blocking (because it was closed or reset). It isn't closed if that
+// happens later on: event loops should watch CloseChan as well.
+func (s *Stream) Writable() <-chan struct{} {
+	if isClosedChan(s.writeCancel) {
+		return closedChan
+	}
+	return s.mp.outboundReady()
+}
+
+// outboundReady returns a channel that's closed once an outbound buffer is
+// free.
+func (mp *Multiplex) outboundReady() <-chan struct{} {
+	mp.readyLock.Lock()
+	defer mp.readyLock.Unlock()
+
+	if len(mp.bufOut) < cap(mp.bufOut) || mp.isShutdown() {
+		return closedChan
+	}
+	if mp.outboundFreed == nil {
+		mp.outboundFreed = make(chan struct{})
+	}
+	return mp.outboundFreed
+}
+
+// notifyOutboundFreed wakes up those waiting for an outbound buffer in
+// outboundReady.
+func (mp *Multiplex) notifyOutboundFreed() {
+	mp.readyLock.Lock()
+	if mp.outboundFreed != nil {
+		close(mp.outboundFreed)
+		mp.outboundFreed = nil
+	}
+	mp.readyLock.Unlock()
+}
+
+// Readable returns a channel that's closed once a read from the stream can
+// proceed without blocking: there's data waiting to be read, the peer closed
+// the stream, or reading was canceled. It lets a single goroutine serve many
+// streams, by selecting on their readiness instead of dedicating a blocked
+// Read to each.
+//
+// Like Read, Readable must not be called concurrently with reads.
+func (s *Stream) Readable() <-chan struct{} {
+	s.readyLock.Lock()
+	defer s.readyLock.Unlock()
+
+	if s.extra != nil || len(s.dataIn) > 0 || isClosedChan(s.readCancel) {
+		return closedChan
+	}
+	s.clLock.Lock()
+	eof := s.readEOF
+	s.clLock.Unlock()
+	if eof {
+		return closedChan
+	}
+
+	if s.readable == nil {
+		s.readable = make(chan struct{})
+	}
+	return s.readable
+}
+
+// notifyReadable wakes up those waiting for the stream in Readable.
+func (s *Stream) notifyReadable() {
+	s.readyLock.Lock()
+	if s.readable != nil {
+		close(s.readable)
+		s.readable = nil
+	}
+	s.readyLock.Unlock()
+}
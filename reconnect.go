@@ -0,0 +1,224 @@
+package multiplex
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// ReconnectConfig configures a ReconnectingMultiplex.
+type ReconnectConfig struct {
+	// MinBackoff and MaxBackoff bound the delay between failed attempts to
+	// connect, which doubles after every failure (defaults to 100ms and
+	// 30s).
+	MinBackoff, MaxBackoff time.Duration
+
+	// NewMemoryManager, if set, is called to get the memory manager of each
+	// new session.
+	NewMemoryManager func() MemoryManager
+
+	// OnConnect, if set, is called whenever a new session is established,
+	// before the registered streams are opened.
+	OnConnect func(mp *Multiplex)
+	// OnDisconnect, if set, is called whenever the session goes away, with
+	// the reason.
+	OnDisconnect func(err error)
+	// OnDialError, if set, is called whenever an attempt to connect fails.
+	OnDialError func(err error)
+	// OnStreamError, if set, is called whenever a registered stream can't
+	// be opened on a session, with its name and the reason (e.g.,
+	// ErrStreamLimitReached, or ErrDraining). It's opened again on the next
+	// session.
+	OnStreamError func(name string, err error)
+
+	// HandleStream, if set, is called, in a new goroutine, with every stream
+	// the peer opens. Without it, those streams are reset: the sessions'
+	// streams are accepted for us, so that the backlog doesn't fill up.
+	HandleStream func(*Stream)
+}
+
+// ReconnectingMultiplex maintains a session to a peer, dialing it again
+// whenever the session fails. Streams registered with RegisterStream are
+// opened again on every new session, and the streams the peer opens are
+// passed to ReconnectConfig.HandleStream. We're the initiator of every session.
+type ReconnectingMultiplex struct {
+	dial func(ctx context.Context) (net.Conn, error)
+	cfg  ReconnectConfig
+	opts []Option
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu       sync.Mutex
+	sess     *Multiplex
+	handlers []namedStreamHandler
+}
+
+type namedStreamHandler struct {
+	name    string
+	handler func(*Stream)
+}
+
+// NewReconnectingMultiplex starts maintaining a session over the connections
+// returned by dial.
+func NewReconnectingMultiplex(dial func(ctx context.Context) (net.Conn, error), cfg ReconnectConfig, opts ...Option) *ReconnectingMultiplex {
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = 100 * time.Millisecond
+	}
+	if cfg.MaxBackoff < cfg.MinBackoff {
+		cfg.MaxBackoff = 30 * time.Second
+		if cfg.MaxBackoff < cfg.MinBackoff {
+			cfg.MaxBackoff = cfg.MinBackoff
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &ReconnectingMultiplex{
+		dial:   dial,
+		cfg:    cfg,
+		opts:   opts,
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go r.run()
+	return r
+}
+
+// RegisterStream registers a stream to open on every session: handler is
+// called, in a new goroutine, with a stream opened with the given name
+// whenever a session is established, including the current one.
+func (r *ReconnectingMultiplex) RegisterStream(name string, handler func(*Stream)) {
+	r.mu.Lock()
+	r.handlers = append(r.handlers, namedStreamHandler{name, handler})
+	sess := r.sess
+	r.mu.Unlock()
+
+	if sess != nil {
+		go r.openStream(sess, name, handler)
+	}
+}
+
+// Session returns the current session, or nil if we're not connected.
+func (r *ReconnectingMultiplex) Session() *Multiplex {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.sess
+}
+
+// Close closes the current session, and stops reconnecting.
+func (r *ReconnectingMultiplex) Close() error {
+	r.cancel()
+	<-r.done
+	return nil
+}
+
+func (r *ReconnectingMultiplex) run() {
+	defer close(r.done)
+
+	backoff := r.cfg.MinBackoff
+	for {
+		err := r.connect()
+		if err != nil {
+			if r.ctx.Err() == nil && r.cfg.OnDialError != nil {
+				r.cfg.OnDialError(err)
+			}
+		} else {
+			// Reconnect right away, but not in a tight loop if the
+			// sessions keep failing immediately.
+			backoff = r.cfg.MinBackoff
+		}
+
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if err != nil {
+			backoff *= 2
+			if backoff > r.cfg.MaxBackoff {
+				backoff = r.cfg.MaxBackoff
+			}
+		}
+	}
+}
+
+// connect establishes a session, and runs it until it fails.
+func (r *ReconnectingMultiplex) connect() error {
+	con, err := r.dial(r.ctx)
+	if err != nil {
+		return err
+	}
+	var mm MemoryManager
+	if r.cfg.NewMemoryManager != nil {
+		mm = r.cfg.NewMemoryManager()
+	}
+	mp, err := NewMultiplex(con, true, mm, r.opts...)
+	if err != nil {
+		con.Close()
+		return err
+	}
+	r.serve(mp)
+	return nil
+}
+
+// serve runs a session until it fails, or we're closed.
+func (r *ReconnectingMultiplex) serve(mp *Multiplex) {
+	if r.cfg.OnConnect != nil {
+		r.cfg.OnConnect(mp)
+	}
+
+	r.mu.Lock()
+	r.sess = mp
+	handlers := append([]namedStreamHandler(nil), r.handlers...)
+	r.mu.Unlock()
+
+	for _, h := range handlers {
+		go r.openStream(mp, h.name, h.handler)
+	}
+	go r.acceptStreams(mp)
+
+	select {
+	case <-mp.CloseChan():
+	case <-r.ctx.Done():
+		mp.Close()
+	}
+
+	r.mu.Lock()
+	r.sess = nil
+	r.mu.Unlock()
+
+	if r.cfg.OnDisconnect != nil {
+		r.cfg.OnDisconnect(mp.ShutdownReason())
+	}
+}
+
+func (r *ReconnectingMultiplex) openStream(mp *Multiplex, name string, handler func(*Stream)) {
+	s, err := mp.NewNamedStream(r.ctx, name)
+	if err != nil {
+		// We'll try again on the next session.
+		if r.ctx.Err() == nil && r.cfg.OnStreamError != nil {
+			r.cfg.OnStreamError(name, err)
+		}
+		return
+	}
+	handler(s)
+}
+
+// acceptStreams passes the streams the peer opens to the handler, until the
+// session goes away.
+func (r *ReconnectingMultiplex) acceptStreams(mp *Multiplex) {
+	for {
+		s, err := mp.Accept()
+		if err != nil {
+			return
+		}
+		if r.cfg.HandleStream == nil {
+			s.Reset()
+			continue
+		}
+		go r.cfg.HandleStream(s)
+	}
+}
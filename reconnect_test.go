@@ -0,0 +1,161 @@
+package multiplex
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReconnectingMultiplex(t *testing.T) {
+	var mu sync.Mutex
+	var servers []*Multiplex
+	accepted := make(chan *Stream, 10)
+	dials := 0
+
+	dial := func(ctx context.Context) (net.Conn, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		dials++
+		if dials == 2 {
+			return nil, errors.New("transient failure")
+		}
+		a, b := net.Pipe()
+		srv, err := NewMultiplex(b, false, nil)
+		if err != nil {
+			return nil, err
+		}
+		servers = append(servers, srv)
+		go func() {
+			for {
+				s, err := srv.Accept()
+				if err != nil {
+					return
+				}
+				accepted <- s
+			}
+		}()
+		return a, nil
+	}
+
+	connects := make(chan *Multiplex, 10)
+	disconnects := make(chan error, 10)
+	dialErrors := make(chan error, 10)
+	r := NewReconnectingMultiplex(dial, ReconnectConfig{
+		MinBackoff:   10 * time.Millisecond,
+		OnConnect:    func(mp *Multiplex) { connects <- mp },
+		OnDisconnect: func(err error) { disconnects <- err },
+		OnDialError:  func(err error) { dialErrors <- err },
+	})
+	defer r.Close()
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, srv := range servers {
+			srv.Close()
+		}
+	}()
+
+	opened := make(chan *Stream, 10)
+	r.RegisterStream("control", func(s *Stream) { opened <- s })
+
+	expect := func() {
+		t.Helper()
+		select {
+		case <-connects:
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected a session")
+		}
+		for _, ch := range []chan *Stream{opened, accepted} {
+			select {
+			case <-ch:
+			case <-time.After(5 * time.Second):
+				t.Fatal("expected the registered stream to be opened")
+			}
+		}
+	}
+	expect()
+
+	// Kill the session from the other end; we should reconnect, despite
+	// the failed dial.
+	mu.Lock()
+	servers[0].Close()
+	mu.Unlock()
+	select {
+	case <-disconnects:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a disconnect")
+	}
+	select {
+	case <-dialErrors:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a dial error")
+	}
+	expect()
+
+	if r.Session() == nil {
+		t.Fatal("expected to be connected")
+	}
+}
+
+func TestReconnectingMultiplexStreams(t *testing.T) {
+	servers := make(chan *Multiplex, 1)
+	dial := func(ctx context.Context) (net.Conn, error) {
+		a, b := net.Pipe()
+		srv, err := NewMultiplex(b, false, nil)
+		if err != nil {
+			return nil, err
+		}
+		servers <- srv
+		return a, nil
+	}
+
+	streamErrors := make(chan error, 10)
+	inbound := make(chan *Stream, 10)
+	r := NewReconnectingMultiplex(dial, ReconnectConfig{
+		OnStreamError: func(name string, err error) {
+			if name == "second" {
+				streamErrors <- err
+			}
+		},
+		HandleStream: func(s *Stream) { inbound <- s },
+	}, WithStreamLimits(0, 1), WithStreamNames())
+	defer r.Close()
+	var srv *Multiplex
+	select {
+	case srv = <-servers:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a session")
+	}
+	defer srv.Close()
+
+	// Failures to open registered streams are reported.
+	r.RegisterStream("first", func(s *Stream) {})
+	if _, err := srv.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	r.RegisterStream("second", func(s *Stream) {})
+	select {
+	case err := <-streamErrors:
+		if err != ErrStreamLimitReached {
+			t.Fatalf("expected ErrStreamLimitReached, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a stream error")
+	}
+
+	// Streams the peer opens are passed to the handler.
+	if _, err := srv.NewNamedStream(context.Background(), "pushed"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case s := <-inbound:
+		if s.Name() != "pushed" {
+			t.Fatalf("unexpected stream %q", s.Name())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the inbound stream to be handled")
+	}
+}
@@ -0,0 +1,70 @@
+package multiplex
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// SetRecordMode switches the stream to record mode, or back. In record mode,
+// each frame the peer sends is read as one record: Read returns a single
+// record at a time, never merging it with the next one nor splitting it, and
+// fails with io.ErrShortBuffer, leaving the record to be read, if b can't hold
+// it. ReadRecord returns records in buffers of their own. Peers running this
+// implementation send each Write of up to ChunkSize bytes in a frame of its
+// own, so protocols sending a message per Write can do without framing of
+// their own.
+//
+// Frames are received whole, rather than in chunks (see
+// WithReceiveChunkSize), into buffers of their own, so records can't be
+// larger than BufferSize, the size of the buffers the session's memory
+// budget is counted in: the stream is reset if the peer sends a larger frame.
+// The mode should be set before the peer starts sending: frames received
+// before that may have been split.
+func (s *Stream) SetRecordMode(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&s.records, v)
+}
+
+// maxRecordSize is the size of the largest record.
+const maxRecordSize = BufferSize
+
+func (s *Stream) isRecordMode() bool {
+	return atomic.LoadInt32(&s.records) != 0
+}
+
+// ReadRecord reads the next record in record mode (see SetRecordMode). In
+// other modes, it returns the data received in the next frame, or chunk of a
+// frame, whatever its boundaries.
+func (s *Stream) ReadRecord() ([]byte, error) {
+	if err := s.nextData(nil); err != nil {
+		return nil, err
+	}
+	record := append([]byte(nil), s.extra...)
+	s.consumeRecord()
+	s.countTraffic(len(record), 0)
+	return record, nil
+}
+
+// readRecordInto reads the record in extra into b.
+func (s *Stream) readRecordInto(b []byte) (int, error) {
+	if len(s.extra) > len(b) {
+		return 0, io.ErrShortBuffer
+	}
+	n := copy(b, s.extra)
+	s.consumeRecord()
+	s.countTraffic(n, 0)
+	return n, nil
+}
+
+// consumeRecord releases the record in extra, once read.
+func (s *Stream) consumeRecord() {
+	if s.exbuf != nil {
+		s.releaseInbound(s.exbuf)
+	}
+	s.extra = nil
+	s.exbuf = nil
+	s.preloadData()
+}
@@ -0,0 +1,184 @@
+package multiplex
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// ResumeToken identifies a resumable session. Anyone holding it can take over
+// the session, so it must be kept secret.
+type ResumeToken [16]byte
+
+// Resumption handshake replies.
+const (
+	resumeNew = iota
+	resumeResumed
+	resumeUnknown
+)
+
+// ErrResumeRejected is returned when the server doesn't know (or no longer
+// knows) the session we tried to resume.
+var ErrResumeRejected = errors.New("session resumption rejected")
+
+// ResumableSession is a session that survives its connection breaking, if
+// the client reconnects within the grace period. The session runs over a
+// connection that retransmits whatever the peer hasn't consumed yet when it's
+// resumed, so streams carry on as if nothing happened. Both sides must use
+// resumable sessions.
+type ResumableSession struct {
+	*Multiplex
+	token ResumeToken
+	conn  *bondedConn
+}
+
+// Token returns the token identifying the session.
+func (s *ResumableSession) Token() ResumeToken {
+	return s.token
+}
+
+// NewResumableClient starts a resumable session over conn, as the client. If
+// the connection breaks, the session waits up to grace for Resume to be
+// called with a new connection to the same server. The session is the
+// initiator.
+func NewResumableClient(conn net.Conn, grace time.Duration, memoryManager MemoryManager, opts ...Option) (*ResumableSession, error) {
+	status, token, err := resumeHandshake(conn, ResumeToken{})
+	if err != nil {
+		return nil, err
+	}
+	if status != resumeNew {
+		return nil, fmt.Errorf("unexpected resumption handshake reply: %d", status)
+	}
+
+	bc := newBondedConn([]net.Conn{conn}, grace, nil)
+	mp, err := NewMultiplex(bc, true, memoryManager, opts...)
+	if err != nil {
+		bc.Close()
+		return nil, err
+	}
+	return &ResumableSession{Multiplex: mp, token: token, conn: bc}, nil
+}
+
+// Resume continues the session over a new connection to the server. It
+// fails with ErrResumeRejected if the server gave up on the session.
+func (s *ResumableSession) Resume(conn net.Conn) error {
+	status, _, err := resumeHandshake(conn, s.token)
+	if err != nil {
+		return err
+	}
+	if status != resumeResumed {
+		conn.Close()
+		return ErrResumeRejected
+	}
+	return s.conn.addPath(conn)
+}
+
+func resumeHandshake(conn net.Conn, token ResumeToken) (byte, ResumeToken, error) {
+	if _, err := conn.Write(token[:]); err != nil {
+		return 0, token, err
+	}
+	var reply [1 + len(token)]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return 0, token, err
+	}
+	copy(token[:], reply[1:])
+	return reply[0], token, nil
+}
+
+// ResumeServer accepts resumable sessions from clients.
+type ResumeServer struct {
+	grace         time.Duration
+	memoryManager func() MemoryManager
+	opts          []Option
+
+	mu       sync.Mutex
+	sessions map[ResumeToken]*ResumableSession
+}
+
+// NewResumeServer creates a server for resumable sessions, which wait up to
+// grace for their client to come back when their connection breaks.
+// newMemoryManager, if not nil, is called to get the memory manager of each
+// new session.
+func NewResumeServer(grace time.Duration, newMemoryManager func() MemoryManager, opts ...Option) *ResumeServer {
+	return &ResumeServer{
+		grace:         grace,
+		memoryManager: newMemoryManager,
+		opts:          opts,
+		sessions:      make(map[ResumeToken]*ResumableSession),
+	}
+}
+
+// Handle handles a new connection from a client. It returns the new session
+// if the client started one, or nil if the client resumed an existing one.
+func (s *ResumeServer) Handle(conn net.Conn) (*ResumableSession, error) {
+	var token ResumeToken
+	if _, err := io.ReadFull(conn, token[:]); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if token != (ResumeToken{}) {
+		s.mu.Lock()
+		sess, ok := s.sessions[token]
+		s.mu.Unlock()
+		if !ok {
+			conn.Write(append([]byte{resumeUnknown}, token[:]...))
+			conn.Close()
+			return nil, ErrResumeRejected
+		}
+		if _, err := conn.Write(append([]byte{resumeResumed}, token[:]...)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if err := sess.conn.addPath(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return nil, nil
+	}
+
+	if _, err := rand.Read(token[:]); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if _, err := conn.Write(append([]byte{resumeNew}, token[:]...)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	var mm MemoryManager
+	if s.memoryManager != nil {
+		mm = s.memoryManager()
+	}
+	bc := newBondedConn([]net.Conn{conn}, s.grace, func() {
+		s.mu.Lock()
+		delete(s.sessions, token)
+		s.mu.Unlock()
+	})
+	mp, err := NewMultiplex(bc, false, mm, s.opts...)
+	if err != nil {
+		bc.Close()
+		return nil, err
+	}
+	sess := &ResumableSession{Multiplex: mp, token: token, conn: bc}
+
+	s.mu.Lock()
+	s.sessions[token] = sess
+	s.mu.Unlock()
+
+	// In case it failed before we registered it.
+	bc.mu.Lock()
+	failed := bc.err != nil
+	bc.mu.Unlock()
+	if failed {
+		s.mu.Lock()
+		delete(s.sessions, token)
+		s.mu.Unlock()
+	}
+
+	return sess, nil
+}
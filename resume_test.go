@@ -0,0 +1,88 @@
+package multiplex
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestResumableSession(t *testing.T) {
+	server := NewResumeServer(time.Second, nil)
+
+	a, b := net.Pipe()
+	type result struct {
+		sess *ResumableSession
+		err  error
+	}
+	accepted := make(chan result, 1)
+	go func() {
+		sess, err := server.Handle(b)
+		accepted <- result{sess, err}
+	}()
+	client, err := NewResumableClient(a, time.Second, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	res := <-accepted
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	srv := res.sess
+	defer srv.Close()
+
+	s, err := client.NewStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss, err := srv.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := s.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(ss, buf); err != nil || string(buf) != "hello" {
+		t.Fatal(err)
+	}
+
+	// Break the connection, and keep writing while it's down.
+	a.Close()
+	time.Sleep(10 * time.Millisecond)
+	if _, err := s.Write([]byte("again")); err != nil {
+		t.Fatal(err)
+	}
+
+	a, b = net.Pipe()
+	go func() {
+		sess, err := server.Handle(b)
+		accepted <- result{sess, err}
+	}()
+	if err := client.Resume(a); err != nil {
+		t.Fatal(err)
+	}
+	if res := <-accepted; res.err != nil || res.sess != nil {
+		t.Fatalf("expected the session to be resumed, got %v", res.err)
+	}
+
+	if _, err := io.ReadFull(ss, buf); err != nil || string(buf) != "again" {
+		t.Fatalf("expected the data written while disconnected, got %q (%v)", buf, err)
+	}
+	if _, err := ss.Write([]byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(s, buf); err != nil || string(buf) != "world" {
+		t.Fatal(err)
+	}
+
+	// Unknown sessions can't be resumed.
+	a, b = net.Pipe()
+	go server.Handle(b)
+	bogus := &ResumableSession{token: ResumeToken{1}}
+	if err := bogus.Resume(a); err != ErrResumeRejected {
+		t.Fatalf("expected ErrResumeRejected, got %v", err)
+	}
+}
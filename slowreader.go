@@ -0,0 +1,33 @@
+package multiplex
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// SlowReaderFunc is called when a stream hasn't taken the data it's sent
+// within ReceiveTimeout, with the number of bytes queued waiting to be read.
+// It returns how much longer to wait for the stream to catch up, or zero to
+// reset it.
+type SlowReaderFunc func(s *Stream, queued int) time.Duration
+
+// WithOnSlowReader registers a function called before resetting a stream that
+// doesn't read its data in time (see ReceiveTimeout), to find out which
+// component is stalling, or to give it more time. The whole session waits
+// for the stream meanwhile: the function is called from the session's read
+// loop, and must be quick.
+func WithOnSlowReader(f SlowReaderFunc) Option {
+	return func(c *config) error {
+		c.onSlowReader = f
+		return nil
+	}
+}
+
+// slowReaderGrace returns how much longer to wait for a stream that didn't
+// read its data in time.
+func (mp *Multiplex) slowReaderGrace(s *Stream) time.Duration {
+	if mp.onSlowReader == nil {
+		return 0
+	}
+	return mp.onSlowReader(s, int(atomic.LoadInt64(&s.inboundBuffered)))
+}
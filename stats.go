@@ -0,0 +1,204 @@
+package multiplex
+
+import (
+	"math/bits"
+	"sync"
+	"sync/atomic"
+)
+
+// counters holds the session's statistics. All fields are updated
+// atomically.
+type counters struct {
+	// inboundBuffered is the number of received bytes waiting to be read.
+	inboundBuffered int64
+
+	// Frames and payload bytes, by wire tag.
+	framesIn, framesOut [8]uint64
+	bytesIn, bytesOut   [8]uint64
+	// Frame payload sizes.
+	sizesIn, sizesOut FrameSizeHistogram
+
+	streamsOpened   uint64
+	streamsAccepted uint64
+	streamsReset    uint64
+	streamsRefused  uint64
+	recvTimeouts    uint64
+	droppedBytes    uint64
+
+	datagramsDropped   uint64
+	halfClosedTimeouts uint64
+
+	// protocols holds the counters of each protocol streams were annotated
+	// with.
+	protoLock sync.Mutex
+	protocols map[string]*protocolCounters
+}
+
+// protocolCounters counts the traffic of the streams annotated with a
+// protocol. All fields are updated atomically.
+type protocolCounters struct {
+	streams           uint64
+	bytesIn, bytesOut uint64
+}
+
+// ProtocolStats is a snapshot of the traffic of the streams annotated with a
+// protocol (see Stream.SetProtocol).
+type ProtocolStats struct {
+	// Streams counts the streams annotated with the protocol.
+	Streams uint64
+	// BytesIn and BytesOut count the bytes read from and written to those
+	// streams.
+	BytesIn, BytesOut uint64
+}
+
+// FrameSizeBuckets is the number of buckets in a FrameSizeHistogram.
+const FrameSizeBuckets = 22
+
+// FrameSizeHistogram counts frames by payload size, in power-of-two buckets:
+// bucket 0 counts empty payloads, and bucket i > 0 counts payloads of
+// 2^(i-1) to 2^i - 1 bytes. The last bucket holds payloads of MaxMessageSize
+// bytes.
+type FrameSizeHistogram [FrameSizeBuckets]uint64
+
+// FrameSizeBucket returns the index of the bucket counting payloads of the
+// given size.
+func FrameSizeBucket(size int) int {
+	b := bits.Len(uint(size))
+	if b >= FrameSizeBuckets {
+		b = FrameSizeBuckets - 1
+	}
+	return b
+}
+
+// Stats is a snapshot of a session's statistics.
+type Stats struct {
+	// FramesIn and FramesOut count the frames received and sent, indexed by
+	// wire tag (see the frame package). BytesIn and BytesOut count their
+	// payload bytes.
+	FramesIn, FramesOut [8]uint64
+	BytesIn, BytesOut   [8]uint64
+	// FrameSizesIn and FrameSizesOut break the frames received and sent
+	// down by payload size.
+	FrameSizesIn, FrameSizesOut FrameSizeHistogram
+
+	// StreamsOpened and StreamsAccepted count the streams opened by us and
+	// by the peer, respectively.
+	StreamsOpened   uint64
+	StreamsAccepted uint64
+	// StreamsReset counts the streams reset by either side.
+	StreamsReset uint64
+	// StreamsRefused counts the streams opened by the peer that were reset
+	// because of a limit on inbound streams (including their rate and the
+	// length of their names), or because the session was draining.
+	StreamsRefused uint64
+	// ReceiveTimeoutResets counts the streams reset because they didn't
+	// read their data within ReceiveTimeout.
+	ReceiveTimeoutResets uint64
+	// DroppedBytes counts the received bytes dropped by lossy streams (see
+	// Stream.SetLossy).
+	DroppedBytes uint64
+	// DatagramsDropped counts the datagrams dropped, on either end, because
+	// there was no room for them (see SendDatagram).
+	DatagramsDropped uint64
+	// HalfClosedTimeouts counts the streams closed because they were left
+	// half-closed for too long (see WithHalfClosedTimeout).
+	HalfClosedTimeouts uint64
+
+	// ReservedMemory is the memory reserved from the MemoryManager, in
+	// bytes.
+	ReservedMemory int
+	// InboundBuffered is the number of received bytes waiting to be read.
+	InboundBuffered int64
+	// WriteQueueDepth is the number of frames waiting to be written.
+	WriteQueueDepth int
+	// InboundBuffers and OutboundBuffers describe the use of the buffer
+	// slots in each direction.
+	InboundBuffers, OutboundBuffers BufferStats
+
+	// Protocols breaks the traffic of streams down by protocol, for the
+	// streams annotated with one.
+	Protocols map[string]ProtocolStats `json:",omitempty"`
+}
+
+// Stat returns a snapshot of the session's statistics.
+func (mp *Multiplex) Stat() Stats {
+	c := mp.counters
+	st := Stats{
+		StreamsOpened:        atomic.LoadUint64(&c.streamsOpened),
+		StreamsAccepted:      atomic.LoadUint64(&c.streamsAccepted),
+		StreamsReset:         atomic.LoadUint64(&c.streamsReset),
+		StreamsRefused:       atomic.LoadUint64(&c.streamsRefused),
+		ReceiveTimeoutResets: atomic.LoadUint64(&c.recvTimeouts),
+		DroppedBytes:         atomic.LoadUint64(&c.droppedBytes),
+		DatagramsDropped:     atomic.LoadUint64(&c.datagramsDropped),
+		HalfClosedTimeouts:   atomic.LoadUint64(&c.halfClosedTimeouts),
+		InboundBuffered:      atomic.LoadInt64(&c.inboundBuffered),
+		WriteQueueDepth:      mp.writeQueue.len(),
+		InboundBuffers:       mp.inSlots.stats(),
+		OutboundBuffers:      mp.outSlots.stats(),
+	}
+	for tag := range st.FramesIn {
+		st.FramesIn[tag] = atomic.LoadUint64(&c.framesIn[tag])
+		st.FramesOut[tag] = atomic.LoadUint64(&c.framesOut[tag])
+		st.BytesIn[tag] = atomic.LoadUint64(&c.bytesIn[tag])
+		st.BytesOut[tag] = atomic.LoadUint64(&c.bytesOut[tag])
+	}
+	for b := range st.FrameSizesIn {
+		st.FrameSizesIn[b] = atomic.LoadUint64(&c.sizesIn[b])
+		st.FrameSizesOut[b] = atomic.LoadUint64(&c.sizesOut[b])
+	}
+	mp.shutdownLock.Lock()
+	if !mp.isShutdown() {
+		st.ReservedMemory = mp.reservedMemory
+	}
+	mp.shutdownLock.Unlock()
+	c.protoLock.Lock()
+	if len(c.protocols) > 0 {
+		st.Protocols = make(map[string]ProtocolStats, len(c.protocols))
+		for proto, pc := range c.protocols {
+			st.Protocols[proto] = ProtocolStats{
+				Streams:  atomic.LoadUint64(&pc.streams),
+				BytesIn:  atomic.LoadUint64(&pc.bytesIn),
+				BytesOut: atomic.LoadUint64(&pc.bytesOut),
+			}
+		}
+	}
+	c.protoLock.Unlock()
+	return st
+}
+
+// RefusedStreams returns the number of streams opened by the peer that were
+// reset because the inbound stream limit was reached, or the session was
+// draining.
+func (mp *Multiplex) RefusedStreams() uint64 {
+	return atomic.LoadUint64(&mp.counters.streamsRefused)
+}
+
+// countFrame accounts for a frame sent or received.
+func (c *counters) countFrame(dir FrameDirection, tag uint64, length int) {
+	b := FrameSizeBucket(length)
+	if dir == FrameInbound {
+		atomic.AddUint64(&c.framesIn[tag&7], 1)
+		atomic.AddUint64(&c.bytesIn[tag&7], uint64(length))
+		atomic.AddUint64(&c.sizesIn[b], 1)
+	} else {
+		atomic.AddUint64(&c.framesOut[tag&7], 1)
+		atomic.AddUint64(&c.bytesOut[tag&7], uint64(length))
+		atomic.AddUint64(&c.sizesOut[b], 1)
+	}
+}
+
+// protocol returns the counters of the given protocol.
+func (c *counters) protocol(proto string) *protocolCounters {
+	c.protoLock.Lock()
+	defer c.protoLock.Unlock()
+	pc, ok := c.protocols[proto]
+	if !ok {
+		if c.protocols == nil {
+			c.protocols = make(map[string]*protocolCounters)
+		}
+		pc = &protocolCounters{}
+		c.protocols[proto] = pc
+	}
+	return pc
+}
@@ -5,9 +5,12 @@ import (
 	"errors"
 	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/multierr"
+
+	"github.com/libp2p/go-mplex/frame"
 )
 
 var (
@@ -15,6 +18,36 @@ var (
 	ErrStreamClosed = errors.New("closed stream")
 )
 
+// MaxResetReasonLength is the maximum length of a reset reason.
+const MaxResetReasonLength = 1024
+
+// ResetError is returned by operations on a stream the peer reset, with the
+// reason it gave if any, or one the session reset on its own (e.g., because it
+// wasn't read from fast enough). Streams reset by calling Reset or
+// ResetWithReason return ErrStreamReset itself. It matches ErrStreamReset with
+// errors.Is.
+type ResetError struct {
+	// Reason is the reason given for the reset, if any.
+	Reason string
+	// Remote is true if the peer reset the stream.
+	Remote bool
+}
+
+func (e *ResetError) Error() string {
+	msg := "stream reset"
+	if e.Remote {
+		msg = "stream reset by peer"
+	}
+	if e.Reason != "" {
+		msg += ": " + e.Reason
+	}
+	return msg
+}
+
+func (e *ResetError) Is(target error) bool {
+	return target == ErrStreamReset
+}
+
 // streamID is a convenience type for operating on stream IDs
 type streamID struct {
 	id        uint64
@@ -23,7 +56,7 @@ type streamID struct {
 
 // header computes the header for the given tag
 func (id *streamID) header(tag uint64) uint64 {
-	header := id.id<<3 | tag
+	header := frame.PackHeader(id.id, tag)
 	if !id.initiator {
 		header--
 	}
@@ -31,8 +64,27 @@ func (id *streamID) header(tag uint64) uint64 {
 }
 
 type Stream struct {
-	id     streamID
-	name   string
+	// inboundBuffered is the number of received bytes waiting to be read.
+	// It's accessed atomically, and must stay the first field for alignment.
+	inboundBuffered int64
+	// droppedBytes counts the received bytes dropped in lossy mode. It's
+	// accessed atomically.
+	droppedBytes uint64
+	// stack is where the stream was opened or accepted, with leak
+	// detection (see WithLeakDetection).
+	stack []uintptr
+
+	// lossy is set in lossy mode (see SetLossy), records in record mode
+	// (see SetRecordMode), and noDelay if writes bypass coalescing (see
+	// SetNoDelay). They're accessed atomically.
+	lossy, records, noDelay int32
+
+	id      streamID
+	name    string
+	headers map[string]string
+	// acked is closed once the peer acknowledged the stream, if we asked
+	// it to.
+	acked  chan struct{}
 	dataIn chan []byte
 	mp     *Multiplex
 
@@ -47,12 +99,113 @@ type Stream struct {
 	clLock                        sync.Mutex
 	writeCancelErr, readCancelErr error
 	writeCancel, readCancel       chan struct{}
+	// readEOF is set once the peer closed its side of the stream. finished
+	// is set once the stream is done in both directions, at which point
+	// done is closed and doneErr says why.
+	readEOF, finished bool
+	done              chan struct{}
+	doneErr           error
+	watchOnce         sync.Once
+	// linger is how long closing waits for queued data to be sent. It's
+	// guarded by clLock.
+	linger time.Duration
+
+	// protocol is guarded by clLock. protoCounters holds the
+	// *protocolCounters of the protocol, if any.
+	protocol      string
+	protoCounters atomic.Value
+
+	// values is the user data attached to the stream.
+	values values
+
+	// closeAck is set if the peer asked to be told once we read its close
+	// (see CloseSync). It's set before dataIn is closed.
+	closeAck     bool
+	closeAckOnce sync.Once
+
+	// readable, if set, is closed once the stream becomes readable (see
+	// Readable). It's guarded by readyLock.
+	readyLock sync.Mutex
+	readable  chan struct{}
+
+	// handler, if set, is handed the data received (see SetDataHandler).
+	// pushMode is set along with it, and accessed atomically. pushedEOF
+	// is set once the handler was told about the EOF. They're guarded by
+	// pushLock, which is held while the handler runs.
+	pushLock  sync.Mutex
+	handler   func([]byte) error
+	pushMode  int32
+	pushedEOF bool
 }
 
 func (s *Stream) Name() string {
 	return s.name
 }
 
+// Protocol returns the protocol the stream was annotated with, if any.
+func (s *Stream) Protocol() string {
+	s.clLock.Lock()
+	defer s.clLock.Unlock()
+	return s.protocol
+}
+
+// SetProtocol annotates the stream with the protocol spoken over it. It's
+// purely local metadata, never sent to the peer: it's included in the
+// stream's logs, and the session's statistics break traffic down by
+// protocol. Traffic is counted towards the protocol from the moment it's set.
+func (s *Stream) SetProtocol(proto string) error {
+	s.clLock.Lock()
+	defer s.clLock.Unlock()
+	if proto == s.protocol {
+		return nil
+	}
+	s.protocol = proto
+	if proto == "" {
+		s.protoCounters.Store((*protocolCounters)(nil))
+		return nil
+	}
+	pc := s.mp.counters.protocol(proto)
+	atomic.AddUint64(&pc.streams, 1)
+	s.protoCounters.Store(pc)
+	return nil
+}
+
+// countTraffic accounts for bytes read from or written to the stream.
+func (s *Stream) countTraffic(read, written int) {
+	pc, _ := s.protoCounters.Load().(*protocolCounters)
+	if pc == nil {
+		return
+	}
+	if read > 0 {
+		atomic.AddUint64(&pc.bytesIn, uint64(read))
+	}
+	if written > 0 {
+		atomic.AddUint64(&pc.bytesOut, uint64(written))
+	}
+}
+
+// nextData makes sure there's data in extra, waiting for some if needed.
+func (s *Stream) nextData(done <-chan struct{}) error {
+	if s.isPushMode() {
+		return ErrDataHandlerSet
+	}
+	select {
+	case <-s.readCancel:
+		s.returnBuffers()
+		return s.readCancelErr
+	default:
+	}
+
+	if s.extra == nil {
+		err := s.waitForData(done)
+		if err == io.EOF {
+			s.ackClose()
+		}
+		return err
+	}
+	return nil
+}
+
 // tries to preload pending data
 func (s *Stream) preloadData() {
 	select {
@@ -66,7 +219,7 @@ func (s *Stream) preloadData() {
 	}
 }
 
-func (s *Stream) waitForData() error {
+func (s *Stream) waitForData(done <-chan struct{}) error {
 	select {
 	case read, ok := <-s.dataIn:
 		if !ok {
@@ -81,15 +234,24 @@ func (s *Stream) waitForData() error {
 		return s.readCancelErr
 	case <-s.rDeadline.wait():
 		return errTimeout
+	case <-done:
+		return errCanceled
 	}
 }
 
 func (s *Stream) returnBuffers() {
 	if s.exbuf != nil {
-		s.mp.putBufferInbound(s.exbuf)
+		s.releaseInbound(s.exbuf)
 		s.exbuf = nil
 		s.extra = nil
 	}
+	s.drainInbound()
+}
+
+// drainInbound returns the buffers delivered to the stream but not picked up
+// by the reader yet. Unlike returnBuffers, it's safe to call from any
+// goroutine.
+func (s *Stream) drainInbound() {
 	for {
 		select {
 		case read, ok := <-s.dataIn:
@@ -99,25 +261,41 @@ func (s *Stream) returnBuffers() {
 			if read == nil {
 				continue
 			}
-			s.mp.putBufferInbound(read)
+			s.releaseInbound(read)
 		default:
 			return
 		}
 	}
 }
 
-func (s *Stream) Read(b []byte) (int, error) {
+// releaseInbound returns a buffer delivered to the stream once it has been
+// consumed.
+func (s *Stream) releaseInbound(b []byte) {
+	s.mp.accountInbound(s, -len(b))
+	s.mp.putBufferInbound(b)
+
+	// Let handleIncoming know in case it's waiting for room.
 	select {
-	case <-s.readCancel:
-		return 0, s.readCancelErr
+	case s.mp.inboundFreed <- struct{}{}:
 	default:
 	}
+}
 
-	if s.extra == nil {
-		err := s.waitForData()
-		if err != nil {
-			return 0, err
+func (s *Stream) Read(b []byte) (int, error) {
+	return s.ReadContext(context.Background(), b)
+}
+
+// ReadContext is like Read, but gives up with the context's error once ctx is
+// done while waiting for data.
+func (s *Stream) ReadContext(ctx context.Context, b []byte) (int, error) {
+	if err := s.nextData(ctx.Done()); err != nil {
+		if err == errCanceled {
+			return 0, ctx.Err()
 		}
+		return 0, err
+	}
+	if s.isRecordMode() {
+		return s.readRecordInto(b)
 	}
 	n := 0
 	for s.extra != nil && n < len(b) {
@@ -127,25 +305,46 @@ func (s *Stream) Read(b []byte) (int, error) {
 			s.extra = s.extra[read:]
 		} else {
 			if s.exbuf != nil {
-				s.mp.putBufferInbound(s.exbuf)
+				s.releaseInbound(s.exbuf)
 			}
 			s.extra = nil
 			s.exbuf = nil
 			s.preloadData()
 		}
 	}
+	s.countTraffic(n, 0)
 	return n, nil
 }
 
+// Write writes b to the stream. Writes larger than ChunkSize (or than the
+// largest frame the peer accepts, if smaller) are split into several frames.
+// If the write deadline passes, or the stream is closed or reset, part way
+// through, Write stops before the next frame: the frames queued so far are
+// still sent, and the returned byte count covers exactly those. A short count
+// always comes with an error; WriteAll tells partial writes apart with a
+// *PartialWriteError.
 func (s *Stream) Write(b []byte) (int, error) {
+	return s.WriteContext(context.Background(), b)
+}
+
+// WriteContext is like Write, but also gives up with the context's error once
+// ctx is done, between frames or while waiting for room to queue one. As with
+// the write deadline, the frames queued before ctx was done are still sent,
+// and are included in the returned byte count.
+func (s *Stream) WriteContext(ctx context.Context, b []byte) (int, error) {
 	var written int
+	defer func() { s.countTraffic(0, written) }()
+	chunkSize := ChunkSize
+	if max := s.mp.peerMaxMessageSize(); chunkSize > max {
+		chunkSize = max
+	}
 	for written < len(b) {
 		wl := len(b) - written
-		if wl > ChunkSize {
-			wl = ChunkSize
+		if wl > chunkSize {
+			wl = chunkSize
 		}
 
-		n, err := s.write(b[written : written+wl])
+		n, err := s.write(ctx, b[written:written+wl])
 		if err != nil {
 			return written, err
 		}
@@ -156,15 +355,25 @@ func (s *Stream) Write(b []byte) (int, error) {
 	return written, nil
 }
 
-func (s *Stream) write(b []byte) (int, error) {
+// write queues a frame carrying b. Cancellation, the write deadline and
+// closing the stream are checked first, so that they take effect between the
+// frames of a large write even when there are outbound buffers to spare.
+func (s *Stream) write(ctx context.Context, b []byte) (int, error) {
 	select {
 	case <-s.writeCancel:
 		return 0, s.writeCancelErr
+	case <-s.wDeadline.wait():
+		return 0, errTimeout
+	case <-ctx.Done():
+		return 0, ctx.Err()
 	default:
 	}
 
-	err := s.mp.sendMsg(s.wDeadline.wait(), s.writeCancel, s.id.header(messageTag), b)
+	err := s.mp.sendMsgContext(ctx.Done(), s.wDeadline.wait(), s.writeCancel, s.id.header(messageTag), b, nil, s.isNoDelay())
 	if err != nil {
+		if err == errCanceled {
+			return 0, ctx.Err()
+		}
 		return 0, err
 	}
 
@@ -175,17 +384,50 @@ func (s *Stream) cancelWrite(err error) bool {
 	s.wDeadline.close()
 
 	s.clLock.Lock()
-	defer s.clLock.Unlock()
 	select {
 	case <-s.writeCancel:
+		s.clLock.Unlock()
 		return false
 	default:
 		s.writeCancelErr = err
 		close(s.writeCancel)
+		s.clLock.Unlock()
+		s.checkFinished()
 		return true
 	}
 }
 
+// remoteClosed is called when the peer closes its side of the stream.
+func (s *Stream) remoteClosed() {
+	s.clLock.Lock()
+	s.readEOF = true
+	s.clLock.Unlock()
+	s.checkFinished()
+	s.mp.trackHalfClosed(s)
+}
+
+// checkFinished notifies the session once the stream is done in both
+// directions: we can't write anymore, and either we stopped reading or the
+// peer won't send anything else.
+func (s *Stream) checkFinished() {
+	s.clLock.Lock()
+	if s.finished || !isClosedChan(s.writeCancel) || !(s.readEOF || isClosedChan(s.readCancel)) {
+		s.clLock.Unlock()
+		return
+	}
+	s.finished = true
+	s.doneErr = ErrStreamClosed
+	if s.writeCancelErr != ErrStreamClosed {
+		s.doneErr = s.writeCancelErr
+	} else if isClosedChan(s.readCancel) && s.readCancelErr != ErrStreamClosed {
+		s.doneErr = s.readCancelErr
+	}
+	close(s.done)
+	s.clLock.Unlock()
+
+	s.mp.streamFinished(s)
+}
+
 func (s *Stream) cancelRead(err error) bool {
 	// Always unregister for reading first, even if we're already closed (or
 	// already closing). When handleIncoming calls this, it expects the
@@ -197,17 +439,29 @@ func (s *Stream) cancelRead(err error) bool {
 	s.rDeadline.close()
 
 	s.clLock.Lock()
-	defer s.clLock.Unlock()
 	select {
 	case <-s.readCancel:
+		s.clLock.Unlock()
 		return false
 	default:
 		s.readCancelErr = err
 		close(s.readCancel)
+		s.clLock.Unlock()
+		// Don't wait for the reader to give back what it won't read.
+		s.drainInbound()
+		s.notifyReadable()
+		s.checkFinished()
 		return true
 	}
 }
 
+// abandon unregisters a stream the peer doesn't know about, and frees it,
+// without telling the peer anything.
+func (s *Stream) abandon(err error) {
+	s.cancelRead(err)
+	s.cancelWrite(err)
+}
+
 func (s *Stream) CloseWrite() error {
 	if !s.cancelWrite(ErrStreamClosed) {
 		// Check if we closed the stream _nicely_. If so, we don't need
@@ -219,16 +473,86 @@ func (s *Stream) CloseWrite() error {
 		return s.writeCancelErr
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), ResetStreamTimeout)
+	return s.sendClose(nil)
+}
+
+// sendClose sends the close frame, with the given payload, once cancelWrite
+// closed the stream for writing.
+func (s *Stream) sendClose(payload []byte) error {
+	s.clLock.Lock()
+	linger := s.linger
+	s.clLock.Unlock()
+	var written chan struct{}
+	if linger != 0 {
+		written = make(chan struct{})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.mp.resetStreamTimeout())
 	defer cancel()
 
-	err := s.mp.sendMsg(ctx.Done(), nil, s.id.header(closeTag), nil)
+	err := s.mp.sendControlMsg(ctx.Done(), s.id.header(closeTag), payload, written)
 	// We failed to close the stream after 2 minutes, something is probably wrong.
 	if err != nil && !s.mp.isShutdown() {
-		log.Warnf("Error closing stream: %s; killing connection", err.Error())
+		s.mp.log.Warnw("error closing stream; killing connection", append(s.logFields(), "error", err)...)
 		s.mp.Close()
 	}
-	return err
+	if err != nil || written == nil {
+		return err
+	}
+	return s.waitWritten(written, linger)
+}
+
+// waitWritten waits for the close frame to be written to the connection.
+// Frames of a stream are written in order, so our data went out before it.
+func (s *Stream) waitWritten(written <-chan struct{}, linger time.Duration) error {
+	var expired <-chan time.Time
+	if linger > 0 {
+		t := s.mp.clock.NewTimer(linger)
+		defer t.Stop()
+		expired = t.Chan()
+	}
+	select {
+	case <-written:
+		return nil
+	case <-expired:
+		return errTimeout
+	case <-s.mp.shutdown:
+		return s.mp.sendErr()
+	}
+}
+
+// SetLinger sets how long closing the stream, with Close or CloseWrite, waits
+// for the data written so far to be handed to the connection. With a zero
+// duration, the default, closing doesn't wait: the data is sent in the
+// background. With a negative duration, closing waits until the data is sent
+// or the session goes away.
+//
+// If the data can't be sent in time, closing returns a timeout error (a
+// net.Error); it's still sent in the background.
+func (s *Stream) SetLinger(d time.Duration) error {
+	s.clLock.Lock()
+	s.linger = d
+	s.clLock.Unlock()
+	return nil
+}
+
+// SetNoDelay controls whether the stream's writes may be held back by write
+// coalescing (see WithWriteCoalescing). With noDelay set, they're flushed to
+// the connection right away, along with whatever is buffered, which suits
+// interactive streams, while bulk streams on the same session keep being
+// coalesced. It's off by default, and makes no difference on sessions that
+// don't coalesce writes.
+func (s *Stream) SetNoDelay(noDelay bool) error {
+	var v int32
+	if noDelay {
+		v = 1
+	}
+	atomic.StoreInt32(&s.noDelay, v)
+	return nil
+}
+
+func (s *Stream) isNoDelay() bool {
+	return atomic.LoadInt32(&s.noDelay) != 0
 }
 
 func (s *Stream) CloseRead() error {
@@ -241,16 +565,90 @@ func (s *Stream) Close() error {
 }
 
 func (s *Stream) Reset() error {
-	s.cancelRead(ErrStreamReset)
+	return s.ResetWithReason("")
+}
 
-	if s.cancelWrite(ErrStreamReset) {
+// ResetWithReason resets the stream, sending a human-readable reason along
+// with the reset. Peers running this implementation surface the reason in a
+// *ResetError returned from the stream's Read and Write; other peers ignore
+// it. Reasons longer than MaxResetReasonLength are truncated.
+func (s *Stream) ResetWithReason(reason string) error {
+	return s.reset(ErrStreamReset, reason)
+}
+
+// reset resets the stream, failing local reads and writes with err.
+func (s *Stream) reset(err error, reason string) error {
+	if len(reason) > MaxResetReasonLength {
+		reason = reason[:MaxResetReasonLength]
+	}
+
+	s.cancelRead(err)
+
+	if s.cancelWrite(err) {
+		atomic.AddUint64(&s.mp.counters.streamsReset, 1)
+		// Free the buffers of the frames still queued right away: the
+		// reset may take a while to be sent, if it can be at all.
+		s.mp.dropQueued(s.id)
 		// Send a reset in the background.
-		go s.mp.sendResetMsg(s.id.header(resetTag), true)
+		s.mp.spawn(func() { s.mp.sendResetMsg(s.id.header(resetTag), true, reason) })
 	}
 
 	return nil
 }
 
+// CloseChan returns a channel that's closed once the stream is done in both
+// directions: it was closed on both sides, reset, or the session went away.
+func (s *Stream) CloseChan() <-chan struct{} {
+	s.watchOnce.Do(func() {
+		// Streams we stopped reading from aren't tracked by the session
+		// anymore, so it won't cancel them when it shuts down. Do it here.
+		s.mp.spawn(func() {
+			select {
+			case <-s.done:
+			case <-s.mp.closed:
+				err := s.mp.streamShutdownErr()
+				s.cancelRead(err)
+				s.cancelWrite(err)
+			}
+		})
+	})
+	return s.done
+}
+
+// Context returns a context that's canceled once the stream is done in both
+// directions, like CloseChan. Its Err matches context.Canceled with
+// errors.Is, and wraps the reason the stream is done: ErrStreamClosed if it
+// was closed on both sides, or the error its reads and writes fail with.
+func (s *Stream) Context() context.Context {
+	return streamContext{s}
+}
+
+type streamContext struct {
+	s *Stream
+}
+
+func (streamContext) Deadline() (time.Time, bool)       { return time.Time{}, false }
+func (c streamContext) Done() <-chan struct{}           { return c.s.CloseChan() }
+func (streamContext) Value(key interface{}) interface{} { return nil }
+
+func (c streamContext) Err() error {
+	select {
+	case <-c.s.CloseChan():
+		return &streamDoneError{c.s.doneErr}
+	default:
+		return nil
+	}
+}
+
+// streamDoneError is the error of a done stream's context.
+type streamDoneError struct {
+	err error
+}
+
+func (e *streamDoneError) Error() string        { return context.Canceled.Error() + ": " + e.err.Error() }
+func (e *streamDoneError) Unwrap() error        { return e.err }
+func (e *streamDoneError) Is(target error) bool { return target == context.Canceled }
+
 func (s *Stream) SetDeadline(t time.Time) error {
 	s.rDeadline.set(t)
 	s.wDeadline.set(t)
@@ -0,0 +1,47 @@
+package multiplex
+
+import (
+	"fmt"
+	"time"
+)
+
+// WithInboundStreamRate caps the rate at which the peer may open streams, with
+// a token bucket: up to burst streams at once, and perSecond on average. The
+// streams opened beyond it are refused, by resetting them, and reported as
+// misbehavior (see WithOnMisbehavior), before they cost more than a frame
+// header.
+func WithInboundStreamRate(perSecond float64, burst int) Option {
+	return func(c *config) error {
+		if perSecond <= 0 || burst < 1 {
+			return fmt.Errorf("invalid inbound stream rate: %g/s (burst %d)", perSecond, burst)
+		}
+		c.streamRate = perSecond
+		c.streamBurst = burst
+		return nil
+	}
+}
+
+// streamBucket is the token bucket limiting the rate of inbound streams. It's
+// only used by the read loop.
+type streamBucket struct {
+	rate, burst, tokens float64
+	last                time.Time
+}
+
+func newStreamBucket(rate float64, burst int, now time.Time) *streamBucket {
+	return &streamBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: now}
+}
+
+// take takes a token, returning false if there's none left.
+func (b *streamBucket) take(now time.Time) bool {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,146 @@
+package multiplex
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/multiformats/go-varint"
+
+	"github.com/libp2p/go-mplex/frame"
+)
+
+// strictMaxNameLength is the longest stream name accepted in strict mode.
+const strictMaxNameLength = 1024
+
+// ProtocolViolationError is the reason a session was shut down after the peer
+// violated the protocol, describing what was received. Sessions running in
+// strict mode (see WithStrictValidation) check for many more violations. It
+// matches ErrInvalidState with errors.Is.
+type ProtocolViolationError struct {
+	// StreamID and Tag are those of the offending frame, as encoded on the
+	// wire. They're zero if the frame header couldn't be read.
+	StreamID, Tag uint64
+	// StreamExisted is set if the frame was for a stream that was open.
+	StreamExisted bool
+	// Reason describes the violation.
+	Reason string
+}
+
+func (e *ProtocolViolationError) Error() string {
+	state := "unknown"
+	if e.StreamExisted {
+		state = "open"
+	}
+	return fmt.Sprintf("protocol violation on %s stream %d (tag %d): %s", state, e.StreamID, e.Tag, e.Reason)
+}
+
+func (e *ProtocolViolationError) Is(target error) bool {
+	return target == ErrInvalidState
+}
+
+// WithStrictValidation makes the session validate everything the peer sends,
+// and shut down with a *ProtocolViolationError on the first violation,
+// instead of tolerating what it can. On top of the checks always made, it
+// rejects:
+//
+//   - varints that aren't minimally encoded, and oversized frames, with a
+//     detailed error,
+//   - frames using the stream ID reserved for control frames, or extension
+//     frames on other streams (but stream opens carrying early data),
+//   - stream names longer than 1024 bytes,
+//   - frames on streams that were never opened: streams of ours above the
+//     last one we opened, and streams of the peer above the last one it
+//     opened.
+//
+// Useful when exposing sessions to untrusted peers.
+func WithStrictValidation() Option {
+	return func(c *config) error {
+		c.strict = true
+		return nil
+	}
+}
+
+// strictReadError reports an error reading a frame header as misbehavior, if
+// the peer is to blame, and turns it into a protocol violation in strict mode.
+func (mp *Multiplex) strictReadError(err error) error {
+	var reason string
+	switch {
+	case errors.Is(err, varint.ErrNotMinimal):
+		reason = "varint not minimally encoded"
+	case errors.Is(err, varint.ErrOverflow):
+		reason = "varint overflows"
+	case errors.Is(err, frame.ErrTooLarge):
+		reason = fmt.Sprintf("frame larger than %d bytes", mp.maxMessageSize)
+	default:
+		return err
+	}
+	if !mp.strict {
+		mp.misbehaved(Misbehavior{Kind: MisbehaviorMalformedFrame, Reason: reason, Fatal: true})
+		return err
+	}
+	return mp.violation(MisbehaviorMalformedFrame, 0, 0, false, reason)
+}
+
+// validateFrame checks a frame whose header has just been read, in strict
+// mode.
+func (mp *Multiplex) validateFrame(ch streamID, wireTag uint64, mlen int) error {
+	if !mp.strict {
+		return nil
+	}
+
+	if ch.id == frame.ControlStreamID {
+		if wireTag != frame.TagExtension {
+			return mp.violation(MisbehaviorViolation, ch.id, wireTag, mp.streamExists(ch), "frame on the reserved control stream ID")
+		}
+		return nil
+	}
+
+	switch wireTag {
+	case frame.TagExtension, frame.TagNewStream:
+		if wireTag == frame.TagExtension {
+			if !mp.negotiate {
+				return mp.violation(MisbehaviorViolation, ch.id, wireTag, mp.streamExists(ch), "extension frame on a data stream")
+			}
+			if mlen > maxOpenFrame {
+				return mp.violation(MisbehaviorViolation, ch.id, wireTag, mp.streamExists(ch), fmt.Sprintf("stream open of %d bytes", mlen))
+			}
+		} else if mlen > strictMaxNameLength {
+			return mp.violation(MisbehaviorViolation, ch.id, wireTag, mp.streamExists(ch), fmt.Sprintf("stream name of %d bytes", mlen))
+		}
+		if !mp.remoteOpened || ch.id > mp.maxRemoteID {
+			mp.remoteOpened = true
+			mp.maxRemoteID = ch.id
+		}
+		return nil
+	}
+
+	var opened bool
+	if ch.initiator {
+		mp.chLock.Lock()
+		opened = ch.id < mp.nextID
+		mp.chLock.Unlock()
+	} else {
+		opened = mp.remoteOpened && ch.id <= mp.maxRemoteID
+	}
+	if !opened {
+		return mp.violation(MisbehaviorViolation, ch.id, wireTag, mp.streamExists(ch), "frame on a stream that was never opened")
+	}
+	return nil
+}
+
+// violation reports a protocol violation the session is shut down for, and
+// returns the error describing it.
+func (mp *Multiplex) violation(kind MisbehaviorKind, id, tag uint64, existed bool, reason string) error {
+	err := &ProtocolViolationError{StreamID: id, Tag: tag, StreamExisted: existed, Reason: reason}
+	mp.log.Warnw("peer violated the protocol; closing session", "stream", id, "tag", tag, "existed", existed, "reason", reason)
+	mp.misbehaved(Misbehavior{Kind: kind, StreamID: id, Tag: tag, Reason: reason, Fatal: true})
+	return err
+}
+
+// streamExists returns true if the stream is open.
+func (mp *Multiplex) streamExists(ch streamID) bool {
+	mp.chLock.Lock()
+	defer mp.chLock.Unlock()
+	_, ok := mp.channels[ch]
+	return ok
+}
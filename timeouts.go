@@ -0,0 +1,62 @@
+package multiplex
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// ErrNotCoalescing is returned by SetWriteCoalesceDelay on sessions that
+// don't coalesce writes (see WithWriteCoalescing).
+var ErrNotCoalescing = errors.New("write coalescing not enabled")
+
+// SetReceiveTimeout sets how long the session waits for a stream to read the
+// data it's sent before resetting it (see WithOnSlowReader), from now on. It
+// defaults to ReceiveTimeout, as of when the session was created. The wait in
+// progress, if any, isn't affected.
+func (mp *Multiplex) SetReceiveTimeout(d time.Duration) error {
+	if d <= 0 {
+		return fmt.Errorf("invalid receive timeout: %s", d)
+	}
+	atomic.StoreInt64(&mp.recvTimeout, int64(d))
+	return nil
+}
+
+// SetResetStreamTimeout sets how long sending a stream's close or reset may
+// take, from now on. It defaults to ResetStreamTimeout, as of when the session
+// was created.
+func (mp *Multiplex) SetResetStreamTimeout(d time.Duration) error {
+	if d <= 0 {
+		return fmt.Errorf("invalid reset stream timeout: %s", d)
+	}
+	atomic.StoreInt64(&mp.resetTimeout, int64(d))
+	return nil
+}
+
+// SetWriteCoalesceDelay sets how long outbound frames may be held back,
+// waiting for more to write with them, from the next frame held back on (see
+// WithWriteCoalescing). It fails with ErrNotCoalescing unless the session
+// coalesces writes.
+func (mp *Multiplex) SetWriteCoalesceDelay(d time.Duration) error {
+	if d < 0 {
+		return fmt.Errorf("invalid write coalescing delay: %s", d)
+	}
+	if mp.bw == nil {
+		return ErrNotCoalescing
+	}
+	atomic.StoreInt64(&mp.coalesceDelay, int64(d))
+	return nil
+}
+
+func (mp *Multiplex) receiveTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&mp.recvTimeout))
+}
+
+func (mp *Multiplex) resetStreamTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&mp.resetTimeout))
+}
+
+func (mp *Multiplex) writeCoalesceDelay() time.Duration {
+	return time.Duration(atomic.LoadInt64(&mp.coalesceDelay))
+}
@@ -0,0 +1,56 @@
+package multiplex
+
+import "sync"
+
+// values holds user data, keyed like context values.
+type values struct {
+	mu sync.Mutex
+	m  map[interface{}]interface{}
+}
+
+func (v *values) set(key, val interface{}) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if val == nil {
+		delete(v.m, key)
+		return
+	}
+	if v.m == nil {
+		v.m = make(map[interface{}]interface{})
+	}
+	v.m[key] = val
+}
+
+func (v *values) get(key interface{}) interface{} {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.m[key]
+}
+
+// SetValue attaches user data to the session under the given key, for
+// applications to keep the peer's identity, authentication state and the
+// like with the session. A nil value removes the key. As with context
+// values, keys should be of a type of their own to avoid collisions, and must
+// be comparable.
+func (mp *Multiplex) SetValue(key, val interface{}) {
+	mp.values.set(key, val)
+}
+
+// Value returns the user data attached to the session under the given key,
+// or nil.
+func (mp *Multiplex) Value(key interface{}) interface{} {
+	return mp.values.get(key)
+}
+
+// SetValue attaches user data to the stream under the given key, for
+// middleware layered over streams (authentication, rate limiting, tracing) to
+// keep its state with the stream. It works like Multiplex.SetValue.
+func (s *Stream) SetValue(key, val interface{}) {
+	s.values.set(key, val)
+}
+
+// Value returns the user data attached to the stream under the given key, or
+// nil.
+func (s *Stream) Value(key interface{}) interface{} {
+	return s.values.get(key)
+}
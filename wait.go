@@ -0,0 +1,87 @@
+package multiplex
+
+import "context"
+
+// Wait waits for the session to be closed, and for everything it runs in the
+// background to be done: the receive and send loops, the goroutines sending
+// resets, acknowledgements and the like, and leak detection. The buffers of
+// the frames still queued when the session was closed are returned to the
+// pool by then, as are those of the data received but not handed to readers.
+// Data a reader has started on is returned by its next Read, which fails.
+//
+// Wait doesn't close the session itself: call Close first to shut it down.
+func (mp *Multiplex) Wait() {
+	mp.WaitClosed(context.Background())
+}
+
+// WaitClosed is like Wait, but gives up once ctx is done, returning its
+// error.
+func (mp *Multiplex) WaitClosed(ctx context.Context) error {
+	select {
+	case <-mp.closed:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	for {
+		mp.goLock.Lock()
+		if mp.goroutines == 0 {
+			mp.goLock.Unlock()
+			break
+		}
+		if mp.idle == nil {
+			mp.idle = make(chan struct{})
+		}
+		idle := mp.idle
+		mp.goLock.Unlock()
+
+		select {
+		case <-idle:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	// Nothing writes anymore, whatever was queued in the meantime won't
+	// be.
+	mp.releaseQueued()
+	return nil
+}
+
+// spawn runs f in a new goroutine, which Wait waits for.
+func (mp *Multiplex) spawn(f func()) {
+	mp.goLock.Lock()
+	mp.goroutines++
+	mp.goLock.Unlock()
+	go func() {
+		defer mp.goroutineDone()
+		f()
+	}()
+}
+
+func (mp *Multiplex) goroutineDone() {
+	mp.goLock.Lock()
+	mp.goroutines--
+	if mp.goroutines == 0 && mp.idle != nil {
+		close(mp.idle)
+		mp.idle = nil
+	}
+	mp.goLock.Unlock()
+}
+
+// releaseQueued returns the buffers of the frames left in the write queue once
+// the session is shut down.
+func (mp *Multiplex) releaseQueued() {
+	if mp.throttled {
+		for i, f := range mp.batch {
+			mp.releaseFrame(f)
+			mp.batch[i] = outFrame{}
+		}
+		mp.throttled = false
+	}
+	for {
+		f, ok := mp.writeQueue.pop()
+		if !ok {
+			return
+		}
+		mp.releaseFrame(f)
+	}
+}
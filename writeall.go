@@ -0,0 +1,39 @@
+package multiplex
+
+import (
+	"context"
+	"fmt"
+)
+
+// PartialWriteError is returned by WriteAll when it fails part way through.
+// Written is the number of bytes queued before the failure: they're still
+// sent, so resuming means writing the rest, from b[Written:].
+type PartialWriteError struct {
+	Written int
+	Err     error
+}
+
+func (e *PartialWriteError) Error() string {
+	return fmt.Sprintf("wrote %d bytes: %s", e.Written, e.Err)
+}
+
+func (e *PartialWriteError) Unwrap() error {
+	return e.Err
+}
+
+// WriteAll writes all of b to the stream, or fails. Like WriteContext, it
+// gives up once ctx is done, the write deadline passes, or the stream is
+// closed or reset; if that happens after part of b was queued, it returns a
+// *PartialWriteError saying how much, so that the caller can resume, or
+// knows that the peer got part of the data. Otherwise, the error is returned
+// as is, and nothing was written.
+func (s *Stream) WriteAll(ctx context.Context, b []byte) error {
+	n, err := s.WriteContext(ctx, b)
+	if err == nil {
+		return nil
+	}
+	if n > 0 {
+		return &PartialWriteError{Written: n, Err: err}
+	}
+	return err
+}
@@ -0,0 +1,177 @@
+package multiplex
+
+import (
+	"sync"
+
+	"github.com/libp2p/go-mplex/frame"
+)
+
+// writeQueue holds outbound frames in per-stream FIFO queues. Streams with
+// pending frames are drained round-robin, one frame at a time, so a single
+// stream doing large writes can't monopolize the connection. Urgent frames
+// skip the line.
+type writeQueue struct {
+	mu     sync.Mutex
+	urgent []outFrame
+	queues map[streamID][]outFrame
+	// order is the round-robin order of the streams with queued frames.
+	order []streamID
+	// ready is signaled whenever a frame is pushed onto an empty queue.
+	ready chan struct{}
+	// n is the total number of queued frames.
+	n int
+}
+
+func newWriteQueue() *writeQueue {
+	return &writeQueue{
+		queues: make(map[streamID][]outFrame),
+		ready:  make(chan struct{}, 1),
+	}
+}
+
+// outFrame is an encoded frame waiting to be written.
+type outFrame struct {
+	data []byte
+	// written, if set, is closed once the frame has been written to the
+	// connection.
+	written chan struct{}
+	// noDelay is set for frames that mustn't be held back by write
+	// coalescing (see Stream.SetNoDelay).
+	noDelay bool
+	// control is set for control frames, whose buffers come from the
+	// control budget.
+	control bool
+	// copies is the number of extra copies of the frame to write, and
+	// injected is set once the frame injector has seen the frame.
+	copies   int
+	injected bool
+}
+
+// frameStreamID recovers the (local) stream ID from a frame header. Frames
+// sent on streams we initiated carry even tags, the others odd ones. The
+// exception is the extension frame opening a stream with early data: it must
+// stay in line with the data written to the stream after it.
+func frameStreamID(header uint64) streamID {
+	id := header >> 3
+	if header&7 == frame.TagExtension && id != frame.ControlStreamID {
+		return streamID{id: id, initiator: true}
+	}
+	return streamID{
+		id:        id,
+		initiator: header&1 == 0,
+	}
+}
+
+// push queues a frame for the given stream.
+func (q *writeQueue) push(id streamID, frame outFrame) {
+	q.mu.Lock()
+	queue, ok := q.queues[id]
+	if !ok {
+		q.order = append(q.order, id)
+	}
+	q.queues[id] = append(queue, frame)
+	q.n++
+	q.mu.Unlock()
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// pushAll queues a frame for each of the given streams in one go, so that the
+// writer picks them all up together.
+func (q *writeQueue) pushAll(ids []streamID, frames []outFrame) {
+	q.mu.Lock()
+	for i, id := range ids {
+		queue, ok := q.queues[id]
+		if !ok {
+			q.order = append(q.order, id)
+		}
+		q.queues[id] = append(queue, frames[i])
+	}
+	q.n += len(frames)
+	q.mu.Unlock()
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// pushUrgent queues a frame ahead of all the others.
+func (q *writeQueue) pushUrgent(frame outFrame) {
+	q.mu.Lock()
+	q.urgent = append(q.urgent, frame)
+	q.n++
+	q.mu.Unlock()
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// drop removes and returns the frames queued for the given stream.
+func (q *writeQueue) drop(id streamID) []outFrame {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	queue, ok := q.queues[id]
+	if !ok {
+		return nil
+	}
+	delete(q.queues, id)
+	for i, qid := range q.order {
+		if qid == id {
+			q.order = append(q.order[:i], q.order[i+1:]...)
+			break
+		}
+	}
+	q.n -= len(queue)
+	return queue
+}
+
+// pop returns the next frame to be written, if any.
+func (q *writeQueue) pop() (outFrame, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.urgent) > 0 {
+		frame := q.urgent[0]
+		q.urgent[0] = outFrame{}
+		q.urgent = q.urgent[1:]
+		q.n--
+		return frame, true
+	}
+
+	if len(q.order) == 0 {
+		return outFrame{}, false
+	}
+
+	id := q.order[0]
+	q.order = q.order[1:]
+
+	queue := q.queues[id]
+	frame := queue[0]
+	q.n--
+	queue[0] = outFrame{}
+	queue = queue[1:]
+
+	if len(queue) == 0 {
+		delete(q.queues, id)
+	} else {
+		// Go to the back of the line.
+		q.queues[id] = queue
+		q.order = append(q.order, id)
+	}
+
+	return frame, true
+}
+
+// len returns the number of queued frames.
+func (q *writeQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.n
+}